@@ -7,7 +7,8 @@ require (
 	github.com/PuerkitoBio/goquery v1.5.1 // indirect
 	github.com/andybalholm/cascadia v1.1.0 // indirect
 	github.com/davecgh/go-spew v1.1.1
-	github.com/fsnotify/fsnotify v1.4.9 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.3.0
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/gdamore/encoding v1.0.0 // indirect
 	github.com/gdamore/tcell v1.3.0
 	github.com/gocarina/gocsv v0.0.0-20200330101823-46266ca37bd3
@@ -26,6 +27,7 @@ require (
 	github.com/mitchellh/mapstructure v1.2.2 // indirect
 	github.com/mmcdole/gofeed v1.0.0-beta2
 	github.com/mmcdole/goxpp v0.0.0-20181012175147-0068e33feabf // indirect
+	github.com/mochi-co/mqtt v1.0.0
 	github.com/nlopes/slack v0.5.0
 	github.com/pelletier/go-toml v1.7.0 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
@@ -57,5 +59,5 @@ require (
 	google.golang.org/grpc v1.34.0
 	google.golang.org/protobuf v1.25.0
 	gopkg.in/ini.v1 v1.55.0 // indirect
-	gopkg.in/yaml.v2 v2.2.8 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
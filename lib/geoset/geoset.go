@@ -1,7 +1,20 @@
 package geoset
 
 import (
+	"container/heap"
 	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	// Radius of Earth in metres (mean earth radius, via https://en.wikipedia.org/wiki/Great-circle_distance)
+	earthRadius = float64(6371000)
+
+	// the minimum number of unindexed entries which will trigger the index to be rebuilt
+	minRebuildThreshold = 16
+	// a tolerance applied to index bounds so floating point error doesn't exclude entries on the boundary
+	epsilon = 1e-9
 )
 
 type entry struct {
@@ -9,38 +22,488 @@ type entry struct {
 	longitude float64
 
 	value interface{}
+
+	// point is the position of the entry on the unit sphere
+	point   [3]float64
+	indexed bool
+	removed bool
+}
+
+// Result is an entry returned from a query, along with its distance (in metres) from the queried location.
+type Result struct {
+	Latitude  float64
+	Longitude float64
+	Value     interface{}
+	Distance  float64
+}
+
+// Bounds is a box described by its minimum and maximum latitude and longitude (in degrees).
+// If MinLongitude is greater than MaxLongitude the box crosses the antimeridian.
+type Bounds struct {
+	MinLatitude  float64
+	MinLongitude float64
+	MaxLatitude  float64
+	MaxLongitude float64
+}
+
+// Contains returns true if the supplied latitude and longitude (in degrees) are inside the bounds.
+func (b Bounds) Contains(lat float64, lon float64) bool {
+	if lat < b.MinLatitude || lat > b.MaxLatitude {
+		return false
+	}
+	if b.MinLongitude <= b.MaxLongitude {
+		return lon >= b.MinLongitude && lon <= b.MaxLongitude
+	}
+	return lon >= b.MinLongitude || lon <= b.MaxLongitude
 }
 
 // GeoSet is a collection that allows for values to be stored by their latitude and longitude;
-// and allows for lookups to find the entry closest to the supplied latitude and longitude.
+// and allows for lookups to find the entries closest to, or within an area around, the supplied latitude and longitude.
+//
+// Entries are indexed by a k-d tree over their positions on the unit sphere, which avoids any special handling
+// of the poles or the antimeridian. The tree is rebuilt lazily by the first query after enough entries have been
+// added or removed; until then new entries are searched linearly. This suits the common case of loading a set
+// once and querying it many times.
+//
+// Values identify entries when removing or updating them, so they must be comparable.
+// It is safe to use a GeoSet from multiple goroutines.
 type GeoSet struct {
-	entries []entry
+	lock sync.RWMutex
+
+	// tree is an implicit k-d tree; the median of each range is the node splitting it, and the depth picks the axis.
+	tree []*entry
+	// treeRemoved is the number of removed entries still present in the tree.
+	treeRemoved int
+	// pending contains the entries added since the tree was built.
+	pending []*entry
+
+	byValue map[interface{}][]*entry
 }
 
 // NewGeoSet returns a new GeoSet
 func NewGeoSet() *GeoSet {
-	return &GeoSet{}
+	return &GeoSet{
+		byValue: map[interface{}][]*entry{},
+	}
 }
 
 // Add the supplied value to the location specified with the latitude and longitude (in degrees)
 func (gs *GeoSet) Add(lat float64, lon float64, value interface{}) {
-	gs.entries = append(gs.entries, entry{lat, lon, value})
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+
+	gs.add(lat, lon, value)
+}
+
+// Remove removes every entry with the supplied value. It returns false if there were none.
+func (gs *GeoSet) Remove(value interface{}) bool {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
+
+	return gs.remove(value)
 }
 
-// Closest returns the entry in the set that is nearest to the supplied latitude and longitude (in degrees)
-func (gs *GeoSet) Closest(lat float64, lon float64) interface{} {
-	shortestDistance := math.MaxFloat64
-	var value interface{}
+// Update moves every entry with the supplied value to the specified latitude and longitude (in degrees).
+// If there is no such entry the value is added. It returns false if the value was added.
+func (gs *GeoSet) Update(lat float64, lon float64, value interface{}) bool {
+	gs.lock.Lock()
+	defer gs.lock.Unlock()
 
-	for _, entry := range gs.entries {
-		distance := distance(lat, lon, entry.latitude, entry.longitude)
-		if distance < shortestDistance {
-			shortestDistance = distance
-			value = entry.value
+	existed := gs.remove(value)
+	gs.add(lat, lon, value)
+	return existed
+}
+
+// Len returns the number of entries in the set.
+func (gs *GeoSet) Len() int {
+	gs.lock.RLock()
+	defer gs.lock.RUnlock()
+
+	return len(gs.tree) - gs.treeRemoved + len(gs.pending)
+}
+
+// Closest returns the entry in the set that is nearest to the supplied latitude and longitude (in degrees),
+// or nil if the set is empty.
+func (gs *GeoSet) Closest(lat float64, lon float64) *Result {
+	results := gs.KNearest(lat, lon, 1)
+	if len(results) < 1 {
+		return nil
+	}
+	return &results[0]
+}
+
+// KNearest returns up to k entries nearest to the supplied latitude and longitude (in degrees), closest first.
+func (gs *GeoSet) KNearest(lat float64, lon float64, k int) []Result {
+	if k < 1 {
+		return nil
+	}
+
+	gs.rLockIndexed()
+	defer gs.lock.RUnlock()
+
+	target := toPoint(lat, lon)
+	nearest := &entryHeap{target: target}
+
+	consider := func(e *entry) {
+		if e.removed {
+			return
+		}
+		if nearest.Len() < k {
+			heap.Push(nearest, e)
+		} else if chordSquared(target, e.point) < chordSquared(target, nearest.entries[0].point) {
+			nearest.entries[0] = e
+			heap.Fix(nearest, 0)
 		}
 	}
 
-	return value
+	for _, e := range gs.pending {
+		consider(e)
+	}
+
+	var search func(lo int, hi int, depth int)
+	search = func(lo int, hi int, depth int) {
+		if lo >= hi {
+			return
+		}
+
+		mid := (lo + hi) / 2
+		axis := depth % 3
+		consider(gs.tree[mid])
+
+		diff := target[axis] - gs.tree[mid].point[axis]
+		near, far := [2]int{lo, mid}, [2]int{mid + 1, hi}
+		if diff > 0 {
+			near, far = far, near
+		}
+
+		search(near[0], near[1], depth+1)
+		// The far side can only contain closer entries if the splitting plane is closer than the furthest we've kept.
+		if nearest.Len() < k || diff*diff < chordSquared(target, nearest.entries[0].point) {
+			search(far[0], far[1], depth+1)
+		}
+	}
+	search(0, len(gs.tree), 0)
+
+	return toResults(lat, lon, nearest.entries)
+}
+
+// WithinRadius returns the entries within the supplied distance (in metres) of the latitude and longitude (in degrees), closest first.
+func (gs *GeoSet) WithinRadius(lat float64, lon float64, metres float64) []Result {
+	if metres < 0 {
+		return nil
+	}
+
+	// The straight line distance through the sphere is monotonic with the distance along its surface,
+	// so we can search the tree using the former.
+	chord := 2.0
+	if metres < math.Pi*earthRadius {
+		chord = 2 * math.Sin(metres/(2*earthRadius))
+	}
+	chord += epsilon
+
+	target := toPoint(lat, lon)
+	var min, max [3]float64
+	for axis := range target {
+		min[axis] = target[axis] - chord
+		max[axis] = target[axis] + chord
+	}
+
+	candidates := gs.searchBox(min, max, func(e *entry) bool {
+		return chordSquared(target, e.point) <= chord*chord
+	})
+
+	var ret []Result
+	for _, result := range toResults(lat, lon, candidates) {
+		if result.Distance <= metres {
+			ret = append(ret, result)
+		}
+	}
+	return ret
+}
+
+// WithinBounds returns the entries inside the supplied bounds.
+// Entries are ordered by their distance from the centre of the bounds, closest first.
+func (gs *GeoSet) WithinBounds(bounds Bounds) []Result {
+	if bounds.MinLatitude > bounds.MaxLatitude {
+		return nil
+	}
+
+	min, max := bounds.box()
+	candidates := gs.searchBox(min, max, func(e *entry) bool {
+		return bounds.Contains(e.latitude, e.longitude)
+	})
+
+	lat, lon := bounds.centre()
+	return toResults(lat, lon, candidates)
+}
+
+// searchBox returns the entries whose points are inside the supplied box on the unit sphere and which satisfy include.
+func (gs *GeoSet) searchBox(min [3]float64, max [3]float64, include func(*entry) bool) []*entry {
+	gs.rLockIndexed()
+	defer gs.lock.RUnlock()
+
+	var ret []*entry
+	consider := func(e *entry) {
+		if !e.removed && include(e) {
+			ret = append(ret, e)
+		}
+	}
+
+	for _, e := range gs.pending {
+		consider(e)
+	}
+
+	var search func(lo int, hi int, depth int)
+	search = func(lo int, hi int, depth int) {
+		if lo >= hi {
+			return
+		}
+
+		mid := (lo + hi) / 2
+		axis := depth % 3
+		split := gs.tree[mid].point[axis]
+
+		if min[axis] <= split && split <= max[axis] {
+			consider(gs.tree[mid])
+		}
+		if min[axis] <= split {
+			search(lo, mid, depth+1)
+		}
+		if max[axis] >= split {
+			search(mid+1, hi, depth+1)
+		}
+	}
+	search(0, len(gs.tree), 0)
+
+	return ret
+}
+
+// rLockIndexed acquires the read lock, first rebuilding the tree if enough has changed since it was built.
+func (gs *GeoSet) rLockIndexed() {
+	gs.lock.RLock()
+	if !gs.needsRebuild() {
+		return
+	}
+	gs.lock.RUnlock()
+
+	gs.lock.Lock()
+	// Another query may have rebuilt the tree while we were waiting for the lock.
+	if gs.needsRebuild() {
+		gs.rebuild()
+	}
+	gs.lock.Unlock()
+
+	gs.lock.RLock()
+}
+
+func (gs *GeoSet) needsRebuild() bool {
+	threshold := int(math.Sqrt(float64(len(gs.tree))))
+	if threshold < minRebuildThreshold {
+		threshold = minRebuildThreshold
+	}
+
+	return len(gs.pending) > threshold || gs.treeRemoved > len(gs.tree)/4
+}
+
+// rebuild creates a balanced tree from the live entries. The caller must hold the write lock.
+func (gs *GeoSet) rebuild() {
+	entries := make([]*entry, 0, len(gs.tree)-gs.treeRemoved+len(gs.pending))
+	for _, e := range gs.tree {
+		if !e.removed {
+			entries = append(entries, e)
+		}
+	}
+	for _, e := range gs.pending {
+		e.indexed = true
+		entries = append(entries, e)
+	}
+
+	var build func(entries []*entry, depth int)
+	build = func(entries []*entry, depth int) {
+		if len(entries) < 2 {
+			return
+		}
+
+		axis := depth % 3
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].point[axis] < entries[j].point[axis]
+		})
+
+		mid := len(entries) / 2
+		build(entries[:mid], depth+1)
+		build(entries[mid+1:], depth+1)
+	}
+	build(entries, 0)
+
+	gs.tree = entries
+	gs.treeRemoved = 0
+	gs.pending = nil
+}
+
+// add inserts a new entry. The caller must hold the write lock.
+func (gs *GeoSet) add(lat float64, lon float64, value interface{}) {
+	e := &entry{
+		latitude:  lat,
+		longitude: lon,
+		value:     value,
+		point:     toPoint(lat, lon),
+	}
+
+	gs.pending = append(gs.pending, e)
+	gs.byValue[value] = append(gs.byValue[value], e)
+}
+
+// remove marks every entry with the value as removed. The caller must hold the write lock.
+func (gs *GeoSet) remove(value interface{}) bool {
+	entries, ok := gs.byValue[value]
+	if !ok {
+		return false
+	}
+	delete(gs.byValue, value)
+
+	for _, e := range entries {
+		e.removed = true
+		if e.indexed {
+			gs.treeRemoved++
+		}
+	}
+
+	pending := gs.pending[:0]
+	for _, e := range gs.pending {
+		if !e.removed {
+			pending = append(pending, e)
+		}
+	}
+	gs.pending = pending
+
+	return true
+}
+
+// box returns a box on the unit sphere which contains every point inside the bounds.
+func (b Bounds) box() ([3]float64, [3]float64) {
+	minLat := b.MinLatitude * math.Pi / 180
+	maxLat := b.MaxLatitude * math.Pi / 180
+	minLon := b.MinLongitude * math.Pi / 180
+	maxLon := b.MaxLongitude * math.Pi / 180
+	if minLon > maxLon {
+		maxLon += 2 * math.Pi
+	}
+
+	// The extremes of sin and cos are at the ends of the range or at multiples of 90 degrees within it.
+	cosLon := []float64{math.Cos(minLon), math.Cos(maxLon)}
+	sinLon := []float64{math.Sin(minLon), math.Sin(maxLon)}
+	for angle := math.Ceil(minLon/(math.Pi/2)) * math.Pi / 2; angle < maxLon; angle += math.Pi / 2 {
+		cosLon = append(cosLon, math.Cos(angle))
+		sinLon = append(sinLon, math.Sin(angle))
+	}
+
+	cosLat := []float64{math.Cos(minLat), math.Cos(maxLat)}
+	if minLat < 0 && maxLat > 0 {
+		cosLat = append(cosLat, 1)
+	}
+
+	var min, max [3]float64
+	min[0], max[0] = productRange(cosLat, cosLon)
+	min[1], max[1] = productRange(cosLat, sinLon)
+	min[2], max[2] = math.Sin(minLat), math.Sin(maxLat)
+
+	for axis := range min {
+		min[axis] -= epsilon
+		max[axis] += epsilon
+	}
+	return min, max
+}
+
+// centre returns the latitude and longitude (in degrees) of the middle of the bounds.
+func (b Bounds) centre() (float64, float64) {
+	maxLon := b.MaxLongitude
+	if b.MinLongitude > maxLon {
+		maxLon += 360
+	}
+
+	lon := (b.MinLongitude + maxLon) / 2
+	if lon > 180 {
+		lon -= 360
+	}
+	return (b.MinLatitude + b.MaxLatitude) / 2, lon
+}
+
+// productRange returns the minimum and maximum products of a value from each set.
+func productRange(a []float64, b []float64) (float64, float64) {
+	min, max := math.MaxFloat64, -math.MaxFloat64
+	for _, x := range a {
+		for _, y := range b {
+			min = math.Min(min, x*y)
+			max = math.Max(max, x*y)
+		}
+	}
+	return min, max
+}
+
+// toResults converts the entries into results relative to the supplied latitude and longitude, closest first.
+func toResults(lat float64, lon float64, entries []*entry) []Result {
+	ret := make([]Result, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, Result{
+			Latitude:  e.latitude,
+			Longitude: e.longitude,
+			Value:     e.value,
+			Distance:  distance(lat, lon, e.latitude, e.longitude),
+		})
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Distance < ret[j].Distance
+	})
+	return ret
+}
+
+// entryHeap is a max-heap of entries ordered by their distance from the target.
+type entryHeap struct {
+	target  [3]float64
+	entries []*entry
+}
+
+func (h *entryHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *entryHeap) Less(i, j int) bool {
+	return chordSquared(h.target, h.entries[i].point) > chordSquared(h.target, h.entries[j].point)
+}
+
+func (h *entryHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(*entry))
+}
+
+func (h *entryHeap) Pop() interface{} {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
+
+// toPoint converts the latitude and longitude (in degrees) to a point on the unit sphere.
+func toPoint(lat float64, lon float64) [3]float64 {
+	la := lat * math.Pi / 180
+	lo := lon * math.Pi / 180
+
+	return [3]float64{
+		math.Cos(la) * math.Cos(lo),
+		math.Cos(la) * math.Sin(lo),
+		math.Sin(la),
+	}
+}
+
+// chordSquared returns the square of the straight line distance between two points.
+func chordSquared(a [3]float64, b [3]float64) float64 {
+	dx := a[0] - b[0]
+	dy := a[1] - b[1]
+	dz := a[2] - b[2]
+	return dx*dx + dy*dy + dz*dz
 }
 
 // haversine function
@@ -50,9 +513,6 @@ func hsin(theta float64) float64 {
 
 // See http://en.wikipedia.org/wiki/Haversine_formula
 func distance(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
-	// Radius of Earth in metres (mean earth radius, via https://en.wikipedia.org/wiki/Great-circle_distance)
-	r := float64(6371000)
-
 	// Convert degrees to radians
 	la1 := lat1 * math.Pi / 180
 	lo1 := lon1 * math.Pi / 180
@@ -60,5 +520,5 @@ func distance(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
 	lo2 := lon2 * math.Pi / 180
 
 	h := hsin(la2-la1) + math.Cos(la1)*math.Cos(la2)*hsin(lo2-lo1)
-	return 2 * r * math.Asin(math.Sqrt(h))
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
 }
@@ -1,9 +1,12 @@
 package geoset
 
 import (
+	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type geosettest struct {
@@ -45,11 +48,238 @@ func TestGeoSet_Closest(t *testing.T) {
 			for _, entry := range tt.entries {
 				geoset.Add(entry.latitude, entry.longitude, entry.value)
 			}
-			val := geoset.Closest(tt.searchLat, tt.searchLon)
-			intVal, ok := val.(int)
+			result := geoset.Closest(tt.searchLat, tt.searchLon)
+			require.NotNil(t, result)
+			intVal, ok := result.Value.(int)
 			assert.True(t, ok)
 			assert.Equal(t, tt.closestValue, intVal)
 		})
 	}
 
+	assert.Nil(t, NewGeoSet().Closest(0, 0))
+}
+
+// Approximate locations of a handful of cities, used by the query tests.
+var cities = []struct {
+	name      string
+	latitude  float64
+	longitude float64
+}{
+	{"waterloo", 43.4643, -80.5204},
+	{"toronto", 43.6532, -79.3832},
+	{"hamilton", 43.2557, -79.8711},
+	{"ottawa", 45.4215, -75.6972},
+	{"vancouver", 49.2827, -123.1207},
+	{"auckland", -36.8485, 174.7633},
+	{"suva", -18.1248, 178.4501},
+	{"apia", -13.8333, -171.7500},
+}
+
+func newCitySet() *GeoSet {
+	gs := NewGeoSet()
+	for _, city := range cities {
+		gs.Add(city.latitude, city.longitude, city.name)
+	}
+	return gs
+}
+
+func resultNames(results []Result) []string {
+	var names []string
+	for _, result := range results {
+		names = append(names, result.Value.(string))
+	}
+	return names
+}
+
+func TestGeoSet_KNearest(t *testing.T) {
+	tests := []struct {
+		name     string
+		lat      float64
+		lon      float64
+		k        int
+		expected []string
+	}{
+		{
+			"closest three to waterloo",
+			43.4643,
+			-80.5204,
+			3,
+			[]string{"waterloo", "hamilton", "toronto"},
+		},
+		{
+			"across the antimeridian",
+			-16,
+			179.9,
+			2,
+			[]string{"suva", "apia"},
+		},
+		{
+			"more than the set",
+			0,
+			0,
+			20,
+			[]string{"waterloo", "toronto", "hamilton", "ottawa", "vancouver", "auckland", "suva", "apia"},
+		},
+		{
+			"none",
+			0,
+			0,
+			0,
+			nil,
+		},
+	}
+
+	gs := newCitySet()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := gs.KNearest(tt.lat, tt.lon, tt.k)
+			assert.ElementsMatch(t, tt.expected, resultNames(results))
+
+			for idx := 1; idx < len(results); idx++ {
+				assert.LessOrEqual(t, results[idx-1].Distance, results[idx].Distance)
+			}
+		})
+	}
+}
+
+func TestGeoSet_WithinRadius(t *testing.T) {
+	tests := []struct {
+		name     string
+		lat      float64
+		lon      float64
+		metres   float64
+		expected []string
+	}{
+		{
+			"southern ontario",
+			43.4643,
+			-80.5204,
+			100000,
+			[]string{"waterloo", "hamilton", "toronto"},
+		},
+		{
+			"exact match",
+			45.4215,
+			-75.6972,
+			0,
+			[]string{"ottawa"},
+		},
+		{
+			"across the antimeridian",
+			-16,
+			-179.9,
+			1000000,
+			[]string{"suva", "apia"},
+		},
+		{
+			"empty ocean",
+			0,
+			-30,
+			1000000,
+			nil,
+		},
+	}
+
+	gs := newCitySet()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := gs.WithinRadius(tt.lat, tt.lon, tt.metres)
+			assert.Equal(t, tt.expected, resultNames(results))
+			for _, result := range results {
+				assert.LessOrEqual(t, result.Distance, tt.metres)
+			}
+		})
+	}
+
+	assert.Len(t, gs.WithinRadius(0, 0, 1e9), len(cities))
+}
+
+func TestGeoSet_WithinBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		bounds   Bounds
+		expected []string
+	}{
+		{
+			"ontario",
+			Bounds{MinLatitude: 42, MinLongitude: -81, MaxLatitude: 46, MaxLongitude: -75},
+			[]string{"toronto", "hamilton", "waterloo", "ottawa"},
+		},
+		{
+			"across the antimeridian",
+			Bounds{MinLatitude: -40, MinLongitude: 170, MaxLatitude: -10, MaxLongitude: -170},
+			[]string{"suva", "auckland", "apia"},
+		},
+		{
+			"inverted latitudes",
+			Bounds{MinLatitude: 46, MinLongitude: -81, MaxLatitude: 42, MaxLongitude: -75},
+			nil,
+		},
+	}
+
+	gs := newCitySet()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, resultNames(gs.WithinBounds(tt.bounds)))
+		})
+	}
+}
+
+func TestGeoSet_RemoveUpdate(t *testing.T) {
+	gs := newCitySet()
+	// Query first so the entries are indexed before they're changed.
+	require.NotNil(t, gs.Closest(0, 0))
+
+	assert.True(t, gs.Remove("hamilton"))
+	assert.False(t, gs.Remove("hamilton"))
+	assert.Equal(t, len(cities)-1, gs.Len())
+	assert.Equal(t, []string{"waterloo", "toronto"}, resultNames(gs.KNearest(43.4643, -80.5204, 2)))
+
+	// Move toronto to somewhere in the Pacific.
+	assert.True(t, gs.Update(-15, -175, "toronto"))
+	assert.Equal(t, []string{"waterloo", "ottawa"}, resultNames(gs.KNearest(43.4643, -80.5204, 2)))
+	assert.Equal(t, "toronto", gs.Closest(-15, -175).Value)
+
+	assert.False(t, gs.Update(43.2557, -79.8711, "hamilton"))
+	assert.Equal(t, len(cities), gs.Len())
+	assert.Equal(t, "hamilton", gs.Closest(43.2557, -79.8711).Value)
+}
+
+func TestGeoSet_MatchesLinearScan(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	gs := NewGeoSet()
+
+	var live []int
+	for idx := 0; idx < 2000; idx++ {
+		gs.Add(rnd.Float64()*180-90, rnd.Float64()*360-180, idx)
+		live = append(live, idx)
+	}
+	// Remove some entries once they've been indexed, and add some which won't be.
+	gs.KNearest(0, 0, 1)
+	for idx := 0; idx < 2000; idx += 7 {
+		gs.Remove(idx)
+	}
+	for idx := 2000; idx < 2010; idx++ {
+		gs.Add(rnd.Float64()*180-90, rnd.Float64()*360-180, idx)
+	}
+
+	for query := 0; query < 50; query++ {
+		lat, lon := rnd.Float64()*180-90, rnd.Float64()*360-180
+
+		var expected []float64
+		for _, e := range gs.byValue {
+			expected = append(expected, distance(lat, lon, e[0].latitude, e[0].longitude))
+		}
+		sort.Float64s(expected)
+
+		results := gs.KNearest(lat, lon, 10)
+		require.Len(t, results, 10)
+		for idx, result := range results {
+			assert.InDelta(t, expected[idx], result.Distance, 1e-6)
+		}
+
+		radius := rnd.Float64() * 2000000
+		count := sort.SearchFloat64s(expected, radius+1e-9)
+		assert.Len(t, gs.WithinRadius(lat, lon, radius), count)
+	}
 }
@@ -0,0 +1,423 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultMaxSegmentBytes is the size at which a journal segment is closed and a new one started.
+	DefaultMaxSegmentBytes = 4 * 1024 * 1024
+
+	segmentSuffix = ".journal"
+)
+
+var (
+	// ErrJournalClosed is returned if a closed journal is used.
+	ErrJournalClosed = errors.New("journal closed")
+	// ErrCorruptRecord is returned if a journal record can't be decoded.
+	ErrCorruptRecord = errors.New("corrupt journal record")
+)
+
+// JournalConfig controls where a journal is stored and how long its contents are retained.
+// Retention is enforced a segment at a time, so slightly more than the configured limits may be kept.
+type JournalConfig struct {
+	// Dir is the directory the segment files are written to. It is created if it doesn't exist.
+	Dir string
+	// MaxSegmentBytes is the size at which a new segment is started. Defaults to DefaultMaxSegmentBytes.
+	MaxSegmentBytes int64
+	// MaxTotalBytes is the total size of all segments beyond which the oldest are removed. 0 disables this limit.
+	MaxTotalBytes int64
+	// MaxAge is the age beyond which segments whose messages are all older are removed. 0 disables this limit.
+	MaxAge time.Duration
+}
+
+type segment struct {
+	path          string
+	firstSequence uint64
+	size          int64
+	modified      time.Time
+}
+
+// Journal is an append-only log of the messages sent by a source, which survives the process restarting.
+// Messages are protobuf-encoded and length-prefixed, and are written to a series of segment files
+// named for the sequence number of the first message they contain. Messages are written to the
+// operating system as they are appended, but the journal never syncs them to disk, including when a
+// segment is rolled or the journal is closed. Messages survive the process crashing, but the most
+// recent ones may be lost if the machine crashes or loses power.
+type Journal struct {
+	logger     *zap.Logger
+	cfg        JournalConfig
+	newMessage func() proto.Message
+
+	lock         sync.Mutex
+	segments     []*segment
+	active       *os.File
+	lastSequence uint64
+	closed       bool
+}
+
+// OpenJournal opens, or creates, the journal in the configured directory.
+// newMessage must return an empty instance of the message type being journaled; it is used when reading records back.
+// A partially written record at the end of the journal, such as one left by a crash, is discarded.
+func OpenJournal(logger *zap.Logger, cfg JournalConfig, newMessage func() proto.Message) (*Journal, error) {
+	if cfg.MaxSegmentBytes <= 0 {
+		cfg.MaxSegmentBytes = DefaultMaxSegmentBytes
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		logger:     logger,
+		cfg:        cfg,
+		newMessage: newMessage,
+	}
+
+	files, err := ioutil.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+
+		firstSequence, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			logger.Info("skipping unrecognized file in journal dir",
+				zap.String("name", file.Name()),
+			)
+			continue
+		}
+
+		j.segments = append(j.segments, &segment{
+			path:          filepath.Join(cfg.Dir, file.Name()),
+			firstSequence: firstSequence,
+			size:          file.Size(),
+			modified:      file.ModTime(),
+		})
+	}
+	sort.Slice(j.segments, func(i, k int) bool {
+		return j.segments[i].firstSequence < j.segments[k].firstSequence
+	})
+
+	if len(j.segments) > 0 {
+		if err := j.recover(j.segments[len(j.segments)-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	j.enforceRetention()
+
+	return j, nil
+}
+
+// LastSequence returns the sequence number of the most recently journaled message, or 0 if the journal is empty.
+func (j *Journal) LastSequence() uint64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.lastSequence
+}
+
+// Append writes the message to the end of the journal.
+func (j *Journal) Append(msg *Message) error {
+	payload, err := proto.Marshal(msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, binary.MaxVarintLen64*2)
+	n := binary.PutUvarint(header, msg.Sequence)
+	n += binary.PutVarint(header[n:], msg.Timestamp.UnixNano())
+
+	record := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+n+len(payload))
+	lenSize := binary.PutUvarint(record, uint64(n+len(payload)))
+	record = append(record[:lenSize], header[:n]...)
+	record = append(record, payload...)
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.closed {
+		return ErrJournalClosed
+	}
+
+	if j.active == nil || j.segments[len(j.segments)-1].size >= j.cfg.MaxSegmentBytes {
+		if err := j.roll(msg.Sequence); err != nil {
+			return err
+		}
+	}
+
+	if _, err := j.active.Write(record); err != nil {
+		return err
+	}
+
+	current := j.segments[len(j.segments)-1]
+	current.size += int64(len(record))
+	current.modified = time.Now()
+	j.lastSequence = msg.Sequence
+	return nil
+}
+
+// ReplayFrom invokes fn, in order, for every retained message with a sequence number greater than the one supplied.
+// Replay stops at the first error returned by fn, which is returned to the caller.
+func (j *Journal) ReplayFrom(sequence uint64, fn func(*Message) error) error {
+	return j.replay(func(segments []segment, idx int) bool {
+		// Only the messages of the next segment follow the requested sequence.
+		return idx+1 < len(segments) && segments[idx+1].firstSequence <= sequence+1
+	}, func(msg *Message) bool {
+		return msg.Sequence > sequence
+	}, fn)
+}
+
+// ReplaySince invokes fn, in order, for every retained message which was sent at or after the supplied time.
+// Replay stops at the first error returned by fn, which is returned to the caller.
+func (j *Journal) ReplaySince(since time.Time, fn func(*Message) error) error {
+	return j.replay(func(segments []segment, idx int) bool {
+		// A segment was last modified when its newest message was appended, so none of its messages are more recent.
+		return segments[idx].modified.Before(since)
+	}, func(msg *Message) bool {
+		return !msg.Timestamp.Before(since)
+	}, fn)
+}
+
+// Close closes the active segment, without syncing it to disk. The journal can't be appended to once closed.
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.closed = true
+	if j.active == nil {
+		return nil
+	}
+
+	err := j.active.Close()
+	j.active = nil
+	return err
+}
+
+// replay invokes fn for each included message of the segments which aren't skipped.
+func (j *Journal) replay(skip func([]segment, int) bool, include func(*Message) bool, fn func(*Message) error) error {
+	// We snapshot the segments so appends can continue while we read;
+	// anything appended after the snapshot may or may not be included.
+	j.lock.Lock()
+	segments := make([]segment, len(j.segments))
+	for idx, seg := range j.segments {
+		segments[idx] = *seg
+	}
+	j.lock.Unlock()
+
+	for idx, seg := range segments {
+		if skip(segments, idx) {
+			continue
+		}
+
+		err := j.readSegment(seg.path, func(msg *Message, _ int64) error {
+			if !include(msg) {
+				return nil
+			}
+			return fn(msg)
+		})
+		if os.IsNotExist(err) {
+			// The segment was removed by retention while we were reading.
+			continue
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSegment decodes each record in the segment, invoking fn with the message and the offset following it.
+// A trailing partial record results in io.ErrUnexpectedEOF.
+func (j *Journal) readSegment(path string, fn func(*Message, int64) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		record := make([]byte, length)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		msg, err := j.decode(record)
+		if err != nil {
+			return err
+		}
+
+		offset += int64(uvarintSize(length)) + int64(length)
+		if err := fn(msg, offset); err != nil {
+			return err
+		}
+	}
+}
+
+func (j *Journal) decode(record []byte) (*Message, error) {
+	sequence, n := binary.Uvarint(record)
+	if n <= 0 {
+		return nil, ErrCorruptRecord
+	}
+	record = record[n:]
+
+	timestamp, n := binary.Varint(record)
+	if n <= 0 {
+		return nil, ErrCorruptRecord
+	}
+	record = record[n:]
+
+	payload := j.newMessage()
+	if err := proto.Unmarshal(record, payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+	}
+
+	return &Message{
+		Sequence:  sequence,
+		Timestamp: time.Unix(0, timestamp),
+		Payload:   payload,
+	}, nil
+}
+
+// recover finds the last sequence in the segment, discarding any partially written trailing record.
+func (j *Journal) recover(seg *segment) error {
+	var validOffset int64
+
+	err := j.readSegment(seg.path, func(msg *Message, offset int64) error {
+		j.lastSequence = msg.Sequence
+		validOffset = offset
+		return nil
+	})
+	if err == io.ErrUnexpectedEOF {
+		j.logger.Info("discarding partial record at the end of the journal",
+			zap.String("path", seg.path),
+			zap.Int64("valid_bytes", validOffset),
+		)
+
+		if err := os.Truncate(seg.path, validOffset); err != nil {
+			return err
+		}
+		seg.size = validOffset
+	} else if err != nil {
+		return err
+	}
+
+	if j.lastSequence == 0 && seg.firstSequence > 0 {
+		// An empty segment still tells us where the sequence had reached.
+		j.lastSequence = seg.firstSequence - 1
+	}
+
+	return nil
+}
+
+// roll closes the active segment, if any, and starts a new one beginning with the supplied sequence.
+// The caller must hold the lock.
+func (j *Journal) roll(firstSequence uint64) error {
+	if j.active != nil {
+		if err := j.active.Close(); err != nil {
+			return err
+		}
+		j.active = nil
+	}
+
+	// Reuse the last segment if it was left empty, otherwise it would share the new segment's name.
+	if len(j.segments) > 0 && j.segments[len(j.segments)-1].size == 0 {
+		seg := j.segments[len(j.segments)-1]
+		j.segments = j.segments[:len(j.segments)-1]
+		os.Remove(seg.path)
+	}
+
+	path := filepath.Join(j.cfg.Dir, fmt.Sprintf("%020d%s", firstSequence, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	j.active = f
+	j.segments = append(j.segments, &segment{
+		path:          path,
+		firstSequence: firstSequence,
+		size:          info.Size(),
+		modified:      time.Now(),
+	})
+
+	j.enforceRetention()
+	return nil
+}
+
+// enforceRetention removes the oldest segments which fall outside the configured limits.
+// The most recent segment is always kept. The caller must hold the lock, or have exclusive access.
+func (j *Journal) enforceRetention() {
+	var total int64
+	for _, seg := range j.segments {
+		total += seg.size
+	}
+
+	for len(j.segments) > 1 {
+		oldest := j.segments[0]
+
+		tooBig := j.cfg.MaxTotalBytes > 0 && total > j.cfg.MaxTotalBytes
+		tooOld := j.cfg.MaxAge > 0 && time.Since(oldest.modified) > j.cfg.MaxAge
+		if !tooBig && !tooOld {
+			return
+		}
+
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			j.logger.Error("unable to remove expired journal segment",
+				zap.String("path", oldest.path),
+				zap.Error(err),
+			)
+			return
+		}
+
+		j.logger.Debug("removed expired journal segment",
+			zap.String("path", oldest.path),
+			zap.Bool("too_big", tooBig),
+			zap.Bool("too_old", tooOld),
+		)
+
+		total -= oldest.size
+		j.segments = j.segments[1:]
+	}
+}
+
+func uvarintSize(v uint64) int {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return binary.PutUvarint(buf, v)
+}
@@ -0,0 +1,250 @@
+package stream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func newStringValue() proto.Message {
+	return &wrappers.StringValue{}
+}
+
+func testJournalDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func appendValues(t *testing.T, j *Journal, first uint64, values ...string) {
+	for idx, value := range values {
+		err := j.Append(&Message{
+			Sequence:  first + uint64(idx),
+			Timestamp: time.Now(),
+			Payload:   &wrappers.StringValue{Value: value},
+		})
+		require.NoError(t, err)
+	}
+}
+
+func replayValues(t *testing.T, j *Journal, after uint64) []string {
+	var values []string
+	err := j.ReplayFrom(after, func(msg *Message) error {
+		values = append(values, msg.Payload.(*wrappers.StringValue).Value)
+		return nil
+	})
+	require.NoError(t, err)
+	return values
+}
+
+func TestJournalReopen(t *testing.T) {
+	dir := testJournalDir(t)
+	logger := zaptest.NewLogger(t)
+
+	j, err := OpenJournal(logger, JournalConfig{Dir: dir}, newStringValue)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), j.LastSequence())
+
+	appendValues(t, j, 1, "a", "b", "c")
+	assert.Equal(t, uint64(3), j.LastSequence())
+	require.NoError(t, j.Close())
+
+	j, err = OpenJournal(logger, JournalConfig{Dir: dir}, newStringValue)
+	require.NoError(t, err)
+	defer j.Close()
+
+	assert.Equal(t, uint64(3), j.LastSequence())
+	appendValues(t, j, 4, "d")
+
+	assert.Equal(t, []string{"a", "b", "c", "d"}, replayValues(t, j, 0))
+	assert.Equal(t, []string{"c", "d"}, replayValues(t, j, 2))
+}
+
+func TestJournalReplaySince(t *testing.T) {
+	j, err := OpenJournal(zaptest.NewLogger(t), JournalConfig{Dir: testJournalDir(t)}, newStringValue)
+	require.NoError(t, err)
+	defer j.Close()
+
+	now := time.Now()
+	for idx, offset := range []time.Duration{-3 * time.Hour, -2 * time.Hour, -time.Hour} {
+		err := j.Append(&Message{
+			Sequence:  uint64(idx + 1),
+			Timestamp: now.Add(offset),
+			Payload:   &wrappers.StringValue{Value: offset.String()},
+		})
+		require.NoError(t, err)
+	}
+
+	var values []string
+	err = j.ReplaySince(now.Add(-2*time.Hour), func(msg *Message) error {
+		values = append(values, msg.Payload.(*wrappers.StringValue).Value)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-2h0m0s", "-1h0m0s"}, values)
+}
+
+func TestJournalReplaySinceSkipsSegments(t *testing.T) {
+	dir := testJournalDir(t)
+
+	// Every record is 13 bytes, so each segment holds 2 records.
+	j, err := OpenJournal(zaptest.NewLogger(t), JournalConfig{
+		Dir:             dir,
+		MaxSegmentBytes: 20,
+	}, newStringValue)
+	require.NoError(t, err)
+	defer j.Close()
+
+	appendValues(t, j, 1, "a", "b")
+	time.Sleep(time.Millisecond)
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+	appendValues(t, j, 3, "c", "d")
+
+	// The segment last written before the time isn't read, so corrupting it has no effect.
+	err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d%s", 1, segmentSuffix)), []byte{0x01, 0x80}, 0644)
+	require.NoError(t, err)
+
+	var values []string
+	err = j.ReplaySince(since, func(msg *Message) error {
+		values = append(values, msg.Payload.(*wrappers.StringValue).Value)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "d"}, values)
+
+	err = j.ReplayFrom(0, func(*Message) error {
+		return nil
+	})
+	assert.Error(t, err)
+}
+
+func TestJournalRetention(t *testing.T) {
+	dir := testJournalDir(t)
+
+	// Every record is 13 bytes, so each segment holds 2 records and at most 2 segments are retained.
+	j, err := OpenJournal(zaptest.NewLogger(t), JournalConfig{
+		Dir:             dir,
+		MaxSegmentBytes: 20,
+		MaxTotalBytes:   60,
+	}, newStringValue)
+	require.NoError(t, err)
+	defer j.Close()
+
+	appendValues(t, j, 1, "a", "b", "c", "d", "e", "f", "g")
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+	assert.Equal(t, []string{"c", "d", "e", "f", "g"}, replayValues(t, j, 0))
+}
+
+func TestJournalPartialRecord(t *testing.T) {
+	dir := testJournalDir(t)
+	logger := zaptest.NewLogger(t)
+
+	j, err := OpenJournal(logger, JournalConfig{Dir: dir}, newStringValue)
+	require.NoError(t, err)
+	appendValues(t, j, 1, "a", "b")
+	require.NoError(t, j.Close())
+
+	// Simulate a crash part way through writing a record.
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{20, 3, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	j, err = OpenJournal(logger, JournalConfig{Dir: dir}, newStringValue)
+	require.NoError(t, err)
+	defer j.Close()
+
+	assert.Equal(t, uint64(2), j.LastSequence())
+	appendValues(t, j, 3, "c")
+	assert.Equal(t, []string{"a", "b", "c"}, replayValues(t, j, 0))
+}
+
+func TestJournaledSource(t *testing.T) {
+	dir := testJournalDir(t)
+	logger := zaptest.NewLogger(t)
+
+	j, err := OpenJournal(logger, JournalConfig{Dir: dir}, newStringValue)
+	require.NoError(t, err)
+	s, err := NewJournaledSource(logger, 2, j)
+	require.NoError(t, err)
+
+	for _, value := range []string{"a", "b", "c", "d"} {
+		s.SendMessage(&wrappers.StringValue{Value: value})
+	}
+	require.NoError(t, j.Close())
+
+	// After a restart the sequence continues and sinks can resume from before the restart,
+	// including from beyond the in-memory history.
+	j, err = OpenJournal(logger, JournalConfig{Dir: dir}, newStringValue)
+	require.NoError(t, err)
+	defer j.Close()
+	s, err = NewJournaledSource(logger, 2, j)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), s.Sequence())
+
+	sink := s.NewSink(Resume(1))
+	defer sink.Close()
+
+	s.SendMessage(&wrappers.StringValue{Value: "e"})
+
+	var values []string
+	var sequences []uint64
+	for len(sink.Messages()) > 0 {
+		msg := <-sink.Messages()
+		assert.Nil(t, msg.Gap)
+		values = append(values, msg.Payload.(*wrappers.StringValue).Value)
+		sequences = append(sequences, msg.Sequence)
+	}
+	assert.Equal(t, []string{"b", "c", "d", "e"}, values)
+	assert.Equal(t, []uint64{2, 3, 4, 5}, sequences)
+}
+
+func TestJournaledSourceResumeSince(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	j, err := OpenJournal(logger, JournalConfig{Dir: testJournalDir(t)}, newStringValue)
+	require.NoError(t, err)
+	defer j.Close()
+	s, err := NewJournaledSource(logger, 2, j)
+	require.NoError(t, err)
+
+	s.SendMessage(&wrappers.StringValue{Value: "a"})
+	time.Sleep(time.Millisecond)
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+	for _, value := range []string{"b", "c", "d"} {
+		s.SendMessage(&wrappers.StringValue{Value: value})
+	}
+
+	// The first message sent since the time has aged out of the history, so it is replayed from the journal.
+	sink := s.NewSink(ResumeSince(since))
+	defer sink.Close()
+
+	var values []string
+	for len(sink.Messages()) > 0 {
+		msg := <-sink.Messages()
+		assert.Nil(t, msg.Gap)
+		values = append(values, msg.Payload.(*wrappers.StringValue).Value)
+	}
+	assert.Equal(t, []string{"b", "c", "d"}, values)
+}
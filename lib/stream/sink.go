@@ -1,27 +1,368 @@
 package stream
 
 import (
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/golang/protobuf/proto"
 )
 
+const (
+	// maxPendingSize bounds the number of messages a coalescing sink will hold beyond its channel.
+	maxPendingSize = 1024
+)
+
+// Message is a single entry delivered to a sink, annotated with its position in the source's log.
+type Message struct {
+	// Sequence is the monotonically increasing position of this message in the source's log.
+	// A consumer wishing to resume later should remember the last sequence it processed.
+	Sequence uint64
+	// Timestamp is the time the source sent the message. It is not set on gaps.
+	Timestamp time.Time
+	// Payload is the message broadcast by the source. It is nil if this entry signals a gap.
+	Payload proto.Message
+	// Gap is set if this entry signals that the requested messages are no longer retained by the source.
+	Gap *Gap
+}
+
+// Gap describes a contiguous range of messages which a resuming sink will never receive because they
+// have aged out of the source's history. A consumer receiving a gap should reseed its view of the world.
+type Gap struct {
+	// First is the sequence number of the first missed message.
+	First uint64
+	// Last is the sequence number of the last missed message.
+	Last uint64
+}
+
+// Policy determines how a source treats a sink whose buffer is full when a new message is sent.
+type Policy int
+
+const (
+	// PolicyDropNewest discards the message being sent. This is the default.
+	PolicyDropNewest Policy = iota
+	// PolicyDropOldest discards the oldest buffered message to make room for the message being sent.
+	PolicyDropOldest
+	// PolicyBlockWithTimeout waits for room in the buffer, discarding the message being sent if the timeout elapses.
+	// Note that a blocked sink delays delivery to every other sink of the source.
+	PolicyBlockWithTimeout
+	// PolicyCoalesceByKey queues messages beyond the buffer, replacing any queued message which has the same key.
+	PolicyCoalesceByKey
+	// PolicyDisconnectSlowConsumer closes the sink, which the consumer will observe as its channel closing.
+	PolicyDisconnectSlowConsumer
+)
+
+// KeyFunc extracts the key a coalescing sink uses to identify messages which supersede each other.
+// Messages with an empty key are never coalesced, and no message sent before them will be coalesced with one sent after.
+type KeyFunc func(proto.Message) string
+
+// Predicate decides whether a message should be delivered to a sink.
+type Predicate func(proto.Message) bool
+
+// SinkOption configures the behaviour of a sink at creation time.
+type SinkOption func(*sinkConfig)
+
+type sinkConfig struct {
+	resume      bool
+	resumeAfter uint64
+	resumeSince time.Time
+
+	policy       Policy
+	blockTimeout time.Duration
+	key          KeyFunc
+
+	filter Predicate
+}
+
+// Resume creates the sink with every retained message sent after the supplied sequence number already queued.
+// Supplying 0 replays the entire retained history. If messages after the sequence have aged out, or there are
+// more than can be queued, the first message received will be a gap covering those which aren't.
+func Resume(sequence uint64) SinkOption {
+	return func(cfg *sinkConfig) {
+		cfg.resume = true
+		cfg.resumeAfter = sequence
+	}
+}
+
+// ResumeSince creates the sink with every retained message sent at or after the supplied time already queued.
+// Messages are matched by the time the source sent them. If the oldest retained message was sent after the time,
+// the messages before it may have been too, so the first message received will be a gap covering them.
+func ResumeSince(since time.Time) SinkOption {
+	return func(cfg *sinkConfig) {
+		cfg.resume = true
+		cfg.resumeSince = since
+	}
+}
+
+// Filter configures the sink to only receive messages which satisfy the supplied predicate.
+// The predicate is evaluated by the source, so messages which are filtered out never occupy the sink's buffer.
+// Gaps are always delivered.
+func Filter(filter Predicate) SinkOption {
+	return func(cfg *sinkConfig) {
+		cfg.filter = filter
+	}
+}
+
+// DropOldest configures the sink to discard its oldest buffered message when full.
+func DropOldest() SinkOption {
+	return func(cfg *sinkConfig) {
+		cfg.policy = PolicyDropOldest
+	}
+}
+
+// BlockWithTimeout configures the sink to block the source for up to the supplied duration when full.
+func BlockWithTimeout(timeout time.Duration) SinkOption {
+	return func(cfg *sinkConfig) {
+		cfg.policy = PolicyBlockWithTimeout
+		cfg.blockTimeout = timeout
+	}
+}
+
+// CoalesceByKey configures the sink to keep only the latest undelivered message for each key.
+func CoalesceByKey(key KeyFunc) SinkOption {
+	return func(cfg *sinkConfig) {
+		cfg.policy = PolicyCoalesceByKey
+		cfg.key = key
+	}
+}
+
+// DisconnectSlowConsumer configures the sink to be closed by the source when full.
+func DisconnectSlowConsumer() SinkOption {
+	return func(cfg *sinkConfig) {
+		cfg.policy = PolicyDisconnectSlowConsumer
+	}
+}
+
+// SinkStats contains the counters tracked for a sink.
+type SinkStats struct {
+	// Dropped is the number of messages which were discarded because the sink was full.
+	Dropped uint64
+	// Coalesced is the number of undelivered messages which were replaced by a newer message with the same key.
+	Coalesced uint64
+	// Disconnected is set if the source closed the sink because it was full.
+	Disconnected bool
+}
+
+type pendingMessage struct {
+	key string
+	msg *Message
+}
+
 // Sink is an implementation of a message sync; it receives messages broadcast by its parent source.
 type Sink struct {
 	id      string
-	channel chan proto.Message
+	channel chan *Message
+	policy  Policy
 
 	source *Source
+	filter Predicate
+
+	// start is the sequence number of the last message sent before the sink was created.
+	start uint64
+
+	blockTimeout time.Duration
+
+	// These are only used by coalescing sinks, whose channel is fed by the pump goroutine.
+	key         KeyFunc
+	pending     []*pendingMessage
+	pendingKeys map[string]*pendingMessage
+	pendingLock sync.Mutex
+	wake        chan struct{}
+	done        chan struct{}
+	pumpDone    chan struct{}
+
+	dropped      uint64
+	coalesced    uint64
+	disconnected int32
+
+	closeOnce sync.Once
+}
+
+func newSink(id string, source *Source, cfg *sinkConfig, bufferSize int) *Sink {
+	sink := &Sink{
+		id:           id,
+		channel:      make(chan *Message, bufferSize),
+		policy:       cfg.policy,
+		source:       source,
+		filter:       cfg.filter,
+		blockTimeout: cfg.blockTimeout,
+	}
+
+	if sink.policy == PolicyCoalesceByKey {
+		sink.key = cfg.key
+		if sink.key == nil {
+			sink.key = func(proto.Message) string { return "" }
+		}
+		sink.pendingKeys = map[string]*pendingMessage{}
+		sink.wake = make(chan struct{}, 1)
+		sink.done = make(chan struct{})
+		sink.pumpDone = make(chan struct{})
+	}
+
+	return sink
 }
 
 // Messages returns the read channel of messages broadcast by the source.
 // The backing channel is buffered to allow for additional messages to be generated
 // while the current message is being processed; that being said the sink has a responsibility
-// to consume messages from this channel as quickly as possible.
-func (s *Sink) Messages() <-chan proto.Message {
+// to consume messages from this channel as quickly as possible. What happens when it does not
+// is determined by the policy the sink was created with.
+func (s *Sink) Messages() <-chan *Message {
 	return s.channel
 }
 
+// StartSequence returns the sequence number of the last message sent by the source before the sink was created,
+// or 0 if nothing had been sent. Messages replayed by a resuming sink may precede it.
+func (s *Sink) StartSequence() uint64 {
+	return s.start
+}
+
+// Stats returns a snapshot of the counters tracked for this sink.
+func (s *Sink) Stats() SinkStats {
+	return SinkStats{
+		Dropped:      atomic.LoadUint64(&s.dropped),
+		Coalesced:    atomic.LoadUint64(&s.coalesced),
+		Disconnected: atomic.LoadInt32(&s.disconnected) == 1,
+	}
+}
+
 // Close releases any resources allocated as part of this sink's creation.
+// It is safe to call Close on a sink which was disconnected by its source.
 func (s *Sink) Close() {
 	s.source.removeSink(s)
-	close(s.channel)
+	s.shutdown()
+}
+
+// shutdown stops the pump, if any, and closes the channel exactly once.
+func (s *Sink) shutdown() {
+	s.closeOnce.Do(func() {
+		if s.pumpDone != nil {
+			close(s.done)
+			<-s.pumpDone
+		}
+		close(s.channel)
+	})
+}
+
+// accepts returns true if the message passes the filter this sink was created with.
+func (s *Sink) accepts(msg *Message) bool {
+	return s.filter == nil || msg.Payload == nil || s.filter(msg.Payload)
+}
+
+// deliver writes the message to the sink according to its policy.
+// It returns false if the sink should be disconnected. The caller must hold the source's sinksLock.
+func (s *Sink) deliver(msg *Message) bool {
+	switch s.policy {
+	case PolicyDropOldest:
+		for {
+			select {
+			case s.channel <- msg:
+				return true
+			default:
+			}
+
+			select {
+			case <-s.channel:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	case PolicyBlockWithTimeout:
+		timer := time.NewTimer(s.blockTimeout)
+		defer timer.Stop()
+
+		select {
+		case s.channel <- msg:
+		case <-timer.C:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+		return true
+	case PolicyCoalesceByKey:
+		s.enqueue(msg)
+		return true
+	case PolicyDisconnectSlowConsumer:
+		select {
+		case s.channel <- msg:
+			return true
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			atomic.StoreInt32(&s.disconnected, 1)
+			return false
+		}
+	default:
+		select {
+		case s.channel <- msg:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+		return true
+	}
+}
+
+// enqueue adds the message to the pending queue of a coalescing sink and wakes the pump.
+func (s *Sink) enqueue(msg *Message) {
+	key := ""
+	if msg.Payload != nil {
+		key = s.key(msg.Payload)
+	}
+
+	s.pendingLock.Lock()
+	if existing, found := s.pendingKeys[key]; key != "" && found {
+		existing.msg = msg
+		atomic.AddUint64(&s.coalesced, 1)
+	} else if len(s.pending) >= maxPendingSize {
+		atomic.AddUint64(&s.dropped, 1)
+	} else {
+		pm := &pendingMessage{
+			key: key,
+			msg: msg,
+		}
+		s.pending = append(s.pending, pm)
+
+		if key == "" {
+			// Nothing queued so far may be coalesced with something sent after this message.
+			s.pendingKeys = map[string]*pendingMessage{}
+		} else {
+			s.pendingKeys[key] = pm
+		}
+	}
+	s.pendingLock.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pump moves messages from the pending queue of a coalescing sink onto its channel.
+func (s *Sink) pump() {
+	defer close(s.pumpDone)
+
+	for {
+		s.pendingLock.Lock()
+		if len(s.pending) < 1 {
+			s.pendingLock.Unlock()
+
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		pm := s.pending[0]
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		if s.pendingKeys[pm.key] == pm {
+			delete(s.pendingKeys, pm.key)
+		}
+		s.pendingLock.Unlock()
+
+		select {
+		case s.channel <- pm.msg:
+		case <-s.done:
+			return
+		}
+	}
 }
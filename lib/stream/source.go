@@ -1,43 +1,165 @@
 package stream
 
 import (
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
+const (
+	// DefaultHistorySize is the number of messages retained by a source created with NewSource.
+	DefaultHistorySize = 256
+
+	sinkBufferSize = 10
+
+	// maxBacklogSize bounds the number of messages replayed to a resuming sink; anything older is signalled as a gap.
+	maxBacklogSize = 1024
+)
+
+// errStopReplay is returned from a replay callback to stop once the message of interest has been found.
+var errStopReplay = errors.New("stop replay")
+
 // Source represents a message source that will be broadcast to its sinks.
+// Every message sent is assigned a monotonically increasing sequence number, and the most recent
+// messages are retained in a bounded history so sinks can be created which resume from a known point.
 type Source struct {
 	logger *zap.Logger
 
+	// sinksLock guards the sinks, the history and the sequence counter.
 	sinks     map[string]*Sink
 	sinksLock sync.Mutex
+
+	sequence uint64
+
+	// journal, if set, records every message sent so it can be replayed after a restart.
+	journal *Journal
+
+	// history is a ring buffer of the most recently sent messages; historyNext is the next slot to write.
+	history      []*Message
+	historyNext  int
+	historyCount int
 }
 
-// NewSource creates a new message source.
+// NewSource creates a new message source which retains the default number of messages.
 func NewSource(logger *zap.Logger) *Source {
+	return NewSourceWithHistory(logger, DefaultHistorySize)
+}
+
+// NewSourceWithHistory creates a new message source which retains up to historySize messages for resuming sinks.
+// A historySize of 0 disables retention; a resuming sink which missed anything will be told of a gap.
+func NewSourceWithHistory(logger *zap.Logger, historySize int) *Source {
+	if historySize < 0 {
+		historySize = 0
+	}
+
 	return &Source{
-		logger: logger,
-		sinks:  map[string]*Sink{},
+		logger:  logger,
+		sinks:   map[string]*Sink{},
+		history: make([]*Message, historySize),
+	}
+}
+
+// NewJournaledSource creates a new message source which also appends every message sent to the supplied journal.
+// Sequence numbers continue on from the last journaled message, and the most recent journaled messages
+// are loaded into the history so sinks can resume from before a restart. Sinks resuming from further back
+// than the in-memory history are replayed from the journal.
+func NewJournaledSource(logger *zap.Logger, historySize int, journal *Journal) (*Source, error) {
+	s := NewSourceWithHistory(logger, historySize)
+	s.journal = journal
+	s.sequence = journal.LastSequence()
+
+	var from uint64
+	if s.sequence > uint64(historySize) {
+		from = s.sequence - uint64(historySize)
 	}
+
+	err := journal.ReplayFrom(from, func(msg *Message) error {
+		if msg.Sequence <= s.sequence {
+			s.record(msg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Sequence returns the sequence number of the most recently sent message, or 0 if nothing has been sent.
+func (s *Source) Sequence() uint64 {
+	s.sinksLock.Lock()
+	defer s.sinksLock.Unlock()
+
+	return s.sequence
 }
 
 // NewSink creates a message sink for this source.
-func (s *Source) NewSink() *Sink {
-	sink := &Sink{
-		id:      uuid.New().String(),
-		channel: make(chan proto.Message, 10),
-		source:  s,
+// By default the sink only receives messages sent after its creation; supply Resume() to replay retained history.
+func (s *Source) NewSink(opts ...SinkOption) *Sink {
+	cfg := &sinkConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	// Reading the journal may be slow, so it is done before taking the lock to avoid holding up messages being sent.
+	// Anything sent in the meantime is caught up on from the history once the lock is held.
+	var journalOldest, journalMatch *Message
+	var journaled []*Message
+	if cfg.resume && s.journal != nil {
+		after, needed := cfg.resumeAfter, true
+		if !cfg.resumeSince.IsZero() {
+			journalOldest, journalMatch = s.journalBefore(cfg.resumeSince)
+			if needed = journalMatch != nil; needed {
+				after = journalMatch.Sequence - 1
+			}
+		}
+
+		if needed && after+1 < s.oldestRetained() {
+			journaled = s.readJournal(after)
+		}
 	}
 
 	s.sinksLock.Lock()
+	defer s.sinksLock.Unlock()
+
+	var backlog []*Message
+	if cfg.resume {
+		after := cfg.resumeAfter
+		if !cfg.resumeSince.IsZero() {
+			after = s.sequenceBefore(cfg.resumeSince, journalOldest, journalMatch)
+		}
+
+		for _, msg := range s.replay(after, journaled) {
+			if cfg.filter == nil || msg.Payload == nil || cfg.filter(msg.Payload) {
+				backlog = append(backlog, msg)
+			}
+		}
+	}
+
+	sink := newSink(uuid.New().String(), s, cfg, sinkBufferSize+len(backlog))
+	sink.start = s.sequence
+
+	// The backlog is written while holding the lock so no message sent concurrently can be reordered ahead of it.
+	for _, msg := range backlog {
+		sink.channel <- msg
+	}
+
+	if sink.policy == PolicyCoalesceByKey {
+		go sink.pump()
+	}
+
 	s.sinks[sink.id] = sink
-	s.sinksLock.Unlock()
 
 	s.logger.Debug("added watcher",
-		zap.String("channel_id", sink.id))
+		zap.String("channel_id", sink.id),
+		zap.Int("policy", int(sink.policy)),
+		zap.Int("backlog", len(backlog)),
+	)
 	return sink
 }
 
@@ -45,14 +167,47 @@ func (s *Source) NewSink() *Sink {
 func (s *Source) SendMessage(msg proto.Message) {
 	s.sinksLock.Lock()
 
-	for _, sink := range s.sinks {
-		// Try to write the message to the sink or log that the write failed
-		select {
-		case sink.channel <- msg:
-			// Add logging here if needed
-		default:
+	s.sequence++
+	entry := &Message{
+		Sequence:  s.sequence,
+		Timestamp: time.Now(),
+		Payload:   msg,
+	}
+	s.record(entry)
+
+	if s.journal != nil {
+		if err := s.journal.Append(entry); err != nil {
+			s.logger.Error("unable to journal message",
+				zap.Uint64("sequence", entry.Sequence),
+				zap.Error(err),
+			)
+		}
+	}
+
+	for id, sink := range s.sinks {
+		if !sink.accepts(entry) {
+			continue
+		}
+
+		dropped := sink.Stats().Dropped
+
+		// Try to write the message to the sink; how a full sink is handled is up to its policy.
+		if !sink.deliver(entry) {
+			s.logger.Info("disconnecting slow consumer",
+				zap.String("channel_id", id),
+				zap.Uint64("sequence", entry.Sequence),
+			)
+
+			delete(s.sinks, id)
+			sink.shutdown()
+			continue
+		}
+
+		if stats := sink.Stats(); stats.Dropped > dropped {
 			s.logger.Debug("channel blocked",
-				zap.String("channel_id", sink.id),
+				zap.String("channel_id", id),
+				zap.Uint64("sequence", entry.Sequence),
+				zap.Uint64("dropped", stats.Dropped),
 				zap.String("message", msg.String()),
 			)
 		}
@@ -66,3 +221,168 @@ func (s *Source) removeSink(sink *Sink) {
 	delete(s.sinks, sink.id)
 	s.sinksLock.Unlock()
 }
+
+// record appends the message to the history, evicting the oldest entry if full. The caller must hold sinksLock.
+func (s *Source) record(msg *Message) {
+	if len(s.history) < 1 {
+		return
+	}
+
+	s.history[s.historyNext] = msg
+	s.historyNext = (s.historyNext + 1) % len(s.history)
+	if s.historyCount < len(s.history) {
+		s.historyCount++
+	}
+}
+
+// oldestRetained returns the sequence number of the oldest message in the history.
+// If the history is empty this is the sequence number the next message will be sent with.
+func (s *Source) oldestRetained() uint64 {
+	s.sinksLock.Lock()
+	defer s.sinksLock.Unlock()
+
+	return s.sequence - uint64(s.historyCount) + 1
+}
+
+// journalBefore returns the oldest journaled message, and the first one sent at or after the supplied time.
+// Either is nil if there is no such message, or the journal can't be read.
+func (s *Source) journalBefore(since time.Time) (*Message, *Message) {
+	var oldest, match *Message
+
+	err := s.journal.ReplayFrom(0, func(msg *Message) error {
+		oldest = msg
+		return errStopReplay
+	})
+	if err == nil || err == errStopReplay {
+		err = s.journal.ReplaySince(since, func(msg *Message) error {
+			match = msg
+			return errStopReplay
+		})
+	}
+	if err != nil && err != errStopReplay {
+		s.logger.Error("unable to replay journal",
+			zap.Time("requested_time", since),
+			zap.Error(err),
+		)
+		return nil, nil
+	}
+
+	return oldest, match
+}
+
+// readJournal returns the most recent journaled messages with a sequence number greater than after,
+// up to the size of the backlog a sink may be sent.
+func (s *Source) readJournal(after uint64) []*Message {
+	var ret []*Message
+
+	err := s.journal.ReplayFrom(after, func(msg *Message) error {
+		if len(ret) >= maxBacklogSize {
+			ret = ret[1:]
+		}
+		ret = append(ret, msg)
+		return nil
+	})
+	if err != nil {
+		s.logger.Error("unable to replay journal",
+			zap.Uint64("requested_sequence", after),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	return ret
+}
+
+// sequenceBefore returns the sequence number to resume after to receive every retained message sent at or after
+// the supplied time. If the oldest retained message matches, 0 is returned since the messages which are no longer
+// retained may have matched as well. The oldest journaled message, and the first journaled message which matches,
+// are supplied by the caller since the journal is read without holding the lock. The caller must hold sinksLock.
+func (s *Source) sequenceBefore(since time.Time, oldest *Message, match *Message) uint64 {
+	for i := 0; i < s.historyCount; i++ {
+		msg := s.history[(s.historyNext-s.historyCount+i+len(s.history))%len(s.history)]
+		if oldest == nil {
+			oldest = msg
+		}
+		if match == nil && !msg.Timestamp.Before(since) {
+			match = msg
+		}
+	}
+
+	if match == nil {
+		return s.sequence
+	} else if match.Sequence == oldest.Sequence {
+		return 0
+	}
+	return match.Sequence - 1
+}
+
+// replay returns the retained messages with a sequence number greater than after, preceded by a gap marker if some
+// of those messages are no longer retained or there are more than a sink may be sent. Messages older than the
+// history are taken from the supplied journaled messages, read by the caller without holding the lock.
+// The caller must hold sinksLock.
+func (s *Source) replay(after uint64, journaled []*Message) []*Message {
+	if after > s.sequence {
+		// The requested position is ahead of anything we've sent, so it came from some other incarnation
+		// of this source. We can't know what was missed so tell the caller everything sent so far is suspect.
+		s.logger.Info("resume requested from a sequence ahead of the source",
+			zap.Uint64("requested_sequence", after),
+			zap.Uint64("source_sequence", s.sequence),
+		)
+
+		if s.sequence > 0 {
+			return []*Message{
+				{
+					Sequence: s.sequence,
+					Gap: &Gap{
+						First: 1,
+						Last:  s.sequence,
+					},
+				},
+			}
+		}
+		return nil
+	}
+
+	var msgs []*Message
+
+	// The journaled messages are only of use if the history picks up where they end; if more was sent while the
+	// journal was read than the history retains, the messages in between are missing.
+	oldest := s.sequence - uint64(s.historyCount) + 1
+	if len(journaled) > 0 && journaled[len(journaled)-1].Sequence+1 >= oldest {
+		for _, msg := range journaled {
+			if msg.Sequence > after && msg.Sequence < oldest {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+
+	for i := 0; i < s.historyCount; i++ {
+		idx := (s.historyNext - s.historyCount + i + len(s.history)) % len(s.history)
+		if s.history[idx].Sequence > after {
+			msgs = append(msgs, s.history[idx])
+		}
+	}
+
+	if len(msgs) > maxBacklogSize {
+		msgs = msgs[len(msgs)-maxBacklogSize:]
+	}
+
+	missingUntil := s.sequence + 1
+	if len(msgs) > 0 {
+		missingUntil = msgs[0].Sequence
+	}
+
+	if after+1 >= missingUntil {
+		return msgs
+	}
+
+	return append([]*Message{
+		{
+			Sequence: missingUntil - 1,
+			Gap: &Gap{
+				First: after + 1,
+				Last:  missingUntil - 1,
+			},
+		},
+	}, msgs...)
+}
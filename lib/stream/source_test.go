@@ -2,9 +2,12 @@ package stream
 
 import (
 	"math/rand"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap/zaptest"
 )
@@ -77,7 +80,7 @@ func TestMessaging(t *testing.T) {
 
 			for i := 0; i < max; i++ {
 				msg := <-sink.Messages()
-				assert.Equal(t, testMsg, msg)
+				assert.Equal(t, testMsg, msg.Payload)
 			}
 
 			sink.Close()
@@ -94,3 +97,309 @@ func TestMessaging(t *testing.T) {
 	messageReceivedWg.Wait()
 	assert.Equal(t, 0, len(s.sinks))
 }
+
+func TestSequence(t *testing.T) {
+	s := NewSource(zaptest.NewLogger(t))
+	sink := s.NewSink()
+	defer sink.Close()
+
+	for i := 0; i < 5; i++ {
+		s.SendMessage(&testMessage{"asdf123"})
+	}
+
+	for i := 1; i <= 5; i++ {
+		msg := <-sink.Messages()
+		assert.Equal(t, uint64(i), msg.Sequence)
+		assert.Nil(t, msg.Gap)
+	}
+	assert.Equal(t, uint64(5), s.Sequence())
+}
+
+var resumeTests = []struct {
+	name        string
+	historySize int
+	sent        int
+	resumeAfter uint64
+
+	expectedGap       *Gap
+	expectedSequences []uint64
+}{
+	{
+		name:              "resume from start with full history",
+		historySize:       10,
+		sent:              3,
+		resumeAfter:       0,
+		expectedSequences: []uint64{1, 2, 3},
+	},
+	{
+		name:              "resume from middle",
+		historySize:       10,
+		sent:              5,
+		resumeAfter:       3,
+		expectedSequences: []uint64{4, 5},
+	},
+	{
+		name:              "resume when up to date",
+		historySize:       10,
+		sent:              5,
+		resumeAfter:       5,
+		expectedSequences: nil,
+	},
+	{
+		name:              "resume from aged out sequence",
+		historySize:       3,
+		sent:              6,
+		resumeAfter:       1,
+		expectedGap:       &Gap{First: 2, Last: 3},
+		expectedSequences: []uint64{4, 5, 6},
+	},
+	{
+		name:              "resume without history",
+		historySize:       0,
+		sent:              4,
+		resumeAfter:       2,
+		expectedGap:       &Gap{First: 3, Last: 4},
+		expectedSequences: nil,
+	},
+	{
+		name:              "resume from sequence ahead of source",
+		historySize:       10,
+		sent:              2,
+		resumeAfter:       100,
+		expectedGap:       &Gap{First: 1, Last: 2},
+		expectedSequences: nil,
+	},
+}
+
+func TestResume(t *testing.T) {
+	for _, tt := range resumeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSourceWithHistory(zaptest.NewLogger(t), tt.historySize)
+			for i := 0; i < tt.sent; i++ {
+				s.SendMessage(&testMessage{"asdf123"})
+			}
+
+			sink := s.NewSink(Resume(tt.resumeAfter))
+			defer sink.Close()
+			assert.Equal(t, uint64(tt.sent), sink.StartSequence())
+
+			if tt.expectedGap != nil {
+				msg := <-sink.Messages()
+				assert.Nil(t, msg.Payload)
+				assert.Equal(t, tt.expectedGap, msg.Gap)
+			}
+
+			var sequences []uint64
+			for len(sink.Messages()) > 0 {
+				msg := <-sink.Messages()
+				assert.Nil(t, msg.Gap)
+				sequences = append(sequences, msg.Sequence)
+			}
+			assert.Equal(t, tt.expectedSequences, sequences)
+
+			// Messages sent after the resume must follow the replayed ones.
+			s.SendMessage(&testMessage{"after"})
+			msg := <-sink.Messages()
+			assert.Equal(t, uint64(tt.sent+1), msg.Sequence)
+		})
+	}
+}
+
+func TestResumeBacklogLimit(t *testing.T) {
+	s := NewSourceWithHistory(zaptest.NewLogger(t), maxBacklogSize+10)
+	for i := 0; i < maxBacklogSize+10; i++ {
+		s.SendMessage(&testMessage{"asdf123"})
+	}
+
+	// Only the most recent messages are replayed; the rest are signalled as a gap.
+	sink := s.NewSink(Resume(0))
+	defer sink.Close()
+
+	msg := <-sink.Messages()
+	assert.Equal(t, &Gap{First: 1, Last: 10}, msg.Gap)
+
+	count := 0
+	for len(sink.Messages()) > 0 {
+		msg := <-sink.Messages()
+		assert.Equal(t, uint64(count+11), msg.Sequence)
+		count++
+	}
+	assert.Equal(t, maxBacklogSize, count)
+}
+
+func TestResumeSince(t *testing.T) {
+	s := NewSourceWithHistory(zaptest.NewLogger(t), 3)
+	for i := 0; i < 3; i++ {
+		s.SendMessage(&testMessage{"before"})
+	}
+	time.Sleep(time.Millisecond)
+	middle := time.Now()
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 2; i++ {
+		s.SendMessage(&testMessage{"after"})
+	}
+
+	messageSequences := func(sink *Sink) []uint64 {
+		var sequences []uint64
+		for len(sink.Messages()) > 0 {
+			msg := <-sink.Messages()
+			assert.Nil(t, msg.Gap)
+			sequences = append(sequences, msg.Sequence)
+		}
+		return sequences
+	}
+
+	// Everything sent since the time is still retained.
+	sink := s.NewSink(ResumeSince(middle))
+	assert.Equal(t, []uint64{4, 5}, messageSequences(sink))
+	sink.Close()
+
+	// The oldest retained message matches, so the aged out messages may have as well.
+	sink = s.NewSink(ResumeSince(middle.Add(-time.Hour)))
+	msg := <-sink.Messages()
+	assert.Equal(t, &Gap{First: 1, Last: 2}, msg.Gap)
+	assert.Equal(t, []uint64{3, 4, 5}, messageSequences(sink))
+	sink.Close()
+
+	// Nothing has been sent since the time.
+	sink = s.NewSink(ResumeSince(time.Now().Add(time.Hour)))
+	assert.Empty(t, messageSequences(sink))
+	sink.Close()
+}
+
+func TestDropNewest(t *testing.T) {
+	s := NewSource(zaptest.NewLogger(t))
+	sink := s.NewSink()
+	defer sink.Close()
+
+	for i := 0; i < sinkBufferSize+5; i++ {
+		s.SendMessage(&testMessage{"asdf123"})
+	}
+
+	assert.Equal(t, uint64(5), sink.Stats().Dropped)
+	msg := <-sink.Messages()
+	assert.Equal(t, uint64(1), msg.Sequence)
+}
+
+func TestDropOldest(t *testing.T) {
+	s := NewSource(zaptest.NewLogger(t))
+	sink := s.NewSink(DropOldest())
+	defer sink.Close()
+
+	for i := 0; i < sinkBufferSize+5; i++ {
+		s.SendMessage(&testMessage{"asdf123"})
+	}
+
+	assert.Equal(t, uint64(5), sink.Stats().Dropped)
+	msg := <-sink.Messages()
+	assert.Equal(t, uint64(6), msg.Sequence)
+}
+
+func TestBlockWithTimeout(t *testing.T) {
+	s := NewSource(zaptest.NewLogger(t))
+	sink := s.NewSink(BlockWithTimeout(time.Millisecond))
+	defer sink.Close()
+
+	for i := 0; i < sinkBufferSize+1; i++ {
+		s.SendMessage(&testMessage{"asdf123"})
+	}
+	assert.Equal(t, uint64(1), sink.Stats().Dropped)
+
+	// A consumer which frees up space before the timeout receives the message.
+	blocking := NewSource(zaptest.NewLogger(t))
+	blockingSink := blocking.NewSink(BlockWithTimeout(time.Second))
+	defer blockingSink.Close()
+
+	for i := 0; i < sinkBufferSize; i++ {
+		blocking.SendMessage(&testMessage{"asdf123"})
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-blockingSink.Messages()
+	}()
+	blocking.SendMessage(&testMessage{"asdf123"})
+	assert.Equal(t, uint64(0), blockingSink.Stats().Dropped)
+}
+
+func TestDisconnectSlowConsumer(t *testing.T) {
+	s := NewSource(zaptest.NewLogger(t))
+	sink := s.NewSink(DisconnectSlowConsumer())
+
+	for i := 0; i < sinkBufferSize+1; i++ {
+		s.SendMessage(&testMessage{"asdf123"})
+	}
+
+	assert.True(t, sink.Stats().Disconnected)
+	assert.Equal(t, 0, len(s.sinks))
+
+	// The buffered messages are still readable before the channel reports being closed.
+	for i := 0; i < sinkBufferSize; i++ {
+		_, ok := <-sink.Messages()
+		assert.True(t, ok)
+	}
+	_, ok := <-sink.Messages()
+	assert.False(t, ok)
+
+	// Closing a disconnected sink is safe.
+	sink.Close()
+}
+
+func TestCoalesceByKey(t *testing.T) {
+	s := NewSource(zaptest.NewLogger(t))
+	sink := s.NewSink(CoalesceByKey(func(msg proto.Message) string {
+		return msg.String()
+	}))
+	defer sink.Close()
+
+	// Fill the channel so subsequent messages are held in the pending queue.
+	for i := 0; i < sinkBufferSize; i++ {
+		s.SendMessage(&testMessage{strconv.Itoa(i)})
+	}
+	assert.Eventually(t, func() bool {
+		return len(sink.Messages()) == sinkBufferSize
+	}, time.Second, time.Millisecond)
+
+	s.SendMessage(&testMessage{"a"})
+	s.SendMessage(&testMessage{"b"})
+	s.SendMessage(&testMessage{"a"})
+	// An un-keyed message prevents coalescing across it.
+	s.SendMessage(&testMessage{""})
+	s.SendMessage(&testMessage{"b"})
+
+	var received []string
+	var sequences []uint64
+	for i := 0; i < sinkBufferSize+4; i++ {
+		msg := <-sink.Messages()
+		received = append(received, msg.Payload.String())
+		sequences = append(sequences, msg.Sequence)
+	}
+
+	assert.Equal(t, []string{"a", "b", "", "b"}, received[sinkBufferSize:])
+	assert.Equal(t, []uint64{13, 12, 14, 15}, sequences[sinkBufferSize:])
+	assert.Equal(t, uint64(1), sink.Stats().Coalesced)
+	assert.Equal(t, uint64(0), sink.Stats().Dropped)
+}
+
+func TestFilter(t *testing.T) {
+	s := NewSource(zaptest.NewLogger(t))
+	for i := 0; i < 4; i++ {
+		s.SendMessage(&testMessage{strconv.Itoa(i)})
+	}
+
+	sink := s.NewSink(Resume(0), Filter(func(msg proto.Message) bool {
+		return msg.String() != "2"
+	}))
+	defer sink.Close()
+
+	s.SendMessage(&testMessage{"2"})
+	s.SendMessage(&testMessage{"4"})
+
+	var received []string
+	for len(sink.Messages()) > 0 {
+		msg := <-sink.Messages()
+		received = append(received, msg.Payload.String())
+	}
+
+	assert.Equal(t, []string{"0", "1", "3", "4"}, received)
+	assert.Equal(t, uint64(0), sink.Stats().Dropped)
+}
@@ -0,0 +1,59 @@
+package yamlpb
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v2"
+)
+
+// Unmarshal decodes the YAML document into the supplied message, using the protobuf JSON mapping.
+// An empty document leaves the message empty.
+func Unmarshal(data []byte, m proto.Message) error {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	} else if doc == nil {
+		m.Reset()
+		return nil
+	}
+
+	return UnmarshalValue(doc, m)
+}
+
+// UnmarshalValue converts a value already decoded from YAML into the supplied message, using the protobuf JSON mapping.
+// This allows a message to be embedded in a larger YAML document.
+func UnmarshalValue(in interface{}, m proto.Message) error {
+	data, err := json.Marshal(jsonValue(in))
+	if err != nil {
+		return err
+	}
+	return protojson.Unmarshal(data, proto.MessageV2(m))
+}
+
+// jsonValue converts the maps decoded from YAML, which may have any type of key, into maps which can be encoded as JSON.
+func jsonValue(in interface{}) interface{} {
+	switch v := in.(type) {
+	case map[interface{}]interface{}:
+		out := map[string]interface{}{}
+		for key, val := range v {
+			out[fmt.Sprintf("%v", key)] = jsonValue(val)
+		}
+		return out
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for key, val := range v {
+			out[key] = jsonValue(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, val := range v {
+			out[i] = jsonValue(val)
+		}
+		return out
+	}
+	return in
+}
@@ -0,0 +1,54 @@
+package yamlpb
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestUnmarshal(t *testing.T) {
+	msg := &structpb.Struct{}
+	err := Unmarshal([]byte(`
+name: lamp
+1: numeric key
+traits:
+  - type: BINARY
+    options: [a, b]
+`), msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, "lamp", msg.Fields["name"].GetStringValue())
+	assert.Equal(t, "numeric key", msg.Fields["1"].GetStringValue())
+
+	traits := msg.Fields["traits"].GetListValue().Values
+	require.Len(t, traits, 1)
+	assert.Equal(t, "BINARY", traits[0].GetStructValue().Fields["type"].GetStringValue())
+	assert.Len(t, traits[0].GetStructValue().Fields["options"].GetListValue().Values, 2)
+
+	// An empty document leaves the message empty.
+	require.NoError(t, Unmarshal([]byte(""), msg))
+	assert.True(t, proto.Equal(&structpb.Struct{}, msg))
+
+	assert.Error(t, Unmarshal([]byte("value: 1"), &wrappers.StringValue{}))
+	assert.Error(t, Unmarshal([]byte("{"), msg))
+}
+
+func TestUnmarshalValue(t *testing.T) {
+	var doc struct {
+		Message map[string]interface{} `yaml:"message"`
+	}
+	require.NoError(t, yaml.Unmarshal([]byte(`
+message:
+  nested:
+    enabled: true
+`), &doc))
+
+	msg := &structpb.Struct{}
+	require.NoError(t, UnmarshalValue(doc.Message, msg))
+	assert.True(t, msg.Fields["nested"].GetStructValue().Fields["enabled"].GetBoolValue())
+}
@@ -147,6 +147,12 @@ def go_repositories():
         sum = "h1:RMLoZVzv4GliuWafOuPuQDKSm1SJph7uCRnnS61JAn4=",
         version = "v0.0.0-20181026042036-e10d5fee7954",
     )
+    go_repository(
+        name = "com_github_eclipse_paho_mqtt_golang",
+        importpath = "github.com/eclipse/paho.mqtt.golang",
+        sum = "h1:MU79lqr3FKNKbSrGN7d7bNYqh8MwWW7Zcx0iG+VIw9I=",
+        version = "v1.3.0",
+    )
     go_repository(
         name = "com_github_envoyproxy_go_control_plane",
         importpath = "github.com/envoyproxy/go-control-plane",
@@ -507,6 +513,12 @@ def go_repositories():
         sum = "h1:sWGE2v+hO0Nd4yFU/S/mDBM5plIU8v/Qhfz41hkDIAI=",
         version = "v0.0.0-20181012175147-0068e33feabf",
     )
+    go_repository(
+        name = "com_github_mochi_co_mqtt",
+        importpath = "github.com/mochi-co/mqtt",
+        sum = "h1:WHvSqOyqRKe2vn1JD9pl5m+3yZcpB1zdw3X6w6rc/YU=",
+        version = "v1.0.0",
+    )
     go_repository(
         name = "com_github_modern_go_concurrent",
         importpath = "github.com/modern-go/concurrent",
@@ -668,6 +680,12 @@ def go_repositories():
         sum = "h1:RR9dF3JtopPvtkroDZuVD7qquD0bnHlKSqaQhgwt8yk=",
         version = "v1.3.0",
     )
+    go_repository(
+        name = "com_github_rs_xid",
+        importpath = "github.com/rs/xid",
+        sum = "h1:mhH9Nq+C1fY2l1XIpgxIiUOfNpRBYH1kKcr+qfKgjRc=",
+        version = "v1.2.1",
+    )
     go_repository(
         name = "com_github_sirupsen_logrus",
         importpath = "github.com/sirupsen/logrus",
@@ -0,0 +1,71 @@
+package bridge
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrDuplicateDevice is returned if a batch contains more than one update for the same device.
+	ErrDuplicateDevice = status.New(codes.InvalidArgument, "device updated more than once")
+)
+
+// UpdateStateFunc applies a single device state update.
+type UpdateStateFunc func(ctx context.Context, req *UpdateDeviceStateRequest) (*Device, error)
+
+// BatchUpdate applies each update in the batch concurrently using the supplied function, and collects the results.
+// The batch is rejected without anything being applied if it is empty, or if it updates a device more than once.
+func BatchUpdate(ctx context.Context, req *BatchUpdateDeviceStatesRequest, update UpdateStateFunc) (*BatchUpdateDeviceStatesResponse, error) {
+	if len(req.Requests) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	seen := map[string]bool{}
+	for _, r := range req.Requests {
+		if r == nil || len(r.Id) < 1 {
+			return nil, ErrMissingParam.Err()
+		} else if seen[r.Id] {
+			return nil, ErrDuplicateDevice.Err()
+		}
+		seen[r.Id] = true
+	}
+
+	resp := &BatchUpdateDeviceStatesResponse{
+		Results: make([]*UpdateDeviceStateResult, len(req.Requests)),
+	}
+
+	var wg sync.WaitGroup
+	for idx, r := range req.Requests {
+		wg.Add(1)
+		go func(idx int, r *UpdateDeviceStateRequest) {
+			defer wg.Done()
+
+			result := &UpdateDeviceStateResult{
+				Id: r.Id,
+			}
+
+			device, err := update(ctx, r)
+			if err != nil {
+				s := status.Convert(err)
+				result.Code = int32(s.Code())
+				result.Message = s.Message()
+			} else {
+				result.Device = device
+			}
+
+			// Each goroutine writes to its own slot so no locking is required.
+			resp.Results[idx] = result
+		}(idx, r)
+	}
+	wg.Wait()
+
+	return resp, nil
+}
+
+// Err returns the error describing why the update failed, or nil if it was applied.
+func (r *UpdateDeviceStateResult) Err() error {
+	return status.Error(codes.Code(r.Code), r.Message)
+}
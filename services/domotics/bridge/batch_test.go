@@ -0,0 +1,103 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBatchUpdate(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	sbs := NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{
+		"1": {
+			Id: "1",
+			State: &DeviceState{
+				IsReachable: true,
+				Binary:      &DeviceState_Binary{},
+			},
+		},
+		"2": {
+			Id: "2",
+			State: &DeviceState{
+				IsReachable: true,
+				Binary:      &DeviceState_Binary{},
+			},
+		},
+	}, &mockBridge{})
+
+	on := &DeviceState{
+		IsReachable: true,
+		Binary:      &DeviceState_Binary{IsOn: true},
+	}
+
+	resp, err := sbs.BatchUpdateDeviceStates(context.Background(), &BatchUpdateDeviceStatesRequest{
+		Requests: []*UpdateDeviceStateRequest{
+			{Id: "2", State: on},
+			{Id: "missing", State: on},
+			{Id: "1", State: on},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Results, 3)
+
+	// Results are returned in the order requested, and a failure doesn't prevent the other updates.
+	assert.Equal(t, "2", resp.Results[0].Id)
+	assert.NoError(t, resp.Results[0].Err())
+	assert.True(t, resp.Results[0].Device.State.Binary.IsOn)
+
+	assert.Equal(t, "missing", resp.Results[1].Id)
+	assert.Equal(t, codes.NotFound, status.Code(resp.Results[1].Err()))
+	assert.Nil(t, resp.Results[1].Device)
+
+	assert.Equal(t, "1", resp.Results[2].Id)
+	assert.NoError(t, resp.Results[2].Err())
+	assert.True(t, resp.Results[2].Device.State.Binary.IsOn)
+}
+
+func TestBatchUpdateInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *BatchUpdateDeviceStatesRequest
+	}{
+		{
+			"empty",
+			&BatchUpdateDeviceStatesRequest{},
+		},
+		{
+			"missing id",
+			&BatchUpdateDeviceStatesRequest{
+				Requests: []*UpdateDeviceStateRequest{
+					{Id: "1"},
+					{},
+				},
+			},
+		},
+		{
+			"duplicate device",
+			&BatchUpdateDeviceStatesRequest{
+				Requests: []*UpdateDeviceStateRequest{
+					{Id: "1"},
+					{Id: "1"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			_, err := BatchUpdate(context.Background(), tt.req, func(context.Context, *UpdateDeviceStateRequest) (*Device, error) {
+				called = true
+				return nil, nil
+			})
+			assert.Equal(t, codes.InvalidArgument, status.Code(err))
+			assert.False(t, called)
+		})
+	}
+}
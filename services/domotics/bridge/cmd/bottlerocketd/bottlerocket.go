@@ -40,6 +40,12 @@ var (
 		ModelName:        "X10 Wall Unit",
 		ModelDescription: "Plug-in X10 control unit",
 		Manufacturer:     "x10.com",
+		Traits: []*bridge.Trait{
+			{
+				Type:       bridge.Trait_BINARY,
+				IsWritable: true,
+			},
+		},
 	}
 )
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 
+	_ "github.com/mattn/go-sqlite3" // Blank import for sql drivers is "standard"
 	br "github.com/rmrobinson/bottlerocket-go"
 	"github.com/rmrobinson/nerves/services/domotics/bridge"
 	"github.com/spf13/viper"
@@ -25,6 +26,7 @@ func main() {
 	viper.SetEnvPrefix("NVS")
 	viper.BindEnv(idEnvVar)
 	viper.BindEnv(brUSBPathEnvVar)
+	viper.BindEnv(bridge.ConfigDBPathEnvVar)
 
 	brUSBPath := viper.GetString(brUSBPathEnvVar)
 	if len(brUSBPath) < 1 {
@@ -69,6 +71,17 @@ func main() {
 
 	sbs := bridge.NewSyncBridgeService(logger, brInfo, devices, br)
 
+	if dbPath := viper.GetString(bridge.ConfigDBPathEnvVar); len(dbPath) > 0 {
+		db, err := bridge.RestoreDeviceConfigsFromDB(context.Background(), logger, sbs, dbPath)
+		if err != nil {
+			logger.Fatal("unable to restore device configs",
+				zap.String("path", dbPath),
+				zap.Error(err),
+			)
+		}
+		defer db.Close()
+	}
+
 	ad := bridge.NewAdvertiser(logger, viper.GetString(idEnvVar), lis.Addr().String())
 	go ad.Run()
 	defer ad.Shutdown()
@@ -9,6 +9,7 @@ import (
 	"github.com/rmrobinson/nerves/services/domotics/bridge"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 func getDevices(logger *zap.Logger, h *bridge.Hub) {
@@ -30,9 +31,12 @@ func getDevices(logger *zap.Logger, h *bridge.Hub) {
 }
 
 func setDeviceName(logger *zap.Logger, h *bridge.Hub, id string, name string) {
-	setResp, err := h.UpdateDeviceConfig(context.Background(), id, &bridge.DeviceConfig{
-		Name:        name,
-		Description: "Manually set",
+	setResp, err := h.UpdateDeviceConfig(context.Background(), &bridge.UpdateDeviceConfigRequest{
+		Id: id,
+		Config: &bridge.DeviceConfig{
+			Name:        name,
+			Description: "Manually set",
+		},
 	})
 	if err != nil {
 		logger.Warn("unable to set device name",
@@ -62,7 +66,14 @@ func setDeviceIsOn(logger *zap.Logger, h *bridge.Hub, id string, isOn bool) {
 
 	d.State.Binary.IsOn = isOn
 
-	setResp, err := h.UpdateDeviceState(context.Background(), id, d.State)
+	setResp, err := h.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id:      id,
+		Version: d.Version,
+		State:   d.State,
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"binary.is_on"},
+		},
+	})
 	if err != nil {
 		logger.Warn("unable to set device",
 			zap.String("device_id", id),
@@ -131,10 +142,8 @@ func main() {
 		return
 	}
 
-	bridgeClient := bridge.NewBridgeServiceClient(conn)
-
 	h := bridge.NewHub(logger)
-	h.AddBridge(bridgeClient)
+	h.AddBridgeConn(conn)
 
 	time.Sleep(time.Second)
 
@@ -32,6 +32,12 @@ func (c *Console) getDevices(ctx context.Context) (map[string]*bridge.Device, er
 		IsActive: true,
 		Type:     bridge.DeviceType_SWITCH,
 		Address:  "/console/stdout",
+		Traits: []*bridge.Trait{
+			{
+				Type:       bridge.Trait_BINARY,
+				IsWritable: true,
+			},
+		},
 		Config: &bridge.DeviceConfig{
 			Name:        "Console device",
 			Description: "Basic echo device",
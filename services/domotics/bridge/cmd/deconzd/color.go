@@ -51,6 +51,24 @@ func colorPointsForModel(model string) (points []XY) {
 	return
 }
 
+// miredsToKelvin converts a color temperature in mireds, as used by deCONZ, to Kelvin.
+// 0 is returned if the temperature isn't set.
+func miredsToKelvin(mireds int) int32 {
+	if mireds <= 0 {
+		return 0
+	}
+	return int32(math.Round(1000000 / float64(mireds)))
+}
+
+// kelvinToMireds converts a color temperature in Kelvin to mireds, as used by deCONZ.
+// 0 is returned if the temperature isn't set.
+func kelvinToMireds(kelvin int32) int {
+	if kelvin <= 0 {
+		return 0
+	}
+	return int(math.Round(1000000 / float64(kelvin)))
+}
+
 func crossProduct(p1, p2 XY) float64 {
 	return p1.X*p2.Y - p1.Y*p2.X
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/rmrobinson/deconz-go"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+)
+
+// deCONZ reports the time of the last update in UTC, optionally with milliseconds.
+const lastUpdatedLayout = "2006-01-02T15:04:05"
+
+// lastUpdatedToProto converts the time the sensor last updated, returning nil if it has never reported.
+func lastUpdatedToProto(lastUpdated string) *timestamp.Timestamp {
+	t, err := time.Parse(lastUpdatedLayout, lastUpdated)
+	if err != nil {
+		return nil
+	}
+
+	ts, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil
+	}
+	return ts
+}
+
+func flagReading(flag bool, recordedAt *timestamp.Timestamp) *bridge.DeviceState_Reading {
+	return &bridge.DeviceState_Reading{
+		Value: &bridge.DeviceState_Reading_Flag{
+			Flag: flag,
+		},
+		RecordedAt: recordedAt,
+	}
+}
+
+func numberReading(number float64, unit string, recordedAt *timestamp.Timestamp) *bridge.DeviceState_Reading {
+	return &bridge.DeviceState_Reading{
+		Value: &bridge.DeviceState_Reading_Number{
+			Number: number,
+		},
+		Unit:       unit,
+		RecordedAt: recordedAt,
+	}
+}
+
+// readOnly returns read-only traits of each of the specified types.
+func readOnly(types ...bridge.Trait_Type) []*bridge.Trait {
+	var traits []*bridge.Trait
+	for _, t := range types {
+		traits = append(traits, &bridge.Trait{
+			Type: t,
+		})
+	}
+	return traits
+}
+
+func sensorToDevice(s *deconz.Sensor) *bridge.Device {
+	ret := &bridge.Device{
+		Id:           s.UniqueID,
+		Type:         bridge.DeviceType_SENSOR,
+		IsActive:     true,
+		ModelId:      s.ModelID,
+		Manufacturer: s.ManufacturerName,
+		Config: &bridge.DeviceConfig{
+			Name: s.Name,
+		},
+		State: &bridge.DeviceState{
+			IsReachable: s.Config.Reachable,
+			Version: &bridge.Version{
+				Sw: s.SoftwareVersion,
+			},
+		},
+	}
+
+	// Mains powered sensors don't report a battery level.
+	if s.Config.BatteryLevel > 0 {
+		ret.State.Battery = &bridge.DeviceState_Battery{
+			Percent: int32(s.Config.BatteryLevel),
+		}
+		ret.Traits = append(ret.Traits, readOnly(bridge.Trait_BATTERY)...)
+	}
+
+	// The low battery and tamper flags are reported by the alarm-style sensors.
+	setAlarmState := func(lowBattery bool, tampered bool) {
+		if lowBattery {
+			if ret.State.Battery == nil {
+				ret.State.Battery = &bridge.DeviceState_Battery{}
+				ret.Traits = append(ret.Traits, readOnly(bridge.Trait_BATTERY)...)
+			}
+			ret.State.Battery.IsLow = true
+		}
+		ret.State.Readings["tampered"] = flagReading(tampered, ret.State.ReportedAt)
+	}
+	addReadings := func() {
+		ret.State.Readings = map[string]*bridge.DeviceState_Reading{}
+		ret.Traits = append(ret.Traits, readOnly(bridge.Trait_READINGS)...)
+	}
+
+	switch {
+	case s.TemperatureState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.TemperatureState.LastUpdated)
+		ret.State.Temperature = temperatureToProto(s.TemperatureState.Temperature)
+		ret.Traits = append(ret.Traits, &bridge.Trait{
+			Type: bridge.Trait_TEMPERATURE,
+			Unit: "celsius",
+		})
+	case s.HumidityState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.HumidityState.LastUpdated)
+		// Humidity is reported in hundredths of a percent.
+		ret.State.Humidity = &bridge.DeviceState_Humidity{
+			RelativePercent: float64(s.HumidityState.Humidity) / 100,
+		}
+		ret.Traits = append(ret.Traits, &bridge.Trait{
+			Type: bridge.Trait_HUMIDITY,
+			Unit: "percent",
+		})
+	case s.PressureState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.PressureState.LastUpdated)
+		ret.State.Pressure = &bridge.DeviceState_Pressure{
+			Hectopascals: float64(s.PressureState.Pressure),
+		}
+		ret.Traits = append(ret.Traits, &bridge.Trait{
+			Type: bridge.Trait_PRESSURE,
+			Unit: "hPa",
+		})
+	case s.LightLevelState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.LightLevelState.LastUpdated)
+		ret.State.Illuminance = &bridge.DeviceState_Illuminance{
+			Lux:        float64(s.LightLevelState.Lux),
+			IsDark:     s.LightLevelState.Dark,
+			IsDaylight: s.LightLevelState.Daylight,
+		}
+		ret.Traits = append(ret.Traits, &bridge.Trait{
+			Type: bridge.Trait_ILLUMINANCE,
+			Unit: "lux",
+		})
+	case s.PowerState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.PowerState.LastUpdated)
+		// Current is reported in milliamps.
+		ret.State.Power = &bridge.DeviceState_Power{
+			Watts: float64(s.PowerState.Power),
+			Volts: float64(s.PowerState.Voltage),
+			Amps:  float64(s.PowerState.Current) / 1000,
+		}
+		ret.Traits = append(ret.Traits, readOnly(bridge.Trait_POWER)...)
+	case s.ConsumptionState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.ConsumptionState.LastUpdated)
+		// Consumption is reported in watt hours.
+		ret.State.Power = &bridge.DeviceState_Power{
+			Watts:         float64(s.ConsumptionState.Power),
+			KilowattHours: float64(s.ConsumptionState.Consumption) / 1000,
+		}
+		ret.Traits = append(ret.Traits, readOnly(bridge.Trait_POWER)...)
+	case s.OpenCloseState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.OpenCloseState.LastUpdated)
+		ret.State.Contact = &bridge.DeviceState_Contact{
+			IsOpen: s.OpenCloseState.Open,
+		}
+		ret.Traits = append(ret.Traits, readOnly(bridge.Trait_CONTACT)...)
+	case s.PresenceState != nil:
+		// deCONZ presence sensors are motion detectors, so they're reported as both.
+		ret.State.ReportedAt = lastUpdatedToProto(s.PresenceState.LastUpdated)
+		ret.State.Motion = &bridge.DeviceState_Motion{
+			IsDetected: s.PresenceState.Presence,
+		}
+		ret.State.Presence = &bridge.DeviceState_Presence{
+			IsPresent: s.PresenceState.Presence,
+		}
+		ret.Traits = append(ret.Traits, readOnly(bridge.Trait_MOTION, bridge.Trait_PRESENCE)...)
+	case s.CarbonMonoxideState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.CarbonMonoxideState.LastUpdated)
+		ret.State.AirQuality = &bridge.DeviceState_AirQuality{
+			IsCarbonMonoxideDetected: s.CarbonMonoxideState.CarbonMonoxide,
+		}
+		ret.Traits = append(ret.Traits, readOnly(bridge.Trait_AIR_QUALITY)...)
+		addReadings()
+		setAlarmState(s.CarbonMonoxideState.LowBattery, s.CarbonMonoxideState.Tampered)
+	case s.FireState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.FireState.LastUpdated)
+		addReadings()
+		ret.State.Readings["fire"] = flagReading(s.FireState.Fire, ret.State.ReportedAt)
+		setAlarmState(s.FireState.LowBattery, s.FireState.Tampered)
+	case s.WaterState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.WaterState.LastUpdated)
+		addReadings()
+		ret.State.Readings["water_leak"] = flagReading(s.WaterState.Water, ret.State.ReportedAt)
+		setAlarmState(s.WaterState.LowBattery, s.WaterState.Tampered)
+	case s.AlarmState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.AlarmState.LastUpdated)
+		addReadings()
+		ret.State.Readings["alarm"] = flagReading(s.AlarmState.Alarm, ret.State.ReportedAt)
+		setAlarmState(s.AlarmState.LowBattery, s.AlarmState.Tampered)
+	case s.VibrationState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.VibrationState.LastUpdated)
+		addReadings()
+		ret.State.Readings["vibration"] = flagReading(s.VibrationState.Vibration, ret.State.ReportedAt)
+		ret.State.Readings["vibration_strength"] = numberReading(float64(s.VibrationState.VibrationStrength), "", ret.State.ReportedAt)
+		ret.State.Readings["tilt_angle"] = numberReading(float64(s.VibrationState.TiltAngle), "degrees", ret.State.ReportedAt)
+	case s.ThermostatState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.ThermostatState.LastUpdated)
+		ret.State.Temperature = temperatureToProto(s.ThermostatState.Temperature)
+		ret.Traits = append(ret.Traits, &bridge.Trait{
+			Type: bridge.Trait_TEMPERATURE,
+			Unit: "celsius",
+		})
+		addReadings()
+		ret.State.Readings["valve"] = numberReading(float64(s.ThermostatState.Valve), "percent", ret.State.ReportedAt)
+	case s.SwitchState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.SwitchState.LastUpdated)
+		ret.State.Button = buttonEventToProto(s.SwitchState.ButtonEvent)
+		ret.Traits = append(ret.Traits, readOnly(bridge.Trait_BUTTON)...)
+	case s.ButtonState != nil:
+		ret.State.ReportedAt = lastUpdatedToProto(s.ButtonState.LastUpdated)
+		ret.State.Button = buttonEventToProto(s.ButtonState.ButtonEvent)
+		ret.Traits = append(ret.Traits, readOnly(bridge.Trait_BUTTON)...)
+	}
+
+	return ret
+}
+
+// temperatureToProto converts a temperature reported in hundredths of a degree.
+func temperatureToProto(temperature int) *bridge.DeviceState_Temperature {
+	celsius := float64(temperature) / 100
+	return &bridge.DeviceState_Temperature{
+		Celsius:        int32(math.Round(celsius)),
+		DegreesCelsius: celsius,
+	}
+}
+
+// buttonEventToProto converts a button event, which is reported as the button ID in the thousands and the action
+// in the units (0 for pressed, 1 for held, 2 and 3 for released after a short or long press).
+func buttonEventToProto(event int) []*bridge.DeviceState_Button {
+	if event < 1000 {
+		return nil
+	}
+
+	return []*bridge.DeviceState_Button{
+		{
+			Id:   int32(event / 1000),
+			IsOn: event%1000 <= 1,
+		},
+	}
+}
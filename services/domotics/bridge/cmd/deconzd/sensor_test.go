@@ -0,0 +1,428 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/rmrobinson/deconz-go"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testLastUpdated = "2021-01-02T03:04:05"
+
+var testReportedAt = &timestamp.Timestamp{
+	Seconds: time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC).Unix(),
+}
+
+func TestLastUpdatedToProto(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastUpdated string
+
+		expected *timestamp.Timestamp
+	}{
+		{
+			name:        "seconds",
+			lastUpdated: testLastUpdated,
+			expected:    testReportedAt,
+		},
+		{
+			name:        "milliseconds",
+			lastUpdated: "2021-01-02T03:04:05.250",
+			expected: &timestamp.Timestamp{
+				Seconds: testReportedAt.Seconds,
+				Nanos:   int32(250 * time.Millisecond),
+			},
+		},
+		{
+			name:        "never reported",
+			lastUpdated: "none",
+		},
+		{
+			name:        "empty",
+			lastUpdated: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := lastUpdatedToProto(tt.lastUpdated)
+			if tt.expected == nil {
+				assert.Nil(t, ts)
+				return
+			}
+			assert.True(t, proto.Equal(tt.expected, ts), "timestamp: %s", ts)
+		})
+	}
+}
+
+func TestButtonEventToProto(t *testing.T) {
+	tests := []struct {
+		name  string
+		event int
+
+		expected []*bridge.DeviceState_Button
+	}{
+		{
+			name:  "no event",
+			event: 0,
+		},
+		{
+			name:  "without a button",
+			event: 999,
+		},
+		{
+			name:     "pressed",
+			event:    1000,
+			expected: []*bridge.DeviceState_Button{{Id: 1, IsOn: true}},
+		},
+		{
+			name:     "held",
+			event:    2001,
+			expected: []*bridge.DeviceState_Button{{Id: 2, IsOn: true}},
+		},
+		{
+			name:     "short release",
+			event:    3002,
+			expected: []*bridge.DeviceState_Button{{Id: 3, IsOn: false}},
+		},
+		{
+			name:     "long release",
+			event:    4003,
+			expected: []*bridge.DeviceState_Button{{Id: 4, IsOn: false}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buttons := buttonEventToProto(tt.event)
+			require.Len(t, buttons, len(tt.expected))
+			for idx, button := range buttons {
+				assert.True(t, proto.Equal(tt.expected[idx], button), "button: %s", button)
+			}
+		})
+	}
+}
+
+func newTestSensor(batteryLevel int) deconz.Sensor {
+	return deconz.Sensor{
+		SensorMetadata: deconz.SensorMetadata{
+			Config: deconz.SensorConfig{
+				Reachable:    true,
+				BatteryLevel: batteryLevel,
+			},
+			ManufacturerName: "Acme",
+			ModelID:          "sensor1",
+			Name:             "Sensor",
+			SoftwareVersion:  "2.0",
+			UniqueID:         "00:11:22:33",
+		},
+	}
+}
+
+var sensorToDeviceTests = []struct {
+	name   string
+	sensor func() *deconz.Sensor
+
+	// The expected state has the sensor's reachability and version filled in by the test.
+	expectedTraits []*bridge.Trait
+	expectedState  *bridge.DeviceState
+}{
+	{
+		name: "temperature",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(90)
+			s.TemperatureState = &deconz.ZHATemperature{Temperature: 2150, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_BATTERY},
+			{Type: bridge.Trait_TEMPERATURE, Unit: "celsius"},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt:  testReportedAt,
+			Battery:     &bridge.DeviceState_Battery{Percent: 90},
+			Temperature: &bridge.DeviceState_Temperature{Celsius: 22, DegreesCelsius: 21.5},
+		},
+	},
+	{
+		name: "humidity is scaled from hundredths of a percent",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.HumidityState = &deconz.ZHAHumidity{Humidity: 4550, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_HUMIDITY, Unit: "percent"},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Humidity:   &bridge.DeviceState_Humidity{RelativePercent: 45.5},
+		},
+	},
+	{
+		name: "pressure",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.PressureState = &deconz.ZHAPressure{Pressure: 1013, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_PRESSURE, Unit: "hPa"},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Pressure:   &bridge.DeviceState_Pressure{Hectopascals: 1013},
+		},
+	},
+	{
+		name: "light level",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.LightLevelState = &deconz.ZHALightLevel{Lux: 5, Dark: true, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_ILLUMINANCE, Unit: "lux"},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt:  testReportedAt,
+			Illuminance: &bridge.DeviceState_Illuminance{Lux: 5, IsDark: true},
+		},
+	},
+	{
+		name: "power current is scaled from milliamps",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.PowerState = &deconz.ZHAPower{Power: 60, Voltage: 240, Current: 250, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_POWER},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Power:      &bridge.DeviceState_Power{Watts: 60, Volts: 240, Amps: 0.25},
+		},
+	},
+	{
+		name: "consumption is scaled from watt hours",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.ConsumptionState = &deconz.ZHAConsumption{Power: 60, Consumption: 12345, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_POWER},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Power:      &bridge.DeviceState_Power{Watts: 60, KilowattHours: 12.345},
+		},
+	},
+	{
+		name: "open close",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.OpenCloseState = &deconz.ZHAOpenClose{Open: true, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_CONTACT},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Contact:    &bridge.DeviceState_Contact{IsOpen: true},
+		},
+	},
+	{
+		name: "presence",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.PresenceState = &deconz.ZHAPresence{Presence: true, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_MOTION},
+			{Type: bridge.Trait_PRESENCE},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Motion:     &bridge.DeviceState_Motion{IsDetected: true},
+			Presence:   &bridge.DeviceState_Presence{IsPresent: true},
+		},
+	},
+	{
+		name: "carbon monoxide low battery without a level",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.CarbonMonoxideState = &deconz.ZHACarbonMonoxide{CarbonMonoxide: true, LowBattery: true, Tampered: true, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_AIR_QUALITY},
+			{Type: bridge.Trait_READINGS},
+			{Type: bridge.Trait_BATTERY},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			AirQuality: &bridge.DeviceState_AirQuality{IsCarbonMonoxideDetected: true},
+			Battery:    &bridge.DeviceState_Battery{IsLow: true},
+			Readings: map[string]*bridge.DeviceState_Reading{
+				"tampered": flagReading(true, testReportedAt),
+			},
+		},
+	},
+	{
+		name: "fire low battery merged with the level",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(10)
+			s.FireState = &deconz.ZHAFire{Fire: true, LowBattery: true, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_BATTERY},
+			{Type: bridge.Trait_READINGS},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Battery:    &bridge.DeviceState_Battery{Percent: 10, IsLow: true},
+			Readings: map[string]*bridge.DeviceState_Reading{
+				"fire":     flagReading(true, testReportedAt),
+				"tampered": flagReading(false, testReportedAt),
+			},
+		},
+	},
+	{
+		name: "water never reported",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.WaterState = &deconz.ZHAWater{LastUpdated: "none"}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_READINGS},
+		},
+		expectedState: &bridge.DeviceState{
+			Readings: map[string]*bridge.DeviceState_Reading{
+				"water_leak": flagReading(false, nil),
+				"tampered":   flagReading(false, nil),
+			},
+		},
+	},
+	{
+		name: "alarm",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.AlarmState = &deconz.ZHAAlarm{Alarm: true, Tampered: true, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_READINGS},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Readings: map[string]*bridge.DeviceState_Reading{
+				"alarm":    flagReading(true, testReportedAt),
+				"tampered": flagReading(true, testReportedAt),
+			},
+		},
+	},
+	{
+		name: "vibration",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.VibrationState = &deconz.ZHAVibration{Vibration: true, VibrationStrength: 30, TiltAngle: 45, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_READINGS},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Readings: map[string]*bridge.DeviceState_Reading{
+				"vibration":          flagReading(true, testReportedAt),
+				"vibration_strength": numberReading(30, "", testReportedAt),
+				"tilt_angle":         numberReading(45, "degrees", testReportedAt),
+			},
+		},
+	},
+	{
+		name: "thermostat",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.ThermostatState = &deconz.ZHAThermostat{Temperature: 1925, Valve: 60, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_TEMPERATURE, Unit: "celsius"},
+			{Type: bridge.Trait_READINGS},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt:  testReportedAt,
+			Temperature: &bridge.DeviceState_Temperature{Celsius: 19, DegreesCelsius: 19.25},
+			Readings: map[string]*bridge.DeviceState_Reading{
+				"valve": numberReading(60, "percent", testReportedAt),
+			},
+		},
+	},
+	{
+		name: "switch",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.SwitchState = &deconz.ZHASwitch{ButtonEvent: 2002, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_BUTTON},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Button:     []*bridge.DeviceState_Button{{Id: 2, IsOn: false}},
+		},
+	},
+	{
+		name: "green power button",
+		sensor: func() *deconz.Sensor {
+			s := newTestSensor(0)
+			s.ButtonState = &deconz.ZGPSwitch{ButtonEvent: 1000, LastUpdated: testLastUpdated}
+			return &s
+		},
+		expectedTraits: []*bridge.Trait{
+			{Type: bridge.Trait_BUTTON},
+		},
+		expectedState: &bridge.DeviceState{
+			ReportedAt: testReportedAt,
+			Button:     []*bridge.DeviceState_Button{{Id: 1, IsOn: true}},
+		},
+	},
+}
+
+func TestSensorToDevice(t *testing.T) {
+	for _, tt := range sensorToDeviceTests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := sensorToDevice(tt.sensor())
+
+			assert.Equal(t, "00:11:22:33", d.Id)
+			assert.Equal(t, bridge.DeviceType_SENSOR, d.Type)
+			assert.True(t, d.IsActive)
+			assert.Equal(t, "sensor1", d.ModelId)
+			assert.Equal(t, "Acme", d.Manufacturer)
+			assert.Equal(t, "Sensor", d.Config.Name)
+
+			require.Len(t, d.Traits, len(tt.expectedTraits))
+			for idx, trait := range d.Traits {
+				assert.True(t, proto.Equal(tt.expectedTraits[idx], trait), "trait: %s", trait)
+			}
+
+			expected := proto.Clone(tt.expectedState).(*bridge.DeviceState)
+			expected.IsReachable = true
+			expected.Version = &bridge.Version{Sw: "2.0"}
+			assert.True(t, proto.Equal(expected, d.State), "state: %s", d.State)
+		})
+	}
+}
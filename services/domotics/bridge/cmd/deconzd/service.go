@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/gorilla/websocket"
@@ -14,6 +15,7 @@ import (
 	"github.com/rmrobinson/nerves/services/domotics/bridge"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 // Service represents a handle to a single Service REST API endpoint
@@ -25,6 +27,10 @@ type Service struct {
 
 	updates *stream.Source
 
+	// revisions versions the devices, and writeLock serializes writes so versions can't change between checking and writing.
+	revisions *bridge.RevisionTracker
+	writeLock sync.Mutex
+
 	brInfo *bridge.Bridge
 
 	lightUniqueIDsToPathIDs  map[string]string
@@ -40,6 +46,7 @@ func NewService(logger *zap.Logger, c *deconz.Client) *Service {
 		c:                        c,
 		brInfo:                   &bridge.Bridge{},
 		updates:                  stream.NewSource(logger),
+		revisions:                bridge.NewRevisionTracker(),
 		lightUniqueIDsToPathIDs:  map[string]string{},
 		sensorUniqueIDsToPathIDs: map[string]string{},
 	}
@@ -128,7 +135,7 @@ func (s *Service) Run() error {
 		case "added":
 			if msg.Meta.Resource == "lights" {
 				s.lightUniqueIDsToPathIDs[msg.Meta.UniqueID] = msg.Meta.ResourceID
-				device := lightToDevice(msg.Light)
+				device := s.stamp(lightToDevice(msg.Light))
 				s.updates.SendMessage(&bridge.Update{
 					Action: bridge.Update_ADDED,
 					Update: &bridge.Update_DeviceUpdate{
@@ -141,7 +148,7 @@ func (s *Service) Run() error {
 				})
 			} else if msg.Meta.Resource == "sensors" {
 				s.sensorUniqueIDsToPathIDs[msg.Meta.UniqueID] = msg.Meta.ResourceID
-				device := sensorToDevice(msg.Sensor)
+				device := s.stamp(sensorToDevice(msg.Sensor))
 				s.updates.SendMessage(&bridge.Update{
 					Action: bridge.Update_ADDED,
 					Update: &bridge.Update_DeviceUpdate{
@@ -200,6 +207,7 @@ func (s *Service) Run() error {
 		case "deleted":
 			if msg.Meta.Resource == "lights" {
 				delete(s.lightUniqueIDsToPathIDs, msg.Meta.UniqueID)
+				s.revisions.Remove(msg.Meta.UniqueID)
 				s.updates.SendMessage(&bridge.Update{
 					Action: bridge.Update_REMOVED,
 					Update: &bridge.Update_DeviceUpdate{
@@ -211,6 +219,7 @@ func (s *Service) Run() error {
 				})
 			} else if msg.Meta.Resource == "sensors" {
 				delete(s.sensorUniqueIDsToPathIDs, msg.Meta.UniqueID)
+				s.revisions.Remove(msg.Meta.UniqueID)
 				s.updates.SendMessage(&bridge.Update{
 					Action: bridge.Update_REMOVED,
 					Update: &bridge.Update_DeviceUpdate{
@@ -301,7 +310,7 @@ func (s *Service) ListDevices(ctx context.Context, req *bridge.ListDevicesReques
 		if id == "1" {
 			continue
 		}
-		devices = append(devices, lightToDevice(&light))
+		devices = append(devices, s.stamp(lightToDevice(&light)))
 	}
 
 	sensors, err := s.c.GetSensors(ctx)
@@ -313,7 +322,7 @@ func (s *Service) ListDevices(ctx context.Context, req *bridge.ListDevicesReques
 	}
 
 	for _, sensor := range sensors {
-		devices = append(devices, sensorToDevice(&sensor))
+		devices = append(devices, s.stamp(sensorToDevice(&sensor)))
 	}
 
 	return &bridge.ListDevicesResponse{
@@ -334,7 +343,7 @@ func (s *Service) GetDevice(ctx context.Context, req *bridge.GetDeviceRequest) (
 			return nil, bridge.ErrInternal.Err()
 		}
 
-		return lightToDevice(light), nil
+		return s.stamp(lightToDevice(light)), nil
 	}
 
 	if id, found := s.sensorUniqueIDsToPathIDs[req.Id]; found {
@@ -348,7 +357,7 @@ func (s *Service) GetDevice(ctx context.Context, req *bridge.GetDeviceRequest) (
 			return nil, bridge.ErrInternal.Err()
 		}
 
-		return sensorToDevice(sensor), nil
+		return s.stamp(sensorToDevice(sensor)), nil
 	}
 
 	return nil, bridge.ErrDeviceNotFound.Err()
@@ -360,6 +369,9 @@ func (s *Service) UpdateDeviceConfig(ctx context.Context, req *bridge.UpdateDevi
 		return nil, bridge.ErrMissingParam.Err()
 	}
 
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
 	device, err := s.GetDevice(ctx, &bridge.GetDeviceRequest{Id: req.Id})
 	if err != nil {
 		s.logger.Error("unable to get device ahead of config change",
@@ -370,7 +382,21 @@ func (s *Service) UpdateDeviceConfig(ctx context.Context, req *bridge.UpdateDevi
 		return nil, err
 	}
 
-	if device.Config.String() == req.Config.String() {
+	if err := s.revisions.Check(device, req.Version); err != nil {
+		s.logger.Debug("stale device config update, rejecting",
+			zap.String("device_id", req.Id),
+			zap.String("version", req.Version),
+			zap.String("current_version", device.Version),
+		)
+		return nil, err
+	}
+
+	config, err := bridge.ApplyConfigMask(device.Config, req.Config, req.UpdateMask)
+	if err != nil {
+		return nil, err
+	}
+
+	if device.Config.String() == config.String() {
 		s.logger.Debug("skipping device config update since desired state already present",
 			zap.String("device_id", req.Id),
 		)
@@ -379,7 +405,7 @@ func (s *Service) UpdateDeviceConfig(ctx context.Context, req *bridge.UpdateDevi
 
 	if id, found := s.lightUniqueIDsToPathIDs[req.Id]; found {
 		err = s.c.SetLightConfig(ctx, id, &deconz.SetLightConfigRequest{
-			Name: req.Config.Name,
+			Name: config.Name,
 		})
 
 		if err != nil {
@@ -391,13 +417,13 @@ func (s *Service) UpdateDeviceConfig(ctx context.Context, req *bridge.UpdateDevi
 			return nil, bridge.ErrInternal.Err()
 		}
 
-		device.Config.Name = req.Config.Name
-		return device, nil
+		device.Config.Name = config.Name
+		return s.stamp(device), nil
 	}
 
 	if id, found := s.sensorUniqueIDsToPathIDs[req.Id]; found {
 		err = s.c.SetSensor(ctx, id, &deconz.SetSensorRequest{
-			Name: req.Config.Name,
+			Name: config.Name,
 		})
 
 		if err != nil {
@@ -409,7 +435,8 @@ func (s *Service) UpdateDeviceConfig(ctx context.Context, req *bridge.UpdateDevi
 			return nil, bridge.ErrInternal.Err()
 		}
 
-		device.Config.Name = req.Config.Name
+		device.Config.Name = config.Name
+		s.stamp(device)
 
 		// The Deconz websocket doesn't receive config updates (go figure) so generate the update msg here.
 		s.updates.SendMessage(&bridge.Update{
@@ -431,12 +458,13 @@ func (s *Service) UpdateDeviceConfig(ctx context.Context, req *bridge.UpdateDevi
 
 // UpdateDeviceState updates the specified device with the provided state.
 func (s *Service) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDeviceStateRequest) (*bridge.Device, error) {
-	if len(req.Id) < 1 || req.State == nil || req.State.Binary == nil {
+	if len(req.Id) < 1 || req.State == nil {
 		return nil, bridge.ErrMissingParam.Err()
-	} else if req.State.IsReachable == false {
-		return nil, bridge.ErrNotSupported.Err()
 	}
 
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
 	if id, found := s.lightUniqueIDsToPathIDs[req.Id]; found {
 		light, err := s.c.GetLight(ctx, id)
 		if err != nil {
@@ -448,19 +476,39 @@ func (s *Service) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDevic
 			return nil, bridge.ErrInternal.Err()
 		}
 
+		device := lightToDevice(light)
+		if err := s.revisions.Check(device, req.Version); err != nil {
+			s.logger.Debug("stale light state update, rejecting",
+				zap.String("device_id", req.Id),
+				zap.String("version", req.Version),
+			)
+			return nil, err
+		}
+
+		state, err := lightWriteState(device.State, req.State, req.UpdateMask)
+		if err != nil {
+			return nil, err
+		} else if err := bridge.ValidateState(device, state); err != nil {
+			return nil, err
+		} else if state.Binary == nil {
+			return nil, bridge.ErrMissingParam.Err()
+		} else if state.IsReachable == false {
+			return nil, bridge.ErrNotSupported.Err()
+		}
+
 		stateReq := &deconz.SetLightStateRequest{
-			On: req.State.Binary.IsOn,
+			On: state.Binary.IsOn,
 		}
 
-		if req.State.Range != nil {
-			stateReq.Brightness = int(float64(req.State.Range.Value))
+		if state.Range != nil {
+			stateReq.Brightness = int(float64(state.Range.Value))
 		}
-		if req.State.ColorHsb != nil {
+		if state.ColorHsb != nil {
 			// If we already have things in XY, convert to XY ahead of writing
 			if light.State.ColorMode == "xy" {
-				s := float64(req.State.ColorHsb.Saturation) / float64(100.0)
-				b := float64(req.State.ColorHsb.Brightness) / float64(100.0)
-				c := colorful.Hsv(float64(req.State.ColorHsb.Hue), s, b)
+				s := float64(state.ColorHsb.Saturation) / float64(100.0)
+				b := float64(state.ColorHsb.Brightness) / float64(100.0)
+				c := colorful.Hsv(float64(state.ColorHsb.Hue), s, b)
 
 				x, y, bri := getHueXYBrightnessFromColor(c, light.ModelID)
 
@@ -468,30 +516,30 @@ func (s *Service) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDevic
 				stateReq.XY = []float64{x, y}
 			} else {
 				// Convert from 360 degress/0-100% to the supported ranges.
-				stateReq.Hue = int((float64(req.State.ColorHsb.Hue) * float64(65535.0)) / float64(360.0))
-				stateReq.Saturation = int((float64(req.State.ColorHsb.Saturation) * float64(255.0)) / float64(100.0))
-				stateReq.Brightness = int((float64(req.State.ColorHsb.Brightness) * float64(255.0)) / float64(100.0))
+				stateReq.Hue = int((float64(state.ColorHsb.Hue) * float64(65535.0)) / float64(360.0))
+				stateReq.Saturation = int((float64(state.ColorHsb.Saturation) * float64(255.0)) / float64(100.0))
+				stateReq.Brightness = int((float64(state.ColorHsb.Brightness) * float64(255.0)) / float64(100.0))
 			}
-		} else if req.State.ColorRgb != nil {
+		} else if state.ColorRgb != nil {
 			c := colorful.Color{
-				R: float64(req.State.ColorRgb.Red) / float64(255.0),
-				G: float64(req.State.ColorRgb.Green) / float64(255.0),
-				B: float64(req.State.ColorRgb.Blue) / float64(255.0),
+				R: float64(state.ColorRgb.Red) / float64(255.0),
+				G: float64(state.ColorRgb.Green) / float64(255.0),
+				B: float64(state.ColorRgb.Blue) / float64(255.0),
 			}
 
 			x, y, bri := getHueXYBrightnessFromColor(c, light.ModelID)
 
 			stateReq.Brightness = int(bri)
 			stateReq.XY = []float64{x, y}
-		} else if req.State.ColorTemperature != 0 {
-			stateReq.CT = int(req.State.ColorTemperature)
+		} else if state.ColorTemperature != 0 {
+			stateReq.CT = kelvinToMireds(state.ColorTemperature)
 		}
 
 		s.logger.Debug("about to change light state",
 			zap.String("device_id", req.Id),
 			zap.String("path_id", id),
 			zap.String("name", light.Name),
-			zap.String("orig_req", spew.Sdump(req.State)),
+			zap.String("orig_req", spew.Sdump(state)),
 			zap.String("conv_req", spew.Sdump(stateReq)),
 		)
 
@@ -517,7 +565,7 @@ func (s *Service) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDevic
 			// We don't return an error here since the update already succeeded.
 			// Absent more information we assume the did not apply and return that.
 			// There will shortly be an update triggered which should refresh the values anyways.
-			return lightToDevice(light), nil
+			return s.stamp(lightToDevice(light)), nil
 		}
 
 		return upDevice, nil
@@ -533,6 +581,12 @@ func (s *Service) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDevic
 	return nil, bridge.ErrDeviceNotFound.Err()
 }
 
+// BatchUpdateDeviceStates updates the state of each of the specified devices.
+// Writes to the gateway are serialized, so the updates are applied one at a time.
+func (s *Service) BatchUpdateDeviceStates(ctx context.Context, req *bridge.BatchUpdateDeviceStatesRequest) (*bridge.BatchUpdateDeviceStatesResponse, error) {
+	return bridge.BatchUpdate(ctx, req, s.UpdateDeviceState)
+}
+
 // StreamBridgeUpdates monitors changes for all changes which occur on the bridge.
 func (s *Service) StreamBridgeUpdates(req *bridge.StreamBridgeUpdatesRequest, stream bridge.BridgeService_StreamBridgeUpdatesServer) error {
 	peer, isOk := peer.FromContext(stream.Context())
@@ -546,66 +600,34 @@ func (s *Service) StreamBridgeUpdates(req *bridge.StreamBridgeUpdatesRequest, st
 
 	logger.Debug("bridge update stream initiated")
 
-	sink := s.updates.NewSink()
-	defer sink.Close()
-
-	// Send the device info to start.
-
-	listDevicesResp, err := s.ListDevices(stream.Context(), &bridge.ListDevicesRequest{})
-	if err != nil {
-		s.logger.Error("unable to retrieve devices",
-			zap.Error(err),
-		)
-		// This is already a gRPC error so just return it here
-		return err
-	}
-
-	for _, device := range listDevicesResp.Devices {
-		update := &bridge.Update{
-			Action: bridge.Update_ADDED,
-			Update: &bridge.Update_DeviceUpdate{
-				DeviceUpdate: &bridge.DeviceUpdate{
-					Device:   device,
-					DeviceId: device.Id,
-					BridgeId: s.brInfo.Id,
-				},
-			},
-		}
-		logger.Debug("sending seed info",
-			zap.String("device_info", update.String()),
-		)
-
-		if err := stream.Send(update); err != nil {
-			logger.Error("unable to send update",
-				zap.Error(err),
-			)
-			return err
-		}
-	}
-
-	// Now we wait for updates
-	for {
-		update, ok := <-sink.Messages()
-		if !ok {
-			logger.Debug("stream closed")
-			// Channel has been closed; so we'll close the connection as well
-			return nil
+	return bridge.ServeUpdates(logger, s.updates, req, stream, func(ctx context.Context) ([]*bridge.Update, error) {
+		listDevicesResp, err := s.ListDevices(ctx, &bridge.ListDevicesRequest{})
+		if err != nil {
+			// This is already a gRPC error so just return it here
+			return nil, err
 		}
 
-		bridgeUpdate, ok := update.(*bridge.Update)
-
-		if !ok {
-			panic("update cast incorrect")
+		var updates []*bridge.Update
+		for _, device := range listDevicesResp.Devices {
+			updates = append(updates, &bridge.Update{
+				Action: bridge.Update_ADDED,
+				Update: &bridge.Update_DeviceUpdate{
+					DeviceUpdate: &bridge.DeviceUpdate{
+						Device:   device,
+						DeviceId: device.Id,
+						BridgeId: s.brInfo.Id,
+					},
+				},
+			})
 		}
+		return updates, nil
+	})
+}
 
-		logger.Debug("sending update",
-			zap.String("info", bridgeUpdate.String()),
-		)
-
-		if err := stream.Send(bridgeUpdate); err != nil {
-			return err
-		}
-	}
+// stamp sets the version of the device, returning it for convenience.
+func (s *Service) stamp(device *bridge.Device) *bridge.Device {
+	s.revisions.Stamp(device)
+	return device
 }
 
 func lightToDevice(l *deconz.Light) *bridge.Device {
@@ -615,13 +637,17 @@ func lightToDevice(l *deconz.Light) *bridge.Device {
 		IsActive:     true,
 		ModelId:      l.ModelID,
 		Manufacturer: l.Manufacturer,
-		Range: &bridge.Device_Range{
-			Minimum: 0,
-			Maximum: 255,
-		},
-		ColorTemperature: &bridge.Device_ColorTemperature{
-			Minimum: int32(l.CTMin),
-			Maximum: int32(l.CTMax),
+		Traits: []*bridge.Trait{
+			{
+				Type:       bridge.Trait_BINARY,
+				IsWritable: true,
+			},
+			{
+				Type:       bridge.Trait_RANGE,
+				IsWritable: true,
+				Minimum:    0,
+				Maximum:    255,
+			},
 		},
 		Config: &bridge.DeviceConfig{
 			Name: l.Name,
@@ -640,6 +666,27 @@ func lightToDevice(l *deconz.Light) *bridge.Device {
 		},
 	}
 
+	if l.CTMax > 0 {
+		// deCONZ reports and accepts color temperatures in mireds, so the warmest temperature is the largest value.
+		// If the light doesn't report its coolest temperature the trait has no upper bound.
+		ret.Traits = append(ret.Traits, &bridge.Trait{
+			Type:       bridge.Trait_COLOR_TEMPERATURE,
+			IsWritable: true,
+			Minimum:    miredsToKelvin(l.CTMax),
+			Maximum:    miredsToKelvin(l.CTMin),
+			Unit:       "kelvin",
+		})
+	}
+	if l.State.ColorMode == "xy" || l.State.ColorMode == "hs" || strings.Contains(strings.ToLower(l.Type), "color light") {
+		ret.Traits = append(ret.Traits, &bridge.Trait{
+			Type:       bridge.Trait_COLOR_HSB,
+			IsWritable: true,
+		}, &bridge.Trait{
+			Type:       bridge.Trait_COLOR_RGB,
+			IsWritable: true,
+		})
+	}
+
 	if l.State.ColorMode == "xy" {
 		// Go from Deconz/Hue xy to CIE XYZ
 		x := l.State.XY[0]
@@ -667,7 +714,7 @@ func lightToDevice(l *deconz.Light) *bridge.Device {
 			Brightness: int32((float64(l.State.Brightness) * float64(100.0)) / float64(255.0)),
 		}
 	} else if l.State.ColorMode == "ct" {
-		ret.State.ColorTemperature = int32(l.State.CT)
+		ret.State.ColorTemperature = miredsToKelvin(l.State.CT)
 
 		if strings.Contains(strings.ToLower(l.Type), "color light") {
 			ret.State.ColorHsb = &bridge.DeviceState_ColorHSB{}
@@ -676,27 +723,27 @@ func lightToDevice(l *deconz.Light) *bridge.Device {
 
 	return ret
 }
-func sensorToDevice(s *deconz.Sensor) *bridge.Device {
-	ret := &bridge.Device{
-		Id:           s.UniqueID,
-		Type:         bridge.DeviceType_SENSOR,
-		IsActive:     true,
-		ModelId:      s.ModelID,
-		Manufacturer: s.ManufacturerName,
-		Config: &bridge.DeviceConfig{
-			Name: s.Name,
-		},
-		State: &bridge.DeviceState{
-			IsReachable: s.Config.Reachable,
-			Version: &bridge.Version{
-				Sw: s.SoftwareVersion,
-			},
-			Binary: &bridge.DeviceState_Binary{
-				IsOn: s.Config.On,
-			},
-		},
+
+// lightWriteState returns the state to write to a light. Without a mask this is the requested state; with one,
+// only the fields named in the mask are written, along with the on/off state which every write requires,
+// so the light's other settings aren't needlessly reapplied.
+func lightWriteState(current *bridge.DeviceState, update *bridge.DeviceState, mask *fieldmaskpb.FieldMask) (*bridge.DeviceState, error) {
+	if len(mask.GetPaths()) < 1 {
+		return update, nil
 	}
 
-	// TODO: expose a bunch of sensor info
-	return ret
+	desired, err := bridge.ApplyStateMask(current, update, mask)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := &fieldmaskpb.FieldMask{}
+	for _, path := range mask.GetPaths() {
+		fields.Paths = append(fields.Paths, strings.SplitN(path, ".", 2)[0])
+	}
+
+	return bridge.ApplyStateMask(&bridge.DeviceState{
+		IsReachable: desired.IsReachable,
+		Binary:      desired.Binary,
+	}, desired, fields)
 }
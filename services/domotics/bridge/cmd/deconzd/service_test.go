@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rmrobinson/deconz-go"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestColorTemperatureConversion(t *testing.T) {
+	tests := []struct {
+		mireds int
+		kelvin int32
+	}{
+		{0, 0},
+		{153, 6536},
+		{250, 4000},
+		{500, 2000},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.kelvin, miredsToKelvin(tt.mireds), "%d mireds", tt.mireds)
+		assert.Equal(t, tt.mireds, kelvinToMireds(tt.kelvin), "%d kelvin", tt.kelvin)
+	}
+}
+
+func TestLightToDeviceColorTemperature(t *testing.T) {
+	device := lightToDevice(&deconz.Light{
+		Name:  "lamp",
+		Type:  "Color temperature light",
+		CTMin: 153,
+		CTMax: 500,
+		State: deconz.LightState{
+			On:        true,
+			CT:        250,
+			ColorMode: "ct",
+			Reachable: true,
+		},
+	})
+
+	var trait *bridge.Trait
+	for _, t := range device.Traits {
+		if t.Type == bridge.Trait_COLOR_TEMPERATURE {
+			trait = t
+		}
+	}
+	require.NotNil(t, trait)
+
+	// The coolest temperature, with the fewest mireds, is the largest in Kelvin.
+	assert.Equal(t, int32(2000), trait.Minimum)
+	assert.Equal(t, int32(6536), trait.Maximum)
+	assert.Equal(t, "kelvin", trait.Unit)
+	assert.Equal(t, int32(4000), device.State.ColorTemperature)
+	assert.NoError(t, bridge.ValidateState(device, device.State))
+}
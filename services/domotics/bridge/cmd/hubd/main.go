@@ -2,17 +2,28 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"net"
+	"time"
 
+	_ "github.com/mattn/go-sqlite3" // Blank import for sql drivers is "standard"
+	"github.com/rmrobinson/nerves/lib/stream"
 	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/rmrobinson/nerves/services/domotics/group"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 )
 
 const (
-	idEnvVar   = "ID"
-	portEnvVar = "PORT"
+	idEnvVar              = "ID"
+	portEnvVar            = "PORT"
+	journalDirEnvVar      = "JOURNAL_DIR"
+	journalMaxAgeEnvVar   = "JOURNAL_MAX_AGE"
+	journalMaxBytesEnvVar = "JOURNAL_MAX_BYTES"
+	healthIntervalEnvVar  = "HEALTH_CHECK_INTERVAL"
+	maxBackoffEnvVar      = "RECONNECT_MAX_BACKOFF"
+	groupDBPathEnvVar     = "GROUP_DB_PATH"
 )
 
 func main() {
@@ -24,6 +35,15 @@ func main() {
 	viper.SetEnvPrefix("NVS")
 	viper.BindEnv(idEnvVar)
 	viper.BindEnv(portEnvVar)
+	viper.BindEnv(journalDirEnvVar)
+	viper.BindEnv(journalMaxAgeEnvVar)
+	viper.BindEnv(journalMaxBytesEnvVar)
+	viper.BindEnv(healthIntervalEnvVar)
+	viper.BindEnv(maxBackoffEnvVar)
+	viper.BindEnv(groupDBPathEnvVar)
+
+	viper.SetDefault(healthIntervalEnvVar, 30*time.Second)
+	viper.SetDefault(maxBackoffEnvVar, time.Minute)
 
 	brInfo := &bridge.Bridge{
 		Id:           viper.GetString(idEnvVar),
@@ -32,7 +52,35 @@ func main() {
 		Manufacturer: "Faltung Systems",
 	}
 
-	hub := bridge.NewHub(logger)
+	hubOpts := []bridge.HubOption{
+		bridge.HealthCheck(viper.GetDuration(healthIntervalEnvVar), 5*time.Second),
+		bridge.ReconnectBackoff(time.Second, viper.GetDuration(maxBackoffEnvVar)),
+	}
+
+	var hub *bridge.Hub
+	if journalDir := viper.GetString(journalDirEnvVar); len(journalDir) > 0 {
+		source, journal, err := bridge.NewJournaledUpdateSource(logger, stream.JournalConfig{
+			Dir:           journalDir,
+			MaxAge:        viper.GetDuration(journalMaxAgeEnvVar),
+			MaxTotalBytes: viper.GetInt64(journalMaxBytesEnvVar),
+		})
+		if err != nil {
+			logger.Fatal("error opening journal",
+				zap.String("dir", journalDir),
+				zap.Error(err),
+			)
+		}
+		defer journal.Close()
+
+		logger.Info("journaling updates",
+			zap.String("dir", journalDir),
+			zap.Uint64("sequence", source.Sequence()),
+		)
+
+		hub = bridge.NewHubWithSource(logger, source, hubOpts...)
+	} else {
+		hub = bridge.NewHub(logger, hubOpts...)
+	}
 
 	hm := &HubMonitor{
 		logger: logger,
@@ -61,7 +109,34 @@ func main() {
 	defer ad.Shutdown()
 
 	grpcServer := grpc.NewServer()
-	bridge.RegisterBridgeServiceServer(grpcServer, hm)
+	hs := bridge.NewHubService(logger, brInfo, hub)
+	bridge.RegisterBridgeServiceServer(grpcServer, hs)
+	bridge.RegisterHubServiceServer(grpcServer, hs)
 	bridge.RegisterPingServiceServer(grpcServer, ad)
+
+	// Groups and scenes are only served if there is somewhere to save them.
+	if dbPath := viper.GetString(groupDBPathEnvVar); len(dbPath) > 0 {
+		sqldb, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			logger.Fatal("unable to open group db",
+				zap.String("path", dbPath),
+				zap.Error(err),
+			)
+		}
+		defer sqldb.Close()
+
+		p := group.NewSQLPersister(logger, sqldb)
+		if err := p.Setup(context.Background()); err != nil {
+			logger.Fatal("unable to setup group db",
+				zap.String("path", dbPath),
+				zap.Error(err),
+			)
+		}
+
+		groupAPI := group.NewAPI(logger, p, hub)
+		group.RegisterGroupServiceServer(grpcServer, groupAPI)
+		group.RegisterSceneServiceServer(grpcServer, groupAPI)
+	}
+
 	grpcServer.Serve(lis)
 }
@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
+	"strings"
 	"sync"
 
 	"github.com/rmrobinson/nerves/services/domotics/bridge"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/peer"
-	"google.golang.org/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // HubMonitor is a hub-based implementation of a monitor.
@@ -37,18 +38,21 @@ func (hm *HubMonitor) Alive(t string, id string, connStr string) {
 		return
 	}
 
+	// The hub reconnects to bridges whose connection drops, so we only need to step in if the connection itself is bad.
+	bridgeID := strings.TrimPrefix(id, "uuid:")
+
 	if conn, exists := hm.conns[id]; exists {
 		pingClient := bridge.NewPingServiceClient(conn)
 
 		_, err := pingClient.Ping(context.Background(), &bridge.PingRequest{})
 		if err == nil {
-			_, err := hm.hub.Bridge(id)
-			if err == bridge.ErrBridgeNotFound.Err() {
+			_, err := hm.hub.Bridge(bridgeID)
+			if status.Code(err) == codes.NotFound {
 				hm.logger.Info("adding bridge on existing connection",
 					zap.String("id", id),
 				)
 
-				hm.hub.AddBridge(bridge.NewBridgeServiceClient(conn))
+				hm.hub.AddBridgeConn(conn)
 				return
 			}
 			return
@@ -59,6 +63,8 @@ func (hm *HubMonitor) Alive(t string, id string, connStr string) {
 			zap.Error(err),
 		)
 
+		// The hub would otherwise keep trying to reconnect over the connection we're about to close.
+		hm.hub.RemoveBridge(bridgeID)
 		conn.Close()
 		delete(hm.conns, id)
 	}
@@ -75,7 +81,7 @@ func (hm *HubMonitor) Alive(t string, id string, connStr string) {
 		return
 	}
 
-	hm.hub.AddBridge(bridge.NewBridgeServiceClient(conn))
+	hm.hub.AddBridgeConn(conn)
 	hm.conns[id] = conn
 }
 
@@ -94,117 +100,8 @@ func (hm *HubMonitor) GoingAway(id string) {
 		return
 	}
 
-	hm.hub.RemoveBridge(id)
+	hm.hub.RemoveBridge(strings.TrimPrefix(id, "uuid:"))
 
 	conn.Close()
 	delete(hm.conns, id)
 }
-
-// The methods below allow the monitor to act as a virtual bridge for all the connected bridges.
-
-// GetBridge retrieves the bridge info of this service.
-func (hm *HubMonitor) GetBridge(ctx context.Context, req *bridge.GetBridgeRequest) (*bridge.Bridge, error) {
-	ret := proto.Clone(hm.brInfo).(*bridge.Bridge)
-
-	devices, err := hm.hub.ListDevices()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, device := range devices {
-		ret.Devices = append(ret.Devices, device)
-	}
-
-	return ret, nil
-}
-
-// ListDevices retrieves all registered devices.
-func (hm *HubMonitor) ListDevices(ctx context.Context, req *bridge.ListDevicesRequest) (*bridge.ListDevicesResponse, error) {
-	resp := &bridge.ListDevicesResponse{}
-
-	devices, err := hm.hub.ListDevices()
-	if err != nil {
-		return nil, err
-	}
-	for _, device := range devices {
-		resp.Devices = append(resp.Devices, device)
-	}
-
-	return resp, nil
-}
-
-// GetDevice retrieves the specified device.
-func (hm *HubMonitor) GetDevice(ctx context.Context, req *bridge.GetDeviceRequest) (*bridge.Device, error) {
-	return hm.hub.GetDevice(req.Id)
-}
-
-// UpdateDeviceConfig exists to satisfy the domotics Bridge contract, but is not actually supported.
-func (hm *HubMonitor) UpdateDeviceConfig(ctx context.Context, req *bridge.UpdateDeviceConfigRequest) (*bridge.Device, error) {
-	return hm.hub.UpdateDeviceConfig(ctx, req.Id, req.Config)
-}
-
-// UpdateDeviceState updates the specified device with the provided state.
-func (hm *HubMonitor) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDeviceStateRequest) (*bridge.Device, error) {
-	return hm.hub.UpdateDeviceState(ctx, req.Id, req.State)
-}
-
-// StreamBridgeUpdates monitors changes for all changes which occur on the
-// This will only pick up successful device writes.
-func (hm *HubMonitor) StreamBridgeUpdates(req *bridge.StreamBridgeUpdatesRequest, stream bridge.BridgeService_StreamBridgeUpdatesServer) error {
-	peer, isOk := peer.FromContext(stream.Context())
-
-	addr := "unknown"
-	if isOk {
-		addr = peer.Addr.String()
-	}
-
-	logger := hm.logger.With(zap.String("peer_addr", addr))
-
-	logger.Debug("bridge update stream initiated")
-
-	// Send all of the devices to start.
-	devices, err := hm.hub.ListDevices()
-	if err != nil {
-		hm.logger.Error("unable to get devices during stream initialization",
-			zap.Error(err),
-		)
-		return err
-	}
-
-	for _, device := range devices {
-		update := &bridge.Update{
-			Action: bridge.Update_ADDED,
-			Update: &bridge.Update_DeviceUpdate{
-				DeviceUpdate: &bridge.DeviceUpdate{
-					Device:   device,
-					DeviceId: device.Id,
-					BridgeId: hm.brInfo.Id,
-				},
-			},
-		}
-
-		if err := stream.Send(update); err != nil {
-			logger.Error("unable to send update",
-				zap.Error(err),
-			)
-			return err
-		}
-	}
-
-	updates := hm.hub.Updates()
-	// Now we wait for updates
-	for {
-		update, ok := <-updates
-		if !ok {
-			logger.Debug("stream closed")
-			// Channel has been closed; so we'll close the connection as well
-			return nil
-		}
-
-		logger.Debug("sending update")
-
-		if err := stream.Send(update); err != nil {
-			return err
-		}
-	}
-}
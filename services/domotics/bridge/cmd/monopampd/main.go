@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 
+	_ "github.com/mattn/go-sqlite3" // Blank import for sql drivers is "standard"
 	mpa "github.com/rmrobinson/monoprice-amp-go"
 	"github.com/rmrobinson/nerves/services/domotics/bridge"
 	"github.com/spf13/viper"
@@ -26,6 +27,7 @@ func main() {
 	viper.SetEnvPrefix("NVS")
 	viper.BindEnv(idEnvVar)
 	viper.BindEnv(monopAmpUSBPathEnvVar)
+	viper.BindEnv(bridge.ConfigDBPathEnvVar)
 
 	monopAmpUSBPath := viper.GetString(monopAmpUSBPathEnvVar)
 	if len(monopAmpUSBPath) < 1 {
@@ -82,6 +84,17 @@ func main() {
 
 	sbs := bridge.NewSyncBridgeService(logger, brInfo, devices, br)
 
+	if dbPath := viper.GetString(bridge.ConfigDBPathEnvVar); len(dbPath) > 0 {
+		db, err := bridge.RestoreDeviceConfigsFromDB(context.Background(), logger, sbs, dbPath)
+		if err != nil {
+			logger.Fatal("unable to restore device configs",
+				zap.String("path", dbPath),
+				zap.Error(err),
+			)
+		}
+		defer db.Close()
+	}
+
 	ad := bridge.NewAdvertiser(logger, viper.GetString(idEnvVar), lis.Addr().String())
 	go ad.Run()
 	defer ad.Shutdown()
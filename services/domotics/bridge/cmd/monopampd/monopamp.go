@@ -42,14 +42,34 @@ var (
 		ModelName:        "Zone",
 		ModelDescription: "Monoprice Amp Zone",
 		Manufacturer:     "Monoprice",
-		Input: &bridge.Device_Input{
-			Inputs: []string{
-				channelPrefix + "1",
-				channelPrefix + "2",
-				channelPrefix + "3",
-				channelPrefix + "4",
-				channelPrefix + "5",
-				channelPrefix + "6",
+		Traits: []*bridge.Trait{
+			{
+				Type:       bridge.Trait_BINARY,
+				IsWritable: true,
+			},
+			{
+				Type:       bridge.Trait_INPUT,
+				IsWritable: true,
+				Options: []string{
+					channelPrefix + "1",
+					channelPrefix + "2",
+					channelPrefix + "3",
+					channelPrefix + "4",
+					channelPrefix + "5",
+					channelPrefix + "6",
+				},
+			},
+			{
+				// Volumes are normalized from the amp's range to a percentage.
+				Type:       bridge.Trait_AUDIO,
+				IsWritable: true,
+				Minimum:    0,
+				Maximum:    100,
+				Unit:       "percent",
+			},
+			{
+				Type:       bridge.Trait_STEREO_AUDIO,
+				IsWritable: true,
 			},
 		},
 	}
@@ -198,7 +218,6 @@ func (b *MonopAmp) deviceFromAmp(device *bridge.Device) error {
 		Balance: balanceToProto(zone.State().Balance),
 	}
 
-	proto.Merge(device, baseMonopAmpDevice)
 	return nil
 }
 
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/rmrobinson/nerves/services/domotics/bridge/mqtt"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const (
+	idEnvVar         = "ID"
+	brokerURLEnvVar  = "MQTT_BROKER_URL"
+	usernameEnvVar   = "MQTT_USERNAME"
+	passwordEnvVar   = "MQTT_PASSWORD"
+	configPathEnvVar = "MQTT_CONFIG_PATH"
+)
+
+func main() {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+
+	viper.SetEnvPrefix("NVS")
+	viper.BindEnv(idEnvVar)
+	viper.BindEnv(brokerURLEnvVar)
+	viper.BindEnv(usernameEnvVar)
+	viper.BindEnv(passwordEnvVar)
+	viper.BindEnv(configPathEnvVar)
+
+	id := viper.GetString(idEnvVar)
+	if len(id) < 1 {
+		logger.Fatal("id missing")
+	}
+	brokerURL := viper.GetString(brokerURLEnvVar)
+	if len(brokerURL) < 1 {
+		logger.Fatal("broker url missing")
+	}
+	configPath := viper.GetString(configPathEnvVar)
+	if len(configPath) < 1 {
+		logger.Fatal("config path missing")
+	}
+
+	cfg, err := mqtt.LoadConfig(configPath)
+	if err != nil {
+		logger.Fatal("error loading config",
+			zap.String("config_path", configPath),
+			zap.Error(err),
+		)
+	}
+
+	brInfo := &bridge.Bridge{
+		Id:           id,
+		ModelId:      "mqtt1",
+		ModelName:    "MQTT",
+		Manufacturer: "Faltung Systems",
+		Config: &bridge.BridgeConfig{
+			Address: &bridge.Address{
+				Ip: &bridge.Address_Ip{
+					Host: brokerURL,
+				},
+			},
+		},
+		State: &bridge.BridgeState{
+			IsPaired: true,
+		},
+	}
+
+	var br *mqtt.Bridge
+
+	opts := paho.NewClientOptions().
+		AddBroker(brokerURL).
+		SetClientID("nerves-" + id).
+		SetUsername(viper.GetString(usernameEnvVar)).
+		SetPassword(viper.GetString(passwordEnvVar)).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(func(paho.Client) {
+			logger.Info("connected to broker",
+				zap.String("broker_url", brokerURL),
+			)
+
+			// The subscriptions are lost with the session, so they are renewed on each connection.
+			// This runs on its own goroutine so it can wait on the subscriptions.
+			if err := br.Subscribe(); err != nil {
+				logger.Error("error subscribing",
+					zap.Error(err),
+				)
+			}
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logger.Info("connection to broker lost",
+				zap.String("broker_url", brokerURL),
+				zap.Error(err),
+			)
+		})
+	client := paho.NewClient(opts)
+
+	br, err = mqtt.NewBridge(logger, brInfo, client, cfg)
+	if err != nil {
+		logger.Fatal("error creating bridge",
+			zap.String("config_path", configPath),
+			zap.Error(err),
+		)
+	}
+
+	token := client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		logger.Fatal("error connecting to broker",
+			zap.String("broker_url", brokerURL),
+			zap.Error(err),
+		)
+	}
+	defer client.Disconnect(250)
+
+	lis, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		logger.Fatal("error initializing listener",
+			zap.Error(err),
+		)
+	}
+	defer lis.Close()
+	logger.Info("listening",
+		zap.String("local_addr", lis.Addr().String()),
+		zap.String("bridge_id", id),
+	)
+
+	ad := bridge.NewAdvertiser(logger, id, lis.Addr().String())
+	go ad.Run()
+	defer ad.Shutdown()
+
+	grpcServer := grpc.NewServer()
+	bridge.RegisterBridgeServiceServer(grpcServer, br)
+	bridge.RegisterPingServiceServer(grpcServer, ad)
+	grpcServer.Serve(lis)
+}
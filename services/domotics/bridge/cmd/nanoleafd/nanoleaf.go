@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	"github.com/rmrobinson/nanoleaf-go"
 	"github.com/rmrobinson/nerves/lib/stream"
@@ -19,6 +20,10 @@ type Nanoleaf struct {
 	c  *nanoleaf.Client
 
 	updates *stream.Source
+
+	// revisions versions the panel, and writeLock serializes writes so the version can't change between checking and writing.
+	revisions *bridge.RevisionTracker
+	writeLock sync.Mutex
 }
 
 // NewNanoleaf creates a new instance of a Nanoleaf bridge
@@ -28,9 +33,18 @@ func NewNanoleaf(logger *zap.Logger, id string, c *nanoleaf.Client) *Nanoleaf {
 		id:      id,
 		c:       c,
 		updates: stream.NewSource(logger),
+
+		revisions: bridge.NewRevisionTracker(),
 	}
 }
 
+// toDevice converts the panel to a device, setting its version.
+func (n *Nanoleaf) toDevice(p *nanoleaf.LightPanel) *bridge.Device {
+	device := panelToDevice(p)
+	n.revisions.Stamp(device)
+	return device
+}
+
 func panelToDevice(p *nanoleaf.LightPanel) *bridge.Device {
 	return &bridge.Device{
 		Id:           fmt.Sprintf("%s", p.SerialNumber),
@@ -38,13 +52,29 @@ func panelToDevice(p *nanoleaf.LightPanel) *bridge.Device {
 		IsActive:     true,
 		ModelId:      p.ModelNumber,
 		Manufacturer: p.Manufacturer,
-		Range: &bridge.Device_Range{
-			Minimum: int32(p.State.Brightness.Min),
-			Maximum: int32(p.State.Brightness.Max),
-		},
-		ColorTemperature: &bridge.Device_ColorTemperature{
-			Minimum: int32(p.State.CT.Min),
-			Maximum: int32(p.State.CT.Max),
+		Traits: []*bridge.Trait{
+			{
+				Type:       bridge.Trait_BINARY,
+				IsWritable: true,
+			},
+			{
+				Type:       bridge.Trait_RANGE,
+				IsWritable: true,
+				Minimum:    int32(p.State.Brightness.Min),
+				Maximum:    int32(p.State.Brightness.Max),
+				Unit:       "percent",
+			},
+			{
+				Type:       bridge.Trait_COLOR_HSB,
+				IsWritable: true,
+			},
+			{
+				Type:       bridge.Trait_COLOR_TEMPERATURE,
+				IsWritable: true,
+				Minimum:    int32(p.State.CT.Min),
+				Maximum:    int32(p.State.CT.Max),
+				Unit:       "kelvin",
+			},
 		},
 		Config: &bridge.DeviceConfig{
 			Name: p.Name,
@@ -62,6 +92,7 @@ func panelToDevice(p *nanoleaf.LightPanel) *bridge.Device {
 				Brightness: int32(p.State.Brightness.Value),
 				Saturation: int32(p.State.Saturation.Value),
 			},
+			ColorTemperature: int32(p.State.CT.Value),
 			Version: &bridge.Version{
 				Sw: p.FirmwareVersion,
 			},
@@ -91,7 +122,7 @@ func (n *Nanoleaf) GetBridge(ctx context.Context, req *bridge.GetBridgeRequest)
 			},
 		},
 		Devices: []*bridge.Device{
-			panelToDevice(panel),
+			n.toDevice(panel),
 		},
 	}
 
@@ -109,7 +140,7 @@ func (n *Nanoleaf) ListDevices(ctx context.Context, req *bridge.ListDevicesReque
 	}
 	resp := &bridge.ListDevicesResponse{
 		Devices: []*bridge.Device{
-			panelToDevice(panel),
+			n.toDevice(panel),
 		},
 	}
 
@@ -126,7 +157,7 @@ func (n *Nanoleaf) GetDevice(ctx context.Context, req *bridge.GetDeviceRequest)
 		return nil, bridge.ErrInternal.Err()
 	}
 
-	device := panelToDevice(panel)
+	device := n.toDevice(panel)
 	if device.Id == req.Id {
 		return device, nil
 	}
@@ -143,10 +174,11 @@ func (n *Nanoleaf) UpdateDeviceConfig(ctx context.Context, req *bridge.UpdateDev
 func (n *Nanoleaf) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDeviceStateRequest) (*bridge.Device, error) {
 	if len(req.Id) < 1 || req.State == nil {
 		return nil, bridge.ErrMissingParam.Err()
-	} else if req.State.IsReachable == false {
-		return nil, bridge.ErrNotSupported.Err()
 	}
 
+	n.writeLock.Lock()
+	defer n.writeLock.Unlock()
+
 	panel, err := n.c.GetPanel(ctx)
 	if err != nil {
 		n.logger.Error("unable to retrieve panel",
@@ -155,54 +187,93 @@ func (n *Nanoleaf) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDevi
 		return nil, bridge.ErrInternal.Err()
 	}
 
-	device := panelToDevice(panel)
+	device := n.toDevice(panel)
 
 	if device.Id != req.Id {
 		return nil, bridge.ErrDeviceNotFound.Err()
 	}
 
-	if req.State.String() == device.State.String() {
+	if err := n.revisions.Check(device, req.Version); err != nil {
+		n.logger.Debug("stale write, rejecting",
+			zap.String("device_id", req.Id),
+			zap.String("version", req.Version),
+			zap.String("current_version", device.Version),
+		)
+		return nil, err
+	}
+
+	state, err := bridge.ApplyStateMask(device.State, req.State, req.UpdateMask)
+	if err != nil {
+		return nil, err
+	} else if err := bridge.ValidateState(device, state); err != nil {
+		return nil, err
+	} else if state.IsReachable == false {
+		return nil, bridge.ErrNotSupported.Err()
+	}
+
+	if state.String() == device.State.String() {
 		n.logger.Debug("noop write, ignoring",
 			zap.String("device_id", req.Id),
 		)
 		return device, nil
 	}
 
-	if req.State.Binary != nil && req.State.Binary.IsOn != panel.State.On.Value {
-		err = n.c.SetOn(ctx, req.State.Binary.IsOn)
+	if state.Binary != nil && state.Binary.IsOn != panel.State.On.Value {
+		err = n.c.SetOn(ctx, state.Binary.IsOn)
 		if err != nil {
 			n.logger.Error("unable to set nanoleaf binary state",
-				zap.Bool("is_on", req.State.Binary.IsOn),
+				zap.Bool("is_on", state.Binary.IsOn),
 				zap.Error(err),
 			)
 			return nil, bridge.ErrInternal.Err()
 		}
 	}
-	if req.State.ColorHsb != nil && req.State.ColorHsb.Brightness != int32(panel.State.Brightness.Value) {
-		err = n.c.SetBrightness(ctx, int(req.State.ColorHsb.Brightness), 0)
+	if state.ColorHsb != nil && state.ColorHsb.Brightness != int32(panel.State.Brightness.Value) {
+		err = n.c.SetBrightness(ctx, int(state.ColorHsb.Brightness), 0)
 		if err != nil {
 			n.logger.Error("unable to set nanoleaf brightness state",
-				zap.Int32("brightness", req.State.ColorHsb.Brightness),
+				zap.Int32("brightness", state.ColorHsb.Brightness),
 				zap.Error(err),
 			)
 			return nil, bridge.ErrInternal.Err()
 		}
 	}
-	if req.State.ColorHsb != nil && req.State.ColorHsb.Hue != int32(panel.State.Hue.Value) {
-		err = n.c.SetHue(ctx, int(req.State.ColorHsb.Hue))
+	if state.ColorHsb != nil && state.ColorHsb.Hue != int32(panel.State.Hue.Value) {
+		err = n.c.SetHue(ctx, int(state.ColorHsb.Hue))
 		if err != nil {
 			n.logger.Error("unable to set nanoleaf hue state",
-				zap.Int32("hue", req.State.ColorHsb.Hue),
+				zap.Int32("hue", state.ColorHsb.Hue),
 				zap.Error(err),
 			)
 			return nil, bridge.ErrInternal.Err()
 		}
 	}
-	if req.State.ColorHsb != nil && req.State.ColorHsb.Saturation != int32(panel.State.Saturation.Value) {
-		err = n.c.SetSaturation(ctx, int(req.State.ColorHsb.Saturation))
+	if state.ColorHsb != nil && state.ColorHsb.Saturation != int32(panel.State.Saturation.Value) {
+		err = n.c.SetSaturation(ctx, int(state.ColorHsb.Saturation))
 		if err != nil {
 			n.logger.Error("unable to set nanoleaf saturation state",
-				zap.Int32("saturation", req.State.ColorHsb.Saturation),
+				zap.Int32("saturation", state.ColorHsb.Saturation),
+				zap.Error(err),
+			)
+			return nil, bridge.ErrInternal.Err()
+		}
+	}
+
+	if state.Range != nil && state.Range.Value != int32(panel.State.Brightness.Value) {
+		err = n.c.SetBrightness(ctx, int(state.Range.Value), 0)
+		if err != nil {
+			n.logger.Error("unable to set nanoleaf brightness state",
+				zap.Int32("brightness", state.Range.Value),
+				zap.Error(err),
+			)
+			return nil, bridge.ErrInternal.Err()
+		}
+	}
+	if state.ColorTemperature != 0 && state.ColorTemperature != int32(panel.State.CT.Value) {
+		err = n.c.SetCT(ctx, int(state.ColorTemperature))
+		if err != nil {
+			n.logger.Error("unable to set nanoleaf color temperature state",
+				zap.Int32("color_temperature", state.ColorTemperature),
 				zap.Error(err),
 			)
 			return nil, bridge.ErrInternal.Err()
@@ -218,7 +289,7 @@ func (n *Nanoleaf) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDevi
 		return nil, bridge.ErrInternal.Err()
 	}
 
-	device = panelToDevice(panel)
+	device = n.toDevice(panel)
 
 	n.updates.SendMessage(&bridge.Update{
 		Action: bridge.Update_CHANGED,
@@ -233,6 +304,11 @@ func (n *Nanoleaf) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDevi
 	return device, nil
 }
 
+// BatchUpdateDeviceStates updates the state of each of the specified devices.
+func (n *Nanoleaf) BatchUpdateDeviceStates(ctx context.Context, req *bridge.BatchUpdateDeviceStatesRequest) (*bridge.BatchUpdateDeviceStatesResponse, error) {
+	return bridge.BatchUpdate(ctx, req, n.UpdateDeviceState)
+}
+
 // StreamBridgeUpdates monitors changes for all changes which occur on the bridge.
 func (n *Nanoleaf) StreamBridgeUpdates(req *bridge.StreamBridgeUpdatesRequest, stream bridge.BridgeService_StreamBridgeUpdatesServer) error {
 	peer, isOk := peer.FromContext(stream.Context())
@@ -246,63 +322,27 @@ func (n *Nanoleaf) StreamBridgeUpdates(req *bridge.StreamBridgeUpdatesRequest, s
 
 	logger.Debug("bridge update stream initiated")
 
-	sink := n.updates.NewSink()
-	defer sink.Close()
-
-	// Send the device info to start.
-
-	panel, err := n.c.GetPanel(stream.Context())
-	if err != nil {
-		n.logger.Error("unable to retrieve panel",
-			zap.Error(err),
-		)
-		return bridge.ErrInternal.Err()
-	}
-
-	device := panelToDevice(panel)
-	update := &bridge.Update{
-		Action: bridge.Update_ADDED,
-		Update: &bridge.Update_DeviceUpdate{
-			DeviceUpdate: &bridge.DeviceUpdate{
-				Device:   device,
-				DeviceId: device.Id,
-				BridgeId: n.id,
-			},
-		},
-	}
-
-	logger.Debug("sending seed info",
-		zap.String("device_info", update.String()),
-	)
-
-	if err := stream.Send(update); err != nil {
-		logger.Error("unable to send update",
-			zap.Error(err),
-		)
-		return err
-	}
-
-	// Now we wait for updates
-	for {
-		update, ok := <-sink.Messages()
-		if !ok {
-			logger.Debug("stream closed")
-			// Channel has been closed; so we'll close the connection as well
-			return nil
-		}
-
-		bridgeUpdate, ok := update.(*bridge.Update)
-
-		if !ok {
-			panic("update cast incorrect")
+	return bridge.ServeUpdates(logger, n.updates, req, stream, func(ctx context.Context) ([]*bridge.Update, error) {
+		panel, err := n.c.GetPanel(ctx)
+		if err != nil {
+			logger.Error("unable to retrieve panel",
+				zap.Error(err),
+			)
+			return nil, bridge.ErrInternal.Err()
 		}
 
-		logger.Debug("sending update",
-			zap.String("info", bridgeUpdate.String()),
-		)
-
-		if err := stream.Send(bridgeUpdate); err != nil {
-			return err
-		}
-	}
+		device := n.toDevice(panel)
+		return []*bridge.Update{
+			{
+				Action: bridge.Update_ADDED,
+				Update: &bridge.Update_DeviceUpdate{
+					DeviceUpdate: &bridge.DeviceUpdate{
+						Device:   device,
+						DeviceId: device.Id,
+						BridgeId: n.id,
+					},
+				},
+			},
+		}, nil
+	})
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // Blank import for sql drivers is "standard"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/rmrobinson/nerves/services/domotics/bridge/rest"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const (
+	idEnvVar         = "ID"
+	configPathEnvVar = "REST_CONFIG_PATH"
+	timeoutEnvVar    = "REST_TIMEOUT"
+)
+
+func main() {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+
+	viper.SetEnvPrefix("NVS")
+	viper.BindEnv(idEnvVar)
+	viper.BindEnv(configPathEnvVar)
+	viper.BindEnv(timeoutEnvVar)
+	viper.BindEnv(bridge.ConfigDBPathEnvVar)
+	viper.SetDefault(timeoutEnvVar, 10*time.Second)
+
+	id := viper.GetString(idEnvVar)
+	if len(id) < 1 {
+		logger.Fatal("id missing")
+	}
+	configPath := viper.GetString(configPathEnvVar)
+	if len(configPath) < 1 {
+		logger.Fatal("config path missing")
+	}
+
+	cfg, err := rest.LoadConfig(configPath)
+	if err != nil {
+		logger.Fatal("error loading config",
+			zap.String("config_path", configPath),
+			zap.Error(err),
+		)
+	}
+
+	client := &http.Client{
+		Timeout: viper.GetDuration(timeoutEnvVar),
+	}
+	br, err := rest.NewBridge(logger, client, cfg)
+	if err != nil {
+		logger.Fatal("error creating bridge",
+			zap.String("config_path", configPath),
+			zap.Error(err),
+		)
+	}
+
+	brInfo := &bridge.Bridge{
+		Id:           id,
+		ModelId:      "rest1",
+		ModelName:    "REST",
+		Manufacturer: "Faltung Systems",
+	}
+
+	lis, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		logger.Fatal("error initializing listener",
+			zap.Error(err),
+		)
+	}
+	defer lis.Close()
+	logger.Info("listening",
+		zap.String("local_addr", lis.Addr().String()),
+		zap.String("bridge_id", id),
+	)
+
+	sbs := bridge.NewSyncBridgeService(logger, brInfo, br.Devices(), br)
+
+	if dbPath := viper.GetString(bridge.ConfigDBPathEnvVar); len(dbPath) > 0 {
+		db, err := bridge.RestoreDeviceConfigsFromDB(context.Background(), logger, sbs, dbPath)
+		if err != nil {
+			logger.Fatal("unable to restore device configs",
+				zap.String("path", dbPath),
+				zap.Error(err),
+			)
+		}
+		defer db.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go br.Run(ctx, sbs)
+
+	ad := bridge.NewAdvertiser(logger, id, lis.Addr().String())
+	go ad.Run()
+	defer ad.Shutdown()
+
+	grpcServer := grpc.NewServer()
+	bridge.RegisterBridgeServiceServer(grpcServer, sbs)
+	bridge.RegisterPingServiceServer(grpcServer, ad)
+	grpcServer.Serve(lis)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rmrobinson/nerves/lib/yamlpb"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// ErrInvalidFixture is returned if the fixture doesn't describe a usable bridge.
+	ErrInvalidFixture = errors.New("invalid fixture")
+)
+
+// Fixture describes the simulated bridge and its devices.
+// Fixtures are written in YAML; as YAML is a superset of JSON they may also be written in JSON.
+type Fixture struct {
+	// Bridge is the bridge in the protobuf JSON format.
+	Bridge map[string]interface{} `yaml:"bridge"`
+	// Devices are the devices of the bridge, each of which may have scripted behaviours.
+	Devices []DeviceFixture `yaml:"devices"`
+}
+
+// DeviceFixture describes a simulated device.
+type DeviceFixture struct {
+	// Device is the device in the protobuf JSON format.
+	Device     map[string]interface{} `yaml:"device"`
+	Behaviours []Behaviour            `yaml:"behaviours"`
+}
+
+// Behaviour scripts the device to change by itself. Only one of the fields should be set.
+type Behaviour struct {
+	Drift        *Drift        `yaml:"drift"`
+	Button       *Button       `yaml:"button"`
+	Unreachable  *Unreachable  `yaml:"unreachable"`
+	WriteFailure *WriteFailure `yaml:"write_failure"`
+}
+
+// Drift randomly walks a numeric state field, such as a sensor reading, between the minimum and maximum.
+type Drift struct {
+	// Field is the path to the field in the device state, e.g. "temperature.degrees_celsius".
+	Field    string        `yaml:"field"`
+	Minimum  float64       `yaml:"min"`
+	Maximum  float64       `yaml:"max"`
+	Step     float64       `yaml:"step"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Button presses and releases the specified button on a schedule.
+type Button struct {
+	ID       int32         `yaml:"id"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Unreachable makes the device unreachable for the duration at every interval.
+type Unreachable struct {
+	Interval time.Duration `yaml:"interval"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+// WriteFailure fails writes to the device with the given probability, between 0 and 1.
+type WriteFailure struct {
+	Probability float64 `yaml:"probability"`
+}
+
+// LoadFixture reads the fixture at the specified path.
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Fixture{}
+	if err := yaml.Unmarshal(data, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// BridgeInfo converts the fixture's bridge into its protobuf form.
+func (f *Fixture) BridgeInfo() (*bridge.Bridge, error) {
+	br := &bridge.Bridge{}
+	if err := yamlpb.UnmarshalValue(f.Bridge, br); err != nil {
+		return nil, err
+	} else if len(br.Id) < 1 {
+		return nil, fmt.Errorf("%w: bridge id missing", ErrInvalidFixture)
+	}
+	return br, nil
+}
+
+// ToDevice converts the fixture's device into its protobuf form and checks its behaviours can be applied to it.
+func (df *DeviceFixture) ToDevice() (*bridge.Device, error) {
+	d := &bridge.Device{}
+	if err := yamlpb.UnmarshalValue(df.Device, d); err != nil {
+		return nil, err
+	} else if len(d.Id) < 1 {
+		return nil, fmt.Errorf("%w: device id missing", ErrInvalidFixture)
+	}
+	if d.State == nil {
+		d.State = &bridge.DeviceState{}
+	}
+	if d.Config == nil {
+		d.Config = &bridge.DeviceConfig{}
+	}
+
+	for _, b := range df.Behaviours {
+		switch {
+		case b.Drift != nil:
+			if _, _, err := numericField(proto.Clone(d.State).(*bridge.DeviceState), b.Drift.Field); err != nil {
+				return nil, fmt.Errorf("%w: device %s: %s", ErrInvalidFixture, d.Id, err.Error())
+			} else if b.Drift.Interval <= 0 || b.Drift.Maximum < b.Drift.Minimum {
+				return nil, fmt.Errorf("%w: device %s: drift of %s needs an interval and bounds", ErrInvalidFixture, d.Id, b.Drift.Field)
+			}
+		case b.Button != nil:
+			if b.Button.Interval <= 0 {
+				return nil, fmt.Errorf("%w: device %s: button needs an interval", ErrInvalidFixture, d.Id)
+			}
+		case b.Unreachable != nil:
+			if b.Unreachable.Interval <= 0 || b.Unreachable.Duration <= 0 || b.Unreachable.Duration >= b.Unreachable.Interval {
+				return nil, fmt.Errorf("%w: device %s: unreachable needs a duration shorter than its interval", ErrInvalidFixture, d.Id)
+			}
+		case b.WriteFailure != nil:
+			if b.WriteFailure.Probability < 0 || b.WriteFailure.Probability > 1 {
+				return nil, fmt.Errorf("%w: device %s: write failure probability must be between 0 and 1", ErrInvalidFixture, d.Id)
+			}
+		default:
+			return nil, fmt.Errorf("%w: device %s: empty behaviour", ErrInvalidFixture, d.Id)
+		}
+	}
+
+	return d, nil
+}
+
+// numericField finds the field at the supplied path in the state, creating any messages along the way.
+func numericField(state *bridge.DeviceState, path string) (protoreflect.Message, protoreflect.FieldDescriptor, error) {
+	msg := proto.MessageReflect(state)
+	parts := strings.Split(path, ".")
+
+	for i, part := range parts {
+		fd := msg.Descriptor().Fields().ByName(protoreflect.Name(part))
+		if fd == nil || fd.IsList() || fd.IsMap() {
+			return nil, nil, fmt.Errorf("unknown field %s", path)
+		}
+
+		if i < len(parts)-1 {
+			if fd.Kind() != protoreflect.MessageKind {
+				return nil, nil, fmt.Errorf("unknown field %s", path)
+			}
+			msg = msg.Mutable(fd).Message()
+			continue
+		}
+
+		switch fd.Kind() {
+		case protoreflect.DoubleKind, protoreflect.FloatKind, protoreflect.Int32Kind, protoreflect.Int64Kind:
+			return msg, fd, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("field %s isn't numeric", path)
+}
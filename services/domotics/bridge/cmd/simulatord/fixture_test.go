@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func sensorFixture(behaviours ...Behaviour) *DeviceFixture {
+	return &DeviceFixture{
+		Device: map[string]interface{}{
+			"id":   "sensor",
+			"type": "SENSOR",
+			"state": map[interface{}]interface{}{
+				"temperature": map[interface{}]interface{}{"celsius": 21},
+			},
+		},
+		Behaviours: behaviours,
+	}
+}
+
+func TestDeviceFixtureToDevice(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture *DeviceFixture
+		valid   bool
+	}{
+		{
+			"without behaviours",
+			sensorFixture(),
+			true,
+		},
+		{
+			"missing id",
+			&DeviceFixture{Device: map[string]interface{}{"type": "SENSOR"}},
+			false,
+		},
+		{
+			"unknown device field",
+			&DeviceFixture{Device: map[string]interface{}{"id": "sensor", "colour": "blue"}},
+			false,
+		},
+		{
+			"drift",
+			sensorFixture(Behaviour{Drift: &Drift{Field: "temperature.degrees_celsius", Minimum: 18, Maximum: 24, Step: 1, Interval: time.Second}}),
+			true,
+		},
+		{
+			"drift of an unset message",
+			sensorFixture(Behaviour{Drift: &Drift{Field: "humidity.relative_percent", Minimum: 30, Maximum: 60, Step: 1, Interval: time.Second}}),
+			true,
+		},
+		{
+			"drift of an unknown field",
+			sensorFixture(Behaviour{Drift: &Drift{Field: "temperature.fahrenheit", Minimum: 18, Maximum: 24, Step: 1, Interval: time.Second}}),
+			false,
+		},
+		{
+			"drift without an interval",
+			sensorFixture(Behaviour{Drift: &Drift{Field: "temperature.celsius", Minimum: 18, Maximum: 24, Step: 1}}),
+			false,
+		},
+		{
+			"drift with inverted bounds",
+			sensorFixture(Behaviour{Drift: &Drift{Field: "temperature.celsius", Minimum: 24, Maximum: 18, Step: 1, Interval: time.Second}}),
+			false,
+		},
+		{
+			"button without an interval",
+			sensorFixture(Behaviour{Button: &Button{ID: 1}}),
+			false,
+		},
+		{
+			"unreachable longer than its interval",
+			sensorFixture(Behaviour{Unreachable: &Unreachable{Interval: time.Minute, Duration: 2 * time.Minute}}),
+			false,
+		},
+		{
+			"write failure probability out of range",
+			sensorFixture(Behaviour{WriteFailure: &WriteFailure{Probability: 1.5}}),
+			false,
+		},
+		{
+			"empty behaviour",
+			sensorFixture(Behaviour{}),
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := tt.fixture.ToDevice()
+			if !tt.valid {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "sensor", d.Id)
+			assert.NotNil(t, d.State)
+			assert.NotNil(t, d.Config)
+		})
+	}
+
+	_, err := sensorFixture(Behaviour{}).ToDevice()
+	assert.True(t, errors.Is(err, ErrInvalidFixture))
+}
+
+func TestNumericField(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		kind  protoreflect.Kind
+		valid bool
+	}{
+		{"double", "temperature.degrees_celsius", protoreflect.DoubleKind, true},
+		{"int32", "temperature.celsius", protoreflect.Int32Kind, true},
+		{"nested in an unset message", "power.watts", protoreflect.DoubleKind, true},
+		{"bool", "binary.is_on", 0, false},
+		{"message", "temperature", 0, false},
+		{"list", "button.id", 0, false},
+		{"through a scalar", "color_temperature.value", 0, false},
+		{"unknown", "temperature.kelvin", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &bridge.DeviceState{}
+			msg, fd, err := numericField(state, tt.path)
+			if !tt.valid {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.kind, fd.Kind())
+
+			// The messages along the path are created in the state, so the field can be set.
+			msg.Set(fd, protoreflect.ValueOf(msg.Get(fd).Interface()))
+			top := state.ProtoReflect().Descriptor().Fields().ByName(protoreflect.Name(strings.Split(tt.path, ".")[0]))
+			assert.True(t, state.ProtoReflect().Has(top))
+		})
+	}
+}
+
+func TestLoadFixture(t *testing.T) {
+	f, err := LoadFixture("fixture.yaml")
+	require.NoError(t, err)
+
+	brInfo, err := f.BridgeInfo()
+	require.NoError(t, err)
+	assert.Equal(t, "simulator", brInfo.Id)
+
+	ids := map[string]bool{}
+	for _, df := range f.Devices {
+		d, err := df.ToDevice()
+		require.NoError(t, err)
+		ids[d.Id] = true
+	}
+	assert.Len(t, ids, len(f.Devices))
+	assert.Contains(t, ids, "sim-thermostat")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // Blank import for sql drivers is "standard"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const (
+	idEnvVar          = "ID"
+	fixturePathEnvVar = "FIXTURE_PATH"
+	seedEnvVar        = "SEED"
+)
+
+func main() {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+
+	viper.SetEnvPrefix("NVS")
+	viper.BindEnv(idEnvVar)
+	viper.BindEnv(fixturePathEnvVar)
+	viper.BindEnv(seedEnvVar)
+	viper.BindEnv(bridge.ConfigDBPathEnvVar)
+
+	fixturePath := viper.GetString(fixturePathEnvVar)
+	if len(fixturePath) < 1 {
+		logger.Fatal("fixture path missing")
+	}
+
+	fixture, err := LoadFixture(fixturePath)
+	if err != nil {
+		logger.Fatal("error loading fixture",
+			zap.String("fixture_path", fixturePath),
+			zap.Error(err),
+		)
+	}
+
+	// A fixed seed replays the same behaviours each run; otherwise each run differs.
+	seed := viper.GetInt64(seedEnvVar)
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	sim, err := NewSimulator(logger, fixture, seed)
+	if err != nil {
+		logger.Fatal("error creating simulator",
+			zap.String("fixture_path", fixturePath),
+			zap.Error(err),
+		)
+	}
+
+	brInfo := sim.getBridge()
+	// The ID may be overridden so several simulators can share a fixture.
+	if id := viper.GetString(idEnvVar); len(id) > 0 {
+		brInfo.Id = id
+	}
+
+	lis, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		logger.Fatal("error initializing listener",
+			zap.Error(err),
+		)
+	}
+	defer lis.Close()
+	logger.Info("listening",
+		zap.String("local_addr", lis.Addr().String()),
+		zap.String("bridge_id", brInfo.Id),
+		zap.Int64("seed", seed),
+	)
+
+	sbs := bridge.NewSyncBridgeService(logger, brInfo, sim.getDevices(), sim)
+
+	if dbPath := viper.GetString(bridge.ConfigDBPathEnvVar); len(dbPath) > 0 {
+		db, err := bridge.RestoreDeviceConfigsFromDB(context.Background(), logger, sbs, dbPath)
+		if err != nil {
+			logger.Fatal("unable to restore device configs",
+				zap.String("path", dbPath),
+				zap.Error(err),
+			)
+		}
+		defer db.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sim.Run(ctx, sbs)
+
+	ad := bridge.NewAdvertiser(logger, brInfo.Id, lis.Addr().String())
+	go ad.Run()
+	defer ad.Shutdown()
+
+	grpcServer := grpc.NewServer()
+	bridge.RegisterBridgeServiceServer(grpcServer, sbs)
+	bridge.RegisterPingServiceServer(grpcServer, ad)
+	grpcServer.Serve(lis)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const buttonPressDuration = 500 * time.Millisecond
+
+var (
+	// ErrSimulatedFailure is returned if a write is scripted to fail.
+	ErrSimulatedFailure = errors.New("simulated write failure")
+)
+
+// Reporter records the changes the simulated devices make by themselves.
+// It is satisfied by the bridge.SyncBridgeService.
+type Reporter interface {
+	ReportDeviceChange(id string, change func(*bridge.DeviceState)) (*bridge.Device, error)
+}
+
+// Simulator is a bridge whose devices are described by a fixture, and which change by themselves as scripted.
+type Simulator struct {
+	logger *zap.Logger
+
+	brInfo     *bridge.Bridge
+	devices    map[string]*bridge.Device
+	behaviours map[string][]Behaviour
+
+	rand     *rand.Rand
+	randLock sync.Mutex
+}
+
+// NewSimulator creates a simulated bridge from the supplied fixture, using the seed for its random behaviours.
+func NewSimulator(logger *zap.Logger, f *Fixture, seed int64) (*Simulator, error) {
+	brInfo, err := f.BridgeInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Simulator{
+		logger:     logger,
+		brInfo:     brInfo,
+		devices:    map[string]*bridge.Device{},
+		behaviours: map[string][]Behaviour{},
+		rand:       rand.New(rand.NewSource(seed)),
+	}
+
+	for _, df := range f.Devices {
+		d, err := df.ToDevice()
+		if err != nil {
+			return nil, err
+		} else if _, ok := s.devices[d.Id]; ok {
+			return nil, fmt.Errorf("%w: duplicate device %s", ErrInvalidFixture, d.Id)
+		}
+
+		s.devices[d.Id] = d
+		s.behaviours[d.Id] = df.Behaviours
+	}
+
+	return s, nil
+}
+
+func (s *Simulator) getBridge() *bridge.Bridge {
+	return proto.Clone(s.brInfo).(*bridge.Bridge)
+}
+
+func (s *Simulator) getDevices() map[string]*bridge.Device {
+	devices := map[string]*bridge.Device{}
+	for id, d := range s.devices {
+		devices[id] = proto.Clone(d).(*bridge.Device)
+	}
+	return devices
+}
+
+// SetDeviceState logs the change, failing it if the device is scripted to fail writes.
+func (s *Simulator) SetDeviceState(ctx context.Context, dev *bridge.Device, state *bridge.DeviceState) error {
+	for _, b := range s.behaviours[dev.Id] {
+		if b.WriteFailure != nil && s.random() < b.WriteFailure.Probability {
+			s.logger.Info("failing write",
+				zap.String("device_id", dev.Id),
+			)
+			return ErrSimulatedFailure
+		}
+	}
+
+	s.logger.Info("setting device state",
+		zap.String("device_id", dev.Id),
+		zap.String("state", state.String()),
+	)
+	return nil
+}
+
+// Run plays the scripted behaviours of each device until the context is cancelled.
+func (s *Simulator) Run(ctx context.Context, r Reporter) {
+	var wg sync.WaitGroup
+
+	for id, behaviours := range s.behaviours {
+		for _, b := range behaviours {
+			if b.WriteFailure != nil {
+				// Write failures are applied as writes arrive rather than on a schedule.
+				continue
+			}
+
+			wg.Add(1)
+			go func(id string, b Behaviour) {
+				defer wg.Done()
+
+				switch {
+				case b.Drift != nil:
+					s.drift(ctx, r, id, b.Drift)
+				case b.Button != nil:
+					s.pressButton(ctx, r, id, b.Button)
+				case b.Unreachable != nil:
+					s.disconnect(ctx, r, id, b.Unreachable)
+				}
+			}(id, b)
+		}
+	}
+
+	wg.Wait()
+}
+
+func (s *Simulator) random() float64 {
+	s.randLock.Lock()
+	defer s.randLock.Unlock()
+
+	return s.rand.Float64()
+}
+
+// report applies the change to the current state of the device. The reporter applies it so that it can't revert
+// a write made between reading the state and reporting the change.
+func (s *Simulator) report(r Reporter, id string, change func(*bridge.DeviceState)) {
+	if _, err := r.ReportDeviceChange(id, change); err != nil {
+		s.logger.Info("unable to report device state",
+			zap.String("device_id", id),
+			zap.Error(err),
+		)
+	}
+}
+
+// every invokes the supplied function at each interval until the context is cancelled.
+func every(ctx context.Context, interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f()
+		}
+	}
+}
+
+func (s *Simulator) drift(ctx context.Context, r Reporter, id string, d *Drift) {
+	every(ctx, d.Interval, func() {
+		s.report(r, id, func(state *bridge.DeviceState) {
+			driftStep(state, d, s.random())
+		})
+	})
+}
+
+// driftStep moves the drifting field of the state by up to a step, keeping it within its bounds.
+// The random value, between 0 and 1, picks how far and in which direction the field moves.
+func driftStep(state *bridge.DeviceState, d *Drift, random float64) {
+	msg, fd, err := numericField(state, d.Field)
+	if err != nil {
+		return
+	}
+
+	var value float64
+	switch fd.Kind() {
+	case protoreflect.DoubleKind, protoreflect.FloatKind:
+		value = msg.Get(fd).Float()
+	default:
+		value = float64(msg.Get(fd).Int())
+	}
+
+	value = math.Max(d.Minimum, math.Min(d.Maximum, value+(random*2-1)*d.Step))
+
+	switch fd.Kind() {
+	case protoreflect.DoubleKind:
+		msg.Set(fd, protoreflect.ValueOfFloat64(value))
+	case protoreflect.FloatKind:
+		msg.Set(fd, protoreflect.ValueOfFloat32(float32(value)))
+	case protoreflect.Int32Kind:
+		msg.Set(fd, protoreflect.ValueOfInt32(int32(math.Round(value))))
+	case protoreflect.Int64Kind:
+		msg.Set(fd, protoreflect.ValueOfInt64(int64(math.Round(value))))
+	}
+	state.ReportedAt = ptypes.TimestampNow()
+}
+
+func (s *Simulator) pressButton(ctx context.Context, r Reporter, id string, b *Button) {
+	setButton := func(isOn bool) func(*bridge.DeviceState) {
+		return func(state *bridge.DeviceState) {
+			state.Button = []*bridge.DeviceState_Button{
+				{
+					Id:   b.ID,
+					IsOn: isOn,
+				},
+			}
+			state.ReportedAt = ptypes.TimestampNow()
+		}
+	}
+
+	every(ctx, b.Interval, func() {
+		s.report(r, id, setButton(true))
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(buttonPressDuration):
+		}
+		s.report(r, id, setButton(false))
+	})
+}
+
+func (s *Simulator) disconnect(ctx context.Context, r Reporter, id string, u *Unreachable) {
+	setReachable := func(isReachable bool) func(*bridge.DeviceState) {
+		return func(state *bridge.DeviceState) {
+			state.IsReachable = isReachable
+		}
+	}
+
+	every(ctx, u.Interval, func() {
+		s.logger.Info("device unreachable",
+			zap.String("device_id", id),
+			zap.Duration("duration", u.Duration),
+		)
+		s.report(r, id, setReachable(false))
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(u.Duration):
+		}
+		s.report(r, id, setReachable(true))
+	})
+}
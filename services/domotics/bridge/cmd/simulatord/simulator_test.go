@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestDriftStep(t *testing.T) {
+	tests := []struct {
+		name     string
+		drift    *Drift
+		state    *bridge.DeviceState
+		random   float64
+		expected *bridge.DeviceState
+	}{
+		{
+			"up a full step",
+			&Drift{Field: "humidity.relative_percent", Minimum: 30, Maximum: 60, Step: 2},
+			&bridge.DeviceState{Humidity: &bridge.DeviceState_Humidity{RelativePercent: 40}},
+			1,
+			&bridge.DeviceState{Humidity: &bridge.DeviceState_Humidity{RelativePercent: 42}},
+		},
+		{
+			"down a full step",
+			&Drift{Field: "humidity.relative_percent", Minimum: 30, Maximum: 60, Step: 2},
+			&bridge.DeviceState{Humidity: &bridge.DeviceState_Humidity{RelativePercent: 40}},
+			0,
+			&bridge.DeviceState{Humidity: &bridge.DeviceState_Humidity{RelativePercent: 38}},
+		},
+		{
+			"clamped to the maximum",
+			&Drift{Field: "humidity.relative_percent", Minimum: 30, Maximum: 60, Step: 2},
+			&bridge.DeviceState{Humidity: &bridge.DeviceState_Humidity{RelativePercent: 59}},
+			1,
+			&bridge.DeviceState{Humidity: &bridge.DeviceState_Humidity{RelativePercent: 60}},
+		},
+		{
+			"clamped to the minimum from an unset message",
+			&Drift{Field: "power.watts", Minimum: 40, Maximum: 80, Step: 5},
+			&bridge.DeviceState{},
+			0.5,
+			&bridge.DeviceState{Power: &bridge.DeviceState_Power{Watts: 40}},
+		},
+		{
+			"integers are rounded",
+			&Drift{Field: "temperature.celsius", Minimum: 18, Maximum: 24, Step: 1},
+			&bridge.DeviceState{Temperature: &bridge.DeviceState_Temperature{Celsius: 21}},
+			0.8,
+			&bridge.DeviceState{Temperature: &bridge.DeviceState_Temperature{Celsius: 22}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driftStep(tt.state, tt.drift, tt.random)
+
+			require.NotNil(t, tt.state.ReportedAt)
+			tt.state.ReportedAt = nil
+			assert.Equal(t, tt.expected.String(), tt.state.String())
+		})
+	}
+}
+
+func TestSimulatorReportsChanges(t *testing.T) {
+	// The simulator logs as it stops, which may be after the test completes.
+	logger := zap.NewNop()
+
+	sim, err := NewSimulator(logger, &Fixture{
+		Bridge: map[string]interface{}{"id": "simulator"},
+		Devices: []DeviceFixture{
+			{
+				Device: map[string]interface{}{
+					"id": "switch",
+					"state": map[string]interface{}{
+						"binary": map[string]interface{}{"isOn": false},
+					},
+				},
+				Behaviours: []Behaviour{
+					{Button: &Button{ID: 1, Interval: 10 * time.Millisecond}},
+				},
+			},
+		},
+	}, 1)
+	require.NoError(t, err)
+
+	sbs := bridge.NewSyncBridgeService(zaptest.NewLogger(t), sim.getBridge(), sim.getDevices(), sim)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		sim.Run(ctx, sbs)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		device, err := sbs.GetDevice(context.Background(), &bridge.GetDeviceRequest{Id: "switch"})
+		return err == nil && len(device.State.Button) > 0 && device.State.Button[0].IsOn
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	<-done
+
+	// A write made between the simulator's changes isn't reverted by them.
+	_, err = sbs.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id: "switch",
+		State: &bridge.DeviceState{
+			IsReachable: true,
+			Binary:      &bridge.DeviceState_Binary{IsOn: true},
+		},
+	})
+	require.NoError(t, err)
+
+	sim.report(sbs, "switch", func(state *bridge.DeviceState) {
+		state.Button = nil
+	})
+
+	device, err := sbs.GetDevice(context.Background(), &bridge.GetDeviceRequest{Id: "switch"})
+	require.NoError(t, err)
+	assert.True(t, device.State.Binary.IsOn)
+	assert.Empty(t, device.State.Button)
+}
@@ -0,0 +1,115 @@
+package bridge
+
+import (
+	"context"
+	"database/sql"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+)
+
+const (
+	// ConfigDBPathEnvVar names the environment variable bridge daemons read the path of their device config DB from.
+	// Device configs are only kept across restarts if it is set.
+	ConfigDBPathEnvVar = "CONFIG_DB_PATH"
+
+	createDeviceConfigTableQuery = `CREATE TABLE IF NOT EXISTS device_config(
+		bridge_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		config BLOB,
+		PRIMARY KEY (bridge_id, device_id)
+		);`
+
+	upsertDeviceConfigQuery  = `INSERT INTO device_config(bridge_id, device_id, config) VALUES (?, ?, ?) ON CONFLICT(bridge_id, device_id) DO UPDATE SET config=excluded.config;`
+	selectDeviceConfigsQuery = `SELECT device_id, config FROM device_config WHERE bridge_id=?;`
+)
+
+// DeviceConfigPersister saves the configs of the devices of a bridge, so changes to them survive restarts.
+type DeviceConfigPersister interface {
+	DeviceConfigs(ctx context.Context, bridgeID string) (map[string]*DeviceConfig, error)
+	PutDeviceConfig(ctx context.Context, bridgeID string, deviceID string, config *DeviceConfig) error
+}
+
+// SQLDeviceConfigPersister saves device configs in a SQL DB.
+type SQLDeviceConfigPersister struct {
+	logger *zap.Logger
+	db     *sql.DB
+}
+
+// NewSQLDeviceConfigPersister creates a new persister backed by a SQL DB.
+func NewSQLDeviceConfigPersister(logger *zap.Logger, db *sql.DB) *SQLDeviceConfigPersister {
+	return &SQLDeviceConfigPersister{
+		logger: logger,
+		db:     db,
+	}
+}
+
+// Setup creates the table used by the persister if it doesn't already exist.
+func (p *SQLDeviceConfigPersister) Setup(ctx context.Context) error {
+	_, err := p.db.ExecContext(ctx, createDeviceConfigTableQuery)
+	return err
+}
+
+// RestoreDeviceConfigsFromDB restores the configs of the devices of the service from the SQLite DB at the supplied path,
+// and saves any subsequent changes to them there. The sqlite3 driver must be registered by the caller.
+// The returned closer releases the DB, and should be closed once the service is no longer served.
+func RestoreDeviceConfigsFromDB(ctx context.Context, logger *zap.Logger, sbs *SyncBridgeService, path string) (io.Closer, error) {
+	sqldb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := NewSQLDeviceConfigPersister(logger, sqldb)
+	if err := p.Setup(ctx); err != nil {
+		sqldb.Close()
+		return nil, err
+	}
+	if err := sbs.RestoreDeviceConfigs(ctx, p); err != nil {
+		sqldb.Close()
+		return nil, err
+	}
+	return sqldb, nil
+}
+
+// DeviceConfigs retrieves the saved configs of the devices of the specified bridge, keyed by device ID.
+func (p *SQLDeviceConfigPersister) DeviceConfigs(ctx context.Context, bridgeID string) (map[string]*DeviceConfig, error) {
+	rows, err := p.db.QueryContext(ctx, selectDeviceConfigsQuery, bridgeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	configs := map[string]*DeviceConfig{}
+	for rows.Next() {
+		var deviceID string
+		var data []byte
+		if err := rows.Scan(&deviceID, &data); err != nil {
+			return nil, err
+		}
+
+		config := &DeviceConfig{}
+		if err := proto.Unmarshal(data, config); err != nil {
+			p.logger.Info("unable to unmarshal device config, skipping",
+				zap.String("bridge_id", bridgeID),
+				zap.String("device_id", deviceID),
+				zap.Error(err),
+			)
+			continue
+		}
+		configs[deviceID] = config
+	}
+
+	return configs, rows.Err()
+}
+
+// PutDeviceConfig saves the config of the specified device, replacing any previously saved config.
+func (p *SQLDeviceConfigPersister) PutDeviceConfig(ctx context.Context, bridgeID string, deviceID string, config *DeviceConfig) error {
+	data, err := proto.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.ExecContext(ctx, upsertDeviceConfigQuery, bridgeID, deviceID, data)
+	return err
+}
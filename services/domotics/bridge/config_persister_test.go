@@ -0,0 +1,96 @@
+package bridge
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func newTestConfigPersister(t *testing.T) *SQLDeviceConfigPersister {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	// Each connection to an in-memory DB is distinct, so we need to share one.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	p := NewSQLDeviceConfigPersister(zaptest.NewLogger(t), db)
+	require.NoError(t, p.Setup(context.Background()))
+	return p
+}
+
+func TestDeviceConfigPersistence(t *testing.T) {
+	ctx := context.Background()
+	p := newTestConfigPersister(t)
+
+	require.NoError(t, p.PutDeviceConfig(ctx, "br1", "d1", &DeviceConfig{Name: "Lamp"}))
+	require.NoError(t, p.PutDeviceConfig(ctx, "br1", "d2", &DeviceConfig{Name: "Fan", Description: "Ceiling"}))
+	require.NoError(t, p.PutDeviceConfig(ctx, "br2", "d1", &DeviceConfig{Name: "Speaker"}))
+
+	// Saving a config again replaces it.
+	require.NoError(t, p.PutDeviceConfig(ctx, "br1", "d1", &DeviceConfig{Name: "Desk lamp"}))
+
+	configs, err := p.DeviceConfigs(ctx, "br1")
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+	assert.True(t, proto.Equal(&DeviceConfig{Name: "Desk lamp"}, configs["d1"]))
+	assert.True(t, proto.Equal(&DeviceConfig{Name: "Fan", Description: "Ceiling"}, configs["d2"]))
+
+	configs, err = p.DeviceConfigs(ctx, "br3")
+	require.NoError(t, err)
+	assert.Empty(t, configs)
+}
+
+func TestRestoreDeviceConfigsFromDB(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	dir, err := ioutil.TempDir("", "config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.db")
+
+	newService := func() *SyncBridgeService {
+		return NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{
+			"1232": {
+				Id:     "1232",
+				Config: &DeviceConfig{Name: "Zone 1"},
+				State:  &DeviceState{},
+			},
+		}, &mockBridge{})
+	}
+
+	sbs := newService()
+	db, err := RestoreDeviceConfigsFromDB(context.Background(), logger, sbs, path)
+	require.NoError(t, err)
+
+	_, err = sbs.UpdateDeviceConfig(context.Background(), &UpdateDeviceConfigRequest{
+		Id:     "1232",
+		Config: &DeviceConfig{Name: "Kitchen"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// The config is restored from the DB when the bridge restarts.
+	restarted := newService()
+	db, err = RestoreDeviceConfigsFromDB(context.Background(), logger, restarted, path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	device, err := restarted.GetDevice(context.Background(), &GetDeviceRequest{Id: "1232"})
+	require.NoError(t, err)
+	assert.Equal(t, "Kitchen", device.Config.Name)
+
+	// A DB which can't be set up is reported rather than ignored.
+	_, err = RestoreDeviceConfigsFromDB(context.Background(), logger, newService(), dir)
+	assert.Error(t, err)
+}
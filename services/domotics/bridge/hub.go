@@ -4,16 +4,27 @@ import (
 	"context"
 	"errors"
 	"io"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/rmrobinson/nerves/lib/stream"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	// bridgeInfoTimeout bounds how long we wait for a bridge being added to describe itself.
+	bridgeInfoTimeout = 10 * time.Second
+)
+
 var (
+	errStreamClosed = errors.New("bridge closed the update stream")
+
 	// ErrBridgeAlreadyAdded is returned if the requested bridge already exists
 	ErrBridgeAlreadyAdded = errors.New("bridge already added")
 	// ErrBridgeNotFound is returned if the requested bridge ID could not be found
@@ -21,14 +32,31 @@ var (
 )
 
 type hubBridge struct {
+	// id is the ID of the bridge, which doesn't change even as b is refreshed
+	id string
+
 	// b contains info about the bridge being referenced
 	b *Bridge
 
 	// c is the client connecting to this bridge
 	c BridgeServiceClient
 
-	// used to cancel the update stream on c
-	streamCancel context.CancelFunc
+	// ping checks whether the bridge is responsive
+	ping func(context.Context) error
+
+	// used to stop the management of this bridge, including the update stream on c
+	cancel context.CancelFunc
+
+	// health describes our connection to this bridge
+	health      *BridgeHealth
+	healthMutex sync.Mutex
+}
+
+// hubEvent is a change to be applied by the goroutine which owns the bridge and device maps.
+// It either carries an update, or the bridge whose devices can no longer be reached.
+type hubEvent struct {
+	update *Update
+	lost   *hubBridge
 }
 
 type hubDevice struct {
@@ -43,9 +71,10 @@ type hubDevice struct {
 // The hub may have many consumers interested in its updates - these are managed by the updateSource property.
 // Updates are published to this source by a single goroutine which 'owns' changing the bridge and device maps.
 type Hub struct {
-	logger          *zap.Logger
-	updateSource    *stream.Source
-	internalUpdates chan *Update
+	logger       *zap.Logger
+	cfg          hubConfig
+	updateSource *stream.Source
+	events       chan hubEvent
 
 	devices      map[string]*hubDevice
 	devicesMutex sync.RWMutex
@@ -54,14 +83,72 @@ type Hub struct {
 	bridgesMutex sync.RWMutex
 }
 
+// HubOption configures the behaviour of a hub at creation time.
+type HubOption func(*hubConfig)
+
+type hubConfig struct {
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+}
+
+// ReconnectBackoff configures the delay between attempts to reconnect to a bridge whose connection was lost.
+// The delay starts at min and doubles with each failed attempt, up to max.
+func ReconnectBackoff(min time.Duration, max time.Duration) HubOption {
+	return func(cfg *hubConfig) {
+		cfg.minBackoff = min
+		cfg.maxBackoff = max
+	}
+}
+
+// HealthCheck configures how often each connected bridge is pinged, and how long it has to respond.
+// A bridge which fails to respond is marked as degraded. An interval of 0 disables health checks.
+func HealthCheck(interval time.Duration, timeout time.Duration) HubOption {
+	return func(cfg *hubConfig) {
+		cfg.healthCheckInterval = interval
+		cfg.healthCheckTimeout = timeout
+	}
+}
+
+// backoff returns how long to wait before making the supplied reconnection attempt, counting from 0.
+func (cfg *hubConfig) backoff(attempt int) time.Duration {
+	delay := cfg.minBackoff
+	for i := 0; i < attempt && delay < cfg.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > cfg.maxBackoff {
+		delay = cfg.maxBackoff
+	}
+	return delay
+}
+
 // NewHub creates a new hub with the supplied logger.
-func NewHub(logger *zap.Logger) *Hub {
+func NewHub(logger *zap.Logger, opts ...HubOption) *Hub {
+	return NewHubWithSource(logger, stream.NewSource(logger), opts...)
+}
+
+// NewHubWithSource creates a new hub which publishes its updates to the supplied source.
+// This allows the hub's updates to be recorded, for example by using a journaled source.
+func NewHubWithSource(logger *zap.Logger, source *stream.Source, opts ...HubOption) *Hub {
+	cfg := hubConfig{
+		minBackoff:          time.Second,
+		maxBackoff:          time.Minute,
+		healthCheckInterval: 30 * time.Second,
+		healthCheckTimeout:  5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	ret := &Hub{
-		logger:          logger,
-		updateSource:    stream.NewSource(logger),
-		internalUpdates: make(chan *Update, 100),
-		devices:         map[string]*hubDevice{},
-		bridges:         map[string]*hubBridge{},
+		logger:       logger,
+		cfg:          cfg,
+		updateSource: source,
+		events:       make(chan hubEvent, 100),
+		devices:      map[string]*hubDevice{},
+		bridges:      map[string]*hubBridge{},
 	}
 
 	go ret.processUpdates()
@@ -95,33 +182,46 @@ func (h *Hub) GetDevice(id string) (*Device, error) {
 	return nil, ErrDeviceNotFound.Err()
 }
 
-// UpdateDeviceConfig updates the specified device with the provided config.
-func (h *Hub) UpdateDeviceConfig(ctx context.Context, id string, config *DeviceConfig) (*Device, error) {
-	// This is only a read lock since we aren't mutating the device here - we just require it not change during our call.
+// lookupDevice returns a copy of the specified device along with the client of the bridge which owns it.
+// The lock is only held for the lookup so a slow bridge doesn't hold up changes to the hub while it is called.
+func (h *Hub) lookupDevice(id string) (*Device, BridgeServiceClient, error) {
 	h.devicesMutex.RLock()
 	defer h.devicesMutex.RUnlock()
 
 	hd, found := h.devices[id]
 	if !found {
-		return nil, ErrDeviceNotFound.Err()
+		return nil, nil, ErrDeviceNotFound.Err()
 	}
 
-	if config.String() == hd.d.Config.String() {
+	return proto.Clone(hd.d).(*Device), hd.hb.c, nil
+}
+
+// UpdateDeviceConfig updates the specified device with the provided config.
+// The request is passed to the owning bridge, which applies any update mask and rejects the update if a supplied
+// version is stale.
+func (h *Hub) UpdateDeviceConfig(ctx context.Context, req *UpdateDeviceConfigRequest) (*Device, error) {
+	device, client, err := h.lookupDevice(req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := ApplyConfigMask(device.Config, req.Config, req.UpdateMask)
+	if err != nil {
+		return nil, err
+	}
+
+	// Our copy of the device may lag behind the bridge, so versioned writes are always checked by the bridge.
+	if len(req.Version) < 1 && config.String() == device.Config.String() {
 		h.logger.Debug("noop write, ignoring",
-			zap.String("device_id", id),
+			zap.String("device_id", req.Id),
 		)
-		return proto.Clone(hd.d).(*Device), nil
+		return device, nil
 	}
 
-	// TODO: check against request version field
-
-	resp, err := hd.hb.c.UpdateDeviceConfig(ctx, &UpdateDeviceConfigRequest{
-		Id:     id,
-		Config: config,
-	})
+	resp, err := client.UpdateDeviceConfig(ctx, req)
 	if err != nil {
 		h.logger.Info("error setting device config",
-			zap.String("id", id),
+			zap.String("id", req.Id),
 			zap.Error(err),
 		)
 
@@ -136,32 +236,38 @@ func (h *Hub) UpdateDeviceConfig(ctx context.Context, id string, config *DeviceC
 }
 
 // UpdateDeviceState updates the specified device with the provided state.
-func (h *Hub) UpdateDeviceState(ctx context.Context, id string, state *DeviceState) (*Device, error) {
-	// This is only a read lock since we aren't mutating the device here - we just require it not change during our call.
-	h.devicesMutex.RLock()
-	defer h.devicesMutex.RUnlock()
+// The request is passed to the owning bridge, which applies any update mask and rejects the update if a supplied
+// version is stale. Changes which the device's traits don't allow are rejected without involving the bridge.
+func (h *Hub) UpdateDeviceState(ctx context.Context, req *UpdateDeviceStateRequest) (*Device, error) {
+	device, client, err := h.lookupDevice(req.Id)
+	if err != nil {
+		return nil, err
+	}
 
-	hd, found := h.devices[id]
-	if !found {
-		return nil, ErrDeviceNotFound.Err()
+	state, err := ApplyStateMask(device.State, req.State, req.UpdateMask)
+	if err != nil {
+		return nil, err
+	} else if err := ValidateState(device, state); err != nil {
+		// Rejecting unsupported changes here saves a round trip to the bridge.
+		h.logger.Debug("unsupported write, rejecting",
+			zap.String("device_id", req.Id),
+			zap.Error(err),
+		)
+		return nil, err
 	}
 
-	if state.String() == hd.d.State.String() {
+	// Our copy of the device may lag behind the bridge, so versioned writes are always checked by the bridge.
+	if len(req.Version) < 1 && state.String() == device.State.String() {
 		h.logger.Debug("noop write, ignoring",
-			zap.String("device_id", id),
+			zap.String("device_id", req.Id),
 		)
-		return proto.Clone(hd.d).(*Device), nil
+		return device, nil
 	}
 
-	// TODO: check against request version field
-
-	resp, err := hd.hb.c.UpdateDeviceState(ctx, &UpdateDeviceStateRequest{
-		Id:    id,
-		State: state,
-	})
+	resp, err := client.UpdateDeviceState(ctx, req)
 	if err != nil {
 		h.logger.Info("error setting device state",
-			zap.String("id", id),
+			zap.String("id", req.Id),
 			zap.Error(err),
 		)
 
@@ -175,28 +281,154 @@ func (h *Hub) UpdateDeviceState(ctx context.Context, id string, state *DeviceSta
 	return resp, nil
 }
 
+// BatchUpdateDeviceStates concurrently updates the state of each of the specified devices, returning the result of each.
+// Updates are sent to the owning bridges in parallel, so a slow bridge only delays its own devices.
+func (h *Hub) BatchUpdateDeviceStates(ctx context.Context, req *BatchUpdateDeviceStatesRequest) (*BatchUpdateDeviceStatesResponse, error) {
+	return BatchUpdate(ctx, req, h.UpdateDeviceState)
+}
+
 // Bridge allows the caller to retrieve the bridge information, if present.
+// The bridge's devices are the hub's current view of them.
 func (h *Hub) Bridge(id string) (*Bridge, error) {
 	h.bridgesMutex.RLock()
 	defer h.bridgesMutex.RUnlock()
 
 	if hb, found := h.bridges[id]; found {
-		return hb.b, nil
+		return h.bridgeInfo(hb), nil
+	}
+
+	return nil, ErrBridgeNotFound.Err()
+}
+
+// ListBridges returns the set of currently managed bridges, each with the hub's current view of its devices.
+func (h *Hub) ListBridges() []*Bridge {
+	h.bridgesMutex.RLock()
+	defer h.bridgesMutex.RUnlock()
+
+	ret := []*Bridge{}
+	for _, hb := range h.bridges {
+		ret = append(ret, h.bridgeInfo(hb))
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret
+}
+
+// bridgeInfo returns a copy of the bridge with its devices replaced by the hub's current view of them.
+// The caller must hold bridgesMutex.
+func (h *Hub) bridgeInfo(hb *hubBridge) *Bridge {
+	ret := proto.Clone(hb.b).(*Bridge)
+	ret.Devices = nil
+
+	h.devicesMutex.RLock()
+	defer h.devicesMutex.RUnlock()
+
+	for _, hd := range h.devices {
+		if hd.hb == hb {
+			ret.Devices = append(ret.Devices, proto.Clone(hd.d).(*Device))
+		}
+	}
+
+	sort.Slice(ret.Devices, func(i, j int) bool {
+		return ret.Devices[i].Id < ret.Devices[j].Id
+	})
+	return ret
+}
+
+// seedUpdates returns an ADDED update for each of the currently managed bridges followed by one for each device,
+// attributed to the bridge which owns it. This allows a new subscriber to build up the current state of the hub.
+func (h *Hub) seedUpdates() []*Update {
+	h.bridgesMutex.RLock()
+	defer h.bridgesMutex.RUnlock()
+
+	var bridgeUpdates []*Update
+	var deviceUpdates []*Update
+	for _, hb := range h.bridges {
+		brInfo := h.bridgeInfo(hb)
+		devices := brInfo.Devices
+		brInfo.Devices = nil
+
+		bridgeUpdates = append(bridgeUpdates, &Update{
+			Action: Update_ADDED,
+			Update: &Update_BridgeUpdate{
+				&BridgeUpdate{
+					Bridge:   brInfo,
+					BridgeId: hb.id,
+					Health:   hb.healthSnapshot(),
+				},
+			},
+		})
+
+		for _, device := range devices {
+			deviceUpdates = append(deviceUpdates, &Update{
+				Action: Update_ADDED,
+				Update: &Update_DeviceUpdate{
+					&DeviceUpdate{
+						Device:   device,
+						DeviceId: device.Id,
+						BridgeId: hb.id,
+					},
+				},
+			})
+		}
+	}
+
+	return append(bridgeUpdates, deviceUpdates...)
+}
+
+// BridgeHealth returns the health of the hub's connection to the specified bridge.
+func (h *Hub) BridgeHealth(id string) (*BridgeHealth, error) {
+	h.bridgesMutex.RLock()
+	defer h.bridgesMutex.RUnlock()
+
+	if hb, found := h.bridges[id]; found {
+		return hb.healthSnapshot(), nil
 	}
 
 	return nil, ErrBridgeNotFound.Err()
 }
 
+// ListBridgeHealth returns the health of the hub's connection to each of its bridges, keyed by bridge ID.
+func (h *Hub) ListBridgeHealth() map[string]*BridgeHealth {
+	h.bridgesMutex.RLock()
+	defer h.bridgesMutex.RUnlock()
+
+	ret := map[string]*BridgeHealth{}
+	for id, hb := range h.bridges {
+		ret[id] = hb.healthSnapshot()
+	}
+
+	return ret
+}
+
 // AddBridge takes the supplied bridge services client, checks to see if it is already present,
 // and if not adds the bridge client to the set of bridges active.
+// Since only the bridge service is available, health checks retrieve the bridge info.
 func (h *Hub) AddBridge(c BridgeServiceClient) error {
-	// This method is the one exception to the case of writes occurring in the processing goroutine.
-	// Because we are not talking about 'updates' to a bridge but actual editing the bridge set, we
-	// lock the bridge map for writing here.
-	h.bridgesMutex.Lock()
-	defer h.bridgesMutex.Unlock()
+	return h.addBridge(c, func(ctx context.Context) error {
+		_, err := c.GetBridge(ctx, &GetBridgeRequest{})
+		return err
+	})
+}
+
+// AddBridgeConn adds the bridge served on the supplied connection to the set of bridges active.
+// Health checks use the ping service of the bridge.
+func (h *Hub) AddBridgeConn(conn grpc.ClientConnInterface) error {
+	pingClient := NewPingServiceClient(conn)
+
+	return h.addBridge(NewBridgeServiceClient(conn), func(ctx context.Context) error {
+		_, err := pingClient.Ping(ctx, &PingRequest{})
+		return err
+	})
+}
 
-	brInfo, err := c.GetBridge(context.Background(), &GetBridgeRequest{})
+func (h *Hub) addBridge(c BridgeServiceClient, ping func(context.Context) error) error {
+	// The bridge is retrieved before taking the lock so a slow bridge doesn't hold up the rest of the hub.
+	infoCtx, infoCancel := context.WithTimeout(context.Background(), bridgeInfoTimeout)
+	brInfo, err := c.GetBridge(infoCtx, &GetBridgeRequest{})
+	infoCancel()
 	if err != nil {
 		h.logger.Info("error retrieve bridge info during addition",
 			zap.Error(err),
@@ -205,110 +437,271 @@ func (h *Hub) AddBridge(c BridgeServiceClient) error {
 		return err
 	}
 
+	// This method is the one exception to the case of writes occurring in the processing goroutine.
+	// Because we are not talking about 'updates' to a bridge but actual editing the bridge set, we
+	// lock the bridge map for writing here.
+	h.bridgesMutex.Lock()
 	if _, found := h.bridges[brInfo.Id]; found {
+		h.bridgesMutex.Unlock()
 		return ErrBridgeAlreadyAdded
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	hb := &hubBridge{
-		b: brInfo,
-		c: c,
+		id:     brInfo.Id,
+		b:      brInfo,
+		c:      c,
+		ping:   ping,
+		cancel: cancel,
+		health: &BridgeHealth{
+			State:    BridgeHealth_CONNECTED,
+			LastSeen: ptypes.TimestampNow(),
+		},
 	}
-	h.bridges[hb.b.Id] = hb
+	h.bridges[hb.id] = hb
+	h.bridgesMutex.Unlock()
 
-	h.internalUpdates <- &Update{
+	// The updates are queued once the lock is released since the update processor needs it to apply them.
+	h.queue(&Update{
 		Action: Update_ADDED,
 		Update: &Update_BridgeUpdate{
 			&BridgeUpdate{
-				Bridge:   hb.b,
-				BridgeId: hb.b.Id,
+				Bridge:   proto.Clone(brInfo).(*Bridge),
+				BridgeId: hb.id,
+				Health:   hb.healthSnapshot(),
 			},
 		},
-	}
+	})
 
 	for _, device := range brInfo.Devices {
-		h.internalUpdates <- &Update{
+		h.queue(&Update{
 			Action: Update_ADDED,
 			Update: &Update_DeviceUpdate{
 				&DeviceUpdate{
 					Device:   device,
 					DeviceId: device.Id,
-					BridgeId: hb.b.Id,
+					BridgeId: hb.id,
 				},
 			},
-		}
+		})
 	}
 
-	go h.processBridgeStream(hb)
+	go h.manageBridge(ctx, hb)
 
 	return nil
 }
 
-func (h *Hub) processBridgeStream(hb *hubBridge) {
-	ctx, cancel := context.WithCancel(context.Background())
-	hb.streamCancel = cancel
-	defer func() {
-		if hb.streamCancel != nil {
-			hb.streamCancel()
-			hb.streamCancel = nil
-		}
-	}()
+// manageBridge streams updates from the bridge until it is removed.
+// If the stream is lost the bridge's devices are marked as unreachable and we reconnect, backing off between attempts.
+func (h *Hub) manageBridge(ctx context.Context, hb *hubBridge) {
+	logger := h.logger.With(zap.String("bridge_id", hb.id))
 
-	logger := h.logger.With(zap.String("bridge_id", hb.b.Id))
+	for {
+		err := h.processBridgeStream(ctx, hb)
+		if ctx.Err() != nil {
+			// If the context is cancelled we have already removed the bridge.
+			logger.Info("bridge stream cancelled")
+			return
+		}
 
-	stream, err := hb.c.StreamBridgeUpdates(ctx, &StreamBridgeUpdatesRequest{})
-	if err != nil {
-		logger.Error("error attempting to stream bridge updates",
+		logger.Info("lost connection to bridge, reconnecting",
 			zap.Error(err),
 		)
-		return
-	}
 
-	for {
-		msg, err := stream.Recv()
+		// We assume the devices of a bridge whose stream is gone are unavailable until we reconnect.
+		h.events <- hubEvent{lost: hb}
+		h.updateHealth(ctx, hb, func(health *BridgeHealth) {
+			health.State = BridgeHealth_DISCONNECTED
+			health.LastError = err.Error()
+		})
 
-		if ctx.Err() == context.Canceled {
-			// If we are seeing a cancelled error here we have already removed the bridge.
-			// Simply exit the steam.
-			logger.Info("bridge stream cancelled")
+		if !h.reconnect(ctx, logger, hb) {
+			logger.Info("bridge removed while reconnecting")
 			return
 		}
+	}
+}
 
-		if err == io.EOF {
-			logger.Info("bridge connection went away")
+// reconnect retrieves the bridge info, backing off between attempts, until it succeeds or the bridge is removed.
+// It returns false if the bridge was removed.
+func (h *Hub) reconnect(ctx context.Context, logger *zap.Logger, hb *hubBridge) bool {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(h.cfg.backoff(attempt)):
+		}
 
-			// We assume that a bridge whose stream is gone is unavailable
-			h.RemoveBridge(hb.b.Id)
-			return
+		brInfo, err := hb.c.GetBridge(ctx, &GetBridgeRequest{})
+		if ctx.Err() != nil {
+			return false
 		} else if err != nil {
-			logger.Error("error watching bridge, removing",
+			logger.Debug("unable to reconnect to bridge",
+				zap.Int("attempt", attempt+1),
 				zap.Error(err),
 			)
 
-			// We assume that a bridge whose stream has an error is unavailable
-			h.RemoveBridge(hb.b.Id)
-			return
+			h.updateHealth(ctx, hb, func(health *BridgeHealth) {
+				health.LastError = err.Error()
+				health.ReconnectAttempts = int32(attempt + 1)
+			})
+			continue
+		}
+
+		logger.Info("reconnected to bridge",
+			zap.Int("attempts", attempt+1),
+		)
+
+		// Refresh our copy of the bridge; its devices are refreshed when the new stream sends them.
+		brInfo.Id = hb.id
+		h.queue(&Update{
+			Action: Update_CHANGED,
+			Update: &Update_BridgeUpdate{
+				&BridgeUpdate{
+					Bridge:   brInfo,
+					BridgeId: hb.id,
+				},
+			},
+		})
+
+		h.updateHealth(ctx, hb, func(health *BridgeHealth) {
+			health.State = BridgeHealth_CONNECTED
+			health.LastSeen = ptypes.TimestampNow()
+			health.ReconnectAttempts = 0
+		})
+		return true
+	}
+}
+
+// processBridgeStream passes the updates from the bridge to the hub until the stream fails, returning the cause.
+// While the stream is active the bridge is periodically health checked.
+func (h *Hub) processBridgeStream(ctx context.Context, hb *hubBridge) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := hb.c.StreamBridgeUpdates(ctx, &StreamBridgeUpdatesRequest{})
+	if err != nil {
+		return err
+	}
+
+	if h.cfg.healthCheckInterval > 0 {
+		go h.checkHealth(ctx, hb)
+	}
+
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return errStreamClosed
+		} else if err != nil {
+			return err
 		}
 
+		hb.markSeen()
+
 		// Guard against remote services which don't properly annotate the update.
 		if msg.GetBridgeUpdate() != nil {
-			msg.GetBridgeUpdate().BridgeId = hb.b.Id
+			msg.GetBridgeUpdate().BridgeId = hb.id
 		} else if msg.GetDeviceUpdate() != nil {
-			msg.GetDeviceUpdate().BridgeId = hb.b.Id
+			msg.GetDeviceUpdate().BridgeId = hb.id
 		}
 
-		h.internalUpdates <- msg
+		h.queue(msg)
 	}
 }
 
+// checkHealth pings the bridge until the context is cancelled, marking it as degraded while it fails to respond.
+func (h *Hub) checkHealth(ctx context.Context, hb *hubBridge) {
+	ticker := time.NewTicker(h.cfg.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, h.cfg.healthCheckTimeout)
+		err := hb.ping(pingCtx)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			h.logger.Info("bridge health check failed",
+				zap.String("bridge_id", hb.id),
+				zap.Error(err),
+			)
+		} else {
+			hb.markSeen()
+		}
+
+		h.updateHealth(ctx, hb, func(health *BridgeHealth) {
+			// Only the stream decides whether we are connected; health checks can only degrade a connection.
+			if health.State == BridgeHealth_DISCONNECTED {
+				return
+			}
+
+			if err != nil {
+				health.State = BridgeHealth_DEGRADED
+				health.LastError = err.Error()
+			} else {
+				health.State = BridgeHealth_CONNECTED
+			}
+		})
+	}
+}
+
+// updateHealth applies the supplied change to the health of the bridge.
+// If the state of the bridge changes, and it hasn't been removed, the new health is published.
+func (h *Hub) updateHealth(ctx context.Context, hb *hubBridge, change func(*BridgeHealth)) {
+	hb.healthMutex.Lock()
+	prevState := hb.health.State
+	change(hb.health)
+	changed := hb.health.State != prevState
+	health := proto.Clone(hb.health).(*BridgeHealth)
+	hb.healthMutex.Unlock()
+
+	if !changed || ctx.Err() != nil {
+		return
+	}
+
+	h.logger.Info("bridge health changed",
+		zap.String("bridge_id", hb.id),
+		zap.String("prev_state", prevState.String()),
+		zap.String("state", health.State.String()),
+	)
+
+	h.bridgesMutex.RLock()
+	brInfo := proto.Clone(hb.b).(*Bridge)
+	h.bridgesMutex.RUnlock()
+
+	h.queue(&Update{
+		Action: Update_CHANGED,
+		Update: &Update_BridgeUpdate{
+			&BridgeUpdate{
+				Bridge:   brInfo,
+				BridgeId: hb.id,
+				Health:   health,
+			},
+		},
+	})
+}
+
+// queue passes the update to the processing goroutine to be applied.
+func (h *Hub) queue(update *Update) {
+	h.events <- hubEvent{update: update}
+}
+
 // RemoveBridge takes the specified bridge ID out of the system.
-// It will not close the socket, if it is still open, but it will cancel any streaming requests.
+// It will not close the socket, if it is still open, but it will cancel any streaming requests and stop reconnecting.
 // This will trigger a state change for any devices owned by this bridge, marking them as offline.
 // Removing a bridge does not remove the device, as it is expected that a bridge going away is temporary.
 func (h *Hub) RemoveBridge(id string) error {
 	h.bridgesMutex.RLock()
-	defer h.bridgesMutex.RUnlock()
-
 	hb, found := h.bridges[id]
+	h.bridgesMutex.RUnlock()
+
 	if !found {
 		h.logger.Info("removing a bridge that is already gone",
 			zap.String("bridge_id", id),
@@ -316,69 +709,69 @@ func (h *Hub) RemoveBridge(id string) error {
 		return ErrBridgeNotFound.Err()
 	}
 
-	// We mark all of the devices owned by this bridge as unavailable
-	h.devicesMutex.RLock()
-	defer h.devicesMutex.RUnlock()
-	for deviceID, hd := range h.devices {
-		if hd.hb != hb {
-			continue
-		}
-
-		h.devices[deviceID].d.State.IsReachable = false
+	// Stop managing the bridge first so it doesn't publish anything after it is removed.
+	hb.cancel()
 
-		h.internalUpdates <- &Update{
-			Action: Update_CHANGED,
-			Update: &Update_DeviceUpdate{
-				&DeviceUpdate{
-					Device:   h.devices[deviceID].d,
-					DeviceId: deviceID,
-					BridgeId: hb.b.Id,
-				},
-			},
-		}
-	}
+	// We mark all of the devices owned by this bridge as unavailable
+	h.events <- hubEvent{lost: hb}
 
-	h.internalUpdates <- &Update{
+	h.queue(&Update{
 		Action: Update_REMOVED,
 		Update: &Update_BridgeUpdate{
 			&BridgeUpdate{
-				BridgeId: hb.b.Id,
+				BridgeId: hb.id,
 			},
 		},
+	})
+
+	return nil
+}
+
+func (hb *hubBridge) markSeen() {
+	hb.healthMutex.Lock()
+	hb.health.LastSeen = ptypes.TimestampNow()
+	hb.healthMutex.Unlock()
+}
+
+func (hb *hubBridge) healthSnapshot() *BridgeHealth {
+	hb.healthMutex.Lock()
+	defer hb.healthMutex.Unlock()
+
+	return proto.Clone(hb.health).(*BridgeHealth)
+}
+
+// UpdateKey identifies updates which supersede each other; it is suitable for use with stream.CoalesceByKey.
+// Only CHANGED updates are keyed, so a lagging consumer never misses a device being added or removed.
+func UpdateKey(msg proto.Message) string {
+	update, ok := msg.(*Update)
+	if !ok || update.Action != Update_CHANGED {
+		return ""
 	}
 
-	if hb.streamCancel != nil {
-		hb.streamCancel()
-		hb.streamCancel = nil
+	if deviceUpdate := update.GetDeviceUpdate(); deviceUpdate != nil {
+		deviceID := deviceUpdate.DeviceId
+		if deviceUpdate.Device != nil {
+			deviceID = deviceUpdate.Device.Id
+		}
+		return "device/" + deviceID
+	} else if bridgeUpdate := update.GetBridgeUpdate(); bridgeUpdate != nil {
+		return "bridge/" + bridgeUpdate.BridgeId
 	}
 
-	return nil
+	return ""
+}
+
+// Subscribe creates a typed sink of the changes to the underlying bridges and devices which satisfy the filter.
+// If the consumer falls behind only the latest change to each device and bridge is retained.
+// The caller is responsible for closing the sink when done.
+func (h *Hub) Subscribe(filter *UpdateFilter) *UpdateSink {
+	return NewUpdateSink(h.updateSource, filter, stream.CoalesceByKey(UpdateKey))
 }
 
 // Updates exposes the stream of received changes to the underlying bridges and devices.
+// If the consumer falls behind only the latest change to each device and bridge is retained.
 func (h *Hub) Updates() <-chan *Update {
-	ret := make(chan *Update)
-
-	go func() {
-		sink := h.updateSource.NewSink()
-		defer sink.Close()
-		for {
-			u, ok := <-sink.Messages()
-			if !ok {
-				// Channel has been closed; so we'll close the connection as well
-				close(ret)
-				return
-			}
-
-			update, ok := u.(*Update)
-			if !ok {
-				panic("bridge update cast failed")
-			}
-
-			ret <- update
-		}
-	}()
-	return ret
+	return h.Subscribe(nil).Updates()
 }
 
 func (h *Hub) processUpdates() {
@@ -386,7 +779,12 @@ func (h *Hub) processUpdates() {
 	// we can be guaranteed that map entries will exist or will not; we don't need to guard them at check time.
 	// We do, however, need to guard writes as other callers may be reading the map values.
 	for {
-		update := <-h.internalUpdates
+		event := <-h.events
+		if event.lost != nil {
+			h.markUnreachable(event.lost)
+			continue
+		}
+		update := event.update
 
 		// Process bridge updates
 		if update.GetBridgeUpdate() != nil {
@@ -398,14 +796,19 @@ func (h *Hub) processUpdates() {
 			// Added updates are already handled by the caller.
 			if update.Action == Update_CHANGED {
 				h.bridgesMutex.Lock()
-				if hb, found := h.bridges[update.GetBridgeUpdate().BridgeId]; found {
+				hb, found := h.bridges[update.GetBridgeUpdate().BridgeId]
+				if found && update.GetBridgeUpdate().Bridge != nil {
 					hb.b = proto.Clone(update.GetBridgeUpdate().Bridge).(*Bridge)
-				} else {
+				}
+				h.bridgesMutex.Unlock()
+
+				if !found {
+					// This can happen if the bridge was removed while a change was pending; it's no longer relevant.
 					h.logger.Info("received bridge changed call for non-existent bridge",
 						zap.String("bridge_id", update.GetBridgeUpdate().BridgeId),
 					)
+					continue
 				}
-				h.bridgesMutex.Unlock()
 			} else if update.Action == Update_REMOVED {
 				h.bridgesMutex.Lock()
 				delete(h.bridges, update.GetBridgeUpdate().BridgeId)
@@ -425,7 +828,7 @@ func (h *Hub) processUpdates() {
 					zap.String("action", update.Action.String()),
 					zap.String("bridge_id", deviceUpdate.BridgeId),
 				)
-				return
+				continue
 			}
 
 			if deviceUpdate.Device != nil {
@@ -439,7 +842,9 @@ func (h *Hub) processUpdates() {
 				zap.String("device_id", deviceID),
 			)
 
+			h.bridgesMutex.RLock()
 			hb, found := h.bridges[deviceUpdate.BridgeId]
+			h.bridgesMutex.RUnlock()
 			if !found {
 				h.logger.Info("received device update for non-existent bridge",
 					zap.String("device_id", deviceID),
@@ -448,6 +853,15 @@ func (h *Hub) processUpdates() {
 				continue
 			}
 
+			if update.Action != Update_REMOVED && deviceUpdate.Device == nil {
+				h.logger.Info("received device update without the device, ignoring",
+					zap.String("action", update.Action.String()),
+					zap.String("device_id", deviceID),
+					zap.String("bridge_id", deviceUpdate.BridgeId),
+				)
+				continue
+			}
+
 			h.devicesMutex.Lock()
 			switch update.Action {
 			case Update_ADDED:
@@ -466,7 +880,17 @@ func (h *Hub) processUpdates() {
 			case Update_REMOVED:
 				delete(h.devices, deviceID)
 			case Update_CHANGED:
-				h.devices[deviceID].d = proto.Clone(deviceUpdate.Device).(*Device)
+				hubd, found := h.devices[deviceID]
+				if !found {
+					// This can happen if the device was removed while a change was pending; it's no longer relevant.
+					h.devicesMutex.Unlock()
+					h.logger.Info("received device changed call for non-existent device",
+						zap.String("device_id", deviceID),
+						zap.String("bridge_id", deviceUpdate.BridgeId),
+					)
+					continue
+				}
+				hubd.d = proto.Clone(deviceUpdate.Device).(*Device)
 			default:
 				h.logger.Info("received update with unsupported action",
 					zap.Int("action", int(update.Action)),
@@ -480,3 +904,39 @@ func (h *Hub) processUpdates() {
 		}
 	}
 }
+
+// markUnreachable flags each of the devices owned by the bridge as unreachable, publishing the change.
+// It is applied by the processing goroutine so it always works from the current state of each device.
+func (h *Hub) markUnreachable(hb *hubBridge) {
+	var updates []*Update
+
+	h.devicesMutex.Lock()
+	for deviceID, hd := range h.devices {
+		if hd.hb != hb {
+			continue
+		}
+
+		if hd.d.State == nil {
+			hd.d.State = &DeviceState{}
+		} else if !hd.d.State.IsReachable {
+			continue
+		}
+		hd.d.State.IsReachable = false
+
+		updates = append(updates, &Update{
+			Action: Update_CHANGED,
+			Update: &Update_DeviceUpdate{
+				&DeviceUpdate{
+					Device:   proto.Clone(hd.d).(*Device),
+					DeviceId: deviceID,
+					BridgeId: hb.id,
+				},
+			},
+		})
+	}
+	h.devicesMutex.Unlock()
+
+	for _, update := range updates {
+		h.updateSource.SendMessage(update)
+	}
+}
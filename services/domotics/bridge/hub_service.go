@@ -0,0 +1,118 @@
+package bridge
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rmrobinson/nerves/lib/stream"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
+)
+
+// HubService serves a hub over gRPC.
+// It acts as a single bridge exposing the devices of all of the hub's bridges through the BridgeService API,
+// and exposes the bridges themselves through the HubService API.
+type HubService struct {
+	logger *zap.Logger
+	brInfo *Bridge
+	hub    *Hub
+}
+
+// NewHubService creates a new service for the supplied hub, which identifies itself using the supplied bridge info.
+func NewHubService(logger *zap.Logger, brInfo *Bridge, hub *Hub) *HubService {
+	return &HubService{
+		logger: logger,
+		brInfo: brInfo,
+		hub:    hub,
+	}
+}
+
+// GetBridge retrieves the specified bridge. If no bridge is specified, the info of the hub itself is returned,
+// including all of the devices across all of the bridges.
+func (s *HubService) GetBridge(ctx context.Context, req *GetBridgeRequest) (*Bridge, error) {
+	if len(req.Id) > 0 {
+		return s.hub.Bridge(req.Id)
+	}
+
+	ret := proto.Clone(s.brInfo).(*Bridge)
+
+	devices, err := s.hub.ListDevices()
+	if err != nil {
+		return nil, err
+	}
+	ret.Devices = devices
+
+	return ret, nil
+}
+
+// ListBridges retrieves all of the bridges of the hub.
+func (s *HubService) ListBridges(ctx context.Context, req *ListBridgesRequest) (*ListBridgesResponse, error) {
+	return &ListBridgesResponse{
+		Bridges: s.hub.ListBridges(),
+	}, nil
+}
+
+// GetBridgeHealth retrieves the health of the hub's connection to the specified bridge.
+func (s *HubService) GetBridgeHealth(ctx context.Context, req *GetBridgeHealthRequest) (*BridgeHealth, error) {
+	return s.hub.BridgeHealth(req.Id)
+}
+
+// ListBridgeHealth retrieves the health of the hub's connection to each of its bridges.
+func (s *HubService) ListBridgeHealth(ctx context.Context, req *ListBridgeHealthRequest) (*ListBridgeHealthResponse, error) {
+	return &ListBridgeHealthResponse{
+		Health: s.hub.ListBridgeHealth(),
+	}, nil
+}
+
+// ListDevices retrieves all registered devices.
+func (s *HubService) ListDevices(ctx context.Context, req *ListDevicesRequest) (*ListDevicesResponse, error) {
+	devices, err := s.hub.ListDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ListDevicesResponse{
+		Devices: devices,
+	}, nil
+}
+
+// GetDevice retrieves the specified device.
+func (s *HubService) GetDevice(ctx context.Context, req *GetDeviceRequest) (*Device, error) {
+	return s.hub.GetDevice(req.Id)
+}
+
+// UpdateDeviceConfig updates the specified device with the provided config.
+func (s *HubService) UpdateDeviceConfig(ctx context.Context, req *UpdateDeviceConfigRequest) (*Device, error) {
+	return s.hub.UpdateDeviceConfig(ctx, req)
+}
+
+// UpdateDeviceState updates the specified device with the provided state.
+func (s *HubService) UpdateDeviceState(ctx context.Context, req *UpdateDeviceStateRequest) (*Device, error) {
+	return s.hub.UpdateDeviceState(ctx, req)
+}
+
+// BatchUpdateDeviceStates updates the state of each of the specified devices, across all of the bridges.
+func (s *HubService) BatchUpdateDeviceStates(ctx context.Context, req *BatchUpdateDeviceStatesRequest) (*BatchUpdateDeviceStatesResponse, error) {
+	return s.hub.BatchUpdateDeviceStates(ctx, req)
+}
+
+// StreamBridgeUpdates monitors changes for all changes which occur on the hub's bridges.
+// The stream starts with an ADDED update for each bridge followed by one for each device, attributed to its bridge,
+// unless it resumes a previous stream.
+func (s *HubService) StreamBridgeUpdates(req *StreamBridgeUpdatesRequest, srv BridgeService_StreamBridgeUpdatesServer) error {
+	peer, isOk := peer.FromContext(srv.Context())
+
+	addr := "unknown"
+	if isOk {
+		addr = peer.Addr.String()
+	}
+
+	logger := s.logger.With(zap.String("peer_addr", addr))
+
+	logger.Debug("bridge update stream initiated")
+
+	// If the consumer falls behind only the latest change to each device and bridge is retained, as with Subscribe.
+	return ServeUpdates(logger, s.hub.updateSource, req, srv, func(context.Context) ([]*Update, error) {
+		return s.hub.seedUpdates(), nil
+	}, stream.CoalesceByKey(UpdateKey))
+}
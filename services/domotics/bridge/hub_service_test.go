@@ -0,0 +1,128 @@
+package bridge
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestHubService(t *testing.T) {
+	// The hub's goroutines may still be logging as the test completes, which zaptest doesn't allow.
+	logger := zap.NewNop()
+
+	bridgeServer := &testBridgeServer{
+		t: t,
+		sbs: NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{
+			"1232": {
+				Id: "1232",
+				State: &DeviceState{
+					IsReachable: true,
+					Binary:      &DeviceState_Binary{},
+				},
+			},
+		}, &mockBridge{}),
+	}
+	bridgeServer.start()
+	defer bridgeServer.stop()
+
+	bridgeConn := bridgeServer.dial()
+	defer bridgeConn.Close()
+
+	h := NewHub(logger, HealthCheck(0, 0))
+	require.NoError(t, h.AddBridgeConn(bridgeConn))
+	defer h.RemoveBridge("test")
+
+	require.Eventually(t, func() bool {
+		_, err := h.GetDevice("1232")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	hs := NewHubService(logger, &Bridge{Id: "hub"}, h)
+
+	lis := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	RegisterBridgeServiceServer(server, hs)
+	RegisterHubServiceServer(server, hs)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	bridgeClient := NewBridgeServiceClient(conn)
+	hubClient := NewHubServiceClient(conn)
+
+	t.Run("bridges", func(t *testing.T) {
+		listResp, err := hubClient.ListBridges(context.Background(), &ListBridgesRequest{})
+		require.NoError(t, err)
+		require.Len(t, listResp.Bridges, 1)
+		assert.Equal(t, "test", listResp.Bridges[0].Id)
+		require.Len(t, listResp.Bridges[0].Devices, 1)
+		assert.Equal(t, "1232", listResp.Bridges[0].Devices[0].Id)
+
+		br, err := hubClient.GetBridge(context.Background(), &GetBridgeRequest{Id: "test"})
+		require.NoError(t, err)
+		assert.Equal(t, "test", br.Id)
+
+		_, err = hubClient.GetBridge(context.Background(), &GetBridgeRequest{Id: "missing"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+
+		// Without an ID the hub describes itself.
+		br, err = bridgeClient.GetBridge(context.Background(), &GetBridgeRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, "hub", br.Id)
+		assert.Len(t, br.Devices, 1)
+	})
+
+	t.Run("stream seeding", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		stream, err := bridgeClient.StreamBridgeUpdates(ctx, &StreamBridgeUpdatesRequest{})
+		require.NoError(t, err)
+
+		update, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, Update_ADDED, update.Action)
+		require.NotNil(t, update.GetBridgeUpdate())
+		assert.Equal(t, "test", update.GetBridgeUpdate().BridgeId)
+		assert.Equal(t, BridgeHealth_CONNECTED, update.GetBridgeUpdate().Health.State)
+
+		// Devices are attributed to the bridge which owns them rather than the hub.
+		update, err = stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, Update_ADDED, update.Action)
+		require.NotNil(t, update.GetDeviceUpdate())
+		assert.Equal(t, "1232", update.GetDeviceUpdate().DeviceId)
+		assert.Equal(t, "test", update.GetDeviceUpdate().BridgeId)
+	})
+
+	t.Run("stream seeding filtered", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		stream, err := bridgeClient.StreamBridgeUpdates(ctx, &StreamBridgeUpdatesRequest{
+			Filter: &UpdateFilter{
+				DevicesOnly: true,
+			},
+		})
+		require.NoError(t, err)
+
+		update, err := stream.Recv()
+		require.NoError(t, err)
+		require.NotNil(t, update.GetDeviceUpdate())
+		assert.Equal(t, "1232", update.GetDeviceUpdate().DeviceId)
+	})
+}
@@ -0,0 +1,328 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type pingServer struct{}
+
+func (p *pingServer) Ping(context.Context, *PingRequest) (*Pong, error) {
+	return &Pong{}, nil
+}
+
+// testBridgeServer serves a bridge over an in-memory listener which can be stopped and restarted.
+type testBridgeServer struct {
+	t   *testing.T
+	sbs *SyncBridgeService
+
+	lock   sync.Mutex
+	lis    *bufconn.Listener
+	server *grpc.Server
+}
+
+func (s *testBridgeServer) start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lis = bufconn.Listen(1024 * 1024)
+	s.server = grpc.NewServer()
+	RegisterBridgeServiceServer(s.server, s.sbs)
+	RegisterPingServiceServer(s.server, &pingServer{})
+
+	go s.server.Serve(s.lis)
+}
+
+func (s *testBridgeServer) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.server.Stop()
+}
+
+func (s *testBridgeServer) dial() *grpc.ClientConn {
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		s.lock.Lock()
+		lis := s.lis
+		s.lock.Unlock()
+
+		return lis.Dial()
+	}))
+	require.NoError(s.t, err)
+
+	return conn
+}
+
+func TestHubBackoff(t *testing.T) {
+	cfg := &hubConfig{
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Second,
+	}
+
+	assert.Equal(t, time.Second, cfg.backoff(0))
+	assert.Equal(t, 2*time.Second, cfg.backoff(1))
+	assert.Equal(t, 4*time.Second, cfg.backoff(2))
+	assert.Equal(t, 5*time.Second, cfg.backoff(3))
+	assert.Equal(t, 5*time.Second, cfg.backoff(100))
+}
+
+func TestHubReconnect(t *testing.T) {
+	// The hub's goroutines may still be logging as the test completes, which zaptest doesn't allow.
+	logger := zap.NewNop()
+
+	server := &testBridgeServer{
+		t: t,
+		sbs: NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{
+			"1232": {
+				Id: "1232",
+				State: &DeviceState{
+					IsReachable: true,
+					Binary:      &DeviceState_Binary{},
+				},
+			},
+		}, &mockBridge{}),
+	}
+	server.start()
+	defer server.stop()
+
+	conn := server.dial()
+	defer conn.Close()
+
+	h := NewHub(logger, ReconnectBackoff(10*time.Millisecond, 50*time.Millisecond), HealthCheck(0, 0))
+	require.NoError(t, h.AddBridgeConn(conn))
+
+	deviceReachable := func() bool {
+		device, err := h.GetDevice("1232")
+		return err == nil && device.State.IsReachable
+	}
+	healthState := func() BridgeHealth_State {
+		health, err := h.BridgeHealth("test")
+		require.NoError(t, err)
+		return health.State
+	}
+
+	require.Eventually(t, deviceReachable, time.Second, 10*time.Millisecond)
+	assert.Equal(t, BridgeHealth_CONNECTED, healthState())
+
+	// Losing the bridge marks its devices as unreachable but keeps the bridge around.
+	server.stop()
+	require.Eventually(t, func() bool {
+		return healthState() == BridgeHealth_DISCONNECTED
+	}, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return !deviceReachable()
+	}, time.Second, 10*time.Millisecond)
+
+	health, err := h.BridgeHealth("test")
+	require.NoError(t, err)
+	assert.NotEmpty(t, health.LastError)
+
+	// Once the bridge is back we reconnect and its devices are refreshed.
+	server.start()
+	require.Eventually(t, func() bool {
+		return healthState() == BridgeHealth_CONNECTED
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, deviceReachable, time.Second, 10*time.Millisecond)
+
+	health, err = h.BridgeHealth("test")
+	require.NoError(t, err)
+	assert.Zero(t, health.ReconnectAttempts)
+
+	require.NoError(t, h.RemoveBridge("test"))
+}
+
+func TestHubHealthCheck(t *testing.T) {
+	logger := zap.NewNop()
+
+	server := &testBridgeServer{
+		t:   t,
+		sbs: NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{}, &mockBridge{}),
+	}
+	server.start()
+	defer server.stop()
+
+	conn := server.dial()
+	defer conn.Close()
+
+	h := NewHub(logger, HealthCheck(10*time.Millisecond, 10*time.Millisecond))
+	sink := h.Subscribe(&UpdateFilter{
+		Actions: []Update_Action{Update_CHANGED},
+	})
+	defer sink.Close()
+
+	var failingLock sync.Mutex
+	failing := false
+	err := h.addBridge(NewBridgeServiceClient(conn), func(context.Context) error {
+		failingLock.Lock()
+		defer failingLock.Unlock()
+
+		if failing {
+			return errors.New("no response")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	defer h.RemoveBridge("test")
+
+	nextHealth := func() *BridgeHealth {
+		select {
+		case update := <-sink.Updates():
+			require.NotNil(t, update.GetBridgeUpdate())
+			require.NotNil(t, update.GetBridgeUpdate().Health)
+			return update.GetBridgeUpdate().Health
+		case <-time.After(time.Second):
+			require.Fail(t, "timed out waiting for health change")
+		}
+		return nil
+	}
+
+	failingLock.Lock()
+	failing = true
+	failingLock.Unlock()
+
+	health := nextHealth()
+	assert.Equal(t, BridgeHealth_DEGRADED, health.State)
+	assert.Equal(t, "no response", health.LastError)
+
+	failingLock.Lock()
+	failing = false
+	failingLock.Unlock()
+
+	health = nextHealth()
+	assert.Equal(t, BridgeHealth_CONNECTED, health.State)
+}
+
+// slowBridgeClient blocks retrieving the bridge until released.
+type slowBridgeClient struct {
+	BridgeServiceClient
+
+	release chan struct{}
+}
+
+func (c *slowBridgeClient) GetBridge(ctx context.Context, in *GetBridgeRequest, opts ...grpc.CallOption) (*Bridge, error) {
+	select {
+	case <-c.release:
+		return nil, errors.New("unavailable")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestHubAddBridgeDoesNotBlock(t *testing.T) {
+	h := NewHub(zap.NewNop(), HealthCheck(0, 0))
+
+	c := &slowBridgeClient{release: make(chan struct{})}
+	added := make(chan error)
+	go func() {
+		added <- h.addBridge(c, nil)
+	}()
+
+	// The hub remains usable while the bridge being added is slow to respond.
+	listed := make(chan struct{})
+	go func() {
+		h.ListBridgeHealth()
+		close(listed)
+	}()
+
+	select {
+	case <-listed:
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for the bridge health")
+	}
+
+	close(c.release)
+	assert.Error(t, <-added)
+	assert.Empty(t, h.ListBridgeHealth())
+}
+
+func TestHubProcessUpdates(t *testing.T) {
+	h := NewHub(zap.NewNop(), HealthCheck(0, 0))
+
+	hb := &hubBridge{
+		id:     "test",
+		b:      &Bridge{Id: "test"},
+		health: &BridgeHealth{State: BridgeHealth_CONNECTED},
+	}
+	h.bridgesMutex.Lock()
+	h.bridges[hb.id] = hb
+	h.bridgesMutex.Unlock()
+
+	// Subscribing directly to the source ensures each change to the device is seen, rather than only the latest.
+	sink := NewUpdateSink(h.updateSource, nil)
+	defer sink.Close()
+
+	deviceUpdate := func(action Update_Action, device *Device) *Update {
+		return &Update{
+			Action: action,
+			Update: &Update_DeviceUpdate{
+				&DeviceUpdate{
+					Device:   device,
+					BridgeId: hb.id,
+				},
+			},
+		}
+	}
+	nextDevice := func() *Device {
+		select {
+		case update := <-sink.Updates():
+			require.NotNil(t, update.GetDeviceUpdate())
+			return update.GetDeviceUpdate().Device
+		case <-time.After(time.Second):
+			require.Fail(t, "timed out waiting for device update")
+		}
+		return nil
+	}
+
+	// Malformed updates and changes to unknown devices are skipped without stopping the processing of later updates.
+	h.queue(deviceUpdate(Update_ADDED, nil))
+	h.queue(deviceUpdate(Update_CHANGED, &Device{Id: "unknown"}))
+	h.queue(deviceUpdate(Update_ADDED, &Device{
+		Id: "1232",
+		State: &DeviceState{
+			IsReachable: true,
+			Binary:      &DeviceState_Binary{},
+		},
+	}))
+	assert.Equal(t, "1232", nextDevice().Id)
+
+	_, err := h.GetDevice("unknown")
+	assert.Error(t, err)
+
+	// Losing the bridge is applied on top of the latest state of each device.
+	h.queue(deviceUpdate(Update_CHANGED, &Device{
+		Id: "1232",
+		State: &DeviceState{
+			IsReachable: true,
+			Binary:      &DeviceState_Binary{IsOn: true},
+		},
+	}))
+	h.events <- hubEvent{lost: hb}
+
+	assert.True(t, nextDevice().State.Binary.IsOn)
+	device := nextDevice()
+	assert.False(t, device.State.IsReachable)
+	assert.True(t, device.State.Binary.IsOn)
+
+	device, err = h.GetDevice("1232")
+	require.NoError(t, err)
+	assert.False(t, device.State.IsReachable)
+	assert.True(t, device.State.Binary.IsOn)
+
+	// Losing the bridge after its devices are removed is harmless.
+	h.queue(deviceUpdate(Update_REMOVED, &Device{Id: "1232"}))
+	h.events <- hubEvent{lost: hb}
+	h.queue(deviceUpdate(Update_ADDED, &Device{Id: "1233"}))
+
+	assert.Equal(t, "1232", nextDevice().Id)
+	assert.Equal(t, "1233", nextDevice().Id)
+}
@@ -0,0 +1,120 @@
+package bridge
+
+import (
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+var (
+	// ErrInvalidMask is returned if an update mask names a field which doesn't exist, or which can't be updated on its own.
+	ErrInvalidMask = status.New(codes.InvalidArgument, "invalid update mask")
+)
+
+// ApplyStateMask returns a copy of the current state with the fields named in the mask replaced by those in the update.
+// A field named in the mask which isn't set in the update is cleared. If the mask is empty the update replaces
+// the current state entirely.
+func ApplyStateMask(current *DeviceState, update *DeviceState, mask *fieldmaskpb.FieldMask) (*DeviceState, error) {
+	if len(mask.GetPaths()) < 1 {
+		if update == nil {
+			return nil, nil
+		}
+		return proto.Clone(update).(*DeviceState), nil
+	}
+
+	ret := &DeviceState{}
+	if current != nil {
+		ret = proto.Clone(current).(*DeviceState)
+	}
+	if update == nil {
+		update = &DeviceState{}
+	} else {
+		// The update is cloned so the result doesn't share any lists or messages with it.
+		update = proto.Clone(update).(*DeviceState)
+	}
+
+	if err := applyMask(ret, update, mask); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ApplyConfigMask returns a copy of the current config with the fields named in the mask replaced by those in the update.
+// A field named in the mask which isn't set in the update is cleared. If the mask is empty the update replaces
+// the current config entirely.
+func ApplyConfigMask(current *DeviceConfig, update *DeviceConfig, mask *fieldmaskpb.FieldMask) (*DeviceConfig, error) {
+	if len(mask.GetPaths()) < 1 {
+		if update == nil {
+			return nil, nil
+		}
+		return proto.Clone(update).(*DeviceConfig), nil
+	}
+
+	ret := &DeviceConfig{}
+	if current != nil {
+		ret = proto.Clone(current).(*DeviceConfig)
+	}
+	if update == nil {
+		update = &DeviceConfig{}
+	} else {
+		// The update is cloned so the result doesn't share any lists or messages with it.
+		update = proto.Clone(update).(*DeviceConfig)
+	}
+
+	if err := applyMask(ret, update, mask); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// StateMask returns a mask naming each field which is set in the supplied state.
+// This is useful when the state describes only the fields a caller wants to change.
+func StateMask(state *DeviceState) *fieldmaskpb.FieldMask {
+	mask := &fieldmaskpb.FieldMask{}
+	if state == nil {
+		return mask
+	}
+
+	proto.MessageReflect(state).Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		mask.Paths = append(mask.Paths, string(fd.Name()))
+		return true
+	})
+	return mask
+}
+
+// applyMask copies each field named in the mask from src to dst.
+func applyMask(dst proto.Message, src proto.Message, mask *fieldmaskpb.FieldMask) error {
+	for _, path := range mask.GetPaths() {
+		if err := applyPath(proto.MessageReflect(dst), proto.MessageReflect(src), strings.Split(path, ".")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyPath(dst protoreflect.Message, src protoreflect.Message, names []string) error {
+	fd := dst.Descriptor().Fields().ByName(protoreflect.Name(names[0]))
+	if fd == nil {
+		return ErrInvalidMask.Err()
+	}
+
+	if len(names) == 1 {
+		if src.Has(fd) {
+			dst.Set(fd, src.Get(fd))
+		} else {
+			dst.Clear(fd)
+		}
+		return nil
+	}
+
+	// Only singular messages can be traversed; we can't address an element of a list or map.
+	if fd.Message() == nil || fd.IsList() || fd.IsMap() {
+		return ErrInvalidMask.Err()
+	}
+
+	return applyPath(dst.Mutable(fd).Message(), src.Get(fd).Message(), names[1:])
+}
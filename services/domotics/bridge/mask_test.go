@@ -0,0 +1,142 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func TestApplyStateMask(t *testing.T) {
+	current := &DeviceState{
+		IsReachable: true,
+		Binary:      &DeviceState_Binary{IsOn: true},
+		Range:       &DeviceState_Range{Value: 50},
+		Audio:       &DeviceState_Audio{Volume: 20, Treble: 3},
+	}
+
+	tests := []struct {
+		name     string
+		update   *DeviceState
+		paths    []string
+		expected *DeviceState
+		code     codes.Code
+	}{
+		{
+			"empty mask replaces state",
+			&DeviceState{
+				Binary: &DeviceState_Binary{IsOn: false},
+			},
+			nil,
+			&DeviceState{
+				Binary: &DeviceState_Binary{IsOn: false},
+			},
+			codes.OK,
+		},
+		{
+			"top level field replaced",
+			&DeviceState{
+				Range: &DeviceState_Range{Value: 80},
+			},
+			[]string{"range"},
+			&DeviceState{
+				IsReachable: true,
+				Binary:      &DeviceState_Binary{IsOn: true},
+				Range:       &DeviceState_Range{Value: 80},
+				Audio:       &DeviceState_Audio{Volume: 20, Treble: 3},
+			},
+			codes.OK,
+		},
+		{
+			"nested field replaced",
+			&DeviceState{
+				Audio: &DeviceState_Audio{Volume: 40, Treble: 9},
+			},
+			[]string{"audio.volume"},
+			&DeviceState{
+				IsReachable: true,
+				Binary:      &DeviceState_Binary{IsOn: true},
+				Range:       &DeviceState_Range{Value: 50},
+				Audio:       &DeviceState_Audio{Volume: 40, Treble: 3},
+			},
+			codes.OK,
+		},
+		{
+			"unset field cleared",
+			&DeviceState{},
+			[]string{"range"},
+			&DeviceState{
+				IsReachable: true,
+				Binary:      &DeviceState_Binary{IsOn: true},
+				Audio:       &DeviceState_Audio{Volume: 20, Treble: 3},
+			},
+			codes.OK,
+		},
+		{
+			"unknown field",
+			&DeviceState{},
+			[]string{"brightness"},
+			nil,
+			codes.InvalidArgument,
+		},
+		{
+			"scalar traversed",
+			&DeviceState{},
+			[]string{"is_reachable.value"},
+			nil,
+			codes.InvalidArgument,
+		},
+		{
+			"list traversed",
+			&DeviceState{},
+			[]string{"button.id"},
+			nil,
+			codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mask *fieldmaskpb.FieldMask
+			if tt.paths != nil {
+				mask = &fieldmaskpb.FieldMask{Paths: tt.paths}
+			}
+
+			orig := proto.Clone(current)
+			state, err := ApplyStateMask(current, tt.update, mask)
+			assert.Equal(t, tt.code, status.Code(err))
+			assert.True(t, proto.Equal(tt.expected, state), "expected %v, got %v", tt.expected, state)
+
+			// The inputs must never be modified.
+			assert.True(t, proto.Equal(orig, current))
+		})
+	}
+}
+
+func TestApplyConfigMask(t *testing.T) {
+	current := &DeviceConfig{
+		Name:        "Lamp",
+		Description: "Living room",
+	}
+
+	config, err := ApplyConfigMask(current, &DeviceConfig{Name: "Reading lamp"}, &fieldmaskpb.FieldMask{
+		Paths: []string{"name"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Reading lamp", config.Name)
+	assert.Equal(t, "Living room", config.Description)
+}
+
+func TestStateMask(t *testing.T) {
+	mask := StateMask(&DeviceState{
+		IsReachable: true,
+		Audio:       &DeviceState_Audio{Volume: 20},
+	})
+	assert.ElementsMatch(t, []string{"is_reachable", "audio"}, mask.Paths)
+
+	assert.Empty(t, StateMask(nil).Paths)
+}
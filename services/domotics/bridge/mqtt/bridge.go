@@ -0,0 +1,378 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/protobuf/proto"
+	"github.com/rmrobinson/nerves/lib/stream"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// The QoS used for all subscriptions and publishes; at least once.
+	qos            = 1
+	publishTimeout = 5 * time.Second
+)
+
+// Bridge is an implementation of a bridge for devices reachable through an MQTT broker.
+// Each device publishes its state to one or more topics and receives changes on a command topic;
+// templates convert between the payloads of these topics and the device state.
+type Bridge struct {
+	logger *zap.Logger
+
+	brInfo *bridge.Bridge
+	client paho.Client
+
+	devices     map[string]*device
+	devicesLock sync.Mutex
+
+	updates *stream.Source
+
+	// revisions versions the devices, and writeLock serializes writes so the version can't change between checking and writing.
+	revisions *bridge.RevisionTracker
+	writeLock sync.Mutex
+}
+
+// NewBridge creates a new bridge for the devices in the supplied config, which are reached using the supplied client.
+// The bridge doesn't receive any state until Subscribe is called.
+func NewBridge(logger *zap.Logger, brInfo *bridge.Bridge, client paho.Client, cfg *Config) (*Bridge, error) {
+	b := &Bridge{
+		logger:    logger,
+		brInfo:    brInfo,
+		client:    client,
+		devices:   map[string]*device{},
+		updates:   stream.NewSource(logger),
+		revisions: bridge.NewRevisionTracker(),
+	}
+
+	for _, deviceCfg := range cfg.Devices {
+		d, err := newDevice(deviceCfg)
+		if err != nil {
+			return nil, err
+		} else if _, ok := b.devices[d.device.Id]; ok {
+			return nil, fmt.Errorf("%w: duplicate device %s", ErrInvalidConfig, d.device.Id)
+		}
+
+		b.revisions.Stamp(d.device)
+		b.devices[d.device.Id] = d
+	}
+
+	return b, nil
+}
+
+// Subscribe subscribes to the state and availability topics of each device.
+// This should be called each time the client connects, as a clean session doesn't keep the subscriptions.
+func (b *Bridge) Subscribe() error {
+	for _, d := range b.devices {
+		for idx, stateCfg := range d.cfg.State {
+			if err := b.subscribe(stateCfg.Topic, b.stateHandler(d, idx)); err != nil {
+				return err
+			}
+		}
+
+		if d.cfg.Availability != nil {
+			if err := b.subscribe(d.cfg.Availability.Topic, b.availabilityHandler(d)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *Bridge) subscribe(topic string, handler paho.MessageHandler) error {
+	token := b.client.Subscribe(topic, qos, handler)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timed out subscribing to %s", topic)
+	} else if err := token.Error(); err != nil {
+		return err
+	}
+
+	b.logger.Debug("subscribed",
+		zap.String("topic", topic),
+	)
+	return nil
+}
+
+// stateHandler converts the payloads published to the specified state topic of the device into changes to its state.
+func (b *Bridge) stateHandler(d *device, idx int) paho.MessageHandler {
+	return func(_ paho.Client, msg paho.Message) {
+		var payload interface{}
+		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+			// Not every device publishes JSON, e.g. a Tasmota power topic is simply ON or OFF.
+			payload = string(msg.Payload())
+		}
+
+		var buf bytes.Buffer
+		if err := d.stateTemplates[idx].Execute(&buf, payload); err != nil {
+			b.logger.Info("unable to convert state payload",
+				zap.String("device_id", d.device.Id),
+				zap.String("topic", msg.Topic()),
+				zap.Error(err),
+			)
+			return
+		}
+
+		update := &bridge.DeviceState{}
+		if err := protojson.Unmarshal(buf.Bytes(), proto.MessageV2(update)); err != nil {
+			b.logger.Info("state template produced an invalid state",
+				zap.String("device_id", d.device.Id),
+				zap.String("topic", msg.Topic()),
+				zap.String("state", buf.String()),
+				zap.Error(err),
+			)
+			return
+		}
+
+		b.report(d, func(state *bridge.DeviceState) (*bridge.DeviceState, error) {
+			// Only the fields the topic describes are changed; a device may spread its state across many topics.
+			return bridge.ApplyStateMask(state, update, bridge.StateMask(update))
+		})
+	}
+}
+
+// availabilityHandler marks the device as reachable or unreachable as it reports whether it is online.
+func (b *Bridge) availabilityHandler(d *device) paho.MessageHandler {
+	return func(_ paho.Client, msg paho.Message) {
+		var isReachable bool
+		switch string(msg.Payload()) {
+		case d.cfg.Availability.Online:
+			isReachable = true
+		case d.cfg.Availability.Offline:
+			isReachable = false
+		default:
+			b.logger.Info("unknown availability payload",
+				zap.String("device_id", d.device.Id),
+				zap.String("payload", string(msg.Payload())),
+			)
+			return
+		}
+
+		b.report(d, func(state *bridge.DeviceState) (*bridge.DeviceState, error) {
+			state = proto.Clone(state).(*bridge.DeviceState)
+			state.IsReachable = isReachable
+			return state, nil
+		})
+	}
+}
+
+// report applies a change the device reported to its state, notifying any listeners if the state changed.
+func (b *Bridge) report(d *device, change func(*bridge.DeviceState) (*bridge.DeviceState, error)) {
+	b.devicesLock.Lock()
+	defer b.devicesLock.Unlock()
+
+	state, err := change(d.device.State)
+	if err != nil {
+		b.logger.Info("unable to apply reported state",
+			zap.String("device_id", d.device.Id),
+			zap.Error(err),
+		)
+		return
+	} else if proto.Equal(state, d.device.State) {
+		return
+	}
+
+	b.setState(d, state)
+}
+
+// setState records the new state of the device and notifies any listeners. The devices lock must be held.
+func (b *Bridge) setState(d *device, state *bridge.DeviceState) {
+	updated := proto.Clone(d.device).(*bridge.Device)
+	updated.State = state
+	b.revisions.Stamp(updated)
+	d.device = updated
+
+	b.updates.SendMessage(&bridge.Update{
+		Action: bridge.Update_CHANGED,
+		Update: &bridge.Update_DeviceUpdate{
+			DeviceUpdate: &bridge.DeviceUpdate{
+				Device:   updated,
+				DeviceId: updated.Id,
+				BridgeId: b.brInfo.Id,
+			},
+		},
+	})
+}
+
+// listDevices retrieves a copy of each of the devices.
+func (b *Bridge) listDevices() []*bridge.Device {
+	b.devicesLock.Lock()
+	defer b.devicesLock.Unlock()
+
+	var devices []*bridge.Device
+	for _, d := range b.devices {
+		devices = append(devices, d.device)
+	}
+	return devices
+}
+
+// GetBridge retrieves the bridge info of this service.
+func (b *Bridge) GetBridge(ctx context.Context, req *bridge.GetBridgeRequest) (*bridge.Bridge, error) {
+	ret := proto.Clone(b.brInfo).(*bridge.Bridge)
+	ret.Devices = b.listDevices()
+	return ret, nil
+}
+
+// ListDevices retrieves all registered devices.
+func (b *Bridge) ListDevices(ctx context.Context, req *bridge.ListDevicesRequest) (*bridge.ListDevicesResponse, error) {
+	return &bridge.ListDevicesResponse{
+		Devices: b.listDevices(),
+	}, nil
+}
+
+// GetDevice retrieves the specified device.
+func (b *Bridge) GetDevice(ctx context.Context, req *bridge.GetDeviceRequest) (*bridge.Device, error) {
+	b.devicesLock.Lock()
+	defer b.devicesLock.Unlock()
+
+	if d, ok := b.devices[req.Id]; ok {
+		return d.device, nil
+	}
+	return nil, bridge.ErrDeviceNotFound.Err()
+}
+
+// UpdateDeviceConfig exists to satisfy the domotics Bridge contract, but is not actually supported.
+func (b *Bridge) UpdateDeviceConfig(ctx context.Context, req *bridge.UpdateDeviceConfigRequest) (*bridge.Device, error) {
+	return nil, bridge.ErrNotSupported.Err()
+}
+
+// UpdateDeviceState publishes the provided state to the command topic of the specified device.
+// The device is assumed to have changed once the broker has accepted the command; any differences
+// the device later reports on its state topics are applied as they arrive.
+func (b *Bridge) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDeviceStateRequest) (*bridge.Device, error) {
+	if len(req.Id) < 1 || req.State == nil {
+		return nil, bridge.ErrMissingParam.Err()
+	}
+
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	b.devicesLock.Lock()
+	d, ok := b.devices[req.Id]
+	var current *bridge.Device
+	if ok {
+		current = d.device
+	}
+	b.devicesLock.Unlock()
+
+	if !ok {
+		return nil, bridge.ErrDeviceNotFound.Err()
+	} else if d.commandTemplate == nil {
+		return nil, bridge.ErrNotSupported.Err()
+	}
+
+	if err := b.revisions.Check(current, req.Version); err != nil {
+		b.logger.Debug("stale write, rejecting",
+			zap.String("device_id", req.Id),
+			zap.String("version", req.Version),
+			zap.String("current_version", current.Version),
+		)
+		return nil, err
+	}
+
+	state, err := bridge.ApplyStateMask(current.State, req.State, req.UpdateMask)
+	if err != nil {
+		return nil, err
+	} else if err := bridge.ValidateState(current, state); err != nil {
+		b.logger.Debug("unsupported write, rejecting",
+			zap.String("device_id", req.Id),
+			zap.Error(err),
+		)
+		return nil, err
+	} else if state.IsReachable == false {
+		return nil, bridge.ErrNotSupported.Err()
+	}
+
+	if proto.Equal(state, current.State) {
+		b.logger.Debug("noop write, ignoring",
+			zap.String("device_id", req.Id),
+		)
+		return current, nil
+	}
+
+	var buf bytes.Buffer
+	if err := d.commandTemplate.Execute(&buf, state); err != nil {
+		b.logger.Error("unable to convert state to command payload",
+			zap.String("device_id", req.Id),
+			zap.Error(err),
+		)
+		return nil, bridge.ErrInternal.Err()
+	}
+
+	token := b.client.Publish(d.cfg.Command.Topic, qos, d.cfg.Command.Retain, buf.Bytes())
+	if !token.WaitTimeout(publishTimeout) || token.Error() != nil {
+		b.logger.Error("unable to publish command",
+			zap.String("device_id", req.Id),
+			zap.String("topic", d.cfg.Command.Topic),
+			zap.Error(token.Error()),
+		)
+		return nil, bridge.ErrInternal.Err()
+	}
+
+	// The device may have reported changes while the command was published, such as going offline,
+	// so only the fields being written are applied on top of its latest state.
+	mask := req.UpdateMask
+	if len(mask.GetPaths()) < 1 {
+		mask = bridge.StateMask(req.State)
+	}
+
+	b.devicesLock.Lock()
+	defer b.devicesLock.Unlock()
+
+	latest, err := bridge.ApplyStateMask(d.device.State, req.State, mask)
+	if err != nil {
+		return nil, err
+	}
+	// Whether the device can be reached is only ever reported by the device.
+	latest.IsReachable = d.device.State.GetIsReachable()
+
+	if !proto.Equal(latest, d.device.State) {
+		b.setState(d, latest)
+	}
+	return d.device, nil
+}
+
+// BatchUpdateDeviceStates updates the state of each of the specified devices.
+func (b *Bridge) BatchUpdateDeviceStates(ctx context.Context, req *bridge.BatchUpdateDeviceStatesRequest) (*bridge.BatchUpdateDeviceStatesResponse, error) {
+	return bridge.BatchUpdate(ctx, req, b.UpdateDeviceState)
+}
+
+// StreamBridgeUpdates monitors changes for all changes which occur on the bridge.
+func (b *Bridge) StreamBridgeUpdates(req *bridge.StreamBridgeUpdatesRequest, stream bridge.BridgeService_StreamBridgeUpdatesServer) error {
+	peer, isOk := peer.FromContext(stream.Context())
+
+	addr := "unknown"
+	if isOk {
+		addr = peer.Addr.String()
+	}
+
+	logger := b.logger.With(zap.String("peer_addr", addr))
+
+	logger.Debug("bridge update stream initiated")
+
+	return bridge.ServeUpdates(logger, b.updates, req, stream, func(context.Context) ([]*bridge.Update, error) {
+		var updates []*bridge.Update
+		for _, device := range b.listDevices() {
+			updates = append(updates, &bridge.Update{
+				Action: bridge.Update_ADDED,
+				Update: &bridge.Update_DeviceUpdate{
+					DeviceUpdate: &bridge.DeviceUpdate{
+						Device:   device,
+						DeviceId: device.Id,
+						BridgeId: b.brInfo.Id,
+					},
+				},
+			})
+		}
+		return updates, nil
+	})
+}
@@ -0,0 +1,388 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mochi-co/mqtt/server"
+	"github.com/mochi-co/mqtt/server/listeners"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+var testConfig = &Config{
+	Devices: []DeviceConfig{
+		{
+			ID:   "lamp",
+			Type: "LIGHT",
+			Name: "Lamp",
+			Traits: []bridge.TraitConfig{
+				{Type: "BINARY", Writable: true},
+				{Type: "RANGE", Writable: true, Minimum: 0, Maximum: 254},
+			},
+			State: []StateTopic{
+				{
+					Topic:    "zigbee2mqtt/lamp",
+					Template: `{"binary": {"isOn": {{eq .state "ON"}}}, "range": {"value": {{.brightness}}}}`,
+				},
+			},
+			Command: &CommandTopic{
+				Topic:    "zigbee2mqtt/lamp/set",
+				Template: `{"state": "{{if .GetBinary.GetIsOn}}ON{{else}}OFF{{end}}", "brightness": {{.GetRange.GetValue}}}`,
+			},
+			Availability: &AvailabilityTopic{
+				Topic:   "zigbee2mqtt/lamp/availability",
+				Online:  "online",
+				Offline: "offline",
+			},
+		},
+		{
+			ID:   "plug",
+			Type: "OUTLET",
+			Traits: []bridge.TraitConfig{
+				{Type: "BINARY", Writable: true},
+				{Type: "POWER"},
+			},
+			State: []StateTopic{
+				{
+					Topic:    "stat/plug/POWER",
+					Template: `{"binary": {"isOn": {{eq . "ON"}}}}`,
+				},
+				{
+					Topic:    "tele/plug/SENSOR",
+					Template: `{"power": {"watts": {{.ENERGY.Power}}}}`,
+				},
+			},
+			Command: &CommandTopic{
+				Topic:    "cmnd/plug/POWER",
+				Template: `{{if .GetBinary.GetIsOn}}ON{{else}}OFF{{end}}`,
+			},
+		},
+		{
+			ID:   "sensor",
+			Type: "SENSOR",
+			Traits: []bridge.TraitConfig{
+				{Type: "TEMPERATURE", Writable: true},
+			},
+			State: []StateTopic{
+				{
+					Topic:    "zigbee2mqtt/sensor",
+					Template: `{"temperature": {"degreesCelsius": {{.temperature}}}}`,
+				},
+			},
+		},
+	},
+}
+
+// startBroker runs an MQTT broker on a local port for the duration of the test.
+func startBroker(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+
+	broker := server.New()
+	require.NoError(t, broker.AddListener(listeners.NewTCP("test", addr), nil))
+	require.NoError(t, broker.Serve())
+	t.Cleanup(func() {
+		broker.Close()
+	})
+
+	return "tcp://" + addr
+}
+
+func connect(t *testing.T, brokerURL string, clientID string) paho.Client {
+	client := paho.NewClient(paho.NewClientOptions().
+		AddBroker(brokerURL).
+		SetClientID(clientID))
+
+	token := client.Connect()
+	require.True(t, token.WaitTimeout(time.Second))
+	require.NoError(t, token.Error())
+	t.Cleanup(func() {
+		client.Disconnect(0)
+	})
+
+	return client
+}
+
+func publish(t *testing.T, client paho.Client, topic string, payload string) {
+	token := client.Publish(topic, qos, false, payload)
+	require.True(t, token.WaitTimeout(time.Second))
+	require.NoError(t, token.Error())
+}
+
+func newTestBridge(t *testing.T) (*Bridge, paho.Client) {
+	brokerURL := startBroker(t)
+
+	// The client's goroutines may still be logging as the test completes, which zaptest doesn't allow.
+	b, err := NewBridge(zap.NewNop(), &bridge.Bridge{Id: "mqtt"}, connect(t, brokerURL, "bridge"), testConfig)
+	require.NoError(t, err)
+	require.NoError(t, b.Subscribe())
+
+	return b, connect(t, brokerURL, "devices")
+}
+
+func TestBridgeState(t *testing.T) {
+	b, devices := newTestBridge(t)
+
+	getDevice := func(id string) *bridge.Device {
+		d, err := b.GetDevice(context.Background(), &bridge.GetDeviceRequest{Id: id})
+		require.NoError(t, err)
+		return d
+	}
+
+	publish(t, devices, "zigbee2mqtt/lamp", `{"state": "ON", "brightness": 200, "linkquality": 42}`)
+	require.Eventually(t, func() bool {
+		return getDevice("lamp").State.GetBinary().GetIsOn()
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(200), getDevice("lamp").State.Range.Value)
+
+	// Each topic only changes the fields it describes.
+	publish(t, devices, "stat/plug/POWER", "ON")
+	publish(t, devices, "tele/plug/SENSOR", `{"ENERGY": {"Power": 12.5}}`)
+	require.Eventually(t, func() bool {
+		return getDevice("plug").State.GetPower().GetWatts() == 12.5
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, getDevice("plug").State.Binary.IsOn)
+
+	publish(t, devices, "zigbee2mqtt/lamp/availability", "offline")
+	require.Eventually(t, func() bool {
+		return !getDevice("lamp").State.IsReachable
+	}, time.Second, 10*time.Millisecond)
+
+	// Unreachable devices can't be changed.
+	_, err := b.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id:    "lamp",
+		State: &bridge.DeviceState{Binary: &bridge.DeviceState_Binary{IsOn: false}},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"binary.is_on"},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	publish(t, devices, "zigbee2mqtt/lamp/availability", "online")
+	require.Eventually(t, func() bool {
+		return getDevice("lamp").State.IsReachable
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBridgeCommand(t *testing.T) {
+	b, devices := newTestBridge(t)
+
+	commands := make(chan string, 10)
+	token := devices.Subscribe("#", qos, func(_ paho.Client, msg paho.Message) {
+		commands <- msg.Topic() + " " + string(msg.Payload())
+	})
+	require.True(t, token.WaitTimeout(time.Second))
+	require.NoError(t, token.Error())
+
+	nextCommand := func() string {
+		select {
+		case cmd := <-commands:
+			return cmd
+		case <-time.After(time.Second):
+			require.Fail(t, "timed out waiting for command")
+		}
+		return ""
+	}
+
+	resp, err := b.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id: "lamp",
+		State: &bridge.DeviceState{
+			Binary: &bridge.DeviceState_Binary{IsOn: true},
+			Range:  &bridge.DeviceState_Range{Value: 100},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"binary", "range"},
+		},
+	})
+	require.NoError(t, err)
+	assert.True(t, resp.State.Binary.IsOn)
+	assert.Equal(t, `zigbee2mqtt/lamp/set {"state": "ON", "brightness": 100}`, nextCommand())
+
+	_, err = b.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id: "plug",
+		State: &bridge.DeviceState{
+			Binary: &bridge.DeviceState_Binary{IsOn: true},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"binary.is_on"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "cmnd/plug/POWER ON", nextCommand())
+
+	// Values outside of the traits are rejected before anything is published.
+	_, err = b.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id: "lamp",
+		State: &bridge.DeviceState{
+			Range: &bridge.DeviceState_Range{Value: 300},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"range.value"},
+		},
+	})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	// Devices without a command topic are read-only.
+	_, err = b.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id: "sensor",
+		State: &bridge.DeviceState{
+			Temperature: &bridge.DeviceState_Temperature{Celsius: 30},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = b.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id:    "missing",
+		State: &bridge.DeviceState{},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// hookedClient invokes onPublish before each message is published.
+type hookedClient struct {
+	paho.Client
+
+	onPublish func()
+}
+
+func (c *hookedClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	if c.onPublish != nil {
+		c.onPublish()
+	}
+	return c.Client.Publish(topic, qos, retained, payload)
+}
+
+func TestBridgeCommandKeepsReports(t *testing.T) {
+	brokerURL := startBroker(t)
+
+	client := &hookedClient{Client: connect(t, brokerURL, "bridge")}
+	b, err := NewBridge(zap.NewNop(), &bridge.Bridge{Id: "mqtt"}, client, testConfig)
+	require.NoError(t, err)
+	require.NoError(t, b.Subscribe())
+	devices := connect(t, brokerURL, "devices")
+
+	getDevice := func() *bridge.Device {
+		d, err := b.GetDevice(context.Background(), &bridge.GetDeviceRequest{Id: "lamp"})
+		require.NoError(t, err)
+		return d
+	}
+
+	publish(t, devices, "zigbee2mqtt/lamp", `{"state": "OFF", "brightness": 200}`)
+	require.Eventually(t, func() bool {
+		return getDevice().State.GetRange().GetValue() == 200
+	}, time.Second, 10*time.Millisecond)
+
+	// The lamp reports a new brightness and goes offline while the command is being published.
+	client.onPublish = func() {
+		publish(t, devices, "zigbee2mqtt/lamp", `{"state": "OFF", "brightness": 50}`)
+		publish(t, devices, "zigbee2mqtt/lamp/availability", "offline")
+		require.Eventually(t, func() bool {
+			d := getDevice()
+			return d.State.GetRange().GetValue() == 50 && !d.State.IsReachable
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	resp, err := b.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id: "lamp",
+		State: &bridge.DeviceState{
+			Binary: &bridge.DeviceState_Binary{IsOn: true},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"binary.is_on"},
+		},
+	})
+	require.NoError(t, err)
+	assert.True(t, resp.State.Binary.IsOn)
+	assert.Equal(t, int32(50), resp.State.Range.Value)
+	assert.False(t, resp.State.IsReachable)
+}
+
+func TestBridgeStream(t *testing.T) {
+	b, devices := newTestBridge(t)
+
+	lis := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	bridge.RegisterBridgeServiceServer(grpcServer, b)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := bridge.NewBridgeServiceClient(conn).StreamBridgeUpdates(ctx, &bridge.StreamBridgeUpdatesRequest{
+		Filter: &bridge.UpdateFilter{
+			DeviceIds: []string{"sensor"},
+		},
+	})
+	require.NoError(t, err)
+
+	update, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, bridge.Update_ADDED, update.Action)
+	assert.Equal(t, "sensor", update.GetDeviceUpdate().DeviceId)
+
+	publish(t, devices, "zigbee2mqtt/sensor", `{"temperature": 21.5}`)
+
+	update, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, bridge.Update_CHANGED, update.Action)
+	assert.Equal(t, "mqtt", update.GetDeviceUpdate().BridgeId)
+	assert.Equal(t, 21.5, update.GetDeviceUpdate().Device.State.Temperature.DegreesCelsius)
+}
+
+func TestNewBridgeInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  DeviceConfig
+	}{
+		{
+			"missing id",
+			DeviceConfig{Type: "LIGHT"},
+		},
+		{
+			"unknown type",
+			DeviceConfig{ID: "1", Type: "TOASTER"},
+		},
+		{
+			"unknown trait",
+			DeviceConfig{ID: "1", Type: "LIGHT", Traits: []bridge.TraitConfig{{Type: "WARP"}}},
+		},
+		{
+			"invalid template",
+			DeviceConfig{ID: "1", Type: "LIGHT", State: []StateTopic{{Topic: "a", Template: "{{.state"}}},
+		},
+		{
+			"missing command topic",
+			DeviceConfig{ID: "1", Type: "LIGHT", Command: &CommandTopic{}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewBridge(zap.NewNop(), &bridge.Bridge{}, nil, &Config{
+				Devices: []DeviceConfig{tt.cfg},
+			})
+			assert.True(t, errors.Is(err, ErrInvalidConfig))
+		})
+	}
+}
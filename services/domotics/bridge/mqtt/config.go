@@ -0,0 +1,156 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// ErrInvalidConfig is returned if the config doesn't describe a usable set of devices.
+	ErrInvalidConfig = errors.New("invalid config")
+)
+
+// Config describes the devices reachable through the broker.
+type Config struct {
+	Devices []DeviceConfig `yaml:"devices"`
+}
+
+// DeviceConfig describes a device and the topics it uses.
+type DeviceConfig struct {
+	ID           string `yaml:"id"`
+	Type         string `yaml:"type"`
+	Name         string `yaml:"name"`
+	Description  string `yaml:"description"`
+	Manufacturer string `yaml:"manufacturer"`
+	Model        string `yaml:"model"`
+
+	Traits []bridge.TraitConfig `yaml:"traits"`
+
+	// State lists the topics the device publishes its state to.
+	State []StateTopic `yaml:"state"`
+	// Command is the topic the device receives state changes on; devices without one are read-only.
+	Command *CommandTopic `yaml:"command"`
+	// Availability is the topic the device publishes whether it is online to, if it does.
+	Availability *AvailabilityTopic `yaml:"availability"`
+}
+
+// StateTopic converts the payloads published to the topic into device state.
+// The template is executed with the decoded JSON payload, or the payload as a string if it isn't JSON,
+// and must produce the changed fields of the state in the protobuf JSON format, e.g.
+// {"binary": {"isOn": {{eq .state "ON"}}}}.
+type StateTopic struct {
+	Topic    string `yaml:"topic"`
+	Template string `yaml:"template"`
+}
+
+// CommandTopic converts state changes into the payloads published to the topic.
+// The template is executed with the bridge.DeviceState being requested; its getters are safe to use
+// on fields which aren't set, e.g. {"state": "{{if .GetBinary.GetIsOn}}ON{{else}}OFF{{end}}"}.
+type CommandTopic struct {
+	Topic    string `yaml:"topic"`
+	Template string `yaml:"template"`
+	Retain   bool   `yaml:"retain"`
+}
+
+// AvailabilityTopic marks the device as reachable or unreachable as the online or offline payloads are published to it.
+type AvailabilityTopic struct {
+	Topic   string `yaml:"topic"`
+	Online  string `yaml:"online"`
+	Offline string `yaml:"offline"`
+}
+
+// LoadConfig reads the config at the specified path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// device is a configured device along with its current state.
+type device struct {
+	cfg DeviceConfig
+
+	stateTemplates  []*template.Template
+	commandTemplate *template.Template
+
+	device *bridge.Device
+}
+
+func newDevice(cfg DeviceConfig) (*device, error) {
+	if len(cfg.ID) < 1 {
+		return nil, fmt.Errorf("%w: device id missing", ErrInvalidConfig)
+	}
+
+	deviceType, ok := bridge.DeviceType_value[cfg.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w: device %s: unknown type %s", ErrInvalidConfig, cfg.ID, cfg.Type)
+	}
+
+	d := &device{
+		cfg: cfg,
+		device: &bridge.Device{
+			Id:           cfg.ID,
+			Type:         bridge.DeviceType(deviceType),
+			IsActive:     true,
+			Manufacturer: cfg.Manufacturer,
+			ModelId:      cfg.Model,
+			Config: &bridge.DeviceConfig{
+				Name:        cfg.Name,
+				Description: cfg.Description,
+			},
+			State: &bridge.DeviceState{
+				IsReachable: true,
+			},
+		},
+	}
+
+	for _, traitCfg := range cfg.Traits {
+		trait, ok := traitCfg.Trait(cfg.Command != nil)
+		if !ok {
+			return nil, fmt.Errorf("%w: device %s: unknown trait %s", ErrInvalidConfig, cfg.ID, traitCfg.Type)
+		}
+		d.device.Traits = append(d.device.Traits, trait)
+	}
+
+	for idx, stateCfg := range cfg.State {
+		if len(stateCfg.Topic) < 1 {
+			return nil, fmt.Errorf("%w: device %s: state topic missing", ErrInvalidConfig, cfg.ID)
+		}
+
+		tmpl, err := template.New(fmt.Sprintf("%s-state-%d", cfg.ID, idx)).Parse(stateCfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("%w: device %s: %s", ErrInvalidConfig, cfg.ID, err.Error())
+		}
+		d.stateTemplates = append(d.stateTemplates, tmpl)
+	}
+
+	if cfg.Command != nil {
+		if len(cfg.Command.Topic) < 1 {
+			return nil, fmt.Errorf("%w: device %s: command topic missing", ErrInvalidConfig, cfg.ID)
+		}
+
+		tmpl, err := template.New(fmt.Sprintf("%s-command", cfg.ID)).Parse(cfg.Command.Template)
+		if err != nil {
+			return nil, fmt.Errorf("%w: device %s: %s", ErrInvalidConfig, cfg.ID, err.Error())
+		}
+		d.commandTemplate = tmpl
+	}
+
+	if cfg.Availability != nil && len(cfg.Availability.Topic) < 1 {
+		return nil, fmt.Errorf("%w: device %s: availability topic missing", ErrInvalidConfig, cfg.ID)
+	}
+
+	return d, nil
+}
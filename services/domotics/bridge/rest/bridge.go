@@ -0,0 +1,245 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrRequestFailed is returned if the device responds to a request with an error.
+	ErrRequestFailed = errors.New("request failed")
+	// ErrReadOnly is returned if a change is requested of a device without any commands.
+	ErrReadOnly = errors.New("device is read-only")
+)
+
+// Reporter records the changes to the state of the devices which are found by polling.
+// It is satisfied by the bridge.SyncBridgeService.
+type Reporter interface {
+	ReportDeviceChange(id string, change func(*bridge.DeviceState)) (*bridge.Device, error)
+}
+
+// Bridge is an implementation of a bridge for devices which expose their state over HTTP.
+// Each device is polled for its state, which is extracted from the JSON response,
+// and is sent requests built from templates to change its state.
+// It is intended to be served by a bridge.SyncBridgeService, which only reports polled state when it changes.
+type Bridge struct {
+	logger  *zap.Logger
+	client  *http.Client
+	devices map[string]*device
+}
+
+// NewBridge creates a new bridge for the devices in the supplied config, which are reached using the supplied client.
+func NewBridge(logger *zap.Logger, client *http.Client, cfg *Config) (*Bridge, error) {
+	b := &Bridge{
+		logger:  logger,
+		client:  client,
+		devices: map[string]*device{},
+	}
+
+	for _, deviceCfg := range cfg.Devices {
+		d, err := newDevice(deviceCfg)
+		if err != nil {
+			return nil, err
+		} else if _, ok := b.devices[d.device.Id]; ok {
+			return nil, fmt.Errorf("%w: duplicate device %s", ErrInvalidConfig, d.device.Id)
+		}
+
+		b.devices[d.device.Id] = d
+	}
+
+	return b, nil
+}
+
+// Devices retrieves a copy of each of the configured devices, to be supplied to the bridge.SyncBridgeService.
+func (b *Bridge) Devices() map[string]*bridge.Device {
+	devices := map[string]*bridge.Device{}
+	for id, d := range b.devices {
+		devices[id] = proto.Clone(d.device).(*bridge.Device)
+	}
+	return devices
+}
+
+// SetDeviceState sends each of the commands of the device which change a field that differs from its current state.
+func (b *Bridge) SetDeviceState(ctx context.Context, dev *bridge.Device, state *bridge.DeviceState) error {
+	d, ok := b.devices[dev.Id]
+	if !ok {
+		return bridge.ErrDeviceNotFound.Err()
+	} else if len(d.commands) < 1 {
+		return ErrReadOnly
+	}
+
+	for _, cmd := range d.commands {
+		if !cmd.changed(dev.State, state) {
+			continue
+		}
+
+		resp, err := b.send(ctx, cmd.request, state)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	return nil
+}
+
+// Run polls the state of each device until the context is cancelled.
+func (b *Bridge) Run(ctx context.Context, r Reporter) {
+	var wg sync.WaitGroup
+
+	for _, d := range b.devices {
+		if d.poll == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			b.run(ctx, r, d)
+		}(d)
+	}
+
+	wg.Wait()
+}
+
+func (b *Bridge) run(ctx context.Context, r Reporter, d *device) {
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		b.poll(ctx, r, d)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll retrieves the state of the device and reports it. A device which can't be polled is reported as unreachable.
+// Only the polled fields are changed, and only once the response is received, so writes made while the device is
+// being polled aren't reverted.
+func (b *Bridge) poll(ctx context.Context, r Reporter, d *device) {
+	doc, err := b.fetch(ctx, d.poll)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+
+		b.logger.Info("unable to poll device",
+			zap.String("device_id", d.device.Id),
+			zap.Error(err),
+		)
+	}
+
+	var extractErrs []error
+	_, reportErr := r.ReportDeviceChange(d.device.Id, func(state *bridge.DeviceState) {
+		state.IsReachable = err == nil
+		if err != nil {
+			return
+		}
+
+		for _, f := range d.fields {
+			if err := f.extract(doc, state); err != nil {
+				extractErrs = append(extractErrs, err)
+			}
+		}
+	})
+	for _, err := range extractErrs {
+		b.logger.Debug("unable to extract field",
+			zap.String("device_id", d.device.Id),
+			zap.Error(err),
+		)
+	}
+	if reportErr != nil {
+		b.logger.Info("unable to report device state",
+			zap.String("device_id", d.device.Id),
+			zap.Error(reportErr),
+		)
+	}
+}
+
+// extract sets the field of the state from the value found in the decoded response.
+func (f *field) extract(doc interface{}, state *bridge.DeviceState) error {
+	raw, err := f.path.lookup(doc)
+	if err != nil {
+		return err
+	}
+
+	var value string
+	switch v := raw.(type) {
+	case string:
+		value = v
+	case bool:
+		value = strconv.FormatBool(v)
+	case float64:
+		value = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Errorf("%w: value isn't a string, number or bool", ErrNoValue)
+	}
+
+	if mapped, ok := f.values[value]; ok {
+		value = mapped
+	}
+	return setField(state, f.field, value)
+}
+
+// fetch sends the request and decodes the JSON response.
+func (b *Bridge) fetch(ctx context.Context, req *request) (interface{}, error) {
+	resp, err := b.send(ctx, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var doc interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// send builds the request from its templates using the supplied data and sends it.
+// A response with an error status is returned as an error; otherwise the caller must close its body.
+func (b *Bridge) send(ctx context.Context, req *request, data interface{}) (*http.Response, error) {
+	var url, body bytes.Buffer
+	if err := req.url.Execute(&url, data); err != nil {
+		return nil, err
+	} else if err := req.body.Execute(&body, data); err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, url.String(), &body)
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range req.headers {
+		httpReq.Header.Set(key, val)
+	}
+
+	resp, err := b.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s %s: %s", ErrRequestFailed, req.method, url.String(), resp.Status)
+	}
+
+	b.logger.Debug("sent request",
+		zap.String("method", req.method),
+		zap.String("url", url.String()),
+	)
+	return resp, nil
+}
@@ -0,0 +1,424 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// testDevice is a device which exposes its state over HTTP, in the style of many small gadgets.
+type testDevice struct {
+	lock       sync.Mutex
+	status     map[string]interface{}
+	failing    bool
+	requests   []string
+	pollCount  int
+	authorized bool
+}
+
+func (td *testDevice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+
+	if td.failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/status":
+		td.pollCount++
+		json.NewEncoder(w).Encode(td.status)
+	default:
+		body, _ := ioutil.ReadAll(r.Body)
+		td.requests = append(td.requests, r.Method+" "+r.URL.Path+" "+string(body))
+		td.authorized = td.authorized || r.Header.Get("Authorization") == "Bearer token"
+	}
+}
+
+func (td *testDevice) set(f func(td *testDevice)) {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	f(td)
+}
+
+func newTestBridge(t *testing.T) (*bridge.SyncBridgeService, *testDevice) {
+	td := &testDevice{
+		status: map[string]interface{}{
+			"relay": map[string]interface{}{
+				"state":     "ON",
+				"intensity": 42,
+			},
+			"sensors": []interface{}{
+				map[string]interface{}{"temp": 21.5},
+			},
+		},
+	}
+	server := httptest.NewServer(td)
+	t.Cleanup(server.Close)
+
+	cfg := &Config{
+		Devices: []DeviceConfig{
+			{
+				ID:   "lamp",
+				Type: "LIGHT",
+				Traits: []bridge.TraitConfig{
+					{Type: "BINARY", Writable: true},
+					{Type: "RANGE", Writable: true, Minimum: 0, Maximum: 100},
+				},
+				Poll: &PollConfig{
+					RequestConfig: RequestConfig{
+						URL: server.URL + "/status",
+					},
+					Interval: 10 * time.Millisecond,
+					Fields: []FieldConfig{
+						{
+							Path:   "$.relay.state",
+							Field:  "binary.is_on",
+							Values: map[string]string{"ON": "true", "OFF": "false"},
+						},
+						{
+							Path:  "$.relay.intensity",
+							Field: "range.value",
+						},
+					},
+				},
+				Commands: []CommandConfig{
+					{
+						RequestConfig: RequestConfig{
+							Method:  http.MethodPost,
+							URL:     server.URL + "/relay/{{if .GetBinary.GetIsOn}}on{{else}}off{{end}}",
+							Headers: map[string]string{"Authorization": "Bearer token"},
+						},
+						Fields: []string{"binary"},
+					},
+					{
+						RequestConfig: RequestConfig{
+							Method: http.MethodPut,
+							URL:    server.URL + "/intensity",
+							Body:   `{"intensity": {{.GetRange.GetValue}}}`,
+						},
+						Fields: []string{"range.value"},
+					},
+				},
+			},
+			{
+				ID:   "sensor",
+				Type: "SENSOR",
+				Traits: []bridge.TraitConfig{
+					{Type: "TEMPERATURE", Writable: true},
+				},
+				Poll: &PollConfig{
+					RequestConfig: RequestConfig{
+						URL: server.URL + "/status",
+					},
+					Interval: 10 * time.Millisecond,
+					Fields: []FieldConfig{
+						{
+							Path:  "$.sensors[0].temp",
+							Field: "temperature.degrees_celsius",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	br, err := NewBridge(zap.NewNop(), server.Client(), cfg)
+	require.NoError(t, err)
+
+	sbs := bridge.NewSyncBridgeService(zap.NewNop(), &bridge.Bridge{Id: "rest"}, br.Devices(), br)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		br.Run(ctx, sbs)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return sbs, td
+}
+
+func TestBridgePoll(t *testing.T) {
+	sbs, td := newTestBridge(t)
+
+	getDevice := func(id string) *bridge.Device {
+		d, err := sbs.GetDevice(context.Background(), &bridge.GetDeviceRequest{Id: id})
+		require.NoError(t, err)
+		return proto.Clone(d).(*bridge.Device)
+	}
+
+	require.Eventually(t, func() bool {
+		return getDevice("lamp").State.GetBinary().GetIsOn()
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(42), getDevice("lamp").State.Range.Value)
+
+	require.Eventually(t, func() bool {
+		return getDevice("sensor").State.GetTemperature().GetDegreesCelsius() == 21.5
+	}, time.Second, 10*time.Millisecond)
+
+	// Polls which find the same state don't change the device.
+	version := getDevice("sensor").Version
+	pollCount := 0
+	td.set(func(td *testDevice) { pollCount = td.pollCount })
+	require.Eventually(t, func() bool {
+		count := 0
+		td.set(func(td *testDevice) { count = td.pollCount })
+		return count > pollCount+4
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, version, getDevice("sensor").Version)
+
+	td.set(func(td *testDevice) {
+		td.status["sensors"] = []interface{}{
+			map[string]interface{}{"temp": 22},
+		}
+	})
+	require.Eventually(t, func() bool {
+		return getDevice("sensor").State.GetTemperature().GetDegreesCelsius() == 22
+	}, time.Second, 10*time.Millisecond)
+	assert.NotEqual(t, version, getDevice("sensor").Version)
+
+	td.set(func(td *testDevice) { td.failing = true })
+	require.Eventually(t, func() bool {
+		return !getDevice("lamp").State.IsReachable
+	}, time.Second, 10*time.Millisecond)
+
+	// Unreachable devices can't be changed.
+	_, err := sbs.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id:    "lamp",
+		State: &bridge.DeviceState{Binary: &bridge.DeviceState_Binary{IsOn: false}},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"binary.is_on"},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	td.set(func(td *testDevice) { td.failing = false })
+	require.Eventually(t, func() bool {
+		return getDevice("lamp").State.IsReachable
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBridgeCommand(t *testing.T) {
+	sbs, td := newTestBridge(t)
+
+	require.Eventually(t, func() bool {
+		d, err := sbs.GetDevice(context.Background(), &bridge.GetDeviceRequest{Id: "lamp"})
+		require.NoError(t, err)
+		return d.State.GetRange().GetValue() == 42
+	}, time.Second, 10*time.Millisecond)
+
+	requests := func() []string {
+		var reqs []string
+		td.set(func(td *testDevice) {
+			reqs = td.requests
+			td.requests = nil
+		})
+		return reqs
+	}
+
+	// Only the commands for the changed fields are sent.
+	_, err := sbs.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id:    "lamp",
+		State: &bridge.DeviceState{Range: &bridge.DeviceState_Range{Value: 80}},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"range.value"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{`PUT /intensity {"intensity": 80}`}, requests())
+
+	// The device must have applied the change, or the next poll would revert it.
+	td.set(func(td *testDevice) {
+		td.status["relay"] = map[string]interface{}{"state": "OFF", "intensity": 80}
+	})
+	require.Eventually(t, func() bool {
+		d, err := sbs.GetDevice(context.Background(), &bridge.GetDeviceRequest{Id: "lamp"})
+		require.NoError(t, err)
+		return !d.State.GetBinary().GetIsOn()
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = sbs.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id: "lamp",
+		State: &bridge.DeviceState{
+			Binary: &bridge.DeviceState_Binary{IsOn: true},
+			Range:  &bridge.DeviceState_Range{Value: 80},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"binary", "range"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"POST /relay/on "}, requests())
+	td.set(func(td *testDevice) { assert.True(t, td.authorized) })
+
+	// Devices whose requests fail aren't changed.
+	td.set(func(td *testDevice) { td.failing = true })
+	_, err = sbs.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id:    "lamp",
+		State: &bridge.DeviceState{Range: &bridge.DeviceState_Range{Value: 10}},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"range.value"},
+		},
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	td.set(func(td *testDevice) { td.failing = false })
+
+	// Devices without commands are read-only.
+	_, err = sbs.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
+		Id: "sensor",
+		State: &bridge.DeviceState{
+			Temperature: &bridge.DeviceState_Temperature{DegreesCelsius: 30},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"temperature"},
+		},
+	})
+	assert.Error(t, err)
+	assert.Empty(t, requests())
+}
+
+func TestNewBridgeInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  DeviceConfig
+	}{
+		{
+			"missing id",
+			DeviceConfig{Type: "LIGHT"},
+		},
+		{
+			"unknown type",
+			DeviceConfig{ID: "1", Type: "TOASTER"},
+		},
+		{
+			"unknown trait",
+			DeviceConfig{ID: "1", Type: "LIGHT", Traits: []bridge.TraitConfig{{Type: "WARP"}}},
+		},
+		{
+			"missing poll url",
+			DeviceConfig{ID: "1", Type: "LIGHT", Poll: &PollConfig{}},
+		},
+		{
+			"invalid path",
+			DeviceConfig{ID: "1", Type: "LIGHT", Poll: &PollConfig{
+				RequestConfig: RequestConfig{URL: "http://light"},
+				Fields:        []FieldConfig{{Path: "state.on", Field: "binary.is_on"}},
+			}},
+		},
+		{
+			"unknown field",
+			DeviceConfig{ID: "1", Type: "LIGHT", Poll: &PollConfig{
+				RequestConfig: RequestConfig{URL: "http://light"},
+				Fields:        []FieldConfig{{Path: "$.state.on", Field: "binary.is_off"}},
+			}},
+		},
+		{
+			"message field",
+			DeviceConfig{ID: "1", Type: "LIGHT", Poll: &PollConfig{
+				RequestConfig: RequestConfig{URL: "http://light"},
+				Fields:        []FieldConfig{{Path: "$.state", Field: "binary"}},
+			}},
+		},
+		{
+			"invalid template",
+			DeviceConfig{ID: "1", Type: "LIGHT", Commands: []CommandConfig{{
+				RequestConfig: RequestConfig{URL: "http://light", Body: "{{.GetBinary"},
+			}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewBridge(zap.NewNop(), http.DefaultClient, &Config{
+				Devices: []DeviceConfig{tt.cfg},
+			})
+			assert.True(t, errors.Is(err, ErrInvalidConfig))
+		})
+	}
+}
+
+// testReporter applies the reported changes to a single state.
+type testReporter struct {
+	state *bridge.DeviceState
+}
+
+func (r *testReporter) ReportDeviceChange(id string, change func(*bridge.DeviceState)) (*bridge.Device, error) {
+	change(r.state)
+	return &bridge.Device{Id: id, State: r.state}, nil
+}
+
+func TestBridgePollMergesFields(t *testing.T) {
+	td := &testDevice{
+		status: map[string]interface{}{
+			"relay": map[string]interface{}{"state": "ON"},
+		},
+	}
+	server := httptest.NewServer(td)
+	defer server.Close()
+
+	br, err := NewBridge(zap.NewNop(), server.Client(), &Config{
+		Devices: []DeviceConfig{
+			{
+				ID:   "lamp",
+				Type: "LIGHT",
+				Poll: &PollConfig{
+					RequestConfig: RequestConfig{URL: server.URL + "/status"},
+					Interval:      time.Minute,
+					Fields: []FieldConfig{
+						{
+							Path:   "$.relay.state",
+							Field:  "binary.is_on",
+							Values: map[string]string{"ON": "true", "OFF": "false"},
+						},
+						{
+							Path:  "$.relay.intensity",
+							Field: "range.value",
+						},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	r := &testReporter{
+		state: &bridge.DeviceState{
+			Range: &bridge.DeviceState_Range{Value: 10},
+			Audio: &bridge.DeviceState_Audio{Volume: 20},
+		},
+	}
+
+	// Fields which aren't polled, or are missing from the response, keep their current values.
+	br.poll(context.Background(), r, br.devices["lamp"])
+	assert.True(t, r.state.IsReachable)
+	assert.True(t, r.state.Binary.IsOn)
+	assert.Equal(t, int32(10), r.state.Range.Value)
+	assert.Equal(t, int32(20), r.state.Audio.Volume)
+
+	// A failed poll only changes the reachability.
+	td.set(func(td *testDevice) { td.failing = true })
+	br.poll(context.Background(), r, br.devices["lamp"])
+	assert.False(t, r.state.IsReachable)
+	assert.True(t, r.state.Binary.IsOn)
+	assert.Equal(t, int32(20), r.state.Audio.Volume)
+}
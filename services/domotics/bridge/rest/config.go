@@ -0,0 +1,249 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultPollInterval = 30 * time.Second
+
+var (
+	// ErrInvalidConfig is returned if the config doesn't describe a usable set of devices.
+	ErrInvalidConfig = errors.New("invalid config")
+)
+
+// Config describes the devices reachable over HTTP.
+type Config struct {
+	Devices []DeviceConfig `yaml:"devices"`
+}
+
+// DeviceConfig describes a device and the requests used to read and change its state.
+type DeviceConfig struct {
+	ID           string `yaml:"id"`
+	Type         string `yaml:"type"`
+	Name         string `yaml:"name"`
+	Description  string `yaml:"description"`
+	Manufacturer string `yaml:"manufacturer"`
+	Model        string `yaml:"model"`
+
+	Traits []bridge.TraitConfig `yaml:"traits"`
+
+	// Poll is the request which retrieves the state of the device; devices without one only have the state written to them.
+	Poll *PollConfig `yaml:"poll"`
+	// Commands are the requests which change the state of the device; devices without any are read-only.
+	Commands []CommandConfig `yaml:"commands"`
+}
+
+// RequestConfig describes an HTTP request. The URL and body are templates; commands execute them with the
+// bridge.DeviceState being requested, whose getters are safe to use on fields which aren't set,
+// e.g. {"on": {{.GetBinary.GetIsOn}}}.
+type RequestConfig struct {
+	Method  string            `yaml:"method"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+}
+
+// PollConfig describes how the state of the device is retrieved. The response must be JSON.
+type PollConfig struct {
+	RequestConfig `yaml:",inline"`
+
+	// Interval is the time between requests; it defaults to 30s.
+	Interval time.Duration `yaml:"interval"`
+	Fields   []FieldConfig `yaml:"fields"`
+}
+
+// FieldConfig extracts a value from the polled response into a field of the device state.
+type FieldConfig struct {
+	// Path is the JSONPath of the value in the response, e.g. $.lights[0].on.
+	Path string `yaml:"path"`
+	// Field is the path to the field in the device state, e.g. "binary.is_on".
+	Field string `yaml:"field"`
+	// Values optionally translates the extracted values before they are set, e.g. "ON" to "true".
+	Values map[string]string `yaml:"values"`
+}
+
+// CommandConfig describes a request which changes the state of the device.
+type CommandConfig struct {
+	RequestConfig `yaml:",inline"`
+
+	// Fields are the paths to the fields in the device state which the request changes, e.g. "range.value".
+	// The request is only sent when one of them changes; if there are none it is sent for every change.
+	Fields []string `yaml:"fields"`
+}
+
+// LoadConfig reads the config at the specified path.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// request is a configured request with its templates parsed.
+type request struct {
+	method  string
+	url     *template.Template
+	headers map[string]string
+	body    *template.Template
+}
+
+func newRequest(name string, cfg RequestConfig) (*request, error) {
+	if len(cfg.URL) < 1 {
+		return nil, errors.New("url missing")
+	}
+
+	r := &request{
+		method:  cfg.Method,
+		headers: cfg.Headers,
+	}
+	if len(r.method) < 1 {
+		r.method = http.MethodGet
+	}
+
+	var err error
+	if r.url, err = template.New(name + "-url").Parse(cfg.URL); err != nil {
+		return nil, err
+	} else if r.body, err = template.New(name + "-body").Parse(cfg.Body); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// field is a configured field with its paths resolved.
+type field struct {
+	path   jsonPath
+	field  []protoreflect.FieldDescriptor
+	values map[string]string
+}
+
+// command is a configured command with its request parsed.
+type command struct {
+	request *request
+	fields  [][]protoreflect.FieldDescriptor
+}
+
+// changed checks whether any of the fields the command changes differ between the states.
+func (c *command) changed(current *bridge.DeviceState, state *bridge.DeviceState) bool {
+	if len(c.fields) < 1 {
+		return true
+	}
+
+	for _, fds := range c.fields {
+		if fieldChanged(current, state, fds) {
+			return true
+		}
+	}
+	return false
+}
+
+// device is a configured device with its requests parsed.
+type device struct {
+	poll         *request
+	pollInterval time.Duration
+	fields       []*field
+	commands     []*command
+
+	device *bridge.Device
+}
+
+func newDevice(cfg DeviceConfig) (*device, error) {
+	if len(cfg.ID) < 1 {
+		return nil, fmt.Errorf("%w: device id missing", ErrInvalidConfig)
+	}
+
+	deviceType, ok := bridge.DeviceType_value[cfg.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w: device %s: unknown type %s", ErrInvalidConfig, cfg.ID, cfg.Type)
+	}
+
+	d := &device{
+		device: &bridge.Device{
+			Id:           cfg.ID,
+			Type:         bridge.DeviceType(deviceType),
+			IsActive:     true,
+			Manufacturer: cfg.Manufacturer,
+			ModelId:      cfg.Model,
+			Config: &bridge.DeviceConfig{
+				Name:        cfg.Name,
+				Description: cfg.Description,
+			},
+			State: &bridge.DeviceState{},
+		},
+	}
+
+	for _, traitCfg := range cfg.Traits {
+		trait, ok := traitCfg.Trait(len(cfg.Commands) > 0)
+		if !ok {
+			return nil, fmt.Errorf("%w: device %s: unknown trait %s", ErrInvalidConfig, cfg.ID, traitCfg.Type)
+		}
+		d.device.Traits = append(d.device.Traits, trait)
+	}
+
+	if cfg.Poll != nil {
+		poll, err := newRequest(cfg.ID+"-poll", cfg.Poll.RequestConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%w: device %s: poll: %s", ErrInvalidConfig, cfg.ID, err.Error())
+		}
+		d.poll = poll
+
+		d.pollInterval = cfg.Poll.Interval
+		if d.pollInterval <= 0 {
+			d.pollInterval = defaultPollInterval
+		}
+
+		for _, fieldCfg := range cfg.Poll.Fields {
+			path, err := parseJSONPath(fieldCfg.Path)
+			if err != nil {
+				return nil, fmt.Errorf("%w: device %s: %s", ErrInvalidConfig, cfg.ID, err.Error())
+			}
+			fds, err := stateField(fieldCfg.Field)
+			if err != nil {
+				return nil, fmt.Errorf("%w: device %s: %s", ErrInvalidConfig, cfg.ID, err.Error())
+			} else if fds[len(fds)-1].Kind() == protoreflect.MessageKind {
+				return nil, fmt.Errorf("%w: device %s: field %s isn't a value", ErrInvalidConfig, cfg.ID, fieldCfg.Field)
+			}
+
+			d.fields = append(d.fields, &field{
+				path:   path,
+				field:  fds,
+				values: fieldCfg.Values,
+			})
+		}
+	}
+
+	for idx, commandCfg := range cfg.Commands {
+		req, err := newRequest(fmt.Sprintf("%s-command-%d", cfg.ID, idx), commandCfg.RequestConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%w: device %s: command: %s", ErrInvalidConfig, cfg.ID, err.Error())
+		}
+
+		cmd := &command{
+			request: req,
+		}
+		for _, path := range commandCfg.Fields {
+			fds, err := stateField(path)
+			if err != nil {
+				return nil, fmt.Errorf("%w: device %s: %s", ErrInvalidConfig, cfg.ID, err.Error())
+			}
+			cmd.fields = append(cmd.fields, fds)
+		}
+		d.commands = append(d.commands, cmd)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,116 @@
+package rest
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// stateField resolves the path to a field of the device state, e.g. "binary.is_on", into the fields along the path.
+func stateField(path string) ([]protoreflect.FieldDescriptor, error) {
+	md := proto.MessageReflect(&bridge.DeviceState{}).Descriptor()
+
+	var fds []protoreflect.FieldDescriptor
+	for _, part := range strings.Split(path, ".") {
+		if md == nil {
+			return nil, fmt.Errorf("unknown field %s", path)
+		}
+
+		fd := md.Fields().ByName(protoreflect.Name(part))
+		if fd == nil || fd.IsList() || fd.IsMap() {
+			return nil, fmt.Errorf("unknown field %s", path)
+		}
+
+		fds = append(fds, fd)
+		md = fd.Message()
+	}
+
+	return fds, nil
+}
+
+// getField retrieves the value of the field in the state; fields which aren't set have their default value.
+func getField(state *bridge.DeviceState, fds []protoreflect.FieldDescriptor) protoreflect.Value {
+	msg := proto.MessageReflect(state)
+	for _, fd := range fds[:len(fds)-1] {
+		msg = msg.Get(fd).Message()
+	}
+	return msg.Get(fds[len(fds)-1])
+}
+
+// fieldChanged checks whether the field differs between the states.
+func fieldChanged(a *bridge.DeviceState, b *bridge.DeviceState, fds []protoreflect.FieldDescriptor) bool {
+	va := getField(a, fds)
+	vb := getField(b, fds)
+
+	if fds[len(fds)-1].Kind() == protoreflect.MessageKind {
+		return !proto.Equal(proto.MessageV1(va.Message().Interface()), proto.MessageV1(vb.Message().Interface()))
+	}
+	return va.Interface() != vb.Interface()
+}
+
+// setField parses the value according to the type of the field and sets it in the state,
+// creating any messages along the way.
+func setField(state *bridge.DeviceState, fds []protoreflect.FieldDescriptor, value string) error {
+	msg := proto.MessageReflect(state)
+	for _, fd := range fds[:len(fds)-1] {
+		msg = msg.Mutable(fd).Message()
+	}
+
+	fd := fds[len(fds)-1]
+	v, err := parseValue(fd, value)
+	if err != nil {
+		return fmt.Errorf("field %s: %w", fd.FullName(), err)
+	}
+	msg.Set(fd, v)
+	return nil
+}
+
+func parseValue(fd protoreflect.FieldDescriptor, value string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfBool(b), nil
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(value)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("unknown value %s", value)
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), nil
+	}
+
+	// Numbers in JSON don't distinguish between integers and floats, so all are parsed as floats.
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return protoreflect.Value{}, err
+	}
+
+	switch fd.Kind() {
+	case protoreflect.DoubleKind:
+		return protoreflect.ValueOfFloat64(f), nil
+	case protoreflect.FloatKind:
+		return protoreflect.ValueOfFloat32(float32(f)), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return protoreflect.ValueOfInt32(int32(math.Round(f))), nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return protoreflect.ValueOfInt64(int64(math.Round(f))), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return protoreflect.ValueOfUint32(uint32(math.Round(f))), nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return protoreflect.ValueOfUint64(uint64(math.Round(f))), nil
+	}
+
+	return protoreflect.Value{}, fmt.Errorf("unsupported type %s", fd.Kind())
+}
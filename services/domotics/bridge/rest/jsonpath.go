@@ -0,0 +1,87 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNoValue is returned if the response doesn't contain a value at the requested path.
+	ErrNoValue = errors.New("no value at path")
+)
+
+// jsonPath is a parsed JSONPath expression. Only the child and index operators are supported,
+// e.g. $.state.on, $.lights[0] or $['state']['on'], as each path must select a single value.
+// Each element is either the string name of an object member or the int index of an array element.
+type jsonPath []interface{}
+
+func parseJSONPath(expr string) (jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("path %s must start with $", expr)
+	}
+
+	var path jsonPath
+	rest := expr[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("path %s has an empty name", expr)
+			}
+
+			path = append(path, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("path %s has an unterminated [", expr)
+			}
+			selector := rest[1:end]
+			rest = rest[end+1:]
+
+			if len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0] {
+				path = append(path, selector[1:len(selector)-1])
+			} else if idx, err := strconv.Atoi(selector); err == nil && idx >= 0 {
+				path = append(path, idx)
+			} else {
+				return nil, fmt.Errorf("path %s has an unsupported selector %s", expr, selector)
+			}
+		default:
+			return nil, fmt.Errorf("path %s is malformed at %s", expr, rest)
+		}
+	}
+
+	return path, nil
+}
+
+// lookup finds the value at the path in the decoded JSON document.
+func (p jsonPath) lookup(doc interface{}) (interface{}, error) {
+	val := doc
+	for _, elem := range p {
+		switch e := elem.(type) {
+		case string:
+			obj, ok := val.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%w: %s isn't an object", ErrNoValue, e)
+			}
+			if val, ok = obj[e]; !ok {
+				return nil, fmt.Errorf("%w: %s missing", ErrNoValue, e)
+			}
+		case int:
+			arr, ok := val.([]interface{})
+			if !ok || e >= len(arr) {
+				return nil, fmt.Errorf("%w: index %d missing", ErrNoValue, e)
+			}
+			val = arr[e]
+		}
+	}
+
+	return val, nil
+}
@@ -0,0 +1,108 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONPath(t *testing.T) {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"state": {"on": true, "bri": 144, "effect": "none"},
+		"lights": [{"name": "desk"}, {"name": "shelf"}],
+		"dotted.key": 1
+	}`), &doc))
+
+	tests := []struct {
+		name     string
+		path     string
+		expected interface{}
+		err      error
+	}{
+		{
+			"child",
+			"$.state.on",
+			true,
+			nil,
+		},
+		{
+			"number",
+			"$.state.bri",
+			float64(144),
+			nil,
+		},
+		{
+			"index",
+			"$.lights[1].name",
+			"shelf",
+			nil,
+		},
+		{
+			"quoted",
+			"$['dotted.key']",
+			float64(1),
+			nil,
+		},
+		{
+			"root",
+			"$",
+			doc,
+			nil,
+		},
+		{
+			"missing member",
+			"$.state.hue",
+			nil,
+			ErrNoValue,
+		},
+		{
+			"index out of range",
+			"$.lights[2]",
+			nil,
+			ErrNoValue,
+		},
+		{
+			"member of a value",
+			"$.state.on.value",
+			nil,
+			ErrNoValue,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := parseJSONPath(tt.path)
+			require.NoError(t, err)
+
+			val, err := path.lookup(doc)
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, val)
+		})
+	}
+}
+
+func TestParseJSONPathInvalid(t *testing.T) {
+	tests := []string{
+		"state.on",
+		"$..on",
+		"$.lights[",
+		"$.lights[*]",
+		"$.lights[-1]",
+		"$state",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			_, err := parseJSONPath(tt)
+			assert.Error(t, err)
+		})
+	}
+}
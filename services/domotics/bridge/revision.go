@@ -0,0 +1,85 @@
+package bridge
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrVersionMismatch is returned if an update is supplied with a version which doesn't match the device.
+	ErrVersionMismatch = status.New(codes.Aborted, "device version mismatch")
+)
+
+type deviceRevision struct {
+	revision uint64
+	contents string
+}
+
+// RevisionTracker assigns versions to devices which increase monotonically as the config or state of each device changes.
+// Changes are detected by comparing the device contents each time a device is stamped, so bridges which read
+// their devices from the underlying system on request can use it as easily as bridges which cache them.
+// Revisions are seeded from the time the tracker is created so they continue to increase across restarts.
+type RevisionTracker struct {
+	lock      sync.Mutex
+	next      uint64
+	revisions map[string]*deviceRevision
+}
+
+// NewRevisionTracker creates a new revision tracker.
+func NewRevisionTracker() *RevisionTracker {
+	return &RevisionTracker{
+		next:      uint64(time.Now().UnixNano()),
+		revisions: map[string]*deviceRevision{},
+	}
+}
+
+// Stamp sets the version of the device to its current revision, first allocating a new revision if the device
+// has changed since it was last stamped.
+func (rt *RevisionTracker) Stamp(device *Device) {
+	if device == nil {
+		return
+	}
+
+	contents := device.Config.String() + "|" + device.State.String()
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	current, ok := rt.revisions[device.Id]
+	if !ok || current.contents != contents {
+		rt.next++
+		current = &deviceRevision{
+			revision: rt.next,
+			contents: contents,
+		}
+		rt.revisions[device.Id] = current
+	}
+
+	device.Version = strconv.FormatUint(current.revision, 10)
+}
+
+// Check returns ErrVersionMismatch if a version is supplied which isn't the current version of the device.
+// An empty version always passes the check.
+func (rt *RevisionTracker) Check(device *Device, version string) error {
+	if len(version) < 1 {
+		return nil
+	}
+
+	rt.Stamp(device)
+	if device.Version != version {
+		return ErrVersionMismatch.Err()
+	}
+	return nil
+}
+
+// Remove stops tracking the specified device.
+func (rt *RevisionTracker) Remove(id string) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	delete(rt.revisions, id)
+}
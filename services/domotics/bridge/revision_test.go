@@ -0,0 +1,48 @@
+package bridge
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevisionTracker(t *testing.T) {
+	rt := NewRevisionTracker()
+
+	device := &Device{
+		Id: "1",
+		State: &DeviceState{
+			Binary: &DeviceState_Binary{IsOn: false},
+		},
+	}
+
+	rt.Stamp(device)
+	first := device.Version
+	require.NotEmpty(t, first)
+
+	// Stamping an unchanged device keeps its version.
+	rt.Stamp(device)
+	assert.Equal(t, first, device.Version)
+	assert.NoError(t, rt.Check(device, first))
+	assert.NoError(t, rt.Check(device, ""))
+
+	device.State.Binary.IsOn = true
+	rt.Stamp(device)
+	second := device.Version
+	assert.NotEqual(t, first, second)
+
+	firstRevision, err := strconv.ParseUint(first, 10, 64)
+	require.NoError(t, err)
+	secondRevision, err := strconv.ParseUint(second, 10, 64)
+	require.NoError(t, err)
+	assert.Greater(t, secondRevision, firstRevision)
+
+	assert.Equal(t, ErrVersionMismatch.Err(), rt.Check(device, first))
+	assert.NoError(t, rt.Check(device, second))
+
+	// A config change is also a new revision.
+	device.Config = &DeviceConfig{Name: "lamp"}
+	assert.Equal(t, ErrVersionMismatch.Err(), rt.Check(device, second))
+}
@@ -47,16 +47,23 @@ type SyncBridgeService struct {
 	br      SyncBridge
 	brLock  sync.Mutex
 
-	updates *stream.Source
+	// configs saves changes to the device configs, if set; otherwise they are only kept in memory.
+	configs DeviceConfigPersister
+
+	revisions *RevisionTracker
+	updates   *stream.Source
 }
 
 // NewSyncBridgeService takes the supplied bridge and device profiles and takes on management of them.
 // The supplied synchronous bridge interface will be used when the service detects an incoming
 // write which requires a state change in the underlying device.
 func NewSyncBridgeService(logger *zap.Logger, brInfo *Bridge, devices map[string]*Device, br SyncBridge) *SyncBridgeService {
+	revisions := NewRevisionTracker()
+
 	// Ensure we mark all these devices as reachable
 	for id := range devices {
 		devices[id].State.IsReachable = true
+		revisions.Stamp(devices[id])
 	}
 	return &SyncBridgeService{
 		logger:  logger,
@@ -64,7 +71,8 @@ func NewSyncBridgeService(logger *zap.Logger, brInfo *Bridge, devices map[string
 		devices: devices,
 		br:      br,
 
-		updates: stream.NewSource(logger),
+		revisions: revisions,
+		updates:   stream.NewSource(logger),
 	}
 }
 
@@ -76,7 +84,7 @@ func (s *SyncBridgeService) GetBridge(ctx context.Context, req *GetBridgeRequest
 	defer s.brLock.Unlock()
 
 	for _, device := range s.devices {
-		ret.Devices = append(ret.Devices, device)
+		ret.Devices = append(ret.Devices, proto.Clone(device).(*Device))
 	}
 
 	return ret, nil
@@ -86,8 +94,11 @@ func (s *SyncBridgeService) GetBridge(ctx context.Context, req *GetBridgeRequest
 func (s *SyncBridgeService) ListDevices(ctx context.Context, req *ListDevicesRequest) (*ListDevicesResponse, error) {
 	resp := &ListDevicesResponse{}
 
+	s.brLock.Lock()
+	defer s.brLock.Unlock()
+
 	for _, device := range s.devices {
-		resp.Devices = append(resp.Devices, device)
+		resp.Devices = append(resp.Devices, proto.Clone(device).(*Device))
 	}
 
 	return resp, nil
@@ -95,44 +106,152 @@ func (s *SyncBridgeService) ListDevices(ctx context.Context, req *ListDevicesReq
 
 // GetDevice retrieves the specified device.
 func (s *SyncBridgeService) GetDevice(ctx context.Context, req *GetDeviceRequest) (*Device, error) {
+	s.brLock.Lock()
+	defer s.brLock.Unlock()
+
 	if device, found := s.devices[req.Id]; found {
-		return device, nil
+		return proto.Clone(device).(*Device), nil
 	}
 
 	return nil, ErrDeviceNotFound.Err()
 }
 
-// UpdateDeviceConfig exists to satisfy the domotics Bridge contract, but is not actually supported.
+// RestoreDeviceConfigs replaces the configs of the devices with any saved by the supplied persister,
+// and saves any subsequent changes to them using it. This should be called before the service is served.
+func (s *SyncBridgeService) RestoreDeviceConfigs(ctx context.Context, configs DeviceConfigPersister) error {
+	saved, err := configs.DeviceConfigs(ctx, s.brInfo.Id)
+	if err != nil {
+		return err
+	}
+
+	s.brLock.Lock()
+	defer s.brLock.Unlock()
+
+	for id, config := range saved {
+		device, found := s.devices[id]
+		if !found {
+			s.logger.Debug("saved config for unknown device, ignoring",
+				zap.String("device_id", id),
+			)
+			continue
+		}
+
+		device.Config = config
+		s.revisions.Stamp(device)
+	}
+
+	s.configs = configs
+	return nil
+}
+
+// UpdateDeviceConfig updates the specified device with the provided config.
+// The underlying bridge isn't involved; the config is saved by the persister supplied to RestoreDeviceConfigs, if any.
 func (s *SyncBridgeService) UpdateDeviceConfig(ctx context.Context, req *UpdateDeviceConfigRequest) (*Device, error) {
-	return nil, ErrNotSupported.Err()
+	if len(req.Id) < 1 || req.Config == nil {
+		return nil, ErrMissingParam.Err()
+	}
+
+	s.brLock.Lock()
+	defer s.brLock.Unlock()
+
+	device, found := s.devices[req.Id]
+	if !found {
+		return nil, ErrDeviceNotFound.Err()
+	}
+
+	if err := s.revisions.Check(device, req.Version); err != nil {
+		s.logger.Debug("stale config write, rejecting",
+			zap.String("device_id", req.Id),
+			zap.String("version", req.Version),
+			zap.String("current_version", device.Version),
+		)
+		return nil, err
+	}
+
+	config, err := ApplyConfigMask(device.Config, req.Config, req.UpdateMask)
+	if err != nil {
+		s.logger.Debug("invalid update mask",
+			zap.String("device_id", req.Id),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	if proto.Equal(config, device.Config) {
+		s.logger.Debug("noop config write, ignoring",
+			zap.String("device_id", req.Id),
+		)
+		return proto.Clone(device).(*Device), nil
+	}
+
+	if s.configs != nil {
+		if err := s.configs.PutDeviceConfig(ctx, s.brInfo.Id, req.Id, config); err != nil {
+			s.logger.Info("error saving device config",
+				zap.String("device_id", req.Id),
+				zap.Error(err),
+			)
+			return nil, ErrInternal.Err()
+		}
+	}
+
+	device.Config = config
+	s.revisions.Stamp(device)
+
+	s.updates.SendMessage(s.deviceUpdate(Update_CHANGED, device))
+
+	return proto.Clone(device).(*Device), nil
 }
 
 // UpdateDeviceState updates the specified device with the provided state.
+// Changes which the device's traits don't allow are rejected before the underlying bridge is invoked.
 func (s *SyncBridgeService) UpdateDeviceState(ctx context.Context, req *UpdateDeviceStateRequest) (*Device, error) {
-	var device *Device
-	var found bool
-
 	if len(req.Id) < 1 || req.State == nil {
 		return nil, ErrMissingParam.Err()
-	} else if req.State.IsReachable == false {
-		return nil, ErrNotSupported.Err()
-	} else if device, found = s.devices[req.Id]; !found {
+	}
+
+	// The lock is held until the device is updated so the version can't change between checking and writing it.
+	s.brLock.Lock()
+	defer s.brLock.Unlock()
+
+	device, found := s.devices[req.Id]
+	if !found {
 		return nil, ErrDeviceNotFound.Err()
 	}
 
-	if req.State.String() == device.State.String() {
-		s.logger.Debug("noop write, ignoring",
+	if err := s.revisions.Check(device, req.Version); err != nil {
+		s.logger.Debug("stale write, rejecting",
 			zap.String("device_id", req.Id),
+			zap.String("version", req.Version),
+			zap.String("current_version", device.Version),
 		)
-		return device, nil
+		return nil, err
 	}
 
-	// TODO: check against request version field
+	state, err := ApplyStateMask(device.State, req.State, req.UpdateMask)
+	if err != nil {
+		s.logger.Debug("invalid update mask",
+			zap.String("device_id", req.Id),
+			zap.Error(err),
+		)
+		return nil, err
+	} else if err := ValidateState(device, state); err != nil {
+		s.logger.Debug("unsupported write, rejecting",
+			zap.String("device_id", req.Id),
+			zap.Error(err),
+		)
+		return nil, err
+	} else if state.IsReachable == false {
+		return nil, ErrNotSupported.Err()
+	}
 
-	s.brLock.Lock()
-	err := s.br.SetDeviceState(ctx, device, req.State)
-	s.brLock.Unlock()
+	if state.String() == device.State.String() {
+		s.logger.Debug("noop write, ignoring",
+			zap.String("device_id", req.Id),
+		)
+		return proto.Clone(device).(*Device), nil
+	}
 
+	err = s.br.SetDeviceState(ctx, device, state)
 	if err != nil {
 		s.logger.Info("error setting device state",
 			zap.String("id", req.Id),
@@ -141,23 +260,84 @@ func (s *SyncBridgeService) UpdateDeviceState(ctx context.Context, req *UpdateDe
 		return nil, ErrInternal.Err()
 	}
 
-	s.devices[req.Id].State = req.State
+	device.State = state
+	s.revisions.Stamp(device)
 
-	s.updates.SendMessage(&Update{
-		Action: Update_CHANGED,
+	s.updates.SendMessage(s.deviceUpdate(Update_CHANGED, device))
+
+	return proto.Clone(device).(*Device), nil
+}
+
+// ReportDeviceState records a change to the state of the specified device which originated from the device itself,
+// such as a new sensor reading or the device becoming unreachable, and notifies anyone watching for updates.
+// As the device is reporting its own state, the change isn't checked against its traits.
+func (s *SyncBridgeService) ReportDeviceState(id string, state *DeviceState) (*Device, error) {
+	if state == nil {
+		return nil, ErrMissingParam.Err()
+	}
+
+	return s.ReportDeviceChange(id, func(current *DeviceState) {
+		current.Reset()
+		proto.Merge(current, state)
+	})
+}
+
+// ReportDeviceChange is like ReportDeviceState, but applies the supplied change to the current state of the device.
+// The change is made while no other writes to the device can happen, so fields it doesn't touch are never reverted.
+// It must not call back into the service.
+func (s *SyncBridgeService) ReportDeviceChange(id string, change func(*DeviceState)) (*Device, error) {
+	if len(id) < 1 || change == nil {
+		return nil, ErrMissingParam.Err()
+	}
+
+	s.brLock.Lock()
+	defer s.brLock.Unlock()
+
+	device, found := s.devices[id]
+	if !found {
+		return nil, ErrDeviceNotFound.Err()
+	}
+
+	state := &DeviceState{}
+	if device.State != nil {
+		state = proto.Clone(device.State).(*DeviceState)
+	}
+	change(state)
+
+	if proto.Equal(device.State, state) {
+		return proto.Clone(device).(*Device), nil
+	}
+
+	device.State = state
+	s.revisions.Stamp(device)
+
+	s.updates.SendMessage(s.deviceUpdate(Update_CHANGED, device))
+
+	return proto.Clone(device).(*Device), nil
+}
+
+// deviceUpdate creates an update for a copy of the device, so it can be sent once the lock is released.
+// The bridge lock must be held.
+func (s *SyncBridgeService) deviceUpdate(action Update_Action, device *Device) *Update {
+	return &Update{
+		Action: action,
 		Update: &Update_DeviceUpdate{
 			&DeviceUpdate{
-				Device:   s.devices[req.Id],
+				Device:   proto.Clone(device).(*Device),
 				BridgeId: s.brInfo.Id,
 			},
 		},
-	})
+	}
+}
 
-	return s.devices[req.Id], nil
+// BatchUpdateDeviceStates updates the state of each of the specified devices.
+// The underlying bridge is only ever asked to change one device at a time.
+func (s *SyncBridgeService) BatchUpdateDeviceStates(ctx context.Context, req *BatchUpdateDeviceStatesRequest) (*BatchUpdateDeviceStatesResponse, error) {
+	return BatchUpdate(ctx, req, s.UpdateDeviceState)
 }
 
-// StreamBridgeUpdates monitors changes for all changes which occur on the
-// This will only pick up successful device writes.
+// StreamBridgeUpdates monitors changes for all changes which occur on the bridge.
+// This will only pick up successful device writes, and changes reported by the devices.
 func (s *SyncBridgeService) StreamBridgeUpdates(req *StreamBridgeUpdatesRequest, stream BridgeService_StreamBridgeUpdatesServer) error {
 	peer, isOk := peer.FromContext(stream.Context())
 
@@ -170,55 +350,17 @@ func (s *SyncBridgeService) StreamBridgeUpdates(req *StreamBridgeUpdatesRequest,
 
 	logger.Debug("bridge update stream initiated")
 
-	sink := s.updates.NewSink()
-	defer sink.Close()
-
-	// Send all of the devices to start.
-	for _, device := range s.devices {
-		update := &Update{
-			Action: Update_ADDED,
-			Update: &Update_DeviceUpdate{
-				&DeviceUpdate{
-					Device:   device,
-					BridgeId: s.brInfo.Id,
-				},
-			},
-		}
-
-		logger.Debug("sending seed info",
-			zap.String("device_info", update.String()),
-		)
-
-		if err := stream.Send(update); err != nil {
-			logger.Error("unable to send update",
-				zap.Error(err),
-			)
-			return err
-		}
-	}
-	// TODO: the above is subject to a race condition where the add is processed after we've added the watcher
-	// but before we get the range of devices so we duplicate data.
-	// This shouldn't cause issues on the client (they should be tolerant to this) but let's fix this anyways.
-
-	// Now we wait for updates
-	for {
-		update, ok := <-sink.Messages()
-		if !ok {
-			logger.Debug("stream closed")
-			// Channel has been closed; so we'll close the connection as well
-			return nil
-		}
-
-		bridgeUpdate, ok := update.(*Update)
-
-		if !ok {
-			panic("update cast incorrect")
-		}
+	return ServeUpdates(logger, s.updates, req, stream, s.seedUpdates)
+}
 
-		logger.Debug("sending update")
+// seedUpdates returns an update adding each of the devices, copied while locked as they may change while being sent.
+func (s *SyncBridgeService) seedUpdates(ctx context.Context) ([]*Update, error) {
+	s.brLock.Lock()
+	defer s.brLock.Unlock()
 
-		if err := stream.Send(bridgeUpdate); err != nil {
-			return err
-		}
+	var updates []*Update
+	for _, device := range s.devices {
+		updates = append(updates, s.deviceUpdate(Update_ADDED, device))
 	}
+	return updates, nil
 }
@@ -5,8 +5,13 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 type mockBridge struct{}
@@ -123,6 +128,9 @@ func TestUpdateDeviceState(t *testing.T) {
 				},
 			}
 
+			sbs.revisions.Stamp(testDevice)
+			original := testDevice.Version
+
 			sbs.devices = map[string]*Device{
 				testDevice.Id: testDevice,
 			}
@@ -130,28 +138,360 @@ func TestUpdateDeviceState(t *testing.T) {
 			var wg sync.WaitGroup
 			var update *Update
 			updateSync := sbs.updates.NewSink()
+			defer updateSync.Close()
 
-			go func() {
-				if tt.expectedUpdate == nil {
-					return
-				}
-
+			if tt.expectedUpdate != nil {
 				wg.Add(1)
-				u := <-updateSync.Messages()
-				update = u.(*Update)
-				updateSync.Close()
-				wg.Done()
-			}()
+				go func() {
+					defer wg.Done()
+					u := <-updateSync.Messages()
+					update = u.Payload.(*Update)
+				}()
+			}
 
 			resp, err := sbs.UpdateDeviceState(context.Background(), tt.req)
-			assert.Equal(t, tt.expectedResp, resp)
 			assert.Equal(t, tt.expectedErr, err)
+			if tt.expectedResp == nil {
+				assert.Nil(t, resp)
+			} else {
+				require.NotNil(t, resp)
+				assert.Equal(t, tt.expectedResp.Id, resp.Id)
+				assert.True(t, proto.Equal(tt.expectedResp.State, resp.State), "state: %s", resp.State)
+
+				// The version only changes if the state did.
+				if tt.expectedUpdate != nil {
+					assert.NotEqual(t, original, resp.Version)
+				} else {
+					assert.Equal(t, original, resp.Version)
+				}
+			}
 
 			wg.Wait()
 			if tt.expectedUpdate != nil {
+				require.NotNil(t, update)
 				assert.Equal(t, Update_CHANGED, update.Action)
-				assert.Equal(t, tt.expectedUpdate, update.GetDeviceUpdate())
+				assert.Equal(t, tt.expectedUpdate.BridgeId, update.GetDeviceUpdate().BridgeId)
+				assert.Equal(t, tt.expectedUpdate.Device.Id, update.GetDeviceUpdate().Device.Id)
+				assert.True(t, proto.Equal(tt.expectedUpdate.Device.State, update.GetDeviceUpdate().Device.State), "state: %s", update.GetDeviceUpdate().Device.State)
+				assert.Equal(t, resp.Version, update.GetDeviceUpdate().Device.Version)
 			}
 		})
 	}
 }
+
+func TestUpdateDeviceStateVersion(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	sbs := NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{
+		"1232": {
+			Id: "1232",
+			State: &DeviceState{
+				Binary: &DeviceState_Binary{},
+			},
+		},
+	}, &mockBridge{})
+
+	device, err := sbs.GetDevice(context.Background(), &GetDeviceRequest{Id: "1232"})
+	require.NoError(t, err)
+	original := device.Version
+	require.NotEmpty(t, original)
+
+	resp, err := sbs.UpdateDeviceState(context.Background(), &UpdateDeviceStateRequest{
+		Id:      "1232",
+		Version: original,
+		State: &DeviceState{
+			IsReachable: true,
+			Binary:      &DeviceState_Binary{IsOn: true},
+		},
+	})
+	require.NoError(t, err)
+	assert.NotEqual(t, original, resp.Version)
+
+	// A second writer which read the device before the first write must be rejected.
+	_, err = sbs.UpdateDeviceState(context.Background(), &UpdateDeviceStateRequest{
+		Id:      "1232",
+		Version: original,
+		State: &DeviceState{
+			IsReachable: true,
+			Binary:      &DeviceState_Binary{IsOn: false},
+		},
+	})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	device, err = sbs.GetDevice(context.Background(), &GetDeviceRequest{Id: "1232"})
+	require.NoError(t, err)
+	assert.True(t, device.State.Binary.IsOn)
+	assert.Equal(t, resp.Version, device.Version)
+}
+
+func TestUpdateDeviceStateMask(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	sbs := NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{
+		"1232": {
+			Id: "1232",
+			State: &DeviceState{
+				IsReachable: true,
+				Binary:      &DeviceState_Binary{IsOn: true},
+				Audio:       &DeviceState_Audio{Volume: 20, IsMuted: true},
+			},
+		},
+	}, &mockBridge{})
+
+	resp, err := sbs.UpdateDeviceState(context.Background(), &UpdateDeviceStateRequest{
+		Id: "1232",
+		State: &DeviceState{
+			Audio: &DeviceState_Audio{Volume: 35},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"audio.volume"},
+		},
+	})
+	require.NoError(t, err)
+	assert.True(t, resp.State.IsReachable)
+	assert.True(t, resp.State.Binary.IsOn)
+	assert.Equal(t, int32(35), resp.State.Audio.Volume)
+	assert.True(t, resp.State.Audio.IsMuted)
+
+	_, err = sbs.UpdateDeviceState(context.Background(), &UpdateDeviceStateRequest{
+		Id:    "1232",
+		State: &DeviceState{},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"audio.loudness"},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestUpdateDeviceStateTraits(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	sbs := NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{
+		"1232": {
+			Id: "1232",
+			Traits: []*Trait{
+				{Type: Trait_BINARY, IsWritable: true},
+				{Type: Trait_TEMPERATURE},
+			},
+			State: &DeviceState{
+				IsReachable: true,
+				Binary:      &DeviceState_Binary{IsOn: true},
+				Temperature: &DeviceState_Temperature{Celsius: 21},
+			},
+		},
+	}, &mockBridge{})
+
+	// Sending back the read-only temperature unchanged is fine.
+	resp, err := sbs.UpdateDeviceState(context.Background(), &UpdateDeviceStateRequest{
+		Id: "1232",
+		State: &DeviceState{
+			IsReachable: true,
+			Binary:      &DeviceState_Binary{IsOn: false},
+			Temperature: &DeviceState_Temperature{Celsius: 21},
+		},
+	})
+	require.NoError(t, err)
+	assert.False(t, resp.State.Binary.IsOn)
+
+	_, err = sbs.UpdateDeviceState(context.Background(), &UpdateDeviceStateRequest{
+		Id: "1232",
+		State: &DeviceState{
+			Temperature: &DeviceState_Temperature{Celsius: 30},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"temperature"},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestReportDeviceState(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	sbs := NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{
+		"1232": {
+			Id:     "1232",
+			Traits: []*Trait{{Type: Trait_TEMPERATURE}},
+			State: &DeviceState{
+				Temperature: &DeviceState_Temperature{Celsius: 21},
+			},
+		},
+	}, &mockBridge{})
+
+	device, err := sbs.GetDevice(context.Background(), &GetDeviceRequest{Id: "1232"})
+	require.NoError(t, err)
+	original := device.Version
+
+	sink := sbs.updates.NewSink()
+	defer sink.Close()
+
+	// The device reports read-only fields, so they aren't checked against its traits.
+	resp, err := sbs.ReportDeviceState("1232", &DeviceState{
+		IsReachable: true,
+		Temperature: &DeviceState_Temperature{Celsius: 23},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(23), resp.State.Temperature.Celsius)
+	assert.NotEqual(t, original, resp.Version)
+
+	update := (<-sink.Messages()).Payload.(*Update)
+	assert.Equal(t, Update_CHANGED, update.Action)
+	assert.Equal(t, "1232", update.GetDeviceUpdate().Device.Id)
+
+	_, err = sbs.ReportDeviceState("1235", &DeviceState{})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestUpdateDeviceConfig(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	p := newTestConfigPersister(t)
+
+	newDevices := func() map[string]*Device {
+		return map[string]*Device{
+			"1232": {
+				Id:     "1232",
+				Config: &DeviceConfig{Name: "Zone 1"},
+				State:  &DeviceState{},
+			},
+			"1233": {
+				Id:     "1233",
+				Config: &DeviceConfig{Name: "Zone 2"},
+				State:  &DeviceState{},
+			},
+		}
+	}
+
+	sbs := NewSyncBridgeService(logger, &Bridge{Id: "test"}, newDevices(), &mockBridge{})
+	require.NoError(t, sbs.RestoreDeviceConfigs(context.Background(), p))
+
+	device, err := sbs.GetDevice(context.Background(), &GetDeviceRequest{Id: "1232"})
+	require.NoError(t, err)
+	original := device.Version
+
+	sink := sbs.updates.NewSink()
+	defer sink.Close()
+
+	resp, err := sbs.UpdateDeviceConfig(context.Background(), &UpdateDeviceConfigRequest{
+		Id:      "1232",
+		Version: original,
+		Config:  &DeviceConfig{Name: "Kitchen", Description: "Ignored"},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"name"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Kitchen", resp.Config.Name)
+	assert.Empty(t, resp.Config.Description)
+	assert.NotEqual(t, original, resp.Version)
+
+	update := (<-sink.Messages()).Payload.(*Update)
+	assert.Equal(t, Update_CHANGED, update.Action)
+	assert.Equal(t, "Kitchen", update.GetDeviceUpdate().Device.Config.Name)
+
+	_, err = sbs.UpdateDeviceConfig(context.Background(), &UpdateDeviceConfigRequest{
+		Id:      "1232",
+		Version: original,
+		Config:  &DeviceConfig{Name: "Dining room"},
+	})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	_, err = sbs.UpdateDeviceConfig(context.Background(), &UpdateDeviceConfigRequest{
+		Id:     "1235",
+		Config: &DeviceConfig{},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// The config is restored when the bridge restarts, and only for the device which was changed.
+	restarted := NewSyncBridgeService(logger, &Bridge{Id: "test"}, newDevices(), &mockBridge{})
+	require.NoError(t, restarted.RestoreDeviceConfigs(context.Background(), p))
+
+	device, err = restarted.GetDevice(context.Background(), &GetDeviceRequest{Id: "1232"})
+	require.NoError(t, err)
+	assert.Equal(t, "Kitchen", device.Config.Name)
+
+	device, err = restarted.GetDevice(context.Background(), &GetDeviceRequest{Id: "1233"})
+	require.NoError(t, err)
+	assert.Equal(t, "Zone 2", device.Config.Name)
+}
+
+func TestReportDeviceChange(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	sbs := NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{
+		"1232": {
+			Id: "1232",
+			State: &DeviceState{
+				Binary:      &DeviceState_Binary{},
+				Temperature: &DeviceState_Temperature{Celsius: 21},
+			},
+		},
+	}, &mockBridge{})
+
+	_, err := sbs.UpdateDeviceState(context.Background(), &UpdateDeviceStateRequest{
+		Id: "1232",
+		State: &DeviceState{
+			IsReachable: true,
+			Binary:      &DeviceState_Binary{IsOn: true},
+			Temperature: &DeviceState_Temperature{Celsius: 21},
+		},
+	})
+	require.NoError(t, err)
+
+	// Only the fields the change touches are replaced, so the write above is kept.
+	resp, err := sbs.ReportDeviceChange("1232", func(state *DeviceState) {
+		state.Temperature = &DeviceState_Temperature{Celsius: 23}
+	})
+	require.NoError(t, err)
+	assert.True(t, resp.State.Binary.IsOn)
+	assert.Equal(t, int32(23), resp.State.Temperature.Celsius)
+
+	// The returned device is a copy, so changing it doesn't change the service.
+	resp.State.Binary.IsOn = false
+	device, err := sbs.GetDevice(context.Background(), &GetDeviceRequest{Id: "1232"})
+	require.NoError(t, err)
+	assert.True(t, device.State.Binary.IsOn)
+
+	_, err = sbs.ReportDeviceChange("1235", func(*DeviceState) {})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestSyncBridgeServiceConcurrentReports(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+
+	sbs := NewSyncBridgeService(logger, &Bridge{Id: "test"}, map[string]*Device{
+		"1232": {
+			Id:    "1232",
+			State: &DeviceState{Temperature: &DeviceState_Temperature{}},
+		},
+	}, &mockBridge{})
+
+	sink := sbs.updates.NewSink()
+	defer sink.Close()
+
+	// Readers get copies, so reports made while they read the devices don't race with them.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := int32(1); i <= 50; i++ {
+			_, err := sbs.ReportDeviceChange("1232", func(state *DeviceState) {
+				state.Temperature.Celsius = i
+			})
+			assert.NoError(t, err)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		device, err := sbs.GetDevice(context.Background(), &GetDeviceRequest{Id: "1232"})
+		require.NoError(t, err)
+		_ = device.State.String()
+
+		resp, err := sbs.ListDevices(context.Background(), &ListDevicesRequest{})
+		require.NoError(t, err)
+		_ = resp.Devices[0].Version
+	}
+	wg.Wait()
+
+	update := (<-sink.Messages()).Payload.(*Update)
+	assert.Equal(t, int32(1), update.GetDeviceUpdate().Device.State.Temperature.Celsius)
+}
@@ -0,0 +1,213 @@
+package bridge
+
+import (
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var (
+	// ErrTraitNotSupported is returned if an update changes a field the device doesn't have a trait for.
+	ErrTraitNotSupported = status.New(codes.InvalidArgument, "device doesn't support the requested change")
+	// ErrTraitReadOnly is returned if an update changes a field the device only reports.
+	ErrTraitReadOnly = status.New(codes.InvalidArgument, "field is read-only")
+	// ErrTraitOutOfRange is returned if an update sets a field to a value the device doesn't support.
+	ErrTraitOutOfRange = status.New(codes.OutOfRange, "value out of range")
+)
+
+// TraitConfig describes a capability of a device in the YAML config of a bridge.
+// The type is the name of a Trait_Type, e.g. "BINARY".
+type TraitConfig struct {
+	Type     string   `yaml:"type"`
+	Writable bool     `yaml:"writable"`
+	Minimum  int32    `yaml:"min"`
+	Maximum  int32    `yaml:"max"`
+	Unit     string   `yaml:"unit"`
+	Options  []string `yaml:"options"`
+}
+
+// Trait converts the config into a trait. It is only writable if the device it belongs to can be written to.
+// false is returned if the type isn't the name of a Trait_Type.
+func (cfg TraitConfig) Trait(canWrite bool) (*Trait, bool) {
+	traitType, ok := Trait_Type_value[cfg.Type]
+	if !ok {
+		return nil, false
+	}
+
+	return &Trait{
+		Type:       Trait_Type(traitType),
+		IsWritable: cfg.Writable && canWrite,
+		Minimum:    cfg.Minimum,
+		Maximum:    cfg.Maximum,
+		Unit:       cfg.Unit,
+		Options:    cfg.Options,
+	}, true
+}
+
+// Trait retrieves the trait of the specified type from the device, or nil if the device doesn't have it.
+func (d *Device) Trait(t Trait_Type) *Trait {
+	for _, trait := range d.GetTraits() {
+		if trait.Type == t {
+			return trait
+		}
+	}
+	return nil
+}
+
+// IsWritable returns whether the device has a writable trait of the specified type.
+func (d *Device) IsWritable(t Trait_Type) bool {
+	trait := d.Trait(t)
+	return trait != nil && trait.IsWritable
+}
+
+// ValidateState checks whether the device can be changed to the supplied state.
+// Each field which is set in the state and differs from the current state of the device must have a writable trait,
+// and its value must be within the bounds of the trait. Devices which don't declare any traits aren't validated.
+func ValidateState(device *Device, state *DeviceState) error {
+	if len(device.Traits) < 1 || state == nil {
+		return nil
+	}
+
+	current := device.State
+	if current == nil {
+		current = &DeviceState{}
+	}
+
+	var err error
+	proto.MessageReflect(state).Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		// Reachability, versions and report times describe the device itself rather than one of its traits.
+		if fd.Name() == "is_reachable" || fd.Name() == "version" || fd.Name() == "reported_at" || !fieldChanged(current, state, fd) {
+			return true
+		}
+
+		// Each trait type describes the state field of the same name, so e.g. COLOR_RGB describes color_rgb.
+		trait := device.Trait(Trait_Type(Trait_Type_value[strings.ToUpper(string(fd.Name()))]))
+		if trait == nil {
+			err = ErrTraitNotSupported.Err()
+		} else if !trait.IsWritable {
+			err = ErrTraitReadOnly.Err()
+		} else {
+			err = validateTraitValue(trait, state)
+		}
+		return err == nil
+	})
+	return err
+}
+
+// fieldChanged returns whether the specified field differs between the two states.
+func fieldChanged(current *DeviceState, update *DeviceState, fd protoreflect.FieldDescriptor) bool {
+	cur := &DeviceState{}
+	if proto.MessageReflect(current).Has(fd) {
+		proto.MessageReflect(cur).Set(fd, proto.MessageReflect(current).Get(fd))
+	}
+	upd := &DeviceState{}
+	if proto.MessageReflect(update).Has(fd) {
+		proto.MessageReflect(upd).Set(fd, proto.MessageReflect(update).Get(fd))
+	}
+	return !proto.Equal(cur, upd)
+}
+
+func validateTraitValue(trait *Trait, state *DeviceState) error {
+	if trait.Maximum > trait.Minimum {
+		if value, ok := traitValue(trait.Type, state); ok && (value < trait.Minimum || value > trait.Maximum) {
+			return ErrTraitOutOfRange.Err()
+		}
+	}
+
+	if trait.Type == Trait_INPUT && state.Input != nil && len(trait.Options) > 0 {
+		for _, option := range trait.Options {
+			if option == state.Input.Input {
+				return nil
+			}
+		}
+		return ErrTraitOutOfRange.Err()
+	}
+
+	switch {
+	case trait.Type == Trait_COVER && state.Cover != nil:
+		if state.Cover.Position < 0 || state.Cover.Position > 100 {
+			return ErrTraitOutOfRange.Err()
+		}
+	case trait.Type == Trait_LOCK && state.Lock != nil:
+		// A lock can be asked to lock or unlock; whether it is jammed is only reported by the device.
+		if state.Lock.State != DeviceState_Lock_LOCKED && state.Lock.State != DeviceState_Lock_UNLOCKED {
+			return ErrTraitOutOfRange.Err()
+		}
+	case trait.Type == Trait_THERMOSTAT && state.Thermostat != nil:
+		return validateThermostat(trait, state.Thermostat)
+	}
+
+	return nil
+}
+
+// validateThermostat checks the mode is one the thermostat supports and the setpoints used by the mode are within its bounds.
+func validateThermostat(trait *Trait, thermostat *DeviceState_Thermostat) error {
+	if len(trait.Options) > 0 {
+		supported := false
+		for _, option := range trait.Options {
+			if option == thermostat.Mode.String() {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return ErrTraitOutOfRange.Err()
+		}
+	}
+
+	inBounds := func(setpoint float64) bool {
+		return trait.Maximum <= trait.Minimum || (setpoint >= float64(trait.Minimum) && setpoint <= float64(trait.Maximum))
+	}
+
+	switch thermostat.Mode {
+	case DeviceState_Thermostat_HEAT:
+		if !inBounds(thermostat.HeatSetpointCelsius) {
+			return ErrTraitOutOfRange.Err()
+		}
+	case DeviceState_Thermostat_COOL:
+		if !inBounds(thermostat.CoolSetpointCelsius) {
+			return ErrTraitOutOfRange.Err()
+		}
+	case DeviceState_Thermostat_HEAT_COOL:
+		if !inBounds(thermostat.HeatSetpointCelsius) || !inBounds(thermostat.CoolSetpointCelsius) ||
+			thermostat.HeatSetpointCelsius > thermostat.CoolSetpointCelsius {
+			return ErrTraitOutOfRange.Err()
+		}
+	}
+
+	return nil
+}
+
+// traitValue retrieves the primary value of the field described by the trait type, if it is numeric and set.
+func traitValue(t Trait_Type, state *DeviceState) (int32, bool) {
+	switch t {
+	case Trait_RANGE:
+		if state.Range != nil {
+			return state.Range.Value, true
+		}
+	case Trait_SPEED:
+		if state.Speed != nil {
+			return state.Speed.Speed, true
+		}
+	case Trait_TEMPERATURE:
+		if state.Temperature != nil {
+			return state.Temperature.Celsius, true
+		}
+	case Trait_AUDIO:
+		if state.Audio != nil {
+			return state.Audio.Volume, true
+		}
+	case Trait_COLOR_TEMPERATURE:
+		if state.ColorTemperature != 0 {
+			return state.ColorTemperature, true
+		}
+	case Trait_COVER:
+		if state.Cover != nil {
+			return state.Cover.Position, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,234 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateState(t *testing.T) {
+	device := &Device{
+		Id: "1232",
+		Traits: []*Trait{
+			{Type: Trait_BINARY, IsWritable: true},
+			{Type: Trait_RANGE, IsWritable: true, Minimum: 0, Maximum: 255},
+			{Type: Trait_INPUT, IsWritable: true, Options: []string{"tv", "radio"}},
+			{Type: Trait_TEMPERATURE, Unit: "celsius"},
+		},
+		State: &DeviceState{
+			IsReachable: true,
+			Binary:      &DeviceState_Binary{IsOn: true},
+			Range:       &DeviceState_Range{Value: 50},
+			Input:       &DeviceState_Input{Input: "tv"},
+			Temperature: &DeviceState_Temperature{Celsius: 21},
+		},
+	}
+
+	cover := &Device{
+		Id:     "1240",
+		Type:   DeviceType_WINDOW_COVERING,
+		Traits: []*Trait{{Type: Trait_COVER, IsWritable: true}},
+		State: &DeviceState{
+			Cover: &DeviceState_Cover{Position: 100},
+		},
+	}
+	lock := &Device{
+		Id:     "1241",
+		Type:   DeviceType_LOCK,
+		Traits: []*Trait{{Type: Trait_LOCK, IsWritable: true}},
+		State: &DeviceState{
+			Lock: &DeviceState_Lock{State: DeviceState_Lock_UNLOCKED},
+		},
+	}
+	thermostat := &Device{
+		Id:   "1242",
+		Type: DeviceType_THERMOSTAT,
+		Traits: []*Trait{
+			{Type: Trait_THERMOSTAT, IsWritable: true, Minimum: 10, Maximum: 30, Unit: "celsius", Options: []string{"OFF", "HEAT", "COOL", "HEAT_COOL"}},
+		},
+		State: &DeviceState{
+			Thermostat: &DeviceState_Thermostat{
+				Mode:                DeviceState_Thermostat_HEAT,
+				HeatSetpointCelsius: 20,
+				CurrentCelsius:      19.5,
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		device *Device
+		state  *DeviceState
+		code   codes.Code
+	}{
+		{
+			"writable fields changed",
+			device,
+			&DeviceState{
+				Binary: &DeviceState_Binary{IsOn: false},
+				Range:  &DeviceState_Range{Value: 255},
+				Input:  &DeviceState_Input{Input: "radio"},
+			},
+			codes.OK,
+		},
+		{
+			"read-only field unchanged",
+			device,
+			&DeviceState{
+				IsReachable: true,
+				Temperature: &DeviceState_Temperature{Celsius: 21},
+			},
+			codes.OK,
+		},
+		{
+			"report time ignored",
+			device,
+			&DeviceState{
+				ReportedAt: ptypes.TimestampNow(),
+			},
+			codes.OK,
+		},
+		{
+			"read-only field changed",
+			device,
+			&DeviceState{
+				Temperature: &DeviceState_Temperature{Celsius: 25},
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"unsupported field",
+			device,
+			&DeviceState{
+				Audio: &DeviceState_Audio{Volume: 10},
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"value above maximum",
+			device,
+			&DeviceState{
+				Range: &DeviceState_Range{Value: 256},
+			},
+			codes.OutOfRange,
+		},
+		{
+			"unknown option",
+			device,
+			&DeviceState{
+				Input: &DeviceState_Input{Input: "phono"},
+			},
+			codes.OutOfRange,
+		},
+		{
+			"cover position changed",
+			cover,
+			&DeviceState{
+				Cover: &DeviceState_Cover{Position: 40},
+			},
+			codes.OK,
+		},
+		{
+			"cover position above fully open",
+			cover,
+			&DeviceState{
+				Cover: &DeviceState_Cover{Position: 120},
+			},
+			codes.OutOfRange,
+		},
+		{
+			"lock locked",
+			lock,
+			&DeviceState{
+				Lock: &DeviceState_Lock{State: DeviceState_Lock_LOCKED},
+			},
+			codes.OK,
+		},
+		{
+			"lock can't be jammed",
+			lock,
+			&DeviceState{
+				Lock: &DeviceState_Lock{State: DeviceState_Lock_JAMMED},
+			},
+			codes.OutOfRange,
+		},
+		{
+			"thermostat setpoint changed",
+			thermostat,
+			&DeviceState{
+				Thermostat: &DeviceState_Thermostat{Mode: DeviceState_Thermostat_HEAT, HeatSetpointCelsius: 22.5},
+			},
+			codes.OK,
+		},
+		{
+			"thermostat setpoint above maximum",
+			thermostat,
+			&DeviceState{
+				Thermostat: &DeviceState_Thermostat{Mode: DeviceState_Thermostat_HEAT, HeatSetpointCelsius: 31},
+			},
+			codes.OutOfRange,
+		},
+		{
+			"thermostat mode unsupported",
+			thermostat,
+			&DeviceState{
+				Thermostat: &DeviceState_Thermostat{Mode: DeviceState_Thermostat_ECO},
+			},
+			codes.OutOfRange,
+		},
+		{
+			"thermostat setpoints crossed",
+			thermostat,
+			&DeviceState{
+				Thermostat: &DeviceState_Thermostat{Mode: DeviceState_Thermostat_HEAT_COOL, HeatSetpointCelsius: 24, CoolSetpointCelsius: 22},
+			},
+			codes.OutOfRange,
+		},
+		{
+			"device without traits",
+			&Device{
+				Id:    "1233",
+				State: &DeviceState{},
+			},
+			&DeviceState{
+				Audio: &DeviceState_Audio{Volume: 10},
+			},
+			codes.OK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateState(tt.device, tt.state)
+			assert.Equal(t, tt.code, status.Code(err))
+		})
+	}
+}
+
+func TestTraitConfig(t *testing.T) {
+	cfg := TraitConfig{
+		Type:     "RANGE",
+		Writable: true,
+		Minimum:  0,
+		Maximum:  254,
+		Unit:     "percent",
+	}
+
+	trait, ok := cfg.Trait(true)
+	assert.True(t, ok)
+	assert.Equal(t, Trait_RANGE, trait.Type)
+	assert.True(t, trait.IsWritable)
+	assert.Equal(t, int32(254), trait.Maximum)
+	assert.Equal(t, "percent", trait.Unit)
+
+	// A trait is only writable if its device can be written to.
+	trait, ok = cfg.Trait(false)
+	assert.True(t, ok)
+	assert.False(t, trait.IsWritable)
+
+	_, ok = TraitConfig{Type: "WARP"}.Trait(true)
+	assert.False(t, ok)
+}
@@ -0,0 +1,315 @@
+package bridge
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/rmrobinson/nerves/lib/stream"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrInvalidResumeTime is returned if a stream is resumed from a time which can't be represented.
+	ErrInvalidResumeTime = status.New(codes.InvalidArgument, "invalid resume time")
+)
+
+// Matches returns true if the supplied update satisfies every populated criteria of the filter.
+// A nil filter matches every update.
+func (f *UpdateFilter) Matches(update *Update) bool {
+	if f == nil {
+		return true
+	} else if update == nil {
+		return false
+	}
+
+	if len(f.Actions) > 0 && !containsAction(f.Actions, update.Action) {
+		return false
+	}
+
+	deviceUpdate := update.GetDeviceUpdate()
+
+	bridgeID := ""
+	if deviceUpdate != nil {
+		bridgeID = deviceUpdate.BridgeId
+	} else if bridgeUpdate := update.GetBridgeUpdate(); bridgeUpdate != nil {
+		bridgeID = bridgeUpdate.BridgeId
+	}
+	if len(f.BridgeIds) > 0 && !containsString(f.BridgeIds, bridgeID) {
+		return false
+	}
+
+	if deviceUpdate == nil {
+		return !f.DevicesOnly && len(f.DeviceIds) < 1 && len(f.DeviceTypes) < 1
+	}
+
+	if len(f.DeviceIds) > 0 {
+		deviceID := deviceUpdate.DeviceId
+		if deviceUpdate.Device != nil && len(deviceUpdate.Device.Id) > 0 {
+			deviceID = deviceUpdate.Device.Id
+		}
+
+		if !containsString(f.DeviceIds, deviceID) {
+			return false
+		}
+	}
+
+	// A removal may not carry the device, in which case we can't know the type so we let it through.
+	if len(f.DeviceTypes) > 0 && deviceUpdate.Device != nil && !containsDeviceType(f.DeviceTypes, deviceUpdate.Device.Type) {
+		return false
+	}
+
+	return true
+}
+
+// Predicate adapts the filter for use with stream.Filter. Messages which aren't updates never match.
+func (f *UpdateFilter) Predicate() stream.Predicate {
+	return func(msg proto.Message) bool {
+		update, ok := msg.(*Update)
+		if !ok {
+			return false
+		}
+		return f.Matches(update)
+	}
+}
+
+// UpdateSink is a typed view over a stream.Sink whose source only carries updates.
+// It saves consumers from having to cast each received message, and annotates each update with its sequence number
+// and the time it was sent.
+type UpdateSink struct {
+	sink    *stream.Sink
+	updates chan *Update
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewUpdateSink subscribes to the supplied source, only delivering the updates which satisfy the filter.
+// A nil filter delivers every update. Gaps signalled by the underlying sink are delivered as updates carrying the gap.
+func NewUpdateSink(source *stream.Source, filter *UpdateFilter, opts ...stream.SinkOption) *UpdateSink {
+	if filter != nil {
+		opts = append(opts, stream.Filter(filter.Predicate()))
+	}
+
+	us := &UpdateSink{
+		sink:    source.NewSink(opts...),
+		updates: make(chan *Update),
+		done:    make(chan struct{}),
+	}
+
+	go us.run()
+	return us
+}
+
+// Updates returns the channel of updates. It is closed when the sink is closed.
+func (us *UpdateSink) Updates() <-chan *Update {
+	return us.updates
+}
+
+// StartSequence returns the sequence number of the last update sent before the sink was created.
+func (us *UpdateSink) StartSequence() uint64 {
+	return us.sink.StartSequence()
+}
+
+// Stats returns the counters tracked for the underlying sink.
+func (us *UpdateSink) Stats() stream.SinkStats {
+	return us.sink.Stats()
+}
+
+// Close releases the underlying sink.
+func (us *UpdateSink) Close() {
+	us.closeOnce.Do(func() {
+		close(us.done)
+		us.sink.Close()
+	})
+}
+
+func (us *UpdateSink) run() {
+	defer close(us.updates)
+
+	for {
+		msg, ok := <-us.sink.Messages()
+		if !ok {
+			// Channel has been closed; so we'll close the connection as well
+			return
+		}
+
+		var update *Update
+		if msg.Gap != nil {
+			update = &Update{
+				Update: &Update_Gap{
+					&UpdateGap{
+						FirstSequence: msg.Gap.First,
+						LastSequence:  msg.Gap.Last,
+					},
+				},
+				Sequence: msg.Sequence,
+			}
+		} else {
+			payload, ok := msg.Payload.(*Update)
+			if !ok {
+				panic("bridge update cast failed")
+			}
+
+			sentAt, err := ptypes.TimestampProto(msg.Timestamp)
+			if err != nil {
+				sentAt = nil
+			}
+
+			// The payload is shared with the other sinks, so it is copied rather than annotated in place.
+			update = &Update{
+				Action:   payload.Action,
+				Update:   payload.Update,
+				Sequence: msg.Sequence,
+				SentAt:   sentAt,
+			}
+		}
+
+		select {
+		case us.updates <- update:
+		case <-us.done:
+			return
+		}
+	}
+}
+
+// ServeUpdates sends the updates sent to the source which satisfy the filter of the request to the stream, until the
+// stream is cancelled or the sink is closed. The stream starts with the updates returned by seed, which describe the
+// current state, unless the request resumes a previous stream, either after a sequence number or since a time.
+// If the updates it resumes from are no longer retained the gap is sent, followed by the seed.
+func ServeUpdates(logger *zap.Logger, source *stream.Source, req *StreamBridgeUpdatesRequest, srv BridgeService_StreamBridgeUpdatesServer, seed func(context.Context) ([]*Update, error), opts ...stream.SinkOption) error {
+	resuming := true
+	if req.ResumeAfterSequence > 0 {
+		opts = append(opts, stream.Resume(req.ResumeAfterSequence))
+	} else if req.ResumeSince != nil {
+		since, err := ptypes.Timestamp(req.ResumeSince)
+		if err != nil {
+			return ErrInvalidResumeTime.Err()
+		}
+		opts = append(opts, stream.ResumeSince(since))
+	} else {
+		resuming = false
+	}
+
+	// We subscribe before seeding so nothing is missed; anything which changes in between may be sent twice,
+	// which consumers are expected to tolerate.
+	sink := NewUpdateSink(source, req.Filter, opts...)
+	defer sink.Close()
+
+	sendSeed := func(sequence uint64) error {
+		updates, err := seed(srv.Context())
+		if err != nil {
+			logger.Error("unable to retrieve seed info",
+				zap.Error(err),
+			)
+			return err
+		}
+
+		for _, update := range updates {
+			if !req.Filter.Matches(update) {
+				continue
+			}
+
+			update.Sequence = sequence
+			logger.Debug("sending seed info",
+				zap.String("update", update.String()),
+			)
+
+			if err := srv.Send(update); err != nil {
+				logger.Error("unable to send update",
+					zap.Error(err),
+				)
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !resuming {
+		if err := sendSeed(sink.StartSequence()); err != nil {
+			return err
+		}
+	}
+
+	// Now we wait for updates
+	for {
+		select {
+		case <-srv.Context().Done():
+			logger.Debug("stream cancelled")
+			return nil
+		case update, ok := <-sink.Updates():
+			if !ok {
+				logger.Debug("stream closed")
+				// Channel has been closed; so we'll close the connection as well
+				return nil
+			}
+
+			logger.Debug("sending update",
+				zap.Uint64("sequence", update.Sequence),
+			)
+
+			if err := srv.Send(update); err != nil {
+				return err
+			}
+
+			if gap := update.GetGap(); gap != nil {
+				logger.Info("resumed stream missed updates, reseeding",
+					zap.Uint64("first_sequence", gap.FirstSequence),
+					zap.Uint64("last_sequence", gap.LastSequence),
+				)
+
+				if err := sendSeed(gap.LastSequence); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// NewJournaledUpdateSource creates a source of updates which journals them to the configured directory, so streams
+// can be resumed from before a restart. The returned journal must be closed once the source is no longer used.
+func NewJournaledUpdateSource(logger *zap.Logger, cfg stream.JournalConfig) (*stream.Source, *stream.Journal, error) {
+	journal, err := stream.OpenJournal(logger, cfg, func() proto.Message {
+		return &Update{}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	source, err := stream.NewJournaledSource(logger, stream.DefaultHistorySize, journal)
+	if err != nil {
+		journal.Close()
+		return nil, nil, err
+	}
+	return source, journal, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAction(values []Update_Action, value Update_Action) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsDeviceType(values []DeviceType, value DeviceType) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
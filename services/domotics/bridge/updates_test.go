@@ -0,0 +1,251 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/rmrobinson/nerves/lib/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var lightAdded = &Update{
+	Action: Update_ADDED,
+	Update: &Update_DeviceUpdate{
+		&DeviceUpdate{
+			Device: &Device{
+				Id:   "light1",
+				Type: DeviceType_LIGHT,
+			},
+			BridgeId: "bridge1",
+		},
+	},
+}
+
+var sensorRemoved = &Update{
+	Action: Update_REMOVED,
+	Update: &Update_DeviceUpdate{
+		&DeviceUpdate{
+			DeviceId: "sensor1",
+			BridgeId: "bridge2",
+		},
+	},
+}
+
+var bridgeChanged = &Update{
+	Action: Update_CHANGED,
+	Update: &Update_BridgeUpdate{
+		&BridgeUpdate{
+			BridgeId: "bridge1",
+		},
+	},
+}
+
+var updateFilterTests = []struct {
+	name   string
+	filter *UpdateFilter
+
+	expected []bool
+}{
+	{
+		name:     "nil filter matches everything",
+		filter:   nil,
+		expected: []bool{true, true, true},
+	},
+	{
+		name:     "empty filter matches everything",
+		filter:   &UpdateFilter{},
+		expected: []bool{true, true, true},
+	},
+	{
+		name:     "device ids",
+		filter:   &UpdateFilter{DeviceIds: []string{"light1", "sensor1"}},
+		expected: []bool{true, true, false},
+	},
+	{
+		name:     "bridge ids",
+		filter:   &UpdateFilter{BridgeIds: []string{"bridge1"}},
+		expected: []bool{true, false, true},
+	},
+	{
+		name:     "actions",
+		filter:   &UpdateFilter{Actions: []Update_Action{Update_ADDED, Update_CHANGED}},
+		expected: []bool{true, false, true},
+	},
+	{
+		name:     "device types let through removals without a device",
+		filter:   &UpdateFilter{DeviceTypes: []DeviceType{DeviceType_SENSOR}},
+		expected: []bool{false, true, false},
+	},
+	{
+		name:     "devices only",
+		filter:   &UpdateFilter{DevicesOnly: true},
+		expected: []bool{true, true, false},
+	},
+	{
+		name: "all criteria must match",
+		filter: &UpdateFilter{
+			BridgeIds: []string{"bridge1"},
+			Actions:   []Update_Action{Update_REMOVED},
+		},
+		expected: []bool{false, false, false},
+	},
+}
+
+func TestUpdateFilterMatches(t *testing.T) {
+	updates := []*Update{lightAdded, sensorRemoved, bridgeChanged}
+
+	for _, tt := range updateFilterTests {
+		t.Run(tt.name, func(t *testing.T) {
+			for idx, update := range updates {
+				assert.Equal(t, tt.expected[idx], tt.filter.Matches(update), update.String())
+				assert.Equal(t, tt.expected[idx], tt.filter.Predicate()(update), update.String())
+			}
+		})
+	}
+}
+
+type testUpdatesServer struct {
+	grpc.ServerStream
+
+	ctx     context.Context
+	updates chan *Update
+}
+
+func (s *testUpdatesServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testUpdatesServer) Send(update *Update) error {
+	s.updates <- update
+	return nil
+}
+
+type expectedUpdate struct {
+	action   Update_Action
+	sequence uint64
+	gap      *UpdateGap
+}
+
+var serveUpdatesTests = []struct {
+	name string
+	req  *StreamBridgeUpdatesRequest
+
+	expected []expectedUpdate
+}{
+	{
+		name: "seeded at the current sequence",
+		req:  &StreamBridgeUpdatesRequest{},
+		expected: []expectedUpdate{
+			{action: Update_ADDED, sequence: 5},
+		},
+	},
+	{
+		name: "resumed within the history",
+		req:  &StreamBridgeUpdatesRequest{ResumeAfterSequence: 3},
+		expected: []expectedUpdate{
+			{action: Update_CHANGED, sequence: 4},
+			{action: Update_CHANGED, sequence: 5},
+		},
+	},
+	{
+		name: "resumed before the history",
+		req:  &StreamBridgeUpdatesRequest{ResumeAfterSequence: 1},
+		expected: []expectedUpdate{
+			{sequence: 3, gap: &UpdateGap{FirstSequence: 2, LastSequence: 3}},
+			{action: Update_ADDED, sequence: 3},
+			{action: Update_CHANGED, sequence: 4},
+			{action: Update_CHANGED, sequence: 5},
+		},
+	},
+	{
+		// The time is taken before any of the updates are sent, so the aged out updates may have been missed.
+		name: "resumed since before the history",
+		req:  &StreamBridgeUpdatesRequest{ResumeSince: ptypes.TimestampNow()},
+		expected: []expectedUpdate{
+			{sequence: 3, gap: &UpdateGap{FirstSequence: 1, LastSequence: 3}},
+			{action: Update_ADDED, sequence: 3},
+			{action: Update_CHANGED, sequence: 4},
+			{action: Update_CHANGED, sequence: 5},
+		},
+	},
+}
+
+func TestServeUpdates(t *testing.T) {
+	for _, tt := range serveUpdatesTests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := stream.NewSourceWithHistory(zap.NewNop(), 2)
+			for i := 0; i < 5; i++ {
+				source.SendMessage(bridgeChanged)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			srv := &testUpdatesServer{
+				ctx:     ctx,
+				updates: make(chan *Update, 10),
+			}
+
+			done := make(chan error)
+			go func() {
+				done <- ServeUpdates(zap.NewNop(), source, tt.req, srv, func(context.Context) ([]*Update, error) {
+					return []*Update{proto.Clone(lightAdded).(*Update)}, nil
+				})
+			}()
+
+			receive := func() *Update {
+				select {
+				case update := <-srv.updates:
+					return update
+				case <-time.After(time.Second):
+					require.FailNow(t, "timed out waiting for update")
+				}
+				return nil
+			}
+
+			for _, expected := range tt.expected {
+				update := receive()
+				assert.Equal(t, expected.sequence, update.Sequence, update.String())
+				if expected.gap != nil {
+					assert.True(t, proto.Equal(expected.gap, update.GetGap()), update.String())
+				} else {
+					assert.Equal(t, expected.action, update.Action, update.String())
+				}
+
+				// Only the updates sent through the source, rather than the seed or gaps, say when they were sent.
+				assert.Equal(t, expected.gap == nil && expected.action == Update_CHANGED, update.SentAt != nil, update.String())
+			}
+
+			// Anything sent once the stream is established follows on from what was already delivered.
+			source.SendMessage(bridgeChanged)
+			update := receive()
+			assert.Equal(t, Update_CHANGED, update.Action)
+			assert.Equal(t, uint64(6), update.Sequence)
+
+			cancel()
+			assert.NoError(t, <-done)
+		})
+	}
+}
+
+func TestServeUpdatesInvalidResumeTime(t *testing.T) {
+	srv := &testUpdatesServer{
+		ctx:     context.Background(),
+		updates: make(chan *Update, 10),
+	}
+
+	err := ServeUpdates(zap.NewNop(), stream.NewSource(zap.NewNop()), &StreamBridgeUpdatesRequest{
+		ResumeSince: &timestamp.Timestamp{Nanos: -1},
+	}, srv, func(context.Context) ([]*Update, error) {
+		return nil, nil
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Empty(t, srv.updates)
+}
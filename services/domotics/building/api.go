@@ -52,66 +52,27 @@ func (a *API) StreamBridgeUpdates(req *bridge.StreamBridgeUpdatesRequest, stream
 
 	logger.Debug("watchBridges request")
 
-	sink := a.svc.bridgeUpdatesSource.NewSink()
-
-	// Send all of the currently active devices to start.
-	devices, err := a.svc.GetDevices(context.Background())
-	if err != nil {
-		a.logger.Error("unable to retrieve devices",
-			zap.Error(err),
-		)
-		return err
-	}
-
-	for _, device := range devices {
-		update := &bridge.Update{
-			Action: bridge.Update_ADDED,
-			Update: &bridge.Update_DeviceUpdate{
-				DeviceUpdate: &bridge.DeviceUpdate{
-					Device:   device,
-					BridgeId: "todo-building-bridge-id",
-				},
-			},
-		}
-
-		logger.Debug("sending seed info",
-			zap.String("update", update.String()),
-		)
-
-		if err := stream.Send(update); err != nil {
-			logger.Error("error sending update",
-				zap.Error(err),
-			)
-			return err
-		}
-	}
-	// TODO: the above is subject to a race condition where the add is processed after we've added the watcher
-	// but before we get the range of bridges so we duplicate data.
-	// This shouldn't cause issues on the client (they should be tolerant to this) but let's fix this anyways.
-
-	// Now we wait for updates
-	for {
-		update, ok := <-sink.Messages()
-		if !ok {
-			// Channel has been closed; so we'll close the connection as well
-			return nil
+	return bridge.ServeUpdates(logger, a.svc.bridgeUpdatesSource, req, stream, func(ctx context.Context) ([]*bridge.Update, error) {
+		// Send all of the currently active devices to start.
+		devices, err := a.svc.GetDevices(ctx)
+		if err != nil {
+			return nil, err
 		}
 
-		bridgeUpdate, ok := update.(*bridge.Update)
-		if !ok {
-			panic("bridge update cast failed)")
-		}
-
-		logger.Debug("sending update",
-			zap.String("bridge_info", update.String()),
-		)
-		if err := stream.Send(bridgeUpdate); err != nil {
-			logger.Error("err sending update",
-				zap.Error(err),
-			)
-			return err
+		var updates []*bridge.Update
+		for _, device := range devices {
+			updates = append(updates, &bridge.Update{
+				Action: bridge.Update_ADDED,
+				Update: &bridge.Update_DeviceUpdate{
+					DeviceUpdate: &bridge.DeviceUpdate{
+						Device:   device,
+						BridgeId: "todo-building-bridge-id",
+					},
+				},
+			})
 		}
-	}
+		return updates, nil
+	})
 }
 
 // ListDevices retrieves all registered devices.
@@ -162,6 +123,11 @@ func (a *API) UpdateDeviceState(ctx context.Context, req *bridge.UpdateDeviceSta
 	return nil, ErrNotImplemented.Err()
 }
 
+// BatchUpdateDeviceStates updates the state of each of the specified devices.
+func (a *API) BatchUpdateDeviceStates(ctx context.Context, req *bridge.BatchUpdateDeviceStatesRequest) (*bridge.BatchUpdateDeviceStatesResponse, error) {
+	return nil, ErrNotImplemented.Err()
+}
+
 var (
 	// ErrBuildingCreateFailed is returned when creating the building failed
 	ErrBuildingCreateFailed = status.New(codes.Internal, "unable to create bridge")
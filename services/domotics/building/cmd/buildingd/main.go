@@ -7,6 +7,7 @@ import (
 	"net"
 
 	_ "github.com/mattn/go-sqlite3" // Blank import for sql drivers is "standard"
+	"github.com/rmrobinson/nerves/lib/stream"
 	"github.com/rmrobinson/nerves/services/domotics/bridge"
 	"github.com/rmrobinson/nerves/services/domotics/building"
 	"github.com/spf13/viper"
@@ -15,8 +16,11 @@ import (
 )
 
 var (
-	portEnvVar   = "PORT"
-	dbPathEnvVar = "DB_PATH"
+	portEnvVar            = "PORT"
+	dbPathEnvVar          = "DB_PATH"
+	journalDirEnvVar      = "JOURNAL_DIR"
+	journalMaxAgeEnvVar   = "JOURNAL_MAX_AGE"
+	journalMaxBytesEnvVar = "JOURNAL_MAX_BYTES"
 )
 
 func main() {
@@ -28,6 +32,9 @@ func main() {
 	viper.SetEnvPrefix("NVS")
 	viper.BindEnv(portEnvVar)
 	viper.BindEnv(dbPathEnvVar)
+	viper.BindEnv(journalDirEnvVar)
+	viper.BindEnv(journalMaxAgeEnvVar)
+	viper.BindEnv(journalMaxBytesEnvVar)
 
 	sqldb, err := sql.Open("sqlite3", viper.GetString(dbPathEnvVar))
 	if err != nil {
@@ -37,7 +44,31 @@ func main() {
 	}
 
 	p := building.NewSQLPersister(logger, sqldb)
-	s := building.NewService(logger, p)
+
+	var s *building.Service
+	if journalDir := viper.GetString(journalDirEnvVar); len(journalDir) > 0 {
+		source, journal, err := bridge.NewJournaledUpdateSource(logger, stream.JournalConfig{
+			Dir:           journalDir,
+			MaxAge:        viper.GetDuration(journalMaxAgeEnvVar),
+			MaxTotalBytes: viper.GetInt64(journalMaxBytesEnvVar),
+		})
+		if err != nil {
+			logger.Fatal("error opening journal",
+				zap.String("dir", journalDir),
+				zap.Error(err),
+			)
+		}
+		defer journal.Close()
+
+		logger.Info("journaling updates",
+			zap.String("dir", journalDir),
+			zap.Uint64("sequence", source.Sequence()),
+		)
+
+		s = building.NewServiceWithSource(logger, p, source)
+	} else {
+		s = building.NewService(logger, p)
+	}
 
 	if err := s.Setup(context.Background()); err != nil {
 		logger.Fatal("unable to setup service",
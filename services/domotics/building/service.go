@@ -59,6 +59,12 @@ type Service struct {
 
 // NewService creates a new Service
 func NewService(logger *zap.Logger, persister StatePersister) *Service {
+	return NewServiceWithSource(logger, persister, stream.NewSource(logger))
+}
+
+// NewServiceWithSource creates a new Service which publishes its bridge updates to the supplied source.
+// This allows the updates to be recorded, for example by using a journaled source.
+func NewServiceWithSource(logger *zap.Logger, persister StatePersister, source *stream.Source) *Service {
 	return &Service{
 		logger:    logger,
 		persister: persister,
@@ -77,7 +83,7 @@ func NewService(logger *zap.Logger, persister StatePersister) *Service {
 				Description: "a virtual bridge which aggregates all linked bridges in the house",
 			},
 		},
-		bridgeUpdatesSource: stream.NewSource(logger),
+		bridgeUpdatesSource: source,
 	}
 }
 
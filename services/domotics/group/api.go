@@ -0,0 +1,431 @@
+package group
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrMissingParam is returned if a required parameter isn't supplied.
+	ErrMissingParam = status.New(codes.InvalidArgument, "required parameter missing")
+	// ErrDuplicateDevice is returned if a group contains the same device more than once.
+	ErrDuplicateDevice = status.New(codes.InvalidArgument, "device included more than once")
+	// ErrGroupNotFound is returned if the requested group doesn't exist.
+	ErrGroupNotFound = status.New(codes.NotFound, "group not found")
+	// ErrSceneNotFound is returned if the requested scene doesn't exist.
+	ErrSceneNotFound = status.New(codes.NotFound, "scene not found")
+	// ErrInternal is returned if the groups or scenes can't be saved or retrieved.
+	ErrInternal = status.New(codes.Internal, "unable to access groups and scenes")
+)
+
+// Hub is the source of the devices which groups and scenes are applied to; it is implemented by bridge.Hub.
+type Hub interface {
+	GetDevice(id string) (*bridge.Device, error)
+	BatchUpdateDeviceStates(ctx context.Context, req *bridge.BatchUpdateDeviceStatesRequest) (*bridge.BatchUpdateDeviceStatesResponse, error)
+}
+
+// API is an implementation of the GroupService and SceneService servers.
+type API struct {
+	logger    *zap.Logger
+	persister *SQLPersister
+	hub       Hub
+}
+
+// NewAPI creates a new group and scene service server which applies its changes to the devices of the supplied hub.
+func NewAPI(logger *zap.Logger, persister *SQLPersister, hub Hub) *API {
+	return &API{
+		logger:    logger,
+		persister: persister,
+		hub:       hub,
+	}
+}
+
+// CreateGroup saves a new group, assigning it an ID.
+func (api *API) CreateGroup(ctx context.Context, req *CreateGroupRequest) (*Group, error) {
+	if err := validateGroup(req.Group); err != nil {
+		return nil, err
+	}
+
+	group := &Group{
+		Id:          uuid.New().String(),
+		Name:        req.Group.Name,
+		Description: req.Group.Description,
+		DeviceIds:   req.Group.DeviceIds,
+	}
+	if err := api.persister.PutGroup(ctx, group); err != nil {
+		api.logger.Info("error creating group",
+			zap.String("name", group.Name),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	return group, nil
+}
+
+// GetGroup retrieves the specified group.
+func (api *API) GetGroup(ctx context.Context, req *GetGroupRequest) (*Group, error) {
+	if len(req.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	return api.group(ctx, req.Id)
+}
+
+// ListGroups retrieves all of the groups.
+func (api *API) ListGroups(ctx context.Context, req *ListGroupsRequest) (*ListGroupsResponse, error) {
+	groups, err := api.persister.ListGroups(ctx)
+	if err != nil {
+		api.logger.Info("error listing groups",
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	return &ListGroupsResponse{
+		Groups: groups,
+	}, nil
+}
+
+// UpdateGroup replaces the name, description and members of an existing group.
+func (api *API) UpdateGroup(ctx context.Context, req *UpdateGroupRequest) (*Group, error) {
+	if err := validateGroup(req.Group); err != nil {
+		return nil, err
+	} else if len(req.Group.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	if _, err := api.group(ctx, req.Group.Id); err != nil {
+		return nil, err
+	}
+
+	if err := api.persister.PutGroup(ctx, req.Group); err != nil {
+		api.logger.Info("error updating group",
+			zap.String("group_id", req.Group.Id),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	return req.Group, nil
+}
+
+// DeleteGroup removes the specified group. The devices of the group are unaffected.
+func (api *API) DeleteGroup(ctx context.Context, req *DeleteGroupRequest) (*DeleteGroupResponse, error) {
+	if len(req.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	if err := api.persister.DeleteGroup(ctx, req.Id); err == ErrNotFound {
+		return nil, ErrGroupNotFound.Err()
+	} else if err != nil {
+		api.logger.Info("error deleting group",
+			zap.String("group_id", req.Id),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	return &DeleteGroupResponse{}, nil
+}
+
+// GetGroupState retrieves the aggregate state of the devices in the specified group.
+func (api *API) GetGroupState(ctx context.Context, req *GetGroupStateRequest) (*GroupState, error) {
+	if len(req.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	group, err := api.group(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []*bridge.Device
+	for _, deviceID := range group.DeviceIds {
+		device, err := api.hub.GetDevice(deviceID)
+		if err != nil {
+			api.logger.Debug("error retrieving group member",
+				zap.String("group_id", group.Id),
+				zap.String("device_id", deviceID),
+				zap.Error(err),
+			)
+			// A missing device is reported as unreachable.
+			device = &bridge.Device{
+				Id: deviceID,
+			}
+		}
+		devices = append(devices, device)
+	}
+
+	state := aggregateState(devices)
+	state.GroupId = group.Id
+	return state, nil
+}
+
+// SetGroupState applies the supplied state to each member of the specified group.
+// The result of each device update is reported separately; the request only fails if the group can't be updated at all.
+func (api *API) SetGroupState(ctx context.Context, req *SetGroupStateRequest) (*SetGroupStateResponse, error) {
+	if len(req.Id) < 1 || req.State == nil {
+		return nil, ErrMissingParam.Err()
+	}
+
+	group, err := api.group(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	mask := req.UpdateMask
+	if len(mask.GetPaths()) < 1 {
+		mask = bridge.StateMask(req.State)
+	}
+
+	batch := &bridge.BatchUpdateDeviceStatesRequest{}
+	for _, deviceID := range group.DeviceIds {
+		batch.Requests = append(batch.Requests, &bridge.UpdateDeviceStateRequest{
+			Id:         deviceID,
+			State:      req.State,
+			UpdateMask: mask,
+		})
+	}
+
+	resp, err := api.hub.BatchUpdateDeviceStates(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SetGroupStateResponse{
+		Results: resp.Results,
+	}, nil
+}
+
+// CreateScene saves a new scene, assigning it an ID.
+func (api *API) CreateScene(ctx context.Context, req *CreateSceneRequest) (*Scene, error) {
+	if err := validateScene(req.Scene); err != nil {
+		return nil, err
+	}
+
+	scene := &Scene{
+		Id:          uuid.New().String(),
+		Name:        req.Scene.Name,
+		Description: req.Scene.Description,
+		States:      req.Scene.States,
+	}
+	if err := api.persister.PutScene(ctx, scene); err != nil {
+		api.logger.Info("error creating scene",
+			zap.String("name", scene.Name),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	return scene, nil
+}
+
+// GetScene retrieves the specified scene.
+func (api *API) GetScene(ctx context.Context, req *GetSceneRequest) (*Scene, error) {
+	if len(req.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	return api.scene(ctx, req.Id)
+}
+
+// ListScenes retrieves all of the scenes.
+func (api *API) ListScenes(ctx context.Context, req *ListScenesRequest) (*ListScenesResponse, error) {
+	scenes, err := api.persister.ListScenes(ctx)
+	if err != nil {
+		api.logger.Info("error listing scenes",
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	return &ListScenesResponse{
+		Scenes: scenes,
+	}, nil
+}
+
+// UpdateScene replaces the name, description and device states of an existing scene.
+func (api *API) UpdateScene(ctx context.Context, req *UpdateSceneRequest) (*Scene, error) {
+	if err := validateScene(req.Scene); err != nil {
+		return nil, err
+	} else if len(req.Scene.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	if _, err := api.scene(ctx, req.Scene.Id); err != nil {
+		return nil, err
+	}
+
+	if err := api.persister.PutScene(ctx, req.Scene); err != nil {
+		api.logger.Info("error updating scene",
+			zap.String("scene_id", req.Scene.Id),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	return req.Scene, nil
+}
+
+// DeleteScene removes the specified scene.
+func (api *API) DeleteScene(ctx context.Context, req *DeleteSceneRequest) (*DeleteSceneResponse, error) {
+	if len(req.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	if err := api.persister.DeleteScene(ctx, req.Id); err == ErrNotFound {
+		return nil, ErrSceneNotFound.Err()
+	} else if err != nil {
+		api.logger.Info("error deleting scene",
+			zap.String("scene_id", req.Id),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	return &DeleteSceneResponse{}, nil
+}
+
+// ActivateScene applies the state of each device in the specified scene.
+// Only the fields set in each device's state are applied, so a scene can change the brightness of a light without
+// turning it on, for example. The result of each device update is reported separately.
+func (api *API) ActivateScene(ctx context.Context, req *ActivateSceneRequest) (*ActivateSceneResponse, error) {
+	if len(req.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	scene, err := api.scene(ctx, req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var deviceIDs []string
+	for deviceID := range scene.States {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+
+	batch := &bridge.BatchUpdateDeviceStatesRequest{}
+	for _, deviceID := range deviceIDs {
+		batch.Requests = append(batch.Requests, &bridge.UpdateDeviceStateRequest{
+			Id:         deviceID,
+			State:      scene.States[deviceID],
+			UpdateMask: bridge.StateMask(scene.States[deviceID]),
+		})
+	}
+
+	api.logger.Debug("activating scene",
+		zap.String("scene_id", scene.Id),
+		zap.String("name", scene.Name),
+	)
+
+	resp, err := api.hub.BatchUpdateDeviceStates(ctx, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ActivateSceneResponse{
+		Results: resp.Results,
+	}, nil
+}
+
+func (api *API) group(ctx context.Context, id string) (*Group, error) {
+	group, err := api.persister.GetGroup(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrGroupNotFound.Err()
+	} else if err != nil {
+		api.logger.Info("error retrieving group",
+			zap.String("group_id", id),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+	return group, nil
+}
+
+func (api *API) scene(ctx context.Context, id string) (*Scene, error) {
+	scene, err := api.persister.GetScene(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrSceneNotFound.Err()
+	} else if err != nil {
+		api.logger.Info("error retrieving scene",
+			zap.String("scene_id", id),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+	return scene, nil
+}
+
+func validateGroup(group *Group) error {
+	if group == nil || len(group.Name) < 1 || len(group.DeviceIds) < 1 {
+		return ErrMissingParam.Err()
+	}
+
+	seen := map[string]bool{}
+	for _, deviceID := range group.DeviceIds {
+		if len(deviceID) < 1 {
+			return ErrMissingParam.Err()
+		} else if seen[deviceID] {
+			return ErrDuplicateDevice.Err()
+		}
+		seen[deviceID] = true
+	}
+	return nil
+}
+
+func validateScene(scene *Scene) error {
+	if scene == nil || len(scene.Name) < 1 || len(scene.States) < 1 {
+		return ErrMissingParam.Err()
+	}
+
+	for deviceID, state := range scene.States {
+		if len(deviceID) < 1 || state == nil {
+			return ErrMissingParam.Err()
+		}
+	}
+	return nil
+}
+
+// aggregateState summarizes the binary state of the supplied devices.
+// Devices which aren't reachable are reported separately and don't contribute to the power state,
+// nor do devices which can't be turned on or off.
+func aggregateState(devices []*bridge.Device) *GroupState {
+	state := &GroupState{}
+
+	on := 0
+	total := 0
+	for _, device := range devices {
+		if !device.GetState().GetIsReachable() {
+			state.UnreachableDeviceIds = append(state.UnreachableDeviceIds, device.Id)
+			continue
+		} else if device.State.Binary == nil {
+			continue
+		}
+
+		total++
+		if device.State.Binary.IsOn {
+			on++
+		}
+	}
+
+	switch {
+	case total < 1:
+		state.Power = GroupState_UNKNOWN
+	case on < 1:
+		state.Power = GroupState_ALL_OFF
+	case on == total:
+		state.Power = GroupState_ALL_ON
+	default:
+		state.Power = GroupState_SOME_ON
+	}
+
+	return state
+}
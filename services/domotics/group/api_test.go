@@ -0,0 +1,229 @@
+package group
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeHub applies updates to an in-memory set of devices.
+type fakeHub struct {
+	lock    sync.Mutex
+	devices map[string]*bridge.Device
+}
+
+func (h *fakeHub) GetDevice(id string) (*bridge.Device, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	device, ok := h.devices[id]
+	if !ok {
+		return nil, bridge.ErrDeviceNotFound.Err()
+	}
+	return proto.Clone(device).(*bridge.Device), nil
+}
+
+func (h *fakeHub) BatchUpdateDeviceStates(ctx context.Context, req *bridge.BatchUpdateDeviceStatesRequest) (*bridge.BatchUpdateDeviceStatesResponse, error) {
+	return bridge.BatchUpdate(ctx, req, func(ctx context.Context, req *bridge.UpdateDeviceStateRequest) (*bridge.Device, error) {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+
+		device, ok := h.devices[req.Id]
+		if !ok {
+			return nil, bridge.ErrDeviceNotFound.Err()
+		}
+
+		state, err := bridge.ApplyStateMask(device.State, req.State, req.UpdateMask)
+		if err != nil {
+			return nil, err
+		}
+		device.State = state
+		return proto.Clone(device).(*bridge.Device), nil
+	})
+}
+
+func binaryDevice(id string, reachable bool, on bool) *bridge.Device {
+	return &bridge.Device{
+		Id: id,
+		State: &bridge.DeviceState{
+			IsReachable: reachable,
+			Binary:      &bridge.DeviceState_Binary{IsOn: on},
+			Range:       &bridge.DeviceState_Range{Value: 100},
+		},
+	}
+}
+
+func TestAggregateState(t *testing.T) {
+	tests := []struct {
+		name        string
+		devices     []*bridge.Device
+		power       GroupState_Power
+		unreachable []string
+	}{
+		{
+			"all on",
+			[]*bridge.Device{binaryDevice("1", true, true), binaryDevice("2", true, true)},
+			GroupState_ALL_ON,
+			nil,
+		},
+		{
+			"some on",
+			[]*bridge.Device{binaryDevice("1", true, true), binaryDevice("2", true, false)},
+			GroupState_SOME_ON,
+			nil,
+		},
+		{
+			"all off",
+			[]*bridge.Device{binaryDevice("1", true, false), binaryDevice("2", true, false)},
+			GroupState_ALL_OFF,
+			nil,
+		},
+		{
+			"unreachable ignored",
+			[]*bridge.Device{binaryDevice("1", true, true), binaryDevice("2", false, false)},
+			GroupState_ALL_ON,
+			[]string{"2"},
+		},
+		{
+			"nothing reachable",
+			[]*bridge.Device{binaryDevice("1", false, true), {Id: "2"}},
+			GroupState_UNKNOWN,
+			[]string{"1", "2"},
+		},
+		{
+			"no binary devices",
+			[]*bridge.Device{{Id: "1", State: &bridge.DeviceState{IsReachable: true}}},
+			GroupState_UNKNOWN,
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := aggregateState(tt.devices)
+			assert.Equal(t, tt.power, state.Power)
+			assert.Equal(t, tt.unreachable, state.UnreachableDeviceIds)
+		})
+	}
+}
+
+func TestGroups(t *testing.T) {
+	ctx := context.Background()
+	hub := &fakeHub{
+		devices: map[string]*bridge.Device{
+			"1": binaryDevice("1", true, false),
+			"2": binaryDevice("2", true, true),
+			"3": binaryDevice("3", false, false),
+		},
+	}
+	api := NewAPI(zaptest.NewLogger(t), newTestPersister(t), hub)
+
+	_, err := api.CreateGroup(ctx, &CreateGroupRequest{
+		Group: &Group{Name: "Duplicates", DeviceIds: []string{"1", "1"}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	group, err := api.CreateGroup(ctx, &CreateGroupRequest{
+		Group: &Group{Name: "Lights", DeviceIds: []string{"1", "2", "3", "missing"}},
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, group.Id)
+
+	state, err := api.GetGroupState(ctx, &GetGroupStateRequest{Id: group.Id})
+	require.NoError(t, err)
+	assert.Equal(t, GroupState_SOME_ON, state.Power)
+	assert.Equal(t, []string{"3", "missing"}, state.UnreachableDeviceIds)
+
+	resp, err := api.SetGroupState(ctx, &SetGroupStateRequest{
+		Id: group.Id,
+		State: &bridge.DeviceState{
+			Binary: &bridge.DeviceState_Binary{IsOn: true},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Results, 4)
+	assert.NoError(t, resp.Results[0].Err())
+	assert.Equal(t, codes.NotFound, status.Code(resp.Results[3].Err()))
+
+	// Only the supplied fields are applied to the members.
+	device, err := hub.GetDevice("1")
+	require.NoError(t, err)
+	assert.True(t, device.State.Binary.IsOn)
+	assert.Equal(t, int32(100), device.State.Range.Value)
+
+	state, err = api.GetGroupState(ctx, &GetGroupStateRequest{Id: group.Id})
+	require.NoError(t, err)
+	assert.Equal(t, GroupState_ALL_ON, state.Power)
+
+	_, err = api.UpdateGroup(ctx, &UpdateGroupRequest{
+		Group: &Group{Id: "missing", Name: "Missing", DeviceIds: []string{"1"}},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = api.DeleteGroup(ctx, &DeleteGroupRequest{Id: group.Id})
+	require.NoError(t, err)
+	_, err = api.GetGroupState(ctx, &GetGroupStateRequest{Id: group.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestActivateScene(t *testing.T) {
+	ctx := context.Background()
+	hub := &fakeHub{
+		devices: map[string]*bridge.Device{
+			"1": binaryDevice("1", true, false),
+			"2": binaryDevice("2", true, true),
+		},
+	}
+	api := NewAPI(zaptest.NewLogger(t), newTestPersister(t), hub)
+
+	scene, err := api.CreateScene(ctx, &CreateSceneRequest{
+		Scene: &Scene{
+			Name: "Evening",
+			States: map[string]*bridge.DeviceState{
+				"1": {
+					Binary: &bridge.DeviceState_Binary{IsOn: true},
+					Range:  &bridge.DeviceState_Range{Value: 30},
+				},
+				"2": {
+					Binary: &bridge.DeviceState_Binary{IsOn: false},
+				},
+				"missing": {
+					Binary: &bridge.DeviceState_Binary{IsOn: true},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	resp, err := api.ActivateScene(ctx, &ActivateSceneRequest{Id: scene.Id})
+	require.NoError(t, err)
+	require.Len(t, resp.Results, 3)
+	assert.Equal(t, "1", resp.Results[0].Id)
+	assert.NoError(t, resp.Results[0].Err())
+	assert.Equal(t, "2", resp.Results[1].Id)
+	assert.NoError(t, resp.Results[1].Err())
+	assert.Equal(t, "missing", resp.Results[2].Id)
+	assert.Equal(t, codes.NotFound, status.Code(resp.Results[2].Err()))
+
+	device, err := hub.GetDevice("1")
+	require.NoError(t, err)
+	assert.True(t, device.State.Binary.IsOn)
+	assert.Equal(t, int32(30), device.State.Range.Value)
+
+	// Fields not set in the scene are left alone.
+	device, err = hub.GetDevice("2")
+	require.NoError(t, err)
+	assert.False(t, device.State.Binary.IsOn)
+	assert.Equal(t, int32(100), device.State.Range.Value)
+
+	_, err = api.ActivateScene(ctx, &ActivateSceneRequest{Id: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,322 @@
+package group
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNotFound is returned if the requested group or scene doesn't exist.
+	ErrNotFound = errors.New("not found")
+)
+
+const (
+	createGroupTableQuery = `CREATE TABLE IF NOT EXISTS device_group(
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT
+		);`
+	createGroupMemberTableQuery = `CREATE TABLE IF NOT EXISTS device_group_member(
+		group_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (group_id, device_id)
+		);`
+	createSceneTableQuery = `CREATE TABLE IF NOT EXISTS scene(
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT
+		);`
+	createSceneStateTableQuery = `CREATE TABLE IF NOT EXISTS scene_device_state(
+		scene_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		state BLOB,
+		PRIMARY KEY (scene_id, device_id)
+		);`
+
+	upsertGroupQuery        = `INSERT INTO device_group(id, name, description) VALUES (?, ?, ?) ON CONFLICT(id) DO UPDATE SET name=excluded.name, description=excluded.description;`
+	deleteGroupQuery        = `DELETE FROM device_group WHERE id=?;`
+	selectGroupsQuery       = `SELECT id, name, description FROM device_group ORDER BY name, id;`
+	selectGroupQuery        = `SELECT id, name, description FROM device_group WHERE id=?;`
+	insertGroupMemberQuery  = `INSERT INTO device_group_member(group_id, device_id, position) VALUES (?, ?, ?);`
+	deleteGroupMembersQuery = `DELETE FROM device_group_member WHERE group_id=?;`
+	selectGroupMembersQuery = `SELECT device_id FROM device_group_member WHERE group_id=? ORDER BY position;`
+
+	upsertSceneQuery       = `INSERT INTO scene(id, name, description) VALUES (?, ?, ?) ON CONFLICT(id) DO UPDATE SET name=excluded.name, description=excluded.description;`
+	deleteSceneQuery       = `DELETE FROM scene WHERE id=?;`
+	selectScenesQuery      = `SELECT id, name, description FROM scene ORDER BY name, id;`
+	selectSceneQuery       = `SELECT id, name, description FROM scene WHERE id=?;`
+	insertSceneStateQuery  = `INSERT INTO scene_device_state(scene_id, device_id, state) VALUES (?, ?, ?);`
+	deleteSceneStatesQuery = `DELETE FROM scene_device_state WHERE scene_id=?;`
+	selectSceneStatesQuery = `SELECT device_id, state FROM scene_device_state WHERE scene_id=?;`
+)
+
+// SQLPersister saves groups and scenes in a SQL DB.
+type SQLPersister struct {
+	logger *zap.Logger
+	db     *sql.DB
+}
+
+// NewSQLPersister creates a new persister backed by a SQL DB
+func NewSQLPersister(logger *zap.Logger, db *sql.DB) *SQLPersister {
+	return &SQLPersister{
+		logger: logger,
+		db:     db,
+	}
+}
+
+// Setup creates the tables used by the persister if they don't already exist.
+func (p *SQLPersister) Setup(ctx context.Context) error {
+	for _, query := range []string{createGroupTableQuery, createGroupMemberTableQuery, createSceneTableQuery, createSceneStateTableQuery} {
+		if _, err := p.db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PutGroup saves the supplied group, replacing any existing group with the same ID.
+func (p *SQLPersister) PutGroup(ctx context.Context, group *Group) error {
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, upsertGroupQuery, group.Id, group.Name, group.Description); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, deleteGroupMembersQuery, group.Id); err != nil {
+			return err
+		}
+		for idx, deviceID := range group.DeviceIds {
+			if _, err := tx.ExecContext(ctx, insertGroupMemberQuery, group.Id, deviceID, idx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteGroup removes the specified group. ErrNotFound is returned if it doesn't exist.
+func (p *SQLPersister) DeleteGroup(ctx context.Context, id string) error {
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, deleteGroupQuery, id)
+		if err != nil {
+			return err
+		}
+		if count, err := res.RowsAffected(); err != nil {
+			return err
+		} else if count < 1 {
+			return ErrNotFound
+		}
+
+		_, err = tx.ExecContext(ctx, deleteGroupMembersQuery, id)
+		return err
+	})
+}
+
+// GetGroup retrieves the specified group. ErrNotFound is returned if it doesn't exist.
+func (p *SQLPersister) GetGroup(ctx context.Context, id string) (*Group, error) {
+	group := &Group{}
+	var description sql.NullString
+	err := p.db.QueryRowContext(ctx, selectGroupQuery, id).Scan(&group.Id, &group.Name, &description)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	group.Description = description.String
+
+	if group.DeviceIds, err = p.groupMembers(ctx, id); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// ListGroups retrieves all of the saved groups, ordered by name.
+func (p *SQLPersister) ListGroups(ctx context.Context) ([]*Group, error) {
+	rows, err := p.db.QueryContext(ctx, selectGroupsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*Group
+	for rows.Next() {
+		group := &Group{}
+		var description sql.NullString
+		if err := rows.Scan(&group.Id, &group.Name, &description); err != nil {
+			return nil, err
+		}
+		group.Description = description.String
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		if group.DeviceIds, err = p.groupMembers(ctx, group.Id); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+func (p *SQLPersister) groupMembers(ctx context.Context, id string) ([]string, error) {
+	rows, err := p.db.QueryContext(ctx, selectGroupMembersQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deviceIDs []string
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return nil, err
+		}
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	return deviceIDs, rows.Err()
+}
+
+// PutScene saves the supplied scene, replacing any existing scene with the same ID.
+func (p *SQLPersister) PutScene(ctx context.Context, scene *Scene) error {
+	// Sort the device IDs so the stored rows are deterministic.
+	var deviceIDs []string
+	for deviceID := range scene.States {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, upsertSceneQuery, scene.Id, scene.Name, scene.Description); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, deleteSceneStatesQuery, scene.Id); err != nil {
+			return err
+		}
+		for _, deviceID := range deviceIDs {
+			state, err := proto.Marshal(scene.States[deviceID])
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, insertSceneStateQuery, scene.Id, deviceID, state); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteScene removes the specified scene. ErrNotFound is returned if it doesn't exist.
+func (p *SQLPersister) DeleteScene(ctx context.Context, id string) error {
+	return p.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, deleteSceneQuery, id)
+		if err != nil {
+			return err
+		}
+		if count, err := res.RowsAffected(); err != nil {
+			return err
+		} else if count < 1 {
+			return ErrNotFound
+		}
+
+		_, err = tx.ExecContext(ctx, deleteSceneStatesQuery, id)
+		return err
+	})
+}
+
+// GetScene retrieves the specified scene. ErrNotFound is returned if it doesn't exist.
+func (p *SQLPersister) GetScene(ctx context.Context, id string) (*Scene, error) {
+	scene := &Scene{}
+	var description sql.NullString
+	err := p.db.QueryRowContext(ctx, selectSceneQuery, id).Scan(&scene.Id, &scene.Name, &description)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	scene.Description = description.String
+
+	if scene.States, err = p.sceneStates(ctx, id); err != nil {
+		return nil, err
+	}
+	return scene, nil
+}
+
+// ListScenes retrieves all of the saved scenes, ordered by name.
+func (p *SQLPersister) ListScenes(ctx context.Context) ([]*Scene, error) {
+	rows, err := p.db.QueryContext(ctx, selectScenesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var scenes []*Scene
+	for rows.Next() {
+		scene := &Scene{}
+		var description sql.NullString
+		if err := rows.Scan(&scene.Id, &scene.Name, &description); err != nil {
+			return nil, err
+		}
+		scene.Description = description.String
+		scenes = append(scenes, scene)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, scene := range scenes {
+		if scene.States, err = p.sceneStates(ctx, scene.Id); err != nil {
+			return nil, err
+		}
+	}
+	return scenes, nil
+}
+
+func (p *SQLPersister) sceneStates(ctx context.Context, id string) (map[string]*bridge.DeviceState, error) {
+	rows, err := p.db.QueryContext(ctx, selectSceneStatesQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := map[string]*bridge.DeviceState{}
+	for rows.Next() {
+		var deviceID string
+		var stateBytes []byte
+		if err := rows.Scan(&deviceID, &stateBytes); err != nil {
+			return nil, err
+		}
+
+		state := &bridge.DeviceState{}
+		if err := proto.Unmarshal(stateBytes, state); err != nil {
+			return nil, err
+		}
+		states[deviceID] = state
+	}
+	return states, rows.Err()
+}
+
+func (p *SQLPersister) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			p.logger.Info("error rolling back transaction",
+				zap.Error(rbErr),
+			)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
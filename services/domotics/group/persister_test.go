@@ -0,0 +1,104 @@
+package group
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func newTestPersister(t *testing.T) *SQLPersister {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	// Each connection to an in-memory DB is distinct, so we need to share one.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	p := NewSQLPersister(zaptest.NewLogger(t), db)
+	require.NoError(t, p.Setup(context.Background()))
+	return p
+}
+
+func TestGroupPersistence(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersister(t)
+
+	group := &Group{
+		Id:          "g1",
+		Name:        "Living room",
+		Description: "All of the lights",
+		DeviceIds:   []string{"c", "a", "b"},
+	}
+	require.NoError(t, p.PutGroup(ctx, group))
+	require.NoError(t, p.PutGroup(ctx, &Group{
+		Id:        "g2",
+		Name:      "Kitchen",
+		DeviceIds: []string{"d"},
+	}))
+
+	// Members are returned in the order they were saved.
+	saved, err := p.GetGroup(ctx, "g1")
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(group, saved), "expected %v, got %v", group, saved)
+
+	group.Name = "Den"
+	group.DeviceIds = []string{"b"}
+	require.NoError(t, p.PutGroup(ctx, group))
+
+	groups, err := p.ListGroups(ctx)
+	require.NoError(t, err)
+	require.Len(t, groups, 2)
+	assert.Equal(t, "Den", groups[0].Name)
+	assert.Equal(t, []string{"b"}, groups[0].DeviceIds)
+	assert.Equal(t, "Kitchen", groups[1].Name)
+
+	require.NoError(t, p.DeleteGroup(ctx, "g1"))
+	_, err = p.GetGroup(ctx, "g1")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, p.DeleteGroup(ctx, "g1"))
+}
+
+func TestScenePersistence(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersister(t)
+
+	scene := &Scene{
+		Id:   "s1",
+		Name: "Movie night",
+		States: map[string]*bridge.DeviceState{
+			"lamp": {
+				Binary: &bridge.DeviceState_Binary{IsOn: true},
+				Range:  &bridge.DeviceState_Range{Value: 20},
+			},
+			"tv": {
+				Audio: &bridge.DeviceState_Audio{Volume: 30},
+			},
+		},
+	}
+	require.NoError(t, p.PutScene(ctx, scene))
+
+	saved, err := p.GetScene(ctx, "s1")
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(scene, saved), "expected %v, got %v", scene, saved)
+
+	delete(scene.States, "tv")
+	require.NoError(t, p.PutScene(ctx, scene))
+
+	scenes, err := p.ListScenes(ctx)
+	require.NoError(t, err)
+	require.Len(t, scenes, 1)
+	assert.True(t, proto.Equal(scene, scenes[0]), "expected %v, got %v", scene, scenes[0])
+
+	require.NoError(t, p.DeleteScene(ctx, "s1"))
+	_, err = p.GetScene(ctx, "s1")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, p.DeleteScene(ctx, "s1"))
+}
@@ -0,0 +1,124 @@
+package history
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrMissingDeviceID is returned if a device ID isn't supplied.
+	ErrMissingDeviceID = status.New(codes.InvalidArgument, "device id required")
+	// ErrInvalidTimeRange is returned if the supplied time range is malformed or ends before it starts.
+	ErrInvalidTimeRange = status.New(codes.InvalidArgument, "invalid time range")
+	// ErrInvalidInterval is returned if the supplied sample interval is missing or not positive.
+	ErrInvalidInterval = status.New(codes.InvalidArgument, "invalid interval")
+	// ErrInvalidField is returned if the supplied field can't be downsampled.
+	ErrInvalidField = status.New(codes.InvalidArgument, "invalid field")
+	// ErrInternal is returned if the history can't be retrieved.
+	ErrInternal = status.New(codes.Internal, "unable to retrieve history")
+)
+
+// API is an implementation of the HistoryService server.
+type API struct {
+	logger    *zap.Logger
+	persister *SQLPersister
+}
+
+// NewAPI creates a new history service server.
+func NewAPI(logger *zap.Logger, persister *SQLPersister) *API {
+	return &API{
+		logger:    logger,
+		persister: persister,
+	}
+}
+
+// GetDeviceHistory retrieves the state transitions of a device in the requested time range.
+func (api *API) GetDeviceHistory(ctx context.Context, req *GetDeviceHistoryRequest) (*GetDeviceHistoryResponse, error) {
+	if len(req.DeviceId) < 1 {
+		return nil, ErrMissingDeviceID.Err()
+	}
+
+	start, end, err := timeRange(req.StartTime, req.EndTime)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := api.persister.ListStates(ctx, req.DeviceId, start, end, int(req.Limit))
+	if err != nil {
+		api.logger.Info("error listing device states",
+			zap.String("device_id", req.DeviceId),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	return &GetDeviceHistoryResponse{
+		Records: records,
+	}, nil
+}
+
+// GetDeviceSeries retrieves the values of a numeric state field of a device in the requested time range,
+// downsampled to the requested interval.
+func (api *API) GetDeviceSeries(ctx context.Context, req *GetDeviceSeriesRequest) (*GetDeviceSeriesResponse, error) {
+	if len(req.DeviceId) < 1 {
+		return nil, ErrMissingDeviceID.Err()
+	} else if _, ok := seriesColumns[req.Field]; !ok {
+		return nil, ErrInvalidField.Err()
+	}
+
+	start, end, err := timeRange(req.StartTime, req.EndTime)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Interval == nil {
+		return nil, ErrInvalidInterval.Err()
+	}
+	interval, err := ptypes.Duration(req.Interval)
+	if err != nil || interval <= 0 {
+		return nil, ErrInvalidInterval.Err()
+	}
+
+	samples, err := api.persister.ListSamples(ctx, req.DeviceId, req.Field, start, end, interval)
+	if err != nil {
+		api.logger.Info("error listing device samples",
+			zap.String("device_id", req.DeviceId),
+			zap.String("field", req.Field.String()),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	return &GetDeviceSeriesResponse{
+		Samples: samples,
+	}, nil
+}
+
+// timeRange converts the supplied range, defaulting an unset start to the epoch and an unset end to now.
+func timeRange(startTime *timestamp.Timestamp, endTime *timestamp.Timestamp) (time.Time, time.Time, error) {
+	start := time.Unix(0, 0)
+	end := time.Now()
+
+	var err error
+	if startTime != nil {
+		if start, err = ptypes.Timestamp(startTime); err != nil {
+			return start, end, ErrInvalidTimeRange.Err()
+		}
+	}
+	if endTime != nil {
+		if end, err = ptypes.Timestamp(endTime); err != nil {
+			return start, end, ErrInvalidTimeRange.Err()
+		}
+	}
+
+	if end.Before(start) {
+		return start, end, ErrInvalidTimeRange.Err()
+	}
+	return start, end, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+
+	_ "github.com/mattn/go-sqlite3" // Blank import for sql drivers is "standard"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/rmrobinson/nerves/services/domotics/history"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const (
+	portEnvVar           = "PORT"
+	dbPathEnvVar         = "DB_PATH"
+	bridgeEndpointEnvVar = "BRIDGE_ENDPOINT"
+)
+
+func main() {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+
+	viper.SetEnvPrefix("NVS")
+	viper.BindEnv(portEnvVar)
+	viper.BindEnv(dbPathEnvVar)
+	viper.BindEnv(bridgeEndpointEnvVar)
+
+	sqldb, err := sql.Open("sqlite3", viper.GetString(dbPathEnvVar))
+	if err != nil {
+		logger.Fatal("unable to open db",
+			zap.Error(err),
+		)
+	}
+	defer sqldb.Close()
+
+	p := history.NewSQLPersister(logger, sqldb)
+	if err := p.Setup(context.Background()); err != nil {
+		logger.Fatal("unable to setup db",
+			zap.Error(err),
+		)
+	}
+
+	bridgeConn, err := grpc.Dial(viper.GetString(bridgeEndpointEnvVar), grpc.WithInsecure())
+	if err != nil {
+		logger.Fatal("unable to dial bridge",
+			zap.String("endpoint", viper.GetString(bridgeEndpointEnvVar)),
+			zap.Error(err),
+		)
+	}
+	defer bridgeConn.Close()
+
+	r := history.NewRecorder(logger, bridge.NewBridgeServiceClient(bridgeConn), p)
+	go r.Run(context.Background())
+
+	connStr := fmt.Sprintf("%s:%d", "", viper.GetInt(portEnvVar))
+	lis, err := net.Listen("tcp", connStr)
+	if err != nil {
+		logger.Fatal("error initializing listener",
+			zap.Error(err),
+		)
+	}
+	defer lis.Close()
+	logger.Info("listening",
+		zap.String("local_addr", connStr),
+	)
+
+	grpcServer := grpc.NewServer()
+	history.RegisterHistoryServiceServer(grpcServer, history.NewAPI(logger, p))
+	grpcServer.Serve(lis)
+}
@@ -0,0 +1,204 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrUnsupportedField is returned if a series is requested for a field which isn't recorded numerically.
+	ErrUnsupportedField = errors.New("unsupported field")
+)
+
+const (
+	createDeviceStateTableQuery = `CREATE TABLE IF NOT EXISTS device_state(
+		device_id TEXT NOT NULL,
+		bridge_id TEXT,
+		recorded_at INTEGER NOT NULL,
+		state BLOB,
+		range_value INTEGER,
+		temperature_celsius INTEGER,
+		audio_volume INTEGER
+		);`
+	createDeviceStateIndexQuery = `CREATE INDEX IF NOT EXISTS device_state_device_time ON device_state(device_id, recorded_at);`
+
+	insertDeviceStateQuery = `INSERT INTO device_state(device_id, bridge_id, recorded_at, state, range_value, temperature_celsius, audio_volume) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	selectLastStateQuery   = `SELECT device_id, bridge_id, recorded_at, state FROM device_state WHERE device_id=? ORDER BY recorded_at DESC LIMIT 1;`
+	selectStatesQuery      = `SELECT device_id, bridge_id, recorded_at, state FROM device_state WHERE device_id=? AND recorded_at>=? AND recorded_at<? ORDER BY recorded_at ASC LIMIT ?;`
+	// The field column is substituted in from seriesColumns so is never user-supplied.
+	selectSamplesQuery = `SELECT (recorded_at - ?) / ? AS bucket, COUNT(%[1]s), MIN(%[1]s), MAX(%[1]s), AVG(%[1]s) FROM device_state
+		WHERE device_id=? AND recorded_at>=? AND recorded_at<? AND %[1]s IS NOT NULL GROUP BY bucket ORDER BY bucket ASC;`
+)
+
+var seriesColumns = map[GetDeviceSeriesRequest_Field]string{
+	GetDeviceSeriesRequest_RANGE_VALUE:         "range_value",
+	GetDeviceSeriesRequest_TEMPERATURE_CELSIUS: "temperature_celsius",
+	GetDeviceSeriesRequest_AUDIO_VOLUME:        "audio_volume",
+}
+
+// SQLPersister records device state transitions in a SQL DB.
+// The numeric fields which can be downsampled are stored in their own columns so they can be aggregated by the DB.
+type SQLPersister struct {
+	logger *zap.Logger
+	db     *sql.DB
+}
+
+// NewSQLPersister creates a new persister backed by a SQL DB
+func NewSQLPersister(logger *zap.Logger, db *sql.DB) *SQLPersister {
+	return &SQLPersister{
+		logger: logger,
+		db:     db,
+	}
+}
+
+// Setup creates the tables used by the persister if they don't already exist.
+func (p *SQLPersister) Setup(ctx context.Context) error {
+	for _, query := range []string{createDeviceStateTableQuery, createDeviceStateIndexQuery} {
+		if _, err := p.db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RecordState saves the supplied state transition.
+func (p *SQLPersister) RecordState(ctx context.Context, record *DeviceStateRecord) error {
+	recordedAt, err := ptypes.Timestamp(record.RecordedAt)
+	if err != nil {
+		return err
+	}
+
+	state, err := proto.Marshal(record.State)
+	if err != nil {
+		return err
+	}
+
+	var rangeValue, temperature, volume sql.NullInt32
+	if record.State.GetRange() != nil {
+		rangeValue = sql.NullInt32{Int32: record.State.Range.Value, Valid: true}
+	}
+	if record.State.GetTemperature() != nil {
+		temperature = sql.NullInt32{Int32: record.State.Temperature.Celsius, Valid: true}
+	}
+	if record.State.GetAudio() != nil {
+		volume = sql.NullInt32{Int32: record.State.Audio.Volume, Valid: true}
+	}
+
+	_, err = p.db.ExecContext(ctx, insertDeviceStateQuery,
+		record.DeviceId,
+		record.BridgeId,
+		recordedAt.UnixNano(),
+		state,
+		rangeValue,
+		temperature,
+		volume,
+	)
+	return err
+}
+
+// LastState retrieves the most recently recorded state of the device, or nil if nothing has been recorded.
+func (p *SQLPersister) LastState(ctx context.Context, deviceID string) (*DeviceStateRecord, error) {
+	rows, err := p.db.QueryContext(ctx, selectLastStateQuery, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records, err := scanRecords(rows)
+	if err != nil || len(records) < 1 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+// ListStates retrieves the states of the device recorded in the time range, oldest first.
+// If limit is greater than 0 at most limit records are returned.
+func (p *SQLPersister) ListStates(ctx context.Context, deviceID string, start time.Time, end time.Time, limit int) ([]*DeviceStateRecord, error) {
+	if limit < 1 {
+		limit = -1
+	}
+
+	rows, err := p.db.QueryContext(ctx, selectStatesQuery, deviceID, start.UnixNano(), end.UnixNano(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRecords(rows)
+}
+
+// ListSamples downsamples the values of the field recorded for the device in the time range into samples of the
+// supplied interval, oldest first. Intervals with no recorded values are omitted.
+func (p *SQLPersister) ListSamples(ctx context.Context, deviceID string, field GetDeviceSeriesRequest_Field, start time.Time, end time.Time, interval time.Duration) ([]*Sample, error) {
+	column, ok := seriesColumns[field]
+	if !ok {
+		return nil, ErrUnsupportedField
+	}
+
+	rows, err := p.db.QueryContext(ctx, fmt.Sprintf(selectSamplesQuery, column),
+		start.UnixNano(),
+		interval.Nanoseconds(),
+		deviceID,
+		start.UnixNano(),
+		end.UnixNano(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var samples []*Sample
+	for rows.Next() {
+		var bucket int64
+		sample := &Sample{}
+		err = rows.Scan(&bucket, &sample.Count, &sample.Minimum, &sample.Maximum, &sample.Mean)
+		if err != nil {
+			return nil, err
+		}
+
+		sample.StartTime, err = ptypes.TimestampProto(start.Add(time.Duration(bucket) * interval))
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+
+	return samples, rows.Err()
+}
+
+func scanRecords(rows *sql.Rows) ([]*DeviceStateRecord, error) {
+	var records []*DeviceStateRecord
+	for rows.Next() {
+		var recordedAt int64
+		var state []byte
+		record := &DeviceStateRecord{
+			State: &bridge.DeviceState{},
+		}
+
+		err := rows.Scan(&record.DeviceId, &record.BridgeId, &recordedAt, &state)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := proto.Unmarshal(state, record.State); err != nil {
+			return nil, err
+		}
+
+		record.RecordedAt, err = ptypes.TimestampProto(time.Unix(0, recordedAt))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
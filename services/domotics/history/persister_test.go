@@ -0,0 +1,176 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+var testStart = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestPersister(t *testing.T) *SQLPersister {
+	db, err := sql.Open("sqlite3", ":memory:")
+	require.NoError(t, err)
+	// Each connection to an in-memory DB is distinct, so we need to share one.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	p := NewSQLPersister(zaptest.NewLogger(t), db)
+	require.NoError(t, p.Setup(context.Background()))
+	return p
+}
+
+func recordTemperature(t *testing.T, p *SQLPersister, deviceID string, offset time.Duration, celsius int32) {
+	recordedAt, err := ptypes.TimestampProto(testStart.Add(offset))
+	require.NoError(t, err)
+
+	err = p.RecordState(context.Background(), &DeviceStateRecord{
+		DeviceId:   deviceID,
+		BridgeId:   "bridge",
+		RecordedAt: recordedAt,
+		State: &bridge.DeviceState{
+			IsReachable: true,
+			Temperature: &bridge.DeviceState_Temperature{
+				Celsius: celsius,
+			},
+		},
+	})
+	require.NoError(t, err)
+}
+
+func TestListStates(t *testing.T) {
+	p := newTestPersister(t)
+	for idx, celsius := range []int32{10, 11, 12, 13} {
+		recordTemperature(t, p, "device", time.Duration(idx)*time.Minute, celsius)
+	}
+	recordTemperature(t, p, "other", time.Minute, 30)
+
+	tests := []struct {
+		name     string
+		start    time.Time
+		end      time.Time
+		limit    int
+		expected []int32
+	}{
+		{
+			"everything",
+			testStart,
+			testStart.Add(time.Hour),
+			0,
+			[]int32{10, 11, 12, 13},
+		},
+		{
+			"end is exclusive",
+			testStart.Add(time.Minute),
+			testStart.Add(3 * time.Minute),
+			0,
+			[]int32{11, 12},
+		},
+		{
+			"limited",
+			testStart,
+			testStart.Add(time.Hour),
+			2,
+			[]int32{10, 11},
+		},
+		{
+			"empty range",
+			testStart.Add(time.Hour),
+			testStart.Add(2 * time.Hour),
+			0,
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := p.ListStates(context.Background(), "device", tt.start, tt.end, tt.limit)
+			require.NoError(t, err)
+
+			var values []int32
+			for _, record := range records {
+				assert.Equal(t, "device", record.DeviceId)
+				assert.Equal(t, "bridge", record.BridgeId)
+				values = append(values, record.State.Temperature.Celsius)
+			}
+			assert.Equal(t, tt.expected, values)
+		})
+	}
+}
+
+func TestListSamples(t *testing.T) {
+	p := newTestPersister(t)
+	recordTemperature(t, p, "device", 0, 10)
+	recordTemperature(t, p, "device", 5*time.Minute, 20)
+	recordTemperature(t, p, "device", 25*time.Minute, 16)
+
+	// A state without a temperature shouldn't contribute to the samples.
+	recordedAt, err := ptypes.TimestampProto(testStart.Add(time.Minute))
+	require.NoError(t, err)
+	err = p.RecordState(context.Background(), &DeviceStateRecord{
+		DeviceId:   "device",
+		RecordedAt: recordedAt,
+		State:      &bridge.DeviceState{},
+	})
+	require.NoError(t, err)
+
+	samples, err := p.ListSamples(context.Background(), "device", GetDeviceSeriesRequest_TEMPERATURE_CELSIUS, testStart, testStart.Add(time.Hour), 10*time.Minute)
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+
+	assert.Equal(t, int32(2), samples[0].Count)
+	assert.Equal(t, 10.0, samples[0].Minimum)
+	assert.Equal(t, 20.0, samples[0].Maximum)
+	assert.Equal(t, 15.0, samples[0].Mean)
+	assert.Equal(t, testStart.Unix(), samples[0].StartTime.Seconds)
+
+	assert.Equal(t, int32(1), samples[1].Count)
+	assert.Equal(t, 16.0, samples[1].Mean)
+	assert.Equal(t, testStart.Add(20*time.Minute).Unix(), samples[1].StartTime.Seconds)
+
+	_, err = p.ListSamples(context.Background(), "device", GetDeviceSeriesRequest_UNSPECIFIED, testStart, testStart.Add(time.Hour), time.Minute)
+	assert.Equal(t, ErrUnsupportedField, err)
+}
+
+func TestRecorderSkipsUnchangedStates(t *testing.T) {
+	p := newTestPersister(t)
+	r := NewRecorder(zaptest.NewLogger(t), nil, p)
+
+	update := func(isOn bool, version string) *bridge.DeviceUpdate {
+		return &bridge.DeviceUpdate{
+			BridgeId: "bridge",
+			Device: &bridge.Device{
+				Id: "device",
+				State: &bridge.DeviceState{
+					Binary:  &bridge.DeviceState_Binary{IsOn: isOn},
+					Version: &bridge.Version{Sw: version},
+				},
+			},
+		}
+	}
+
+	ctx := context.Background()
+	require.NoError(t, r.record(ctx, update(true, "1"), testStart))
+	require.NoError(t, r.record(ctx, update(true, "2"), testStart.Add(time.Minute)))
+	require.NoError(t, r.record(ctx, update(false, "3"), testStart.Add(2*time.Minute)))
+
+	// A new recorder, such as after a restart, shouldn't record the last state again.
+	r = NewRecorder(zaptest.NewLogger(t), nil, p)
+	require.NoError(t, r.record(ctx, update(false, "3"), testStart.Add(3*time.Minute)))
+
+	records, err := p.ListStates(ctx, "device", testStart, testStart.Add(time.Hour), 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.True(t, records[0].State.Binary.IsOn)
+	assert.False(t, records[1].State.Binary.IsOn)
+}
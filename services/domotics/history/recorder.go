@@ -0,0 +1,176 @@
+package history
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"go.uber.org/zap"
+)
+
+const (
+	// the amount of time to wait before re-establishing a failed update stream
+	streamRetryInterval = time.Second * 10
+)
+
+// Recorder subscribes to the updates of a bridge and records each device state transition.
+// Updates which don't change the state of a device, such as those sent when the stream is established, aren't recorded.
+// If the stream fails it is resumed from the last update received, so transitions made while reconnecting are recorded.
+type Recorder struct {
+	logger    *zap.Logger
+	client    bridge.BridgeServiceClient
+	persister *SQLPersister
+
+	lastStates map[string]*bridge.DeviceState
+	// lastSequence is the sequence number of the last update received, which the stream is resumed after.
+	lastSequence uint64
+}
+
+// NewRecorder creates a new recorder which saves the state transitions of devices managed by the supplied bridge.
+func NewRecorder(logger *zap.Logger, client bridge.BridgeServiceClient, persister *SQLPersister) *Recorder {
+	return &Recorder{
+		logger:     logger,
+		client:     client,
+		persister:  persister,
+		lastStates: map[string]*bridge.DeviceState{},
+	}
+}
+
+// Run records device state transitions until the context is cancelled.
+// If the update stream fails it is re-established after a delay.
+func (r *Recorder) Run(ctx context.Context) {
+	for {
+		err := r.monitor(ctx)
+		r.logger.Info("device update stream ended",
+			zap.Error(err),
+		)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(streamRetryInterval):
+		}
+	}
+}
+
+func (r *Recorder) monitor(ctx context.Context) error {
+	stream, err := r.client.StreamBridgeUpdates(ctx, &bridge.StreamBridgeUpdatesRequest{
+		Filter: &bridge.UpdateFilter{
+			DevicesOnly: true,
+			Actions: []bridge.Update_Action{
+				bridge.Update_ADDED,
+				bridge.Update_CHANGED,
+			},
+		},
+		ResumeAfterSequence: r.lastSequence,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		update, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		if update.Sequence > 0 {
+			r.lastSequence = update.Sequence
+		}
+
+		if gap := update.GetGap(); gap != nil {
+			// The transitions in the gap are lost, but the current state of each device follows,
+			// which is recorded if it changed.
+			r.logger.Info("missed device updates",
+				zap.Uint64("first_sequence", gap.FirstSequence),
+				zap.Uint64("last_sequence", gap.LastSequence),
+			)
+			continue
+		}
+
+		deviceUpdate := update.GetDeviceUpdate()
+		if deviceUpdate == nil || deviceUpdate.Device == nil {
+			continue
+		}
+
+		if err := r.record(ctx, deviceUpdate, changedAt(update)); err != nil {
+			r.logger.Info("unable to record device state",
+				zap.String("device_id", deviceUpdate.Device.Id),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// record saves the state of the device in the update if it differs from the last state recorded.
+func (r *Recorder) record(ctx context.Context, update *bridge.DeviceUpdate, changedAt time.Time) error {
+	device := update.Device
+	if device.State == nil {
+		return nil
+	}
+
+	last, ok := r.lastStates[device.Id]
+	if !ok {
+		// We may have recorded this device in a previous run, so check before recording a duplicate.
+		record, err := r.persister.LastState(ctx, device.Id)
+		if err != nil {
+			return err
+		} else if record != nil {
+			last = record.State
+		}
+	}
+
+	if last != nil && statesEqual(last, device.State) {
+		return nil
+	}
+
+	recordedAt, err := ptypes.TimestampProto(changedAt)
+	if err != nil {
+		return err
+	}
+
+	err = r.persister.RecordState(ctx, &DeviceStateRecord{
+		DeviceId:   device.Id,
+		BridgeId:   update.BridgeId,
+		RecordedAt: recordedAt,
+		State:      device.State,
+	})
+	if err != nil {
+		return err
+	}
+
+	r.logger.Debug("recorded device state",
+		zap.String("device_id", device.Id),
+		zap.String("state", device.State.String()),
+	)
+	r.lastStates[device.Id] = device.State
+	return nil
+}
+
+// changedAt returns when the state of the device in the update changed. This is when the device reported the state,
+// if it says, otherwise when the update was sent. If neither is known it is assumed to have just changed.
+func changedAt(update *bridge.Update) time.Time {
+	for _, ts := range []*timestamp.Timestamp{update.GetDeviceUpdate().GetDevice().GetState().GetReportedAt(), update.SentAt} {
+		if ts == nil {
+			continue
+		}
+		if t, err := ptypes.Timestamp(ts); err == nil {
+			return t
+		}
+	}
+
+	return time.Now()
+}
+
+// statesEqual compares two device states, ignoring their versions.
+func statesEqual(a *bridge.DeviceState, b *bridge.DeviceState) bool {
+	a = proto.Clone(a).(*bridge.DeviceState)
+	b = proto.Clone(b).(*bridge.DeviceState)
+	a.Version = nil
+	b.Version = nil
+
+	return proto.Equal(a, b)
+}
@@ -0,0 +1,133 @@
+package history
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+)
+
+// scriptedBridgeClient serves each requested update stream from the next of its scripts.
+type scriptedBridgeClient struct {
+	bridge.BridgeServiceClient
+
+	scripts  [][]*bridge.Update
+	requests []*bridge.StreamBridgeUpdatesRequest
+}
+
+func (c *scriptedBridgeClient) StreamBridgeUpdates(ctx context.Context, in *bridge.StreamBridgeUpdatesRequest, opts ...grpc.CallOption) (bridge.BridgeService_StreamBridgeUpdatesClient, error) {
+	c.requests = append(c.requests, in)
+
+	stream := &scriptedStream{updates: c.scripts[0]}
+	c.scripts = c.scripts[1:]
+	return stream, nil
+}
+
+// scriptedStream returns each of its updates in turn, then ends.
+type scriptedStream struct {
+	grpc.ClientStream
+
+	updates []*bridge.Update
+}
+
+func (s *scriptedStream) Recv() (*bridge.Update, error) {
+	if len(s.updates) < 1 {
+		return nil, io.EOF
+	}
+
+	update := s.updates[0]
+	s.updates = s.updates[1:]
+	return update, nil
+}
+
+func temperatureUpdate(action bridge.Update_Action, sequence uint64, celsius int32, sentAt *timestamp.Timestamp, reportedAt *timestamp.Timestamp) *bridge.Update {
+	return &bridge.Update{
+		Action: action,
+		Update: &bridge.Update_DeviceUpdate{
+			DeviceUpdate: &bridge.DeviceUpdate{
+				Device: &bridge.Device{
+					Id: "device",
+					State: &bridge.DeviceState{
+						IsReachable: true,
+						Temperature: &bridge.DeviceState_Temperature{
+							Celsius: celsius,
+						},
+						ReportedAt: reportedAt,
+					},
+				},
+				DeviceId: "device",
+				BridgeId: "bridge",
+			},
+		},
+		Sequence: sequence,
+		SentAt:   sentAt,
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPersister(t)
+
+	timestampAt := func(offset time.Duration) *timestamp.Timestamp {
+		ts, err := ptypes.TimestampProto(testStart.Add(offset))
+		require.NoError(t, err)
+		return ts
+	}
+
+	client := &scriptedBridgeClient{
+		scripts: [][]*bridge.Update{
+			{
+				temperatureUpdate(bridge.Update_ADDED, 2, 10, nil, nil),
+				temperatureUpdate(bridge.Update_CHANGED, 3, 10, timestampAt(time.Minute), nil),
+				temperatureUpdate(bridge.Update_CHANGED, 4, 11, timestampAt(2*time.Minute), nil),
+				temperatureUpdate(bridge.Update_CHANGED, 5, 12, timestampAt(4*time.Minute), timestampAt(3*time.Minute)),
+			},
+			{
+				{
+					Update: &bridge.Update_Gap{
+						Gap: &bridge.UpdateGap{
+							FirstSequence: 6,
+							LastSequence:  7,
+						},
+					},
+					Sequence: 7,
+				},
+				temperatureUpdate(bridge.Update_ADDED, 7, 13, nil, nil),
+			},
+		},
+	}
+	r := NewRecorder(zaptest.NewLogger(t), client, p)
+
+	// Updates are recorded as of when the device reported them, or when they were sent, if known.
+	start := time.Now()
+	assert.Equal(t, io.EOF, r.monitor(ctx))
+
+	records, err := p.ListStates(ctx, "device", testStart, testStart.Add(time.Hour), 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, int32(11), records[0].State.Temperature.Celsius)
+	assert.Equal(t, timestampAt(2*time.Minute).Seconds, records[0].RecordedAt.Seconds)
+	assert.Equal(t, int32(12), records[1].State.Temperature.Celsius)
+	assert.Equal(t, timestampAt(3*time.Minute).Seconds, records[1].RecordedAt.Seconds)
+
+	// The stream is resumed after the last update received, and the state following a gap is recorded.
+	assert.Equal(t, io.EOF, r.monitor(ctx))
+
+	require.Len(t, client.requests, 2)
+	assert.Zero(t, client.requests[0].ResumeAfterSequence)
+	assert.Equal(t, uint64(5), client.requests[1].ResumeAfterSequence)
+
+	records, err = p.ListStates(ctx, "device", start, time.Now(), 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, int32(10), records[0].State.Temperature.Celsius)
+	assert.Equal(t, int32(13), records[1].State.Temperature.Celsius)
+}
@@ -35,10 +35,8 @@ func main() {
 		return
 	}
 
-	bridgeClient := bridge.NewBridgeServiceClient(bridgeConn)
-
 	h := bridge.NewHub(logger)
-	h.AddBridge(bridgeClient)
+	h.AddBridgeConn(bridgeConn)
 
 	relayConn, err := grpc.Dial(*relayAddr, opts...)
 	if err != nil {
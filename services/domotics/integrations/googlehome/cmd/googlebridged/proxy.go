@@ -302,7 +302,7 @@ func (p *Proxy) processExecuteRequest(msg *googlehome.ExecuteRequest) *googlehom
 				for _, d := range devices {
 					if d.State.Range != nil {
 						// This comes in as a %; we need to adjust for the fact the range may be larger than 100
-						d.State.Range.Value = int32(float64(actionCmd.BrightnessAbsolute.Brightness) * float64(d.Range.Maximum) / float64(100.0))
+						d.State.Range.Value = rangeFromPercent(d, actionCmd.BrightnessAbsolute.Brightness)
 					}
 				}
 			} else if actionCmd.BrightnessRelative != nil {
@@ -327,29 +327,63 @@ func (p *Proxy) processExecuteRequest(msg *googlehome.ExecuteRequest) *googlehom
 						d.State.ColorRgb.Blue = int32(actionCmd.ColorAbsolute.Color.RGB) & 0x0ff
 					}
 				}
+			} else if actionCmd.Generic != nil {
+				if err := applyGenericCommand(execContext.Payload, devices); err != nil {
+					p.logger.Info("unable to deserialize command",
+						zap.Strings("device_ids", cmd.DeviceIds),
+						zap.Error(err),
+					)
+					execErr = err
+					break
+				}
 			}
 			// TODO: support more commands
 		}
 
+		if len(devices) < 1 {
+			continue
+		}
+
 		// Now that each device has its state set, let's attempt to apply it.
+		// The devices are updated together so a command covering many devices isn't slowed by each one.
+		batchReq := &bridge.BatchUpdateDeviceStatesRequest{}
 		for deviceID, d := range devices {
-			upd, err := p.h.UpdateDeviceState(context.Background(), deviceID, d.State)
-			if err != nil {
+			batchReq.Requests = append(batchReq.Requests, &bridge.UpdateDeviceStateRequest{
+				Id:      deviceID,
+				Version: d.Version,
+				State:   d.State,
+			})
+		}
+
+		batchResp, err := p.h.BatchUpdateDeviceStates(context.Background(), batchReq)
+		if err != nil {
+			p.logger.Info("error updating states",
+				zap.Strings("device_ids", cmd.DeviceIds),
+				zap.Error(err),
+			)
+			for deviceID := range devices {
+				failedDeviceIDs = append(failedDeviceIDs, deviceID)
+			}
+			continue
+		}
+
+		for _, result := range batchResp.Results {
+			if err := result.Err(); err != nil {
 				p.logger.Info("error updating state",
-					zap.String("device_id", deviceID),
+					zap.String("device_id", result.Id),
 					zap.String("cmd", spew.Sdump(cmd.ExecutionContext)),
-					zap.String("state", spew.Sdump(d.State)),
+					zap.String("state", spew.Sdump(devices[result.Id].State)),
 					zap.Error(err),
 				)
-				failedDeviceIDs = append(failedDeviceIDs, deviceID)
+				failedDeviceIDs = append(failedDeviceIDs, result.Id)
 				continue
 			}
 
-			successDeviceIDs = append(successDeviceIDs, deviceID)
-			successState, err = bridgeToGoogleState(upd)
+			successDeviceIDs = append(successDeviceIDs, result.Id)
+			successState, err = bridgeToGoogleState(result.Device)
 			if err != nil {
 				p.logger.Info("error serializing updated state to google format",
-					zap.String("device_id", deviceID),
+					zap.String("device_id", result.Id),
 					zap.Error(err),
 				)
 			}
@@ -491,6 +525,7 @@ func (p *Proxy) processRelayUpdates(relayStream googlehome.GoogleHomeService_Sta
 
 func bridgeToGoogleState(d *bridge.Device) (action.DeviceState, error) {
 	ads := action.NewDeviceState(d.IsActive)
+	var err error
 
 	if d.State == nil {
 		return ads, errors.New("device state missing")
@@ -512,7 +547,7 @@ func bridgeToGoogleState(d *bridge.Device) (action.DeviceState, error) {
 
 		ads.RecordOnOff(d.State.Binary.IsOn)
 		if d.State.Range != nil {
-			ads.RecordBrightness(int(d.State.Range.Value))
+			ads.RecordBrightness(rangeToPercent(d))
 		}
 		if d.State.ColorHsb != nil {
 			// nerves uses 'HSB' while Google uses 'HSV'. These are synonymous and neither are HSL (which is different).
@@ -534,7 +569,31 @@ func bridgeToGoogleState(d *bridge.Device) (action.DeviceState, error) {
 
 		ads.RecordOnOff(d.State.Binary.IsOn)
 		if d.State.Range != nil {
-			ads.RecordBrightness(int(d.State.Range.Value))
+			ads.RecordBrightness(rangeToPercent(d))
+		}
+	case bridge.DeviceType_WINDOW_COVERING:
+		if d.State.Cover == nil {
+			return ads, errors.New("window covering missing required attribute")
+		}
+
+		if ads, err = recordCoverState(ads, d.State.Cover); err != nil {
+			return ads, err
+		}
+	case bridge.DeviceType_LOCK:
+		if d.State.Lock == nil {
+			return ads, errors.New("lock missing required attribute")
+		}
+
+		if ads, err = recordLockState(ads, d.State.Lock); err != nil {
+			return ads, err
+		}
+	case bridge.DeviceType_THERMOSTAT:
+		if d.State.Thermostat == nil {
+			return ads, errors.New("thermostat missing required attribute")
+		}
+
+		if ads, err = recordThermostatState(ads, d.State.Thermostat); err != nil {
+			return ads, err
 		}
 	}
 
@@ -545,42 +604,60 @@ func bridgeToGoogleState(d *bridge.Device) (action.DeviceState, error) {
 
 func bridgeToGoogleDevice(d *bridge.Device) *action.Device {
 	var ad *action.Device
+	var err error
 
 	switch d.Type {
 	case bridge.DeviceType_AV_RECEIVER:
 		var inputs []action.DeviceInput
 
-		if d.Input == nil {
+		inputTrait := d.Trait(bridge.Trait_INPUT)
+		if inputTrait == nil {
 			return nil
 		}
 
-		for _, i := range d.Input.Inputs {
+		for _, i := range inputTrait.Options {
 			inputs = append(inputs, action.DeviceInput{
 				Key: i,
 			})
 		}
-		// Volume-based devices are already normalizing their volume between 0 and 100
+
+		maxVolume := 100
+		if audioTrait := d.Trait(bridge.Trait_AUDIO); audioTrait != nil && audioTrait.Maximum > audioTrait.Minimum {
+			maxVolume = int(audioTrait.Maximum)
+		}
 		// Volume-based devices always support muting
 		// Volume-based devices support state querying
-		ad = action.NewSimpleAVReceiver(d.Id, inputs, 100, true, false)
+		ad = action.NewSimpleAVReceiver(d.Id, inputs, maxVolume, true, false)
 	case bridge.DeviceType_LIGHT:
 		ad = action.NewLight(d.Id)
 
-		if d.State.Range != nil {
+		if d.IsWritable(bridge.Trait_RANGE) {
 			ad.AddBrightnessTrait(false)
 		}
-		if d.State.ColorHsb != nil {
+		if d.IsWritable(bridge.Trait_COLOR_HSB) {
 			ad.AddColourTrait(action.HSV, false)
-		} else if d.State.ColorRgb != nil {
+		} else if d.IsWritable(bridge.Trait_COLOR_RGB) {
 			ad.AddColourTrait(action.RGB, false)
 		}
 	case bridge.DeviceType_OUTLET:
 		ad = action.NewOutlet(d.Id)
 	case bridge.DeviceType_SWITCH:
 		ad = action.NewSwitch(d.Id)
-		if d.State.Range != nil {
+		if d.IsWritable(bridge.Trait_RANGE) {
 			ad.AddBrightnessTrait(false)
 		}
+	case bridge.DeviceType_WINDOW_COVERING:
+		if ad, err = coverToGoogleDevice(d); err != nil {
+			return nil
+		}
+	case bridge.DeviceType_LOCK:
+		if ad, err = lockToGoogleDevice(d); err != nil {
+			return nil
+		}
+	case bridge.DeviceType_THERMOSTAT:
+		if ad, err = thermostatToGoogleDevice(d); err != nil {
+			return nil
+		}
 	default:
 		return nil
 	}
@@ -596,3 +673,23 @@ func bridgeToGoogleDevice(d *bridge.Device) *action.Device {
 
 	return ad
 }
+
+// rangeBounds returns the bounds of the device's range, which are assumed to be a percentage if the device doesn't specify them.
+func rangeBounds(d *bridge.Device) (int32, int32) {
+	if t := d.Trait(bridge.Trait_RANGE); t != nil && t.Maximum > t.Minimum {
+		return t.Minimum, t.Maximum
+	}
+	return 0, 100
+}
+
+// rangeFromPercent converts the supplied percentage into a value within the bounds of the device's range.
+func rangeFromPercent(d *bridge.Device, percent int) int32 {
+	min, max := rangeBounds(d)
+	return min + int32(float64(percent)*float64(max-min)/float64(100.0))
+}
+
+// rangeToPercent converts the current range value of the device into a percentage of its bounds.
+func rangeToPercent(d *bridge.Device) int {
+	min, max := rangeBounds(d)
+	return int(float64(d.State.Range.Value-min) * float64(100.0) / float64(max-min))
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+
+	action "github.com/rmrobinson/google-smart-home-action-go"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+)
+
+// The action library doesn't have helpers for window coverings, locks or thermostats,
+// so their device types, traits, attributes and commands are handled here.
+const (
+	deviceTypeBlinds     = "action.devices.types.BLINDS"
+	deviceTypeLock       = "action.devices.types.LOCK"
+	deviceTypeThermostat = "action.devices.types.THERMOSTAT"
+
+	traitOpenClose          = "action.devices.traits.OpenClose"
+	traitLockUnlock         = "action.devices.traits.LockUnlock"
+	traitTemperatureSetting = "action.devices.traits.TemperatureSetting"
+
+	commandOpenClose          = "action.devices.commands.OpenClose"
+	commandLockUnlock         = "action.devices.commands.LockUnlock"
+	commandThermostatSetpoint = "action.devices.commands.ThermostatTemperatureSetpoint"
+	commandThermostatSetRange = "action.devices.commands.ThermostatTemperatureSetRange"
+	commandThermostatSetMode  = "action.devices.commands.ThermostatSetMode"
+)
+
+// The setpoint bounds reported for thermostats which don't specify their own.
+const (
+	defaultThermostatMinimumCelsius = 10
+	defaultThermostatMaximumCelsius = 32
+)
+
+// thermostatModes maps the thermostat modes to the names Google uses for them.
+var thermostatModes = map[bridge.DeviceState_Thermostat_Mode]string{
+	bridge.DeviceState_Thermostat_OFF:       "off",
+	bridge.DeviceState_Thermostat_HEAT:      "heat",
+	bridge.DeviceState_Thermostat_COOL:      "cool",
+	bridge.DeviceState_Thermostat_HEAT_COOL: "heatcool",
+	bridge.DeviceState_Thermostat_FAN_ONLY:  "fan-only",
+	bridge.DeviceState_Thermostat_ECO:       "eco",
+}
+
+// genericCommand is a command the action library doesn't parse, with its parameters left to the handler.
+type genericCommand struct {
+	Command string          `json:"command"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type openCloseParams struct {
+	OpenPercent int32 `json:"openPercent"`
+}
+
+type lockUnlockParams struct {
+	Lock bool `json:"lock"`
+}
+
+type thermostatParams struct {
+	Setpoint     float64 `json:"thermostatTemperatureSetpoint"`
+	SetpointHigh float64 `json:"thermostatTemperatureSetpointHigh"`
+	SetpointLow  float64 `json:"thermostatTemperatureSetpointLow"`
+	Mode         string  `json:"thermostatMode"`
+}
+
+// newGenericDevice creates a device of the specified type with a single trait described by the supplied attributes.
+// The attributes of a device can only be set by the action library itself, so the device is built from its JSON form.
+func newGenericDevice(id string, deviceType string, trait string, attributes map[string]interface{}) (*action.Device, error) {
+	raw, err := json.Marshal(map[string]interface{}{
+		"id":         id,
+		"type":       deviceType,
+		"traits":     []string{trait},
+		"attributes": attributes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ad := &action.Device{}
+	if err := json.Unmarshal(raw, ad); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// recordGenericState adds state the action library doesn't have a helper for to the device state.
+// The state can only be set by the action library itself, so it is merged through the JSON form of the device state.
+func recordGenericState(ads action.DeviceState, state map[string]interface{}) (action.DeviceState, error) {
+	raw, err := json.Marshal(ads)
+	if err != nil {
+		return ads, err
+	}
+
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return ads, err
+	}
+	for k, v := range state {
+		payload[k] = v
+	}
+
+	if raw, err = json.Marshal(payload); err != nil {
+		return ads, err
+	}
+	ret := action.DeviceState{}
+	if err := json.Unmarshal(raw, &ret); err != nil {
+		return ads, err
+	}
+	return ret, nil
+}
+
+func coverToGoogleDevice(d *bridge.Device) (*action.Device, error) {
+	return newGenericDevice(d.Id, deviceTypeBlinds, traitOpenClose, map[string]interface{}{
+		"discreteOnlyOpenClose": false,
+		"queryOnlyOpenClose":    !d.IsWritable(bridge.Trait_COVER),
+	})
+}
+
+func lockToGoogleDevice(d *bridge.Device) (*action.Device, error) {
+	return newGenericDevice(d.Id, deviceTypeLock, traitLockUnlock, map[string]interface{}{})
+}
+
+func thermostatToGoogleDevice(d *bridge.Device) (*action.Device, error) {
+	min, max := int32(defaultThermostatMinimumCelsius), int32(defaultThermostatMaximumCelsius)
+	var modes []string
+
+	if trait := d.Trait(bridge.Trait_THERMOSTAT); trait != nil {
+		if trait.Maximum > trait.Minimum {
+			min, max = trait.Minimum, trait.Maximum
+		}
+		for _, option := range trait.Options {
+			if mode, ok := thermostatModes[bridge.DeviceState_Thermostat_Mode(bridge.DeviceState_Thermostat_Mode_value[option])]; ok {
+				modes = append(modes, mode)
+			}
+		}
+	}
+	if len(modes) < 1 {
+		modes = []string{"off", "heat"}
+	}
+
+	return newGenericDevice(d.Id, deviceTypeThermostat, traitTemperatureSetting, map[string]interface{}{
+		"availableThermostatModes":  modes,
+		"thermostatTemperatureUnit": "C",
+		"thermostatTemperatureRange": map[string]interface{}{
+			"minThresholdCelsius": min,
+			"maxThresholdCelsius": max,
+		},
+		"queryOnlyTemperatureSetting": !d.IsWritable(bridge.Trait_THERMOSTAT),
+	})
+}
+
+func recordCoverState(ads action.DeviceState, cover *bridge.DeviceState_Cover) (action.DeviceState, error) {
+	return recordGenericState(ads, map[string]interface{}{
+		"openPercent": cover.Position,
+	})
+}
+
+func recordLockState(ads action.DeviceState, lock *bridge.DeviceState_Lock) (action.DeviceState, error) {
+	return recordGenericState(ads, map[string]interface{}{
+		"isLocked": lock.State == bridge.DeviceState_Lock_LOCKED,
+		"isJammed": lock.State == bridge.DeviceState_Lock_JAMMED,
+	})
+}
+
+func recordThermostatState(ads action.DeviceState, thermostat *bridge.DeviceState_Thermostat) (action.DeviceState, error) {
+	state := map[string]interface{}{
+		"thermostatMode":               thermostatModes[thermostat.Mode],
+		"thermostatTemperatureAmbient": thermostat.CurrentCelsius,
+	}
+
+	switch thermostat.Mode {
+	case bridge.DeviceState_Thermostat_HEAT:
+		state["thermostatTemperatureSetpoint"] = thermostat.HeatSetpointCelsius
+	case bridge.DeviceState_Thermostat_COOL:
+		state["thermostatTemperatureSetpoint"] = thermostat.CoolSetpointCelsius
+	case bridge.DeviceState_Thermostat_HEAT_COOL:
+		state["thermostatTemperatureSetpointLow"] = thermostat.HeatSetpointCelsius
+		state["thermostatTemperatureSetpointHigh"] = thermostat.CoolSetpointCelsius
+	}
+
+	switch thermostat.HvacState {
+	case bridge.DeviceState_Thermostat_HEATING:
+		state["activeThermostatMode"] = "heat"
+	case bridge.DeviceState_Thermostat_COOLING:
+		state["activeThermostatMode"] = "cool"
+	case bridge.DeviceState_Thermostat_FAN:
+		state["activeThermostatMode"] = "fan-only"
+	case bridge.DeviceState_Thermostat_IDLE:
+		state["activeThermostatMode"] = "none"
+	}
+
+	return recordGenericState(ads, state)
+}
+
+// applyGenericCommand applies a command the action library doesn't parse to the state of each of the devices.
+func applyGenericCommand(payload []byte, devices map[string]*bridge.Device) error {
+	cmd := &genericCommand{}
+	if err := json.Unmarshal(payload, cmd); err != nil {
+		return err
+	}
+
+	switch cmd.Command {
+	case commandOpenClose:
+		params := &openCloseParams{}
+		if err := json.Unmarshal(cmd.Params, params); err != nil {
+			return err
+		}
+		for _, d := range devices {
+			if d.State.Cover != nil {
+				d.State.Cover.Position = params.OpenPercent
+			}
+		}
+	case commandLockUnlock:
+		params := &lockUnlockParams{}
+		if err := json.Unmarshal(cmd.Params, params); err != nil {
+			return err
+		}
+		for _, d := range devices {
+			if d.State.Lock != nil {
+				d.State.Lock.State = bridge.DeviceState_Lock_UNLOCKED
+				if params.Lock {
+					d.State.Lock.State = bridge.DeviceState_Lock_LOCKED
+				}
+			}
+		}
+	case commandThermostatSetpoint, commandThermostatSetRange, commandThermostatSetMode:
+		params := &thermostatParams{}
+		if err := json.Unmarshal(cmd.Params, params); err != nil {
+			return err
+		}
+		for _, d := range devices {
+			if d.State.Thermostat != nil {
+				applyThermostatCommand(cmd.Command, params, d.State.Thermostat)
+			}
+		}
+	}
+
+	return nil
+}
+
+func applyThermostatCommand(command string, params *thermostatParams, thermostat *bridge.DeviceState_Thermostat) {
+	switch command {
+	case commandThermostatSetpoint:
+		// A single setpoint applies to whichever direction the thermostat is currently working in.
+		if thermostat.Mode == bridge.DeviceState_Thermostat_COOL {
+			thermostat.CoolSetpointCelsius = roundSetpoint(params.Setpoint)
+		} else {
+			thermostat.HeatSetpointCelsius = roundSetpoint(params.Setpoint)
+		}
+	case commandThermostatSetRange:
+		thermostat.HeatSetpointCelsius = roundSetpoint(params.SetpointLow)
+		thermostat.CoolSetpointCelsius = roundSetpoint(params.SetpointHigh)
+	case commandThermostatSetMode:
+		for mode, name := range thermostatModes {
+			if name == params.Mode {
+				thermostat.Mode = mode
+			}
+		}
+	}
+}
+
+// roundSetpoint rounds the setpoint to the half degree, which is as precise as thermostats generally are.
+func roundSetpoint(celsius float64) float64 {
+	return math.Round(celsius*2) / 2
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var syncTests = []struct {
+	name   string
+	device *bridge.Device
+
+	expected string
+}{
+	{
+		name: "writable cover",
+		device: &bridge.Device{
+			Id:     "cover1",
+			Type:   bridge.DeviceType_WINDOW_COVERING,
+			Config: &bridge.DeviceConfig{Name: "Blinds"},
+			Traits: []*bridge.Trait{{Type: bridge.Trait_COVER, IsWritable: true}},
+			State:  &bridge.DeviceState{},
+		},
+		expected: `{
+			"id": "cover1",
+			"type": "action.devices.types.BLINDS",
+			"traits": ["action.devices.traits.OpenClose"],
+			"name": {"name": "Blinds"},
+			"willReportState": true,
+			"attributes": {"discreteOnlyOpenClose": false, "queryOnlyOpenClose": false},
+			"deviceInfo": {}
+		}`,
+	},
+	{
+		name: "read-only cover",
+		device: &bridge.Device{
+			Id:           "cover2",
+			Type:         bridge.DeviceType_WINDOW_COVERING,
+			ModelName:    "Shade",
+			Manufacturer: "Acme",
+			Config:       &bridge.DeviceConfig{Name: "Skylight"},
+			Traits:       []*bridge.Trait{{Type: bridge.Trait_COVER}},
+			State: &bridge.DeviceState{
+				Version: &bridge.Version{Hw: "1", Sw: "2"},
+			},
+		},
+		expected: `{
+			"id": "cover2",
+			"type": "action.devices.types.BLINDS",
+			"traits": ["action.devices.traits.OpenClose"],
+			"name": {"name": "Skylight"},
+			"willReportState": true,
+			"attributes": {"discreteOnlyOpenClose": false, "queryOnlyOpenClose": true},
+			"deviceInfo": {"manufacturer": "Acme", "model": "Shade", "hwVersion": "1", "swVersion": "2"}
+		}`,
+	},
+	{
+		name: "lock",
+		device: &bridge.Device{
+			Id:     "lock1",
+			Type:   bridge.DeviceType_LOCK,
+			Config: &bridge.DeviceConfig{Name: "Front door"},
+			Traits: []*bridge.Trait{{Type: bridge.Trait_LOCK, IsWritable: true}},
+			State:  &bridge.DeviceState{},
+		},
+		expected: `{
+			"id": "lock1",
+			"type": "action.devices.types.LOCK",
+			"traits": ["action.devices.traits.LockUnlock"],
+			"name": {"name": "Front door"},
+			"willReportState": true,
+			"deviceInfo": {}
+		}`,
+	},
+	{
+		name: "thermostat with range and modes",
+		device: &bridge.Device{
+			Id:     "thermostat1",
+			Type:   bridge.DeviceType_THERMOSTAT,
+			Config: &bridge.DeviceConfig{Name: "Hallway"},
+			Traits: []*bridge.Trait{
+				{
+					Type:       bridge.Trait_THERMOSTAT,
+					IsWritable: true,
+					Minimum:    5,
+					Maximum:    30,
+					Options:    []string{"OFF", "HEAT_COOL", "UNKNOWN_MODE"},
+				},
+			},
+			State: &bridge.DeviceState{},
+		},
+		expected: `{
+			"id": "thermostat1",
+			"type": "action.devices.types.THERMOSTAT",
+			"traits": ["action.devices.traits.TemperatureSetting"],
+			"name": {"name": "Hallway"},
+			"willReportState": true,
+			"attributes": {
+				"availableThermostatModes": ["off", "heatcool"],
+				"queryOnlyTemperatureSetting": false,
+				"thermostatTemperatureRange": {"minThresholdCelsius": 5, "maxThresholdCelsius": 30},
+				"thermostatTemperatureUnit": "C"
+			},
+			"deviceInfo": {}
+		}`,
+	},
+	{
+		name: "read-only thermostat with defaults",
+		device: &bridge.Device{
+			Id:     "thermostat2",
+			Type:   bridge.DeviceType_THERMOSTAT,
+			Config: &bridge.DeviceConfig{Name: "Basement"},
+			Traits: []*bridge.Trait{{Type: bridge.Trait_THERMOSTAT}},
+			State:  &bridge.DeviceState{},
+		},
+		expected: `{
+			"id": "thermostat2",
+			"type": "action.devices.types.THERMOSTAT",
+			"traits": ["action.devices.traits.TemperatureSetting"],
+			"name": {"name": "Basement"},
+			"willReportState": true,
+			"attributes": {
+				"availableThermostatModes": ["off", "heat"],
+				"queryOnlyTemperatureSetting": true,
+				"thermostatTemperatureRange": {"minThresholdCelsius": 10, "maxThresholdCelsius": 32},
+				"thermostatTemperatureUnit": "C"
+			},
+			"deviceInfo": {}
+		}`,
+	},
+}
+
+func TestBridgeToGoogleDevice(t *testing.T) {
+	for _, tt := range syncTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ad := bridgeToGoogleDevice(tt.device)
+			require.NotNil(t, ad)
+
+			raw, err := json.Marshal(ad)
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.expected, string(raw))
+		})
+	}
+}
+
+var queryTests = []struct {
+	name   string
+	device *bridge.Device
+
+	expected    string
+	expectedErr bool
+}{
+	{
+		name: "cover",
+		device: &bridge.Device{
+			Type:     bridge.DeviceType_WINDOW_COVERING,
+			IsActive: true,
+			State: &bridge.DeviceState{
+				Cover: &bridge.DeviceState_Cover{Position: 40},
+			},
+		},
+		expected: `{"online": true, "openPercent": 40}`,
+	},
+	{
+		name: "cover missing state",
+		device: &bridge.Device{
+			Type:  bridge.DeviceType_WINDOW_COVERING,
+			State: &bridge.DeviceState{},
+		},
+		expectedErr: true,
+	},
+	{
+		name: "locked lock",
+		device: &bridge.Device{
+			Type:     bridge.DeviceType_LOCK,
+			IsActive: true,
+			State: &bridge.DeviceState{
+				Lock: &bridge.DeviceState_Lock{State: bridge.DeviceState_Lock_LOCKED},
+			},
+		},
+		expected: `{"online": true, "isLocked": true, "isJammed": false}`,
+	},
+	{
+		name: "jammed lock",
+		device: &bridge.Device{
+			Type: bridge.DeviceType_LOCK,
+			State: &bridge.DeviceState{
+				Lock: &bridge.DeviceState_Lock{State: bridge.DeviceState_Lock_JAMMED},
+			},
+		},
+		expected: `{"online": false, "isLocked": false, "isJammed": true}`,
+	},
+	{
+		name: "lock missing state",
+		device: &bridge.Device{
+			Type:  bridge.DeviceType_LOCK,
+			State: &bridge.DeviceState{},
+		},
+		expectedErr: true,
+	},
+	{
+		name: "heating thermostat",
+		device: &bridge.Device{
+			Type:     bridge.DeviceType_THERMOSTAT,
+			IsActive: true,
+			State: &bridge.DeviceState{
+				Thermostat: &bridge.DeviceState_Thermostat{
+					Mode:                bridge.DeviceState_Thermostat_HEAT,
+					HvacState:           bridge.DeviceState_Thermostat_HEATING,
+					CurrentCelsius:      19.5,
+					HeatSetpointCelsius: 21,
+					CoolSetpointCelsius: 25,
+				},
+			},
+		},
+		expected: `{
+			"online": true,
+			"thermostatMode": "heat",
+			"activeThermostatMode": "heat",
+			"thermostatTemperatureAmbient": 19.5,
+			"thermostatTemperatureSetpoint": 21
+		}`,
+	},
+	{
+		name: "cooling thermostat",
+		device: &bridge.Device{
+			Type:     bridge.DeviceType_THERMOSTAT,
+			IsActive: true,
+			State: &bridge.DeviceState{
+				Thermostat: &bridge.DeviceState_Thermostat{
+					Mode:                bridge.DeviceState_Thermostat_COOL,
+					HvacState:           bridge.DeviceState_Thermostat_FAN,
+					CurrentCelsius:      27,
+					HeatSetpointCelsius: 21,
+					CoolSetpointCelsius: 25,
+				},
+			},
+		},
+		expected: `{
+			"online": true,
+			"thermostatMode": "cool",
+			"activeThermostatMode": "fan-only",
+			"thermostatTemperatureAmbient": 27,
+			"thermostatTemperatureSetpoint": 25
+		}`,
+	},
+	{
+		name: "idle heat cool thermostat",
+		device: &bridge.Device{
+			Type:     bridge.DeviceType_THERMOSTAT,
+			IsActive: true,
+			State: &bridge.DeviceState{
+				Thermostat: &bridge.DeviceState_Thermostat{
+					Mode:                bridge.DeviceState_Thermostat_HEAT_COOL,
+					HvacState:           bridge.DeviceState_Thermostat_IDLE,
+					CurrentCelsius:      22,
+					HeatSetpointCelsius: 20,
+					CoolSetpointCelsius: 24,
+				},
+			},
+		},
+		expected: `{
+			"online": true,
+			"thermostatMode": "heatcool",
+			"activeThermostatMode": "none",
+			"thermostatTemperatureAmbient": 22,
+			"thermostatTemperatureSetpointLow": 20,
+			"thermostatTemperatureSetpointHigh": 24
+		}`,
+	},
+	{
+		name: "thermostat missing state",
+		device: &bridge.Device{
+			Type:  bridge.DeviceType_THERMOSTAT,
+			State: &bridge.DeviceState{},
+		},
+		expectedErr: true,
+	},
+}
+
+func TestBridgeToGoogleState(t *testing.T) {
+	for _, tt := range queryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ads, err := bridgeToGoogleState(tt.device)
+			if tt.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			raw, err := json.Marshal(ads)
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.expected, string(raw))
+		})
+	}
+}
+
+func newCommandDevices() map[string]*bridge.Device {
+	return map[string]*bridge.Device{
+		"cover1": {
+			Id: "cover1",
+			State: &bridge.DeviceState{
+				Cover: &bridge.DeviceState_Cover{Position: 100},
+			},
+		},
+		"lock1": {
+			Id: "lock1",
+			State: &bridge.DeviceState{
+				Lock: &bridge.DeviceState_Lock{State: bridge.DeviceState_Lock_UNLOCKED},
+			},
+		},
+		"thermostat1": {
+			Id: "thermostat1",
+			State: &bridge.DeviceState{
+				Thermostat: &bridge.DeviceState_Thermostat{
+					Mode:                bridge.DeviceState_Thermostat_HEAT,
+					HeatSetpointCelsius: 20,
+					CoolSetpointCelsius: 25,
+				},
+			},
+		},
+	}
+}
+
+var executeTests = []struct {
+	name    string
+	payload string
+
+	// expected holds the states of the devices which the command changes; the rest must be left as they were.
+	expected    map[string]*bridge.DeviceState
+	expectedErr bool
+}{
+	{
+		name:    "open close",
+		payload: `{"command": "action.devices.commands.OpenClose", "params": {"openPercent": 30}}`,
+		expected: map[string]*bridge.DeviceState{
+			"cover1": {Cover: &bridge.DeviceState_Cover{Position: 30}},
+		},
+	},
+	{
+		name:    "lock",
+		payload: `{"command": "action.devices.commands.LockUnlock", "params": {"lock": true}}`,
+		expected: map[string]*bridge.DeviceState{
+			"lock1": {Lock: &bridge.DeviceState_Lock{State: bridge.DeviceState_Lock_LOCKED}},
+		},
+	},
+	{
+		name:    "unlock",
+		payload: `{"command": "action.devices.commands.LockUnlock", "params": {"lock": false}}`,
+	},
+	{
+		name:    "setpoint while heating is rounded",
+		payload: `{"command": "action.devices.commands.ThermostatTemperatureSetpoint", "params": {"thermostatTemperatureSetpoint": 21.3}}`,
+		expected: map[string]*bridge.DeviceState{
+			"thermostat1": {
+				Thermostat: &bridge.DeviceState_Thermostat{
+					Mode:                bridge.DeviceState_Thermostat_HEAT,
+					HeatSetpointCelsius: 21.5,
+					CoolSetpointCelsius: 25,
+				},
+			},
+		},
+	},
+	{
+		name:    "set range",
+		payload: `{"command": "action.devices.commands.ThermostatTemperatureSetRange", "params": {"thermostatTemperatureSetpointLow": 18, "thermostatTemperatureSetpointHigh": 26.2}}`,
+		expected: map[string]*bridge.DeviceState{
+			"thermostat1": {
+				Thermostat: &bridge.DeviceState_Thermostat{
+					Mode:                bridge.DeviceState_Thermostat_HEAT,
+					HeatSetpointCelsius: 18,
+					CoolSetpointCelsius: 26,
+				},
+			},
+		},
+	},
+	{
+		name:    "set mode",
+		payload: `{"command": "action.devices.commands.ThermostatSetMode", "params": {"thermostatMode": "eco"}}`,
+		expected: map[string]*bridge.DeviceState{
+			"thermostat1": {
+				Thermostat: &bridge.DeviceState_Thermostat{
+					Mode:                bridge.DeviceState_Thermostat_ECO,
+					HeatSetpointCelsius: 20,
+					CoolSetpointCelsius: 25,
+				},
+			},
+		},
+	},
+	{
+		name:    "unknown mode is ignored",
+		payload: `{"command": "action.devices.commands.ThermostatSetMode", "params": {"thermostatMode": "dry"}}`,
+	},
+	{
+		name:    "unknown command is ignored",
+		payload: `{"command": "action.devices.commands.Dock", "params": {}}`,
+	},
+	{
+		name:        "malformed payload",
+		payload:     `{"command": `,
+		expectedErr: true,
+	},
+	{
+		name:        "open close with bad params",
+		payload:     `{"command": "action.devices.commands.OpenClose", "params": {"openPercent": "half"}}`,
+		expectedErr: true,
+	},
+	{
+		name:        "lock unlock with bad params",
+		payload:     `{"command": "action.devices.commands.LockUnlock", "params": {"lock": "yes"}}`,
+		expectedErr: true,
+	},
+	{
+		name:        "thermostat with bad params",
+		payload:     `{"command": "action.devices.commands.ThermostatTemperatureSetpoint", "params": {"thermostatTemperatureSetpoint": "warm"}}`,
+		expectedErr: true,
+	},
+	{
+		name:        "missing params",
+		payload:     `{"command": "action.devices.commands.OpenClose"}`,
+		expectedErr: true,
+	},
+}
+
+func TestApplyGenericCommand(t *testing.T) {
+	for _, tt := range executeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices := newCommandDevices()
+
+			err := applyGenericCommand([]byte(tt.payload), devices)
+			if tt.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			for id, original := range newCommandDevices() {
+				expected := original.State
+				if state, ok := tt.expected[id]; ok {
+					expected = state
+				}
+				assert.True(t, proto.Equal(expected, devices[id].State), "%s: %s", id, devices[id].State)
+			}
+		})
+	}
+}
@@ -8,10 +8,10 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/golang/protobuf/proto"
 	"github.com/rmrobinson/nerves/services/domotics/bridge"
 	"github.com/rmrobinson/nerves/services/users"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 const (
@@ -50,7 +50,12 @@ func NewDomotics(logger *zap.Logger, svc *Service, bridgeClient bridge.BridgeSer
 
 // Monitor is used to track changes to devices
 func (d *Domotics) Monitor(ctx context.Context) {
-	stream, err := d.bridgeClient.StreamBridgeUpdates(ctx, &bridge.StreamBridgeUpdatesRequest{})
+	// Only device changes are broadcast to users.
+	stream, err := d.bridgeClient.StreamBridgeUpdates(ctx, &bridge.StreamBridgeUpdatesRequest{
+		Filter: &bridge.UpdateFilter{
+			DevicesOnly: true,
+		},
+	})
 	if err != nil {
 		d.logger.Info("error creating device update stream",
 			zap.Error(err),
@@ -189,10 +194,17 @@ func (d *Domotics) setDeviceIsOn(user *users.User, device *bridge.Device, isOn b
 	}
 
 	req := &bridge.UpdateDeviceStateRequest{
-		Id:    device.Id,
-		State: proto.Clone(device.State).(*bridge.DeviceState),
+		Id:      device.Id,
+		Version: device.Version,
+		State: &bridge.DeviceState{
+			Binary: &bridge.DeviceState_Binary{
+				IsOn: isOn,
+			},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"binary.is_on"},
+		},
 	}
-	req.State.Binary.IsOn = isOn
 	_, err := d.bridgeClient.UpdateDeviceState(context.Background(), req)
 	if err != nil {
 		d.logger.Warn("unable to set device state",
@@ -215,10 +227,17 @@ func (d *Domotics) setDeviceVolume(user *users.User, device *bridge.Device, volu
 	}
 
 	req := &bridge.UpdateDeviceStateRequest{
-		Id:    device.Id,
-		State: proto.Clone(device.State).(*bridge.DeviceState),
+		Id:      device.Id,
+		Version: device.Version,
+		State: &bridge.DeviceState{
+			Audio: &bridge.DeviceState_Audio{
+				Volume: volume,
+			},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{
+			Paths: []string{"audio.volume"},
+		},
 	}
-	req.State.Audio.Volume = volume
 	_, err := d.bridgeClient.UpdateDeviceState(context.Background(), req)
 	if err != nil {
 		d.logger.Warn("unable to set device state",
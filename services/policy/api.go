@@ -0,0 +1,202 @@
+package policy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrMissingParam is returned if a required parameter isn't supplied.
+	ErrMissingParam = status.New(codes.InvalidArgument, "required parameter missing")
+	// ErrUnsupportedPolicy is returned if a policy has an invalid condition or a schedule which can't be set up.
+	ErrUnsupportedPolicy = status.New(codes.InvalidArgument, "policy condition invalid")
+	// ErrPolicyNotFound is returned if the requested policy doesn't exist.
+	ErrPolicyNotFound = status.New(codes.NotFound, "policy not found")
+	// ErrInternal is returned if the policies can't be saved.
+	ErrInternal = status.New(codes.Internal, "unable to save policy")
+)
+
+// API is an implementation of the PolicyService server.
+// Changes are applied to the engine and then saved to the policy files; if a change can't be saved
+// the engine is reverted so the running policies match the files.
+type API struct {
+	logger *zap.Logger
+	engine *Engine
+	store  *FileStore
+
+	// changeLock serializes changes so the engine and the files are changed in the same order.
+	changeLock sync.Mutex
+}
+
+// NewAPI creates a new policy service server which manages the policies of the supplied engine.
+func NewAPI(logger *zap.Logger, engine *Engine, store *FileStore) *API {
+	return &API{
+		logger: logger,
+		engine: engine,
+		store:  store,
+	}
+}
+
+// ListPolicies retrieves all of the policies, in the order they are evaluated.
+func (api *API) ListPolicies(ctx context.Context, req *ListPoliciesRequest) (*ListPoliciesResponse, error) {
+	return &ListPoliciesResponse{
+		Policies: api.engine.Policies(),
+	}, nil
+}
+
+// GetPolicy retrieves the specified policy.
+func (api *API) GetPolicy(ctx context.Context, req *GetPolicyRequest) (*Policy, error) {
+	if len(req.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	return api.policy(req.Id)
+}
+
+// CreatePolicy adds a new policy, assigning it an ID.
+func (api *API) CreatePolicy(ctx context.Context, req *CreatePolicyRequest) (*Policy, error) {
+	if err := validatePolicy(req.Policy); err != nil {
+		return nil, err
+	}
+
+	api.changeLock.Lock()
+	defer api.changeLock.Unlock()
+
+	policy := proto.Clone(req.Policy).(*Policy)
+	policy.Id = uuid.New().String()
+	return api.putPolicy(policy, nil)
+}
+
+// UpdatePolicy replaces an existing policy.
+func (api *API) UpdatePolicy(ctx context.Context, req *UpdatePolicyRequest) (*Policy, error) {
+	if err := validatePolicy(req.Policy); err != nil {
+		return nil, err
+	} else if len(req.Policy.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	api.changeLock.Lock()
+	defer api.changeLock.Unlock()
+
+	existing, err := api.policy(req.Policy.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.putPolicy(req.Policy, existing)
+}
+
+// DeletePolicy removes the specified policy, stopping any schedules it uses.
+func (api *API) DeletePolicy(ctx context.Context, req *DeletePolicyRequest) (*DeletePolicyResponse, error) {
+	if len(req.Id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	api.changeLock.Lock()
+	defer api.changeLock.Unlock()
+
+	if _, err := api.policy(req.Id); err != nil {
+		return nil, err
+	}
+
+	// A policy which isn't in a file only needs to be removed from the engine.
+	if err := api.store.Delete(req.Id); err != nil && err != ErrNotFound {
+		api.logger.Info("error deleting policy",
+			zap.String("policy_id", req.Id),
+			zap.Error(err),
+		)
+		return nil, ErrInternal.Err()
+	}
+
+	if err := api.engine.RemovePolicy(req.Id); err == ErrNotFound {
+		return nil, ErrPolicyNotFound.Err()
+	}
+
+	return &DeletePolicyResponse{}, nil
+}
+
+// EnablePolicy allows the specified policy to execute.
+func (api *API) EnablePolicy(ctx context.Context, req *EnablePolicyRequest) (*Policy, error) {
+	return api.setDisabled(req.Id, false)
+}
+
+// DisablePolicy prevents the specified policy from executing until it is enabled again.
+func (api *API) DisablePolicy(ctx context.Context, req *DisablePolicyRequest) (*Policy, error) {
+	return api.setDisabled(req.Id, true)
+}
+
+func (api *API) setDisabled(id string, disabled bool) (*Policy, error) {
+	if len(id) < 1 {
+		return nil, ErrMissingParam.Err()
+	}
+
+	api.changeLock.Lock()
+	defer api.changeLock.Unlock()
+
+	existing, err := api.policy(id)
+	if err != nil {
+		return nil, err
+	} else if existing.IsDisabled == disabled {
+		return existing, nil
+	}
+
+	policy := proto.Clone(existing).(*Policy)
+	policy.IsDisabled = disabled
+	return api.putPolicy(policy, existing)
+}
+
+func (api *API) policy(id string) (*Policy, error) {
+	policy, err := api.engine.Policy(id)
+	if err == ErrNotFound {
+		return nil, ErrPolicyNotFound.Err()
+	} else if err != nil {
+		return nil, ErrInternal.Err()
+	}
+	return policy, nil
+}
+
+// putPolicy applies the policy to the engine and saves it, restoring the previous version on failure.
+// The change lock must be held.
+func (api *API) putPolicy(policy *Policy, previous *Policy) (*Policy, error) {
+	if err := api.engine.PutPolicy(policy); err != nil {
+		return nil, ErrUnsupportedPolicy.Err()
+	}
+
+	if err := api.store.Save(policy); err != nil {
+		api.logger.Info("error saving policy",
+			zap.String("policy_id", policy.Id),
+			zap.String("name", policy.Name),
+			zap.Error(err),
+		)
+
+		if previous != nil {
+			err = api.engine.PutPolicy(previous)
+		} else {
+			err = api.engine.RemovePolicy(policy.Id)
+		}
+		if err != nil {
+			api.logger.Warn("error reverting policy",
+				zap.String("policy_id", policy.Id),
+				zap.Error(err),
+			)
+		}
+		return nil, ErrInternal.Err()
+	}
+
+	return api.engine.Policy(policy.Id)
+}
+
+func validatePolicy(policy *Policy) error {
+	if policy == nil || len(policy.Name) < 1 || policy.Condition == nil {
+		return ErrMissingParam.Err()
+	} else if !policy.Condition.validate() {
+		return ErrUnsupportedPolicy.Err()
+	}
+	return nil
+}
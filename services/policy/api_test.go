@@ -0,0 +1,165 @@
+package policy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestAPI(t *testing.T) (*API, *State, string) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.json", testJSONPolicies)
+
+	logger := zaptest.NewLogger(t)
+	state := NewState(logger, nil)
+	engine := NewEngine(logger, state)
+
+	store := NewFileStore(logger, dir)
+	set, err := store.Load()
+	require.NoError(t, err)
+	engine.SetPolicies(set)
+
+	return NewAPI(logger, engine, store), state, dir
+}
+
+func cronPolicy() *Policy {
+	return &Policy{
+		Name: "cron policy",
+		Condition: &Condition{
+			Name: "every minute",
+			Cron: &Condition_Cron{
+				Entry: "* * * * *",
+			},
+		},
+		Actions: []*Action{
+			{
+				Name: "log",
+				Type: Action_LOG,
+			},
+		},
+	}
+}
+
+func TestAPICreateDelete(t *testing.T) {
+	api, state, dir := newTestAPI(t)
+	ctx := context.Background()
+
+	created, err := api.CreatePolicy(ctx, &CreatePolicyRequest{Policy: cronPolicy()})
+	require.NoError(t, err)
+	assert.NotEmpty(t, created.Id)
+	assert.Len(t, state.cronsByCond, 1)
+	assert.FileExists(t, filepath.Join(dir, created.Id+".yaml"))
+
+	got, err := api.GetPolicy(ctx, &GetPolicyRequest{Id: created.Id})
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(created, got))
+
+	resp, err := api.ListPolicies(ctx, &ListPoliciesRequest{})
+	require.NoError(t, err)
+	assert.Len(t, resp.Policies, 2)
+
+	// Removing the policy stops its schedule.
+	_, err = api.DeletePolicy(ctx, &DeletePolicyRequest{Id: created.Id})
+	require.NoError(t, err)
+	assert.Empty(t, state.cronsByCond)
+	_, err = os.Stat(filepath.Join(dir, created.Id+".yaml"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = api.GetPolicy(ctx, &GetPolicyRequest{Id: created.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = api.DeletePolicy(ctx, &DeletePolicyRequest{Id: created.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAPIUpdate(t *testing.T) {
+	api, state, _ := newTestAPI(t)
+	ctx := context.Background()
+
+	policy, err := api.GetPolicy(ctx, &GetPolicyRequest{Id: "json"})
+	require.NoError(t, err)
+
+	// Replacing a timer condition with a cron condition starts the schedule.
+	policy.Condition = cronPolicy().Condition
+	updated, err := api.UpdatePolicy(ctx, &UpdatePolicyRequest{Policy: policy})
+	require.NoError(t, err)
+	assert.True(t, proto.Equal(policy, updated))
+	assert.Len(t, state.cronsByCond, 1)
+
+	// Disabled policies don't have their schedules running.
+	disabled, err := api.DisablePolicy(ctx, &DisablePolicyRequest{Id: "json"})
+	require.NoError(t, err)
+	assert.True(t, disabled.IsDisabled)
+	assert.Empty(t, state.cronsByCond)
+
+	enabled, err := api.EnablePolicy(ctx, &EnablePolicyRequest{Id: "json"})
+	require.NoError(t, err)
+	assert.False(t, enabled.IsDisabled)
+	assert.Len(t, state.cronsByCond, 1)
+
+	// The changes are saved.
+	set, err := api.store.Load()
+	require.NoError(t, err)
+	require.Len(t, set.Policies, 1)
+	assert.True(t, proto.Equal(enabled, set.Policies[0]))
+
+	missing := cronPolicy()
+	missing.Id = "missing"
+	_, err = api.UpdatePolicy(ctx, &UpdatePolicyRequest{Policy: missing})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAPIInvalidPolicy(t *testing.T) {
+	invalidCron := cronPolicy()
+	invalidCron.Condition.Cron.Entry = "whenever"
+
+	tests := []struct {
+		name   string
+		policy *Policy
+		code   codes.Code
+	}{
+		{
+			"missing policy",
+			nil,
+			codes.InvalidArgument,
+		},
+		{
+			"missing condition",
+			&Policy{Name: "no condition"},
+			codes.InvalidArgument,
+		},
+		{
+			"invalid condition",
+			&Policy{
+				Name: "empty set",
+				Condition: &Condition{
+					Set: &Condition_Set{},
+				},
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"invalid schedule",
+			invalidCron,
+			codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api, state, _ := newTestAPI(t)
+
+			_, err := api.CreatePolicy(context.Background(), &CreatePolicyRequest{Policy: tt.policy})
+			assert.Equal(t, tt.code, status.Code(err))
+			assert.Empty(t, state.cronsByCond)
+			assert.Len(t, api.engine.Policies(), 1)
+		})
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"time"
 
-	"github.com/golang/protobuf/ptypes"
-	"github.com/rmrobinson/nerves/services/domotics/bridge"
 	"github.com/rmrobinson/nerves/services/policy"
+	"github.com/rmrobinson/nerves/services/weather"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -13,14 +15,31 @@ import (
 
 const (
 	envVarDomoticsdEndpoint = "DOMOTICSD_ENDPOINT"
+	envVarWeatherdEndpoint  = "WEATHERD_ENDPOINT"
+	envVarPolicyDir         = "POLICY_DIR"
+	envVarPort              = "PORT"
+	envVarLatitude          = "LATITUDE"
+	envVarLongitude         = "LONGITUDE"
+	envVarTZ                = "TZ"
 )
 
 func main() {
 	viper.SetEnvPrefix("NVS")
 	viper.BindEnv(envVarDomoticsdEndpoint)
+	viper.BindEnv(envVarWeatherdEndpoint)
+	viper.BindEnv(envVarPolicyDir)
+	viper.BindEnv(envVarPort)
+	viper.BindEnv(envVarLatitude)
+	viper.BindEnv(envVarLongitude)
+	viper.BindEnv(envVarTZ)
 
 	logger, _ := zap.NewDevelopment()
 
+	policyDir := viper.GetString(envVarPolicyDir)
+	if len(policyDir) < 1 {
+		logger.Fatal("policy dir missing")
+	}
+
 	var grpcOpts []grpc.DialOption
 	grpcOpts = append(grpcOpts, grpc.WithInsecure())
 
@@ -35,95 +54,71 @@ func main() {
 
 	state := policy.NewState(logger, domoticsConn)
 
-	engine := policy.NewEngine(logger, state)
+	// Sun and dark conditions can't be used without a location, so it is optional.
+	if viper.IsSet(envVarLatitude) && viper.IsSet(envVarLongitude) {
+		tz, err := time.LoadLocation(viper.GetString(envVarTZ))
+		if err != nil {
+			logger.Fatal("unable to load timezone",
+				zap.String("tz", viper.GetString(envVarTZ)),
+				zap.Error(err),
+			)
+		}
+		state.SetLocation(viper.GetFloat64(envVarLatitude), viper.GetFloat64(envVarLongitude), tz)
+	}
 
-	go state.Monitor(context.Background())
+	engine := policy.NewEngine(logger, state)
 
-	device := &policy.DeviceAction{
-		Id: "test-device-id",
-		State: &bridge.DeviceState{
-			Binary: &bridge.DeviceState_Binary{
-				IsOn: true,
-			},
-		},
-	}
-	deviceAction, err := ptypes.MarshalAny(device)
+	store := policy.NewFileStore(logger, policyDir)
+	policies, err := store.Load()
 	if err != nil {
-		panic(err)
+		logger.Fatal("unable to load policies",
+			zap.String("policy_dir", policyDir),
+			zap.Error(err),
+		)
 	}
+	engine.SetPolicies(policies)
+
+	ctx := context.Background()
 
-	timer := &policy.TimerAction{
-		Id: "test-timer-id",
-		Timer: &policy.TimerAction_Timer{
-			IntervalMs: 5000,
-		},
+	go state.Monitor(ctx)
+
+	// Weather conditions are never met without weatherd, so it is optional.
+	if weatherdEndpoint := viper.GetString(envVarWeatherdEndpoint); len(weatherdEndpoint) > 0 {
+		weatherConn, err := grpc.Dial(weatherdEndpoint, grpcOpts...)
+		if err != nil {
+			logger.Fatal("unable to dial weather server",
+				zap.String("endpoint", weatherdEndpoint),
+				zap.Error(err),
+			)
+		}
+		defer weatherConn.Close()
+
+		go state.MonitorWeather(ctx, weather.NewWeatherServiceClient(weatherConn))
 	}
-	timerAction, err := ptypes.MarshalAny(timer)
+	go func() {
+		if err := store.Watch(ctx, engine.SetPolicies); err != nil {
+			logger.Warn("unable to watch policy dir, changes to the files won't be reloaded",
+				zap.String("policy_dir", policyDir),
+				zap.Error(err),
+			)
+		}
+	}()
+
+	connStr := fmt.Sprintf("%s:%d", "", viper.GetInt(envVarPort))
+	lis, err := net.Listen("tcp", connStr)
 	if err != nil {
-		panic(err)
+		logger.Fatal("error initializing listener",
+			zap.Error(err),
+		)
 	}
+	defer lis.Close()
+	logger.Info("listening",
+		zap.String("local_addr", connStr),
+	)
 
-	p := &policy.Policy{
-		Name: "test policy 1 (cron or weather)",
-		Condition: &policy.Condition{
-			Name: "cron or weather condition",
-			Set: &policy.Condition_Set{
-				Operator: policy.Condition_Set_OR,
-				Conditions: []*policy.Condition{
-					{
-						Name: "every minute",
-						Cron: &policy.Condition_Cron{
-							Tz:    "America/Los_Angeles",
-							Entry: "0 * * * * *",
-						},
-					},
-					{
-						Name: "kitchener temp > 10",
-						Weather: &policy.WeatherCondition{
-							Location: "YKF",
-							Temperature: &policy.WeatherCondition_Temperature{
-								Comparison:         policy.Comparison_GREATER_THAN,
-								TemperatureCelsius: 10,
-							},
-						},
-					},
-				},
-			},
-		},
-		Actions: []*policy.Action{
-			{
-				Name: "test log action",
-				Type: policy.Action_LOG,
-			},
-			{
-				Name:    "test device action",
-				Type:    policy.Action_DEVICE,
-				Details: deviceAction,
-			},
-			{
-				Name:    "test timer action",
-				Type:    policy.Action_TIMER,
-				Details: timerAction,
-			},
-		},
-	}
-	engine.AddPolicy(p)
-
-	p2 := &policy.Policy{
-		Name: "test policy 2 (timer)",
-		Condition: &policy.Condition{
-			Name: "timer condition",
-			Timer: &policy.Condition_Timer{
-				Id: "test-timer-id",
-			},
-		},
-		Actions: []*policy.Action{
-			{
-				Name: "timer action triggered",
-				Type: policy.Action_LOG,
-			},
-		},
-	}
-	engine.AddPolicy(p2)
-	engine.Run(context.Background())
+	grpcServer := grpc.NewServer()
+	policy.RegisterPolicyServiceServer(grpcServer, policy.NewAPI(logger, engine, store))
+	go grpcServer.Serve(lis)
+
+	engine.Run(ctx)
 }
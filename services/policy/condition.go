@@ -1,5 +1,14 @@
 package policy
 
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/rmrobinson/nerves/services/weather"
+)
+
 func (c *Condition) validate() bool {
 	if c.Set != nil {
 		if len(c.Set.Conditions) < 1 {
@@ -7,24 +16,37 @@ func (c *Condition) validate() bool {
 		} else if c.Set.Operator == Condition_Set_NO_OPERATOR {
 			return false
 		}
+		for _, condition := range c.Set.Conditions {
+			if condition == nil || !condition.validate() {
+				return false
+			}
+		}
 	} else if c.Cron != nil {
 		if len(c.Cron.Entry) < 1 {
 			return false
 		}
 	} else if c.Weather != nil {
-		if len(c.Weather.Location) < 1 {
-			return false
-		} else if c.Weather.Temperature == nil {
+		if !c.Weather.validate() {
 			return false
 		}
 	} else if c.Device != nil {
-		if c.Device.Binary == nil {
+		if !c.Device.validate() {
 			return false
 		}
 	} else if c.Timer != nil {
 		if len(c.Timer.Id) < 1 {
 			return false
 		}
+	} else if c.Sun != nil {
+		if _, ok := Condition_Sun_Event_name[int32(c.Sun.Event)]; !ok {
+			return false
+		} else if c.Sun.Offset != nil && !c.Sun.Offset.IsValid() {
+			return false
+		}
+	} else if c.Dark != nil {
+		if _, ok := Condition_Dark_Twilight_name[int32(c.Dark.Twilight)]; !ok {
+			return false
+		}
 	} else {
 		return false
 	}
@@ -62,22 +84,11 @@ func (c *Condition) triggered(state *State) bool {
 			}
 		}
 	} else if c.Weather != nil {
-		if report, ok := state.weatherState[c.Weather.Location]; ok {
-			triggered = intComparison(c.Weather.Temperature.Comparison, int32(report.Conditions.Temperature), c.Weather.Temperature.TemperatureCelsius)
-		}
+		report, forecasts := state.weather(c.Weather.Location)
+		triggered = c.Weather.triggered(report, forecasts, time.Now())
 	} else if c.Device != nil {
-		if device, ok := state.deviceState[c.Device.DeviceId]; ok {
-			if c.Device.Binary != nil && device.State.Binary != nil {
-				triggered = c.Device.Binary.IsOn == device.State.Binary.IsOn
-			}
-			if c.Device.Rgb != nil && device.State.ColorRgb != nil {
-				triggered = intComparison(c.Device.Rgb.RedCheck, device.State.ColorRgb.Red, c.Device.Rgb.Red) &&
-					intComparison(c.Device.Rgb.GreenCheck, device.State.ColorRgb.Green, c.Device.Rgb.Green) &&
-					intComparison(c.Device.Rgb.BlueCheck, device.State.ColorRgb.Blue, c.Device.Rgb.Blue)
-			}
-			if c.Device.Presence != nil && device.State.Presence != nil {
-				triggered = c.Device.Presence.IsPresent == device.State.Presence.IsPresent
-			}
+		if device, ok := state.deviceState[c.Device.DeviceId]; ok && device.State != nil {
+			triggered = c.Device.triggered(device.State)
 		}
 	} else if c.Timer != nil {
 		if timer, ok := state.timersByID[c.Timer.Id]; ok {
@@ -85,10 +96,16 @@ func (c *Condition) triggered(state *State) bool {
 				triggered = true
 			}
 		}
+	} else if c.Sun != nil {
+		if sun, ok := state.sunsByCond[c]; ok {
+			if sun.triggered {
+				triggered = true
+			}
+		}
+	} else if c.Dark != nil {
+		triggered = state.dark(c.Dark.Twilight, time.Now())
 	}
 
-	// TODO: add other conditions
-
 	if c.Negate {
 		triggered = !triggered
 	}
@@ -96,6 +113,241 @@ func (c *Condition) triggered(state *State) bool {
 	return triggered
 }
 
+func (c *WeatherCondition) validate() bool {
+	if len(c.Location) < 1 {
+		return false
+	}
+
+	// Every part which is set must be valid, and at least one must be set.
+	parts := 0
+	valid := true
+	check := func(set bool, partValid bool) {
+		if set {
+			parts++
+			valid = valid && partValid
+		}
+	}
+
+	check(c.Temperature != nil, validComparison(c.Temperature.GetComparison()))
+	check(c.Humidity != nil, validComparison(c.Humidity.GetComparison()))
+	check(c.WindSpeed != nil, validComparison(c.WindSpeed.GetComparison()))
+	check(c.UvIndex != nil, validComparison(c.UvIndex.GetComparison()))
+	check(c.SummaryIcon != nil, len(c.SummaryIcon.GetIcons()) > 0)
+	check(c.Forecast != nil, len(c.Forecast.GetIcons()) > 0 && c.Forecast.GetWithinHours() > 0)
+
+	return parts > 0 && valid
+}
+
+// triggered checks whether the supplied weather meets each of the parts of the condition which are set.
+// A part is not met if the weather it checks hasn't been retrieved.
+func (c *WeatherCondition) triggered(report *weather.WeatherReport, forecasts []*weather.WeatherForecast, now time.Time) bool {
+	if !c.validate() {
+		return false
+	}
+
+	current := report.GetConditions()
+	if current == nil && (c.Temperature != nil || c.Humidity != nil || c.WindSpeed != nil || c.UvIndex != nil || c.SummaryIcon != nil) {
+		return false
+	}
+
+	if c.Temperature != nil && !intComparison(c.Temperature.Comparison, int32(current.Temperature), c.Temperature.TemperatureCelsius) {
+		return false
+	}
+	if c.Humidity != nil && !intComparison(c.Humidity.Comparison, current.Humidity, c.Humidity.RelativePercent) {
+		return false
+	}
+	if c.WindSpeed != nil && !intComparison(c.WindSpeed.Comparison, current.WindSpeed, c.WindSpeed.KilometresPerHour) {
+		return false
+	}
+	if c.UvIndex != nil && !intComparison(c.UvIndex.Comparison, current.UvIndex, c.UvIndex.UvIndex) {
+		return false
+	}
+	if c.SummaryIcon != nil && !hasIcon(c.SummaryIcon.Icons, current.SummaryIcon) {
+		return false
+	}
+	if c.Forecast != nil && !forecastTriggered(c.Forecast, forecasts, now) {
+		return false
+	}
+
+	return true
+}
+
+// forecastTriggered checks whether any of the forecast periods starting before the end of the window has one of the icons.
+// Periods which have already started are included as they may still be ongoing.
+func forecastTriggered(cond *WeatherCondition_Forecast, forecasts []*weather.WeatherForecast, now time.Time) bool {
+	end := now.Add(time.Duration(cond.WithinHours) * time.Hour)
+	for _, forecast := range forecasts {
+		if forecast.ForecastedFor == nil || forecast.Conditions == nil || forecast.ForecastedFor.AsTime().After(end) {
+			continue
+		}
+		if hasIcon(cond.Icons, forecast.Conditions.SummaryIcon) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasIcon(icons []weather.WeatherIcon, icon weather.WeatherIcon) bool {
+	for _, i := range icons {
+		if i == icon {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DeviceCondition) validate() bool {
+	if len(c.DeviceId) < 1 {
+		return false
+	}
+
+	// Every part which is set must be valid, and at least one must be set.
+	parts := 0
+	valid := true
+	check := func(set bool, partValid bool) {
+		if set {
+			parts++
+			valid = valid && partValid
+		}
+	}
+
+	check(c.Binary != nil, true)
+	check(c.Range != nil, validComparison(c.Range.GetComparison()))
+	check(c.Rgb != nil, validComparison(c.Rgb.GetRedCheck()) && validComparison(c.Rgb.GetGreenCheck()) && validComparison(c.Rgb.GetBlueCheck()))
+	check(c.Speed != nil, validComparison(c.Speed.GetComparison()))
+	check(c.Input != nil, validComparison(c.Input.GetComparison()))
+	check(c.Control != nil, true)
+	check(c.Temperature != nil, validComparison(c.Temperature.GetTemperatureComparison()))
+	check(c.Button != nil, true)
+	check(c.Presence != nil, true)
+	check(c.Cover != nil, validComparison(c.Cover.GetComparison()))
+	check(c.Lock != nil, true)
+	check(c.Thermostat != nil, c.Thermostat.GetCurrentTemperature() == nil || validComparison(c.Thermostat.CurrentTemperature.TemperatureComparison))
+	check(c.Reachable != nil, true)
+	check(c.Audio != nil, (c.Audio.GetVolume() != nil || c.Audio.GetMute() != nil) && (c.Audio.GetVolume() == nil || validComparison(c.Audio.Volume.Comparison)))
+	check(c.ColorTemperature != nil, validComparison(c.ColorTemperature.GetComparison()))
+	check(c.Hsb != nil, validComparison(c.Hsb.GetHueCheck()) && validComparison(c.Hsb.GetSaturationCheck()) && validComparison(c.Hsb.GetBrightnessCheck()))
+
+	return parts > 0 && valid
+}
+
+// triggered checks whether the supplied device state meets each of the parts of the condition which are set.
+func (c *DeviceCondition) triggered(state *bridge.DeviceState) bool {
+	// An invalid condition, e.g. one without any parts, is never met.
+	if !c.validate() {
+		return false
+	}
+	if c.Reachable != nil && c.Reachable.IsReachable != state.IsReachable {
+		return false
+	}
+	if c.Binary != nil && (state.Binary == nil || c.Binary.IsOn != state.Binary.IsOn) {
+		return false
+	}
+	if c.Range != nil && (state.Range == nil || !intComparison(c.Range.Comparison, state.Range.Value, c.Range.Value)) {
+		return false
+	}
+	if c.Rgb != nil && (state.ColorRgb == nil ||
+		!intComparison(c.Rgb.RedCheck, state.ColorRgb.Red, c.Rgb.Red) ||
+		!intComparison(c.Rgb.GreenCheck, state.ColorRgb.Green, c.Rgb.Green) ||
+		!intComparison(c.Rgb.BlueCheck, state.ColorRgb.Blue, c.Rgb.Blue)) {
+		return false
+	}
+	if c.Hsb != nil && (state.ColorHsb == nil ||
+		!intComparison(c.Hsb.HueCheck, state.ColorHsb.Hue, c.Hsb.Hue) ||
+		!intComparison(c.Hsb.SaturationCheck, state.ColorHsb.Saturation, c.Hsb.Saturation) ||
+		!intComparison(c.Hsb.BrightnessCheck, state.ColorHsb.Brightness, c.Hsb.Brightness)) {
+		return false
+	}
+	// A color temperature of 0 means the device doesn't report one.
+	if c.ColorTemperature != nil && (state.ColorTemperature == 0 ||
+		!intComparison(c.ColorTemperature.Comparison, state.ColorTemperature, c.ColorTemperature.ColorTemperature)) {
+		return false
+	}
+	if c.Speed != nil && (state.Speed == nil || !intComparison(c.Speed.Comparison, state.Speed.Speed, c.Speed.Value)) {
+		return false
+	}
+	if c.Input != nil && (state.Input == nil || !stringComparison(c.Input.Comparison, state.Input.Input, c.Input.Input)) {
+		return false
+	}
+	if c.Control != nil && (state.Control == nil || c.Control.IsOpen != state.Control.IsOpen) {
+		return false
+	}
+	if c.Temperature != nil && (state.Temperature == nil ||
+		!intComparison(c.Temperature.TemperatureComparison, temperatureCelsius(state.Temperature), c.Temperature.TemperatureCelsius)) {
+		return false
+	}
+	if c.Button != nil && !buttonTriggered(c.Button, state.Button) {
+		return false
+	}
+	if c.Presence != nil && (state.Presence == nil || c.Presence.IsPresent != state.Presence.IsPresent) {
+		return false
+	}
+	if c.Audio != nil && !audioTriggered(c.Audio, state.Audio) {
+		return false
+	}
+	if c.Cover != nil && (state.Cover == nil || !intComparison(c.Cover.Comparison, state.Cover.Position, c.Cover.Position)) {
+		return false
+	}
+	if c.Lock != nil && (state.Lock == nil || c.Lock.State != state.Lock.State) {
+		return false
+	}
+	if c.Thermostat != nil && (state.Thermostat == nil || !thermostatTriggered(c.Thermostat, state.Thermostat)) {
+		return false
+	}
+
+	return true
+}
+
+// temperatureCelsius returns the temperature rounded to whole degrees, preferring the more precise value if it is reported.
+func temperatureCelsius(temperature *bridge.DeviceState_Temperature) int32 {
+	if temperature.DegreesCelsius != 0 {
+		return int32(math.Round(temperature.DegreesCelsius))
+	}
+	return temperature.Celsius
+}
+
+func buttonTriggered(cond *DeviceCondition_Button, buttons []*bridge.DeviceState_Button) bool {
+	for _, button := range buttons {
+		if button.Id == cond.Id {
+			return button.IsOn == cond.IsOn
+		}
+	}
+	return false
+}
+
+func audioTriggered(cond *DeviceCondition_Audio, audio *bridge.DeviceState_Audio) bool {
+	if audio == nil {
+		return false
+	} else if cond.Volume != nil && !intComparison(cond.Volume.Comparison, audio.Volume, cond.Volume.Value) {
+		return false
+	} else if cond.Mute != nil && cond.Mute.IsMuted != audio.IsMuted {
+		return false
+	}
+	return true
+}
+
+func thermostatTriggered(cond *DeviceCondition_Thermostat, thermostat *bridge.DeviceState_Thermostat) bool {
+	if cond.Mode != bridge.DeviceState_Thermostat_MODE_UNSPECIFIED && cond.Mode != thermostat.Mode {
+		return false
+	} else if cond.HvacState != bridge.DeviceState_Thermostat_HVAC_UNSPECIFIED && cond.HvacState != thermostat.HvacState {
+		return false
+	} else if cond.CurrentTemperature != nil {
+		current := int32(math.Round(thermostat.CurrentCelsius))
+		return intComparison(cond.CurrentTemperature.TemperatureComparison, current, cond.CurrentTemperature.TemperatureCelsius)
+	}
+
+	return true
+}
+
+func validComparison(comparison Comparison) bool {
+	_, ok := Comparison_name[int32(comparison)]
+	return ok
+}
+
+func stringComparison(comparison Comparison, value string, threshold string) bool {
+	return intComparison(comparison, int32(strings.Compare(value, threshold)), 0)
+}
+
 func intComparison(comparison Comparison, value int32, threshold int32) bool {
 	switch comparison {
 	case Comparison_EQUAL:
@@ -2,11 +2,14 @@ package policy
 
 import (
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/rmrobinson/nerves/services/domotics/bridge"
 	"github.com/rmrobinson/nerves/services/weather"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap/zaptest"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type conditionTest struct {
@@ -154,6 +157,361 @@ var conditionTests = []conditionTest{
 		validate: true,
 		trigger:  true,
 	},
+	{
+		name: "valid device cover condition passes validation and executes",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				DeviceId: "test device",
+				Cover: &DeviceCondition_Cover{
+					Position:   50,
+					Comparison: Comparison_LESS_THAN,
+				},
+			},
+		},
+		validate: true,
+		trigger:  true,
+	},
+	{
+		name: "valid device lock condition passes validation but doesn't execute",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				DeviceId: "test device",
+				Lock: &DeviceCondition_Lock{
+					State: bridge.DeviceState_Lock_UNLOCKED,
+				},
+			},
+		},
+		validate: true,
+		trigger:  false,
+	},
+	{
+		name: "valid device thermostat condition passes validation and executes",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				DeviceId: "test device",
+				Thermostat: &DeviceCondition_Thermostat{
+					HvacState: bridge.DeviceState_Thermostat_HEATING,
+					CurrentTemperature: &DeviceCondition_Temperature{
+						TemperatureCelsius:    20,
+						TemperatureComparison: Comparison_LESS_THAN,
+					},
+				},
+			},
+		},
+		validate: true,
+		trigger:  true,
+	},
+	{
+		name: "device thermostat condition with other mode doesn't execute",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				DeviceId: "test device",
+				Thermostat: &DeviceCondition_Thermostat{
+					Mode: bridge.DeviceState_Thermostat_COOL,
+				},
+			},
+		},
+		validate: true,
+		trigger:  false,
+	},
+	{
+		name: "device condition without a device id fails validation",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				Binary: &DeviceCondition_Binary{
+					IsOn: true,
+				},
+			},
+		},
+		validate: false,
+		trigger:  false,
+	},
+	{
+		name: "device condition without any parts fails validation",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				DeviceId: "test device",
+			},
+		},
+		validate: false,
+		trigger:  false,
+	},
+	{
+		name: "device condition with an unknown comparison fails validation",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				DeviceId: "test device",
+				Range: &DeviceCondition_Range{
+					Value:      10,
+					Comparison: Comparison(42),
+				},
+			},
+		},
+		validate: false,
+		trigger:  false,
+	},
+	{
+		name: "empty device audio condition fails validation",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				DeviceId: "test device",
+				Audio:    &DeviceCondition_Audio{},
+			},
+		},
+		validate: false,
+		trigger:  false,
+	},
+	{
+		name: "device condition only executes if all of its parts are met",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				DeviceId: "test device",
+				Binary: &DeviceCondition_Binary{
+					IsOn: true,
+				},
+				Lock: &DeviceCondition_Lock{
+					State: bridge.DeviceState_Lock_UNLOCKED,
+				},
+			},
+		},
+		validate: true,
+		trigger:  false,
+	},
+	{
+		name: "device condition on a state the device doesn't report doesn't execute",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				DeviceId: "other device",
+				Range: &DeviceCondition_Range{
+					Value:      0,
+					Comparison: Comparison_GREATER_THAN_EQUAL_TO,
+				},
+			},
+		},
+		validate: true,
+		trigger:  false,
+	},
+	{
+		name: "negated device condition on a missing device executes",
+		cond: Condition{
+			Name: "Test",
+			Device: &DeviceCondition{
+				DeviceId: "missing device",
+				Binary: &DeviceCondition_Binary{
+					IsOn: true,
+				},
+			},
+			Negate: true,
+		},
+		validate: true,
+		trigger:  true,
+	},
+}
+
+var deviceConditionTests = []struct {
+	name    string
+	cond    *DeviceCondition
+	trigger bool
+}{
+	{
+		name: "range",
+		cond: &DeviceCondition{
+			Range: &DeviceCondition_Range{Value: 40, Comparison: Comparison_GREATER_THAN_EQUAL_TO},
+		},
+		trigger: true,
+	},
+	{
+		name: "range not met",
+		cond: &DeviceCondition{
+			Range: &DeviceCondition_Range{Value: 40, Comparison: Comparison_LESS_THAN},
+		},
+		trigger: false,
+	},
+	{
+		name: "speed",
+		cond: &DeviceCondition{
+			Speed: &DeviceCondition_Speed{Value: 3, Comparison: Comparison_EQUAL},
+		},
+		trigger: true,
+	},
+	{
+		name: "speed not met",
+		cond: &DeviceCondition{
+			Speed: &DeviceCondition_Speed{Value: 3, Comparison: Comparison_GREATER_THAN},
+		},
+		trigger: false,
+	},
+	{
+		name: "input",
+		cond: &DeviceCondition{
+			Input: &DeviceCondition_Input{Input: "hdmi1", Comparison: Comparison_EQUAL},
+		},
+		trigger: true,
+	},
+	{
+		name: "input not met",
+		cond: &DeviceCondition{
+			Input: &DeviceCondition_Input{Input: "hdmi2", Comparison: Comparison_EQUAL},
+		},
+		trigger: false,
+	},
+	{
+		name: "control",
+		cond: &DeviceCondition{
+			Control: &DeviceCondition_Control{IsOpen: true},
+		},
+		trigger: true,
+	},
+	{
+		name: "control not met",
+		cond: &DeviceCondition{
+			Control: &DeviceCondition_Control{IsOpen: false},
+		},
+		trigger: false,
+	},
+	{
+		name: "temperature uses the precise value",
+		cond: &DeviceCondition{
+			Temperature: &DeviceCondition_Temperature{TemperatureCelsius: 22, TemperatureComparison: Comparison_EQUAL},
+		},
+		trigger: true,
+	},
+	{
+		name: "temperature not met",
+		cond: &DeviceCondition{
+			Temperature: &DeviceCondition_Temperature{TemperatureCelsius: 21, TemperatureComparison: Comparison_LESS_THAN_EQUAL_TO},
+		},
+		trigger: false,
+	},
+	{
+		name: "button",
+		cond: &DeviceCondition{
+			Button: &DeviceCondition_Button{Id: 2, IsOn: true},
+		},
+		trigger: true,
+	},
+	{
+		name: "button not met",
+		cond: &DeviceCondition{
+			Button: &DeviceCondition_Button{Id: 1, IsOn: true},
+		},
+		trigger: false,
+	},
+	{
+		name: "missing button",
+		cond: &DeviceCondition{
+			Button: &DeviceCondition_Button{Id: 3, IsOn: false},
+		},
+		trigger: false,
+	},
+	{
+		name: "presence",
+		cond: &DeviceCondition{
+			Presence: &DeviceCondition_Presence{IsPresent: false},
+		},
+		trigger: true,
+	},
+	{
+		name: "presence not met",
+		cond: &DeviceCondition{
+			Presence: &DeviceCondition_Presence{IsPresent: true},
+		},
+		trigger: false,
+	},
+	{
+		name: "reachable",
+		cond: &DeviceCondition{
+			Reachable: &DeviceCondition_Reachable{IsReachable: true},
+		},
+		trigger: true,
+	},
+	{
+		name: "reachable not met",
+		cond: &DeviceCondition{
+			Reachable: &DeviceCondition_Reachable{IsReachable: false},
+		},
+		trigger: false,
+	},
+	{
+		name: "audio volume and mute",
+		cond: &DeviceCondition{
+			Audio: &DeviceCondition_Audio{
+				Volume: &DeviceCondition_Range{Value: 50, Comparison: Comparison_LESS_THAN},
+				Mute:   &DeviceCondition_Audio_Mute{IsMuted: true},
+			},
+		},
+		trigger: true,
+	},
+	{
+		name: "audio volume not met",
+		cond: &DeviceCondition{
+			Audio: &DeviceCondition_Audio{
+				Volume: &DeviceCondition_Range{Value: 50, Comparison: Comparison_GREATER_THAN},
+			},
+		},
+		trigger: false,
+	},
+	{
+		name: "audio mute not met",
+		cond: &DeviceCondition{
+			Audio: &DeviceCondition_Audio{
+				Mute: &DeviceCondition_Audio_Mute{IsMuted: false},
+			},
+		},
+		trigger: false,
+	},
+	{
+		name: "color temperature",
+		cond: &DeviceCondition{
+			ColorTemperature: &DeviceCondition_ColorTemperature{ColorTemperature: 3000, Comparison: Comparison_LESS_THAN},
+		},
+		trigger: true,
+	},
+	{
+		name: "color temperature not met",
+		cond: &DeviceCondition{
+			ColorTemperature: &DeviceCondition_ColorTemperature{ColorTemperature: 2700, Comparison: Comparison_GREATER_THAN},
+		},
+		trigger: false,
+	},
+	{
+		name: "hsb",
+		cond: &DeviceCondition{
+			Hsb: &DeviceCondition_HSB{
+				Hue:             180,
+				HueCheck:        Comparison_GREATER_THAN,
+				Saturation:      50,
+				SaturationCheck: Comparison_GREATER_THAN_EQUAL_TO,
+				Brightness:      100,
+				BrightnessCheck: Comparison_LESS_THAN,
+			},
+		},
+		trigger: true,
+	},
+	{
+		name: "hsb not met",
+		cond: &DeviceCondition{
+			Hsb: &DeviceCondition_HSB{
+				Hue:             180,
+				HueCheck:        Comparison_LESS_THAN,
+				Saturation:      50,
+				SaturationCheck: Comparison_GREATER_THAN_EQUAL_TO,
+				Brightness:      100,
+				BrightnessCheck: Comparison_LESS_THAN,
+			},
+		},
+		trigger: false,
+	},
 }
 
 func TestCondition(t *testing.T) {
@@ -171,6 +529,25 @@ func TestCondition(t *testing.T) {
 				Green: 110,
 				Blue:  120,
 			},
+			Cover: &bridge.DeviceState_Cover{
+				Position: 30,
+			},
+			Lock: &bridge.DeviceState_Lock{
+				State: bridge.DeviceState_Lock_LOCKED,
+			},
+			Thermostat: &bridge.DeviceState_Thermostat{
+				Mode:                bridge.DeviceState_Thermostat_HEAT,
+				HeatSetpointCelsius: 21,
+				CurrentCelsius:      18.6,
+				HvacState:           bridge.DeviceState_Thermostat_HEATING,
+			},
+		},
+	}
+	s.deviceState["other device"] = &bridge.Device{
+		State: &bridge.DeviceState{
+			Binary: &bridge.DeviceState_Binary{
+				IsOn: false,
+			},
 		},
 	}
 
@@ -183,3 +560,211 @@ func TestCondition(t *testing.T) {
 		})
 	}
 }
+
+func TestDeviceCondition(t *testing.T) {
+	state := &bridge.DeviceState{
+		IsReachable: true,
+		Range: &bridge.DeviceState_Range{
+			Value: 40,
+		},
+		ColorHsb: &bridge.DeviceState_ColorHSB{
+			Hue:        200,
+			Saturation: 50,
+			Brightness: 80,
+		},
+		ColorTemperature: 2700,
+		Speed: &bridge.DeviceState_Speed{
+			Speed: 3,
+		},
+		Input: &bridge.DeviceState_Input{
+			Input: "hdmi1",
+		},
+		Control: &bridge.DeviceState_Control{
+			IsOpen: true,
+		},
+		Temperature: &bridge.DeviceState_Temperature{
+			Celsius:        21,
+			DegreesCelsius: 21.6,
+		},
+		Button: []*bridge.DeviceState_Button{
+			{Id: 1, IsOn: false},
+			{Id: 2, IsOn: true},
+		},
+		Presence: &bridge.DeviceState_Presence{
+			IsPresent: false,
+		},
+		Audio: &bridge.DeviceState_Audio{
+			Volume:  30,
+			IsMuted: true,
+		},
+	}
+
+	for _, tt := range deviceConditionTests {
+		t.Run(tt.name, func(t *testing.T) {
+			cond := proto.Clone(tt.cond).(*DeviceCondition)
+			cond.DeviceId = "test device"
+
+			assert.True(t, cond.validate())
+			assert.Equal(t, tt.trigger, cond.triggered(state))
+		})
+	}
+}
+
+func TestWeatherCondition(t *testing.T) {
+	now := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	report := &weather.WeatherReport{
+		Conditions: &weather.WeatherCondition{
+			SummaryIcon: weather.WeatherIcon_PARTIALLY_CLOUDY,
+			Temperature: 24.5,
+			Humidity:    60,
+			WindSpeed:   15,
+			UvIndex:     7,
+		},
+	}
+	forecasts := []*weather.WeatherForecast{
+		{
+			ForecastedFor: timestamppb.New(now.Add(-time.Hour)),
+			Conditions:    &weather.WeatherCondition{SummaryIcon: weather.WeatherIcon_CLOUDY},
+		},
+		{
+			ForecastedFor: timestamppb.New(now.Add(6 * time.Hour)),
+			Conditions:    &weather.WeatherCondition{SummaryIcon: weather.WeatherIcon_RAIN},
+		},
+	}
+	rain := []weather.WeatherIcon{weather.WeatherIcon_RAIN, weather.WeatherIcon_CHANCE_OF_RAIN}
+
+	tests := []struct {
+		name      string
+		cond      *WeatherCondition
+		report    *weather.WeatherReport
+		forecasts []*weather.WeatherForecast
+		validate  bool
+		trigger   bool
+	}{
+		{
+			name:     "no parts fails validation",
+			cond:     &WeatherCondition{Location: "test loc"},
+			report:   report,
+			validate: false,
+			trigger:  false,
+		},
+		{
+			name: "forecast without a window fails validation",
+			cond: &WeatherCondition{
+				Location: "test loc",
+				Forecast: &WeatherCondition_Forecast{Icons: rain},
+			},
+			forecasts: forecasts,
+			validate:  false,
+			trigger:   false,
+		},
+		{
+			name: "humidity, wind speed and uv index",
+			cond: &WeatherCondition{
+				Location: "test loc",
+				Humidity: &WeatherCondition_Humidity{
+					Comparison:      Comparison_GREATER_THAN_EQUAL_TO,
+					RelativePercent: 60,
+				},
+				WindSpeed: &WeatherCondition_WindSpeed{
+					Comparison:        Comparison_LESS_THAN,
+					KilometresPerHour: 20,
+				},
+				UvIndex: &WeatherCondition_UVIndex{
+					Comparison: Comparison_GREATER_THAN,
+					UvIndex:    5,
+				},
+			},
+			report:   report,
+			validate: true,
+			trigger:  true,
+		},
+		{
+			name: "wind speed not met",
+			cond: &WeatherCondition{
+				Location: "test loc",
+				WindSpeed: &WeatherCondition_WindSpeed{
+					Comparison:        Comparison_GREATER_THAN,
+					KilometresPerHour: 20,
+				},
+			},
+			report:   report,
+			validate: true,
+			trigger:  false,
+		},
+		{
+			name: "summary icon",
+			cond: &WeatherCondition{
+				Location: "test loc",
+				SummaryIcon: &WeatherCondition_SummaryIcon{
+					Icons: []weather.WeatherIcon{weather.WeatherIcon_SUNNY, weather.WeatherIcon_PARTIALLY_CLOUDY},
+				},
+			},
+			report:   report,
+			validate: true,
+			trigger:  true,
+		},
+		{
+			name: "summary icon not met",
+			cond: &WeatherCondition{
+				Location:    "test loc",
+				SummaryIcon: &WeatherCondition_SummaryIcon{Icons: rain},
+			},
+			report:   report,
+			validate: true,
+			trigger:  false,
+		},
+		{
+			name: "current weather not retrieved",
+			cond: &WeatherCondition{
+				Location: "test loc",
+				Temperature: &WeatherCondition_Temperature{
+					Comparison:         Comparison_GREATER_THAN,
+					TemperatureCelsius: -40,
+				},
+			},
+			validate: true,
+			trigger:  false,
+		},
+		{
+			name: "rain forecast within the window",
+			cond: &WeatherCondition{
+				Location: "test loc",
+				Forecast: &WeatherCondition_Forecast{Icons: rain, WithinHours: 6},
+			},
+			forecasts: forecasts,
+			validate:  true,
+			trigger:   true,
+		},
+		{
+			name: "rain forecast after the window",
+			cond: &WeatherCondition{
+				Location: "test loc",
+				Forecast: &WeatherCondition_Forecast{Icons: rain, WithinHours: 5},
+			},
+			forecasts: forecasts,
+			validate:  true,
+			trigger:   false,
+		},
+		{
+			name: "ongoing forecast period",
+			cond: &WeatherCondition{
+				Location: "test loc",
+				Forecast: &WeatherCondition_Forecast{
+					Icons:       []weather.WeatherIcon{weather.WeatherIcon_CLOUDY},
+					WithinHours: 1,
+				},
+			},
+			forecasts: forecasts,
+			validate:  true,
+			trigger:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.validate, tt.cond.validate())
+			assert.Equal(t, tt.trigger, tt.cond.triggered(tt.report, tt.forecasts, now))
+		})
+	}
+}
@@ -2,8 +2,10 @@ package policy
 
 import (
 	"context"
+	"errors"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
@@ -11,6 +13,20 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	// updateTimeout bounds how long a bridge has to apply the device changes of a policy.
+	updateTimeout = 10 * time.Second
+)
+
+var (
+	// ErrInvalidPolicy is returned if a policy is missing its ID, has an invalid condition or trigger, or has a schedule which can't be set up.
+	ErrInvalidPolicy = errors.New("invalid policy supplied")
+	// ErrDuplicatePolicy is returned if a policy is added with the same ID as an existing policy.
+	ErrDuplicatePolicy = errors.New("policy already exists")
+	// ErrNotFound is returned if the requested policy doesn't exist.
+	ErrNotFound = errors.New("policy not found")
+)
+
 // Engine contains a single instance of a policy engine.
 // This engine contains one or more policies, subscribes to updates from one or more services
 // to trigger conditional changes, and uses these subscribed services to execute one or more actions
@@ -24,6 +40,12 @@ type Engine struct {
 	policies   []*Policy
 	policyLock sync.Mutex
 
+	// policyStates tracks the previous evaluations of each policy by ID; it is guarded by the policy lock.
+	policyStates map[string]*policyState
+	// wakeup triggers an evaluation when a policy needs to be evaluated again even if nothing changes.
+	wakeup *time.Timer
+	now    func() time.Time
+
 	state *State
 }
 
@@ -35,6 +57,9 @@ func NewEngine(logger *zap.Logger, state *State) *Engine {
 		done:     make(chan bool),
 		policies: []*Policy{},
 		state:    state,
+
+		policyStates: map[string]*policyState{},
+		now:          time.Now,
 	}
 
 	state.refresh = engine.refresh
@@ -44,26 +69,147 @@ func NewEngine(logger *zap.Logger, state *State) *Engine {
 // AddPolicy registers a new policy with the policy engine.
 // Policies are held in an ordered list, descending by their weights, and this add will ensure
 // the inserted policy is placed in the appropriate location.
-func (e *Engine) AddPolicy(policy *Policy) {
+func (e *Engine) AddPolicy(policy *Policy) error {
+	e.policyLock.Lock()
+	defer e.policyLock.Unlock()
+
+	if e.findPolicy(policy.Id) >= 0 {
+		return ErrDuplicatePolicy
+	}
+
+	return e.putPolicy(policy)
+}
+
+// PutPolicy registers the supplied policy with the policy engine, replacing any policy with the same ID.
+// If the policy is invalid the existing policy is left in place.
+func (e *Engine) PutPolicy(policy *Policy) error {
+	e.policyLock.Lock()
+	defer e.policyLock.Unlock()
+
+	return e.putPolicy(policy)
+}
+
+// RemovePolicy removes the specified policy from the policy engine, stopping any schedules it uses.
+func (e *Engine) RemovePolicy(id string) error {
 	e.policyLock.Lock()
 	defer e.policyLock.Unlock()
 
-	if policy.Condition == nil || !policy.Condition.validate() {
+	idx := e.findPolicy(id)
+	if idx < 0 {
+		return ErrNotFound
+	}
+
+	e.teardownPolicy(e.policies[idx])
+	e.policies = append(e.policies[:idx], e.policies[idx+1:]...)
+	delete(e.policyStates, id)
+	return nil
+}
+
+// SetPolicies replaces the policies of the policy engine with the supplied set.
+// Policies which haven't changed are left in place, so their schedules and timers are unaffected.
+// Invalid policies in the set are skipped.
+func (e *Engine) SetPolicies(set *PolicySet) {
+	e.policyLock.Lock()
+	defer e.policyLock.Unlock()
+
+	ids := map[string]bool{}
+	for _, policy := range set.Policies {
+		ids[policy.Id] = true
+
+		if idx := e.findPolicy(policy.Id); idx >= 0 && proto.Equal(e.policies[idx], policy) {
+			continue
+		}
+		if err := e.putPolicy(policy); err != nil {
+			e.logger.Info("error setting policy, skipping",
+				zap.String("id", policy.Id),
+				zap.String("name", policy.Name),
+				zap.Error(err),
+			)
+		}
+	}
+
+	var policies []*Policy
+	for _, policy := range e.policies {
+		if ids[policy.Id] {
+			policies = append(policies, policy)
+			continue
+		}
+
+		e.logger.Debug("removing policy",
+			zap.String("id", policy.Id),
+			zap.String("name", policy.Name),
+		)
+		e.teardownPolicy(policy)
+		delete(e.policyStates, policy.Id)
+	}
+	e.policies = policies
+}
+
+// Policies retrieves a copy of each of the registered policies, in the order they are evaluated.
+func (e *Engine) Policies() []*Policy {
+	e.policyLock.Lock()
+	defer e.policyLock.Unlock()
+
+	var policies []*Policy
+	for _, policy := range e.policies {
+		policies = append(policies, proto.Clone(policy).(*Policy))
+	}
+	return policies
+}
+
+// Policy retrieves a copy of the specified policy.
+func (e *Engine) Policy(id string) (*Policy, error) {
+	e.policyLock.Lock()
+	defer e.policyLock.Unlock()
+
+	idx := e.findPolicy(id)
+	if idx < 0 {
+		return nil, ErrNotFound
+	}
+	return proto.Clone(e.policies[idx]).(*Policy), nil
+}
+
+// findPolicy returns the index of the specified policy, or -1 if it isn't registered. The policy lock must be held.
+func (e *Engine) findPolicy(id string) int {
+	for idx, policy := range e.policies {
+		if policy.Id == id {
+			return idx
+		}
+	}
+	return -1
+}
+
+// putPolicy adds or replaces the supplied policy. The policy lock must be held.
+func (e *Engine) putPolicy(policy *Policy) error {
+	if len(policy.Id) < 1 || policy.Condition == nil || !policy.Condition.validate() || !policy.Trigger.validate() {
 		e.logger.Info("error validating policy, not adding",
+			zap.String("id", policy.Id),
 			zap.String("name", policy.Name),
 		)
-		return
+		return ErrInvalidPolicy
 	}
 
-	if !e.setupPolicy(policy) {
+	// The engine keeps its own copy so later changes by the caller don't affect the registered conditions.
+	policy = proto.Clone(policy).(*Policy)
+
+	// The new policy is set up before the old one is torn down so a failure leaves the old one untouched.
+	if !policy.IsDisabled && !e.setupPolicy(policy) {
 		e.logger.Info("error setting up policy, not adding",
+			zap.String("id", policy.Id),
 			zap.String("name", policy.Name),
 		)
-		return
+		return ErrInvalidPolicy
 	}
 
-	e.policies = append(e.policies, policy)
-	sort.Slice(e.policies, func(i, j int) bool {
+	if idx := e.findPolicy(policy.Id); idx >= 0 {
+		e.teardownPolicy(e.policies[idx])
+		e.policies[idx] = policy
+	} else {
+		e.policies = append(e.policies, policy)
+	}
+	// A changed policy starts from scratch, so it executes if its condition is already true.
+	delete(e.policyStates, policy.Id)
+	sort.SliceStable(e.policies, func(i, j int) bool {
 		return e.policies[i].Weight < e.policies[j].Weight
 	})
 
@@ -71,6 +217,7 @@ func (e *Engine) AddPolicy(policy *Policy) {
 	go func() {
 		e.refresh <- true
 	}()
+	return nil
 }
 
 // Refresh returns a channel that can be written to to trigger a new policy execution.
@@ -108,30 +255,100 @@ func (e *Engine) Run(ctx context.Context) {
 }
 
 func (e *Engine) setupPolicy(policy *Policy) bool {
-	cronConditions := findCronConditions(policy.Condition)
+	scheduledConditions := findConditions(policy.Condition, scheduled)
 
-	for _, cronCondition := range cronConditions {
-		err := e.state.addCronEntry(cronCondition)
+	for idx, scheduledCondition := range scheduledConditions {
+		err := e.state.addSchedule(scheduledCondition)
 		if err != nil {
-			e.logger.Info("error adding cron condition",
+			e.logger.Info("error adding scheduled condition",
 				zap.String("name", policy.Name),
 				zap.Error(err),
 			)
+
+			// Don't leave the entries which were added running.
+			for _, added := range scheduledConditions[:idx] {
+				e.state.removeSchedule(added)
+			}
 			return false
 		}
 	}
 
+	for _, weatherCondition := range findConditions(policy.Condition, func(c *Condition) bool { return c.Weather != nil }) {
+		e.state.addWeatherCondition(weatherCondition)
+	}
+
 	return true
 }
 
+// teardownPolicy stops the schedules the policy uses, and the polling of the weather it uses.
+func (e *Engine) teardownPolicy(policy *Policy) {
+	for _, scheduledCondition := range findConditions(policy.Condition, scheduled) {
+		e.state.removeSchedule(scheduledCondition)
+	}
+	for _, weatherCondition := range findConditions(policy.Condition, func(c *Condition) bool { return c.Weather != nil }) {
+		e.state.removeWeatherCondition(weatherCondition)
+	}
+}
+
+// scheduled checks whether the condition changes at scheduled times, and so has an entry in the schedule of the state.
+func scheduled(c *Condition) bool {
+	return c.Cron != nil || c.Sun != nil || c.Dark != nil
+}
+
+// deviceBatch is a set of device changes made by a policy, which are sent to the bridge together.
+type deviceBatch struct {
+	policy string
+	req    *bridge.BatchUpdateDeviceStatesRequest
+}
+
+// execute evaluates the policies, then sends the device changes of those which were executed.
+// The changes are sent once the policy lock is released so a slow bridge doesn't hold up changes to the policies.
 func (e *Engine) execute(ctx context.Context) {
+	for _, batch := range e.evaluate(ctx) {
+		e.updateDevices(ctx, batch)
+	}
+}
+
+// evaluate evaluates each policy, executing the actions of those whose trigger is met.
+// The device changes of the executed policies are returned, in order, to be sent by the caller.
+func (e *Engine) evaluate(ctx context.Context) []*deviceBatch {
+	e.policyLock.Lock()
+	defer e.policyLock.Unlock()
+
+	e.state.latchEvents()
+	now := e.now()
+
+	var next time.Duration
+	var batches []*deviceBatch
 	for _, policy := range e.policies {
-		e.executePolicy(ctx, policy)
+		if policy.IsDisabled {
+			delete(e.policyStates, policy.Id)
+			continue
+		}
+
+		delay, policyBatches := e.executePolicy(ctx, policy, now)
+		if delay > 0 && (next <= 0 || delay < next) {
+			next = delay
+		}
+		batches = append(batches, policyBatches...)
 	}
+
+	if e.wakeup != nil {
+		e.wakeup.Stop()
+		e.wakeup = nil
+	}
+	if next > 0 {
+		e.wakeup = time.AfterFunc(next, func() {
+			e.refresh <- true
+		})
+	}
+
+	return batches
 }
 
-func findCronConditions(c *Condition) []*Condition {
-	if c.Cron != nil {
+// findConditions returns the conditions in the supplied condition, including those nested in sets, which match.
+func findConditions(c *Condition, match func(*Condition) bool) []*Condition {
+	if match(c) {
 		return []*Condition{c}
 	} else if c.Set == nil {
 		return nil
@@ -139,67 +356,139 @@ func findCronConditions(c *Condition) []*Condition {
 
 	var ret []*Condition
 	for _, cond := range c.Set.Conditions {
-		ret = append(ret, findCronConditions(cond)...)
+		ret = append(ret, findConditions(cond, match)...)
 	}
 
 	return ret
 }
 
-func (e *Engine) executePolicy(ctx context.Context, p *Policy) {
-	if !p.Condition.triggered(e.state) {
-		e.logger.Debug("policy conditions not met",
+// executePolicy evaluates the policy and executes its actions if its trigger is met.
+// The delay until the policy needs to be evaluated again is returned, or 0 if it only needs to be evaluated on changes,
+// along with the batches of device changes the policy makes, which are left to the caller to send.
+func (e *Engine) executePolicy(ctx context.Context, p *Policy, now time.Time) (time.Duration, []*deviceBatch) {
+	ps, ok := e.policyStates[p.Id]
+	if !ok {
+		ps = &policyState{}
+		e.policyStates[p.Id] = ps
+	}
+
+	triggered := p.Condition.triggered(e.state)
+	execute, next := ps.update(p.Trigger, triggered, now)
+	if !execute {
+		e.logger.Debug("policy trigger not met",
 			zap.String("name", p.Name),
+			zap.Bool("conditions_met", triggered),
 		)
-		return
+		return next, nil
 	}
 
-	e.logger.Debug("policy conditions met, executing actions")
+	e.logger.Debug("policy trigger met, executing actions",
+		zap.String("name", p.Name),
+	)
+
+	// Device actions are collected and sent as a single batch so the devices change together.
+	// A batch can only change a device once, so a repeated device starts a new batch.
+	var batches []*deviceBatch
+	batch := &bridge.BatchUpdateDeviceStatesRequest{}
+	batchIDs := map[string]bool{}
 	for _, action := range p.Actions {
-		e.executeAction(ctx, action)
+		if action.Type != Action_DEVICE {
+			e.executeAction(ctx, action)
+			continue
+		}
+
+		req := e.deviceUpdate(action)
+		if req == nil {
+			continue
+		}
+
+		if batchIDs[req.Id] {
+			batches = append(batches, &deviceBatch{policy: p.Name, req: batch})
+			batch = &bridge.BatchUpdateDeviceStatesRequest{}
+			batchIDs = map[string]bool{}
+		}
+		batch.Requests = append(batch.Requests, req)
+		batchIDs[req.Id] = true
 	}
+
+	if len(batch.Requests) > 0 {
+		batches = append(batches, &deviceBatch{policy: p.Name, req: batch})
+	}
+	return next, batches
 }
 
-func (e *Engine) executeAction(ctx context.Context, a *Action) {
-	switch a.Type {
-	case Action_LOG:
-		e.logger.Info("executing action",
+// deviceUpdate converts a device action into the update to send to the bridge.
+// nil is returned if the action can't be executed.
+func (e *Engine) deviceUpdate(a *Action) *bridge.UpdateDeviceStateRequest {
+	e.logger.Debug("received device action",
+		zap.String("name", a.Name),
+	)
+
+	deviceAction := &DeviceAction{}
+	err := ptypes.UnmarshalAny(a.Details, deviceAction)
+	if err != nil {
+		e.logger.Info("error unmarshaling details",
 			zap.String("name", a.Name),
+			zap.Error(err),
 		)
-	case Action_DEVICE:
-		e.logger.Debug("received device action",
+		return nil
+	}
+
+	device, ok := e.state.deviceState[deviceAction.Id]
+	if !ok {
+		e.logger.Info("action with missing device id",
 			zap.String("name", a.Name),
+			zap.String("device_id", deviceAction.Id),
 		)
+		return nil
+	}
 
-		deviceAction := &DeviceAction{}
-		err := ptypes.UnmarshalAny(a.Details, deviceAction)
-		if err != nil {
-			e.logger.Info("error unmarshaling details",
-				zap.String("name", a.Name),
+	mask := deviceAction.UpdateMask
+	if len(mask.GetPaths()) < 1 {
+		mask = bridge.StateMask(deviceAction.State)
+	}
+
+	// Only the fields the action names are changed, and the version ensures we don't overwrite a change
+	// made since we last saw the device.
+	return &bridge.UpdateDeviceStateRequest{
+		Id:         deviceAction.Id,
+		Version:    device.Version,
+		State:      deviceAction.State,
+		UpdateMask: mask,
+	}
+}
+
+func (e *Engine) updateDevices(ctx context.Context, batch *deviceBatch) {
+	ctx, cancel := context.WithTimeout(ctx, updateTimeout)
+	defer cancel()
+
+	// We don't save the results as the monitor channel will pick up the updates when they are broadcast.
+	resp, err := e.state.bridgeClient.BatchUpdateDeviceStates(ctx, batch.req)
+	if err != nil {
+		e.logger.Info("error setting device states",
+			zap.String("name", batch.policy),
+			zap.Error(err),
+		)
+		return
+	}
+
+	for _, result := range resp.Results {
+		if err := result.Err(); err != nil {
+			e.logger.Info("error setting device state",
+				zap.String("name", batch.policy),
+				zap.String("device_id", result.Id),
 				zap.Error(err),
 			)
-			return
 		}
+	}
+}
 
-		if device, ok := e.state.deviceState[deviceAction.Id]; ok {
-			proto.Merge(device.State, deviceAction.State)
-
-			// We don't save the result as the monitor channel will pick up the update when it is broadcast.
-			_, err := e.state.bridgeClient.UpdateDeviceState(ctx, &bridge.UpdateDeviceStateRequest{
-				Id:    deviceAction.Id,
-				State: device.State,
-			})
-			if err != nil {
-				e.logger.Info("error setting device state",
-					zap.String("name", a.Name),
-					zap.Error(err),
-				)
-			}
-		} else {
-			e.logger.Info("action with missing device id",
-				zap.String("name", a.Name),
-				zap.String("device_id", deviceAction.Id),
-			)
-		}
+func (e *Engine) executeAction(ctx context.Context, a *Action) {
+	switch a.Type {
+	case Action_LOG:
+		e.logger.Info("executing action",
+			zap.String("name", a.Name),
+		)
 	case Action_TIMER:
 		e.logger.Debug("received timer action",
 			zap.String("name", a.Name),
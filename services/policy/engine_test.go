@@ -0,0 +1,91 @@
+package policy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+)
+
+// batchBridgeClient records the device changes sent to it, invoking onBatch as each is received.
+type batchBridgeClient struct {
+	bridge.BridgeServiceClient
+
+	onBatch func(context.Context)
+	batches []*bridge.BatchUpdateDeviceStatesRequest
+}
+
+func (c *batchBridgeClient) BatchUpdateDeviceStates(ctx context.Context, in *bridge.BatchUpdateDeviceStatesRequest, opts ...grpc.CallOption) (*bridge.BatchUpdateDeviceStatesResponse, error) {
+	c.onBatch(ctx)
+	c.batches = append(c.batches, in)
+	return &bridge.BatchUpdateDeviceStatesResponse{}, nil
+}
+
+func TestEngineDeviceActions(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	state := NewState(logger, nil)
+	engine := NewEngine(logger, state)
+
+	client := &batchBridgeClient{}
+	state.bridgeClient = client
+
+	state.deviceState["light"] = &bridge.Device{
+		Id:      "light",
+		Version: "1",
+		State: &bridge.DeviceState{
+			Binary: &bridge.DeviceState_Binary{IsOn: true},
+		},
+	}
+
+	deviceAction := func(isOn bool) *Action {
+		details, err := ptypes.MarshalAny(&DeviceAction{
+			Id: "light",
+			State: &bridge.DeviceState{
+				Binary: &bridge.DeviceState_Binary{IsOn: isOn},
+			},
+		})
+		require.NoError(t, err)
+
+		return &Action{
+			Name:    "set light",
+			Type:    Action_DEVICE,
+			Details: details,
+		}
+	}
+
+	require.NoError(t, engine.AddPolicy(&Policy{
+		Id:   "1",
+		Name: "flash light",
+		Condition: &Condition{
+			Device: &DeviceCondition{
+				DeviceId: "light",
+				Binary:   &DeviceCondition_Binary{IsOn: true},
+			},
+		},
+		Actions: []*Action{
+			deviceAction(false),
+			deviceAction(true),
+		},
+	}))
+
+	// The changes are sent without holding the policy lock, and the bridge only has a limited time to apply them.
+	client.onBatch = func(ctx context.Context) {
+		_, hasDeadline := ctx.Deadline()
+		assert.True(t, hasDeadline)
+		assert.Len(t, engine.Policies(), 1)
+	}
+	engine.execute(context.Background())
+
+	// Changing the same device twice requires a batch for each change.
+	require.Len(t, client.batches, 2)
+	for idx, isOn := range []bool{false, true} {
+		require.Len(t, client.batches[idx].Requests, 1)
+		assert.Equal(t, "1", client.batches[idx].Requests[0].Version)
+		assert.Equal(t, isOn, client.batches[idx].Requests[0].State.Binary.IsOn)
+	}
+}
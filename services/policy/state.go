@@ -13,12 +13,8 @@ import (
 	"google.golang.org/grpc"
 )
 
-const (
-	// the amount of time a cron entry will remain active after triggering
-	cronEntryActiveDuration = time.Second * 5
-	// the amount of time a timer entry will remain active after triggering
-	timerEntryActiveDuration = time.Second * 5
-)
+// weatherPollInterval is how often the weather of the locations used by weather conditions is retrieved.
+const weatherPollInterval = 10 * time.Minute
 
 var (
 	// ErrInvalidCondition is returned if a condition is supplied that doesn't meet the requirements of the method.
@@ -27,12 +23,27 @@ var (
 	// ErrInvalidAction is returned if an action is supplied that doesn't meet the requirements of the method.
 	// For example, providing a timer action with an empty body would yield this error.
 	ErrInvalidAction = errors.New("invalid action supplied")
+	// ErrNoLocation is returned if a sun or dark condition is supplied but the location to compute them for hasn't been set.
+	ErrNoLocation = errors.New("location not set")
 )
 
+// Cron, sun and timer entries are events rather than states: fired is set when the entry fires, and is latched into
+// triggered at the start of the next evaluation so the entry is only triggered for that evaluation.
 type cronEntry struct {
 	condition *Condition
 	cron      *crontab.Cron
 	entryID   crontab.EntryID
+	fired     bool
+	triggered bool
+}
+
+// sunEntry schedules a sun or dark condition. The evaluation of a dark condition only depends on the time, so its
+// entry just triggers an evaluation as it becomes dark or light.
+type sunEntry struct {
+	condition *Condition
+	timer     *time.Timer
+	stopped   bool
+	fired     bool
 	triggered bool
 }
 
@@ -40,6 +51,7 @@ type timerEntry struct {
 	id        string
 	timer     *time.Timer
 	active    bool
+	fired     bool
 	triggered bool
 }
 
@@ -51,13 +63,27 @@ type State struct {
 
 	refresh chan<- bool
 
-	weatherState map[string]*weather.WeatherReport
+	// The weather of each location used by a weather condition, by location name.
+	weatherState     map[string]*weather.WeatherReport
+	weatherForecasts map[string][]*weather.WeatherForecast
+	// weatherByCond records the weather conditions of the active policies, whose locations are polled.
+	weatherByCond  map[*Condition]*WeatherCondition
+	weatherChanged chan bool
+	weatherLock    sync.Mutex
 
 	bridgeState map[string]*bridge.Bridge
 	deviceState map[string]*bridge.Device
 	deviceLock  sync.Mutex
 
+	// cronsByCond is only changed as policies are added or removed, which the engine serializes with evaluation.
 	cronsByCond map[*Condition]*cronEntry
+	// sunsByCond is changed in the same way as cronsByCond.
+	sunsByCond map[*Condition]*sunEntry
+	// sun is the location the position of the sun is computed for, or nil if it hasn't been set.
+	sun *sunLocation
+	// scheduleLock guards the fired flag of the cron and sun entries, and the timers of the sun entries,
+	// which are changed as they fire.
+	scheduleLock sync.Mutex
 
 	timersByID map[string]*timerEntry
 	timerLock  sync.Mutex
@@ -74,13 +100,37 @@ func NewState(logger *zap.Logger, conn *grpc.ClientConn) *State {
 		deviceState:  map[string]*bridge.Device{},
 		weatherState: map[string]*weather.WeatherReport{},
 		cronsByCond:  map[*Condition]*cronEntry{},
+		sunsByCond:   map[*Condition]*sunEntry{},
 		timersByID:   map[string]*timerEntry{},
+
+		weatherForecasts: map[string][]*weather.WeatherForecast{},
+		weatherByCond:    map[*Condition]*WeatherCondition{},
+		weatherChanged:   make(chan bool, 1),
+	}
+}
+
+// SetLocation sets the location sun and dark conditions are computed for. It must be called before any policies
+// with these conditions are added.
+func (s *State) SetLocation(latitude float64, longitude float64, tz *time.Location) {
+	s.sun = &sunLocation{
+		latitude:  latitude,
+		longitude: longitude,
+		tz:        tz,
 	}
 }
 
 // Monitor is used to track changes to devices
 func (s *State) Monitor(ctx context.Context) {
-	stream, err := s.bridgeClient.StreamBridgeUpdates(ctx, &bridge.StreamBridgeUpdatesRequest{})
+	// Policies are only evaluated against the current state of devices, so we don't need bridge changes or removals.
+	stream, err := s.bridgeClient.StreamBridgeUpdates(ctx, &bridge.StreamBridgeUpdatesRequest{
+		Filter: &bridge.UpdateFilter{
+			DevicesOnly: true,
+			Actions: []bridge.Update_Action{
+				bridge.Update_ADDED,
+				bridge.Update_CHANGED,
+			},
+		},
+	})
 	if err != nil {
 		s.logger.Info("error creating device update stream",
 			zap.Error(err),
@@ -113,6 +163,138 @@ func (s *State) handleDeviceUpdate(update *bridge.DeviceUpdate) {
 	s.refresh <- true
 }
 
+// MonitorWeather retrieves the current weather and forecast of the locations used by the weather conditions of
+// the active policies, until the context is cancelled. Locations are polled periodically, and as soon as they are
+// first used.
+func (s *State) MonitorWeather(ctx context.Context, client weather.WeatherServiceClient) {
+	ticker := time.NewTicker(weatherPollInterval)
+	defer ticker.Stop()
+
+	all := true
+	for {
+		s.pollWeather(ctx, client, all)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			all = true
+		case <-s.weatherChanged:
+			all = false
+		}
+	}
+}
+
+// pollWeather retrieves the weather of the locations used by weather conditions; if all isn't set only the locations
+// which haven't been retrieved yet are polled. Locations which are no longer used are forgotten.
+func (s *State) pollWeather(ctx context.Context, client weather.WeatherServiceClient, all bool) {
+	locations := map[string]*WeatherCondition{}
+
+	s.weatherLock.Lock()
+	for _, wc := range s.weatherByCond {
+		if _, ok := locations[wc.Location]; !ok {
+			locations[wc.Location] = wc
+		}
+	}
+	for location := range s.weatherState {
+		if _, ok := locations[location]; !ok {
+			delete(s.weatherState, location)
+			delete(s.weatherForecasts, location)
+		} else if !all {
+			delete(locations, location)
+		}
+	}
+	s.weatherLock.Unlock()
+
+	changed := false
+	for location, wc := range locations {
+		reportResp, err := client.GetCurrentReport(ctx, &weather.GetCurrentReportRequest{
+			Latitude:  wc.Latitude,
+			Longitude: wc.Longitude,
+		})
+		if err != nil || reportResp.Report == nil {
+			s.logger.Info("error getting weather report",
+				zap.String("location", location),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		// Conditions on the current weather can be evaluated without the forecast, so a failure here isn't fatal.
+		forecastResp, err := client.GetForecast(ctx, &weather.GetForecastRequest{
+			Latitude:  wc.Latitude,
+			Longitude: wc.Longitude,
+		})
+		if err != nil {
+			s.logger.Info("error getting weather forecast",
+				zap.String("location", location),
+				zap.Error(err),
+			)
+		}
+
+		s.weatherLock.Lock()
+		s.weatherState[location] = reportResp.Report
+		if forecastResp != nil {
+			s.weatherForecasts[location] = forecastResp.ForecastRecords
+		}
+		s.weatherLock.Unlock()
+		changed = true
+	}
+
+	if changed {
+		s.refresh <- true
+	}
+}
+
+// addWeatherCondition records that the location of the condition needs to be polled.
+func (s *State) addWeatherCondition(c *Condition) {
+	s.weatherLock.Lock()
+	s.weatherByCond[c] = c.Weather
+	_, polled := s.weatherState[c.Weather.Location]
+	s.weatherLock.Unlock()
+
+	if !polled {
+		select {
+		case s.weatherChanged <- true:
+		default:
+		}
+	}
+}
+
+func (s *State) removeWeatherCondition(c *Condition) {
+	s.weatherLock.Lock()
+	defer s.weatherLock.Unlock()
+
+	delete(s.weatherByCond, c)
+}
+
+// weather retrieves the current weather and forecast of the specified location.
+func (s *State) weather(location string) (*weather.WeatherReport, []*weather.WeatherForecast) {
+	s.weatherLock.Lock()
+	defer s.weatherLock.Unlock()
+
+	return s.weatherState[location], s.weatherForecasts[location]
+}
+
+// addSchedule starts the schedule used by the condition, if it has one.
+func (s *State) addSchedule(c *Condition) error {
+	if c.Cron != nil {
+		return s.addCronEntry(c)
+	} else if c.Sun != nil || c.Dark != nil {
+		return s.addSunEntry(c)
+	}
+	return nil
+}
+
+// removeSchedule stops the schedule used by the condition, if it has one.
+func (s *State) removeSchedule(c *Condition) {
+	if c.Cron != nil {
+		s.removeCronEntry(c)
+	} else if c.Sun != nil || c.Dark != nil {
+		s.removeSunEntry(c)
+	}
+}
+
 func (s *State) addCronEntry(c *Condition) error {
 	var loc *time.Location
 	var err error
@@ -135,24 +317,16 @@ func (s *State) addCronEntry(c *Condition) error {
 		triggered: false,
 	}
 	entry.entryID, err = entry.cron.AddFunc(c.Cron.Entry, func() {
-		entry := s.cronsByCond[c]
-
 		s.logger.Debug("timer triggered",
 			zap.String("name", entry.condition.Name),
 			zap.String("rule", entry.condition.Cron.Entry),
 		)
 
-		entry.triggered = true
-		s.refresh <- true
+		s.scheduleLock.Lock()
+		entry.fired = true
+		s.scheduleLock.Unlock()
 
-		go func(entry *cronEntry) {
-			// We need to 'turn off' the entry at some point in the future.
-			// We don't know when the execution triggered by the refresh action will be true
-			// so we use the entry active duration to control this.
-			time.Sleep(cronEntryActiveDuration)
-			entry.triggered = false
-			s.refresh <- true
-		}(entry)
+		s.refresh <- true
 	})
 	if err != nil {
 		return err
@@ -168,6 +342,115 @@ func (s *State) addCronEntry(c *Condition) error {
 	return nil
 }
 
+func (s *State) removeCronEntry(c *Condition) {
+	entry, ok := s.cronsByCond[c]
+	if !ok {
+		return
+	}
+
+	s.logger.Debug("removing cron entry",
+		zap.String("name", c.Name),
+		zap.String("rule", c.Cron.Entry),
+	)
+	entry.cron.Stop()
+	delete(s.cronsByCond, c)
+}
+
+func (s *State) addSunEntry(c *Condition) error {
+	if c.Sun == nil && c.Dark == nil {
+		return ErrInvalidCondition
+	} else if s.sun == nil {
+		return ErrNoLocation
+	}
+
+	entry := &sunEntry{
+		condition: c,
+	}
+
+	s.scheduleLock.Lock()
+	defer s.scheduleLock.Unlock()
+
+	s.scheduleSunEntry(entry, time.Now())
+
+	s.logger.Debug("adding sun entry",
+		zap.String("name", c.Name),
+	)
+	s.sunsByCond[c] = entry
+	return nil
+}
+
+// scheduleSunEntry starts the timer of the entry for its next event after the specified time.
+// If the event doesn't occur soon, e.g. during polar day or night, the entry checks again in a day.
+// The schedule lock must be held.
+func (s *State) scheduleSunEntry(entry *sunEntry, after time.Time) {
+	var next time.Time
+	var ok bool
+	if entry.condition.Sun != nil {
+		next, ok = s.sun.nextSunEvent(entry.condition.Sun.Event, entry.condition.Sun.Offset.AsDuration(), after)
+	} else {
+		next, ok = s.sun.nextDarkChange(entry.condition.Dark.Twilight, after)
+	}
+
+	fire := true
+	if !ok {
+		s.logger.Info("sun event not found in the next week, checking again tomorrow",
+			zap.String("name", entry.condition.Name),
+		)
+		next = after.Add(24 * time.Hour)
+		fire = false
+	}
+
+	entry.timer = time.AfterFunc(next.Sub(after), func() {
+		s.scheduleLock.Lock()
+		defer s.scheduleLock.Unlock()
+
+		if entry.stopped {
+			return
+		}
+		if fire {
+			s.logger.Debug("sun event triggered",
+				zap.String("name", entry.condition.Name),
+			)
+			entry.fired = true
+			go func() {
+				s.refresh <- true
+			}()
+		}
+
+		// The next event is found from the time this one was expected, in case the clock is slightly behind.
+		if now := time.Now(); now.Before(next) {
+			s.scheduleSunEntry(entry, next)
+		} else {
+			s.scheduleSunEntry(entry, now)
+		}
+	})
+}
+
+func (s *State) removeSunEntry(c *Condition) {
+	s.scheduleLock.Lock()
+	defer s.scheduleLock.Unlock()
+
+	entry, ok := s.sunsByCond[c]
+	if !ok {
+		return
+	}
+
+	s.logger.Debug("removing sun entry",
+		zap.String("name", c.Name),
+	)
+	entry.stopped = true
+	entry.timer.Stop()
+	delete(s.sunsByCond, c)
+}
+
+// dark checks whether it is dark at the configured location.
+func (s *State) dark(twilight Condition_Dark_Twilight, now time.Time) bool {
+	if s.sun == nil {
+		return false
+	}
+	return s.sun.dark(twilight, now)
+}
+
 func (s *State) activateTimer(ta *TimerAction) error {
 	s.timerLock.Lock()
 	defer s.timerLock.Unlock()
@@ -186,6 +469,7 @@ func (s *State) activateTimer(ta *TimerAction) error {
 	if te.active {
 		return nil
 	}
+	te.active = true
 	te.timer = time.NewTimer(time.Duration(ta.Timer.IntervalMs) * time.Millisecond)
 	s.timersByID[ta.Id] = te
 
@@ -201,19 +485,36 @@ func (s *State) activateTimer(ta *TimerAction) error {
 			zap.String("id", id),
 		)
 
-		entry.triggered = true
-		s.refresh <- true
+		entry.active = false
+		entry.fired = true
 
-		go func(entry *timerEntry) {
-			// We need to 'turn off' the entry at some point in the future.
-			// We don't know when the execution triggered by the refresh action will be true
-			// so we use the entry active duration to control this.
-			time.Sleep(timerEntryActiveDuration)
-			entry.active = false
-			entry.triggered = false
+		// The refresh is sent without the lock held since the evaluation it triggers needs it.
+		go func() {
 			s.refresh <- true
-		}(entry)
+		}()
 	}(ta.Id)
 
 	return nil
 }
+
+// latchEvents marks the cron, sun and timer entries which have fired since the last evaluation as triggered,
+// and the rest as not triggered. It is called at the start of each evaluation.
+func (s *State) latchEvents() {
+	s.scheduleLock.Lock()
+	for _, entry := range s.cronsByCond {
+		entry.triggered = entry.fired
+		entry.fired = false
+	}
+	for _, entry := range s.sunsByCond {
+		entry.triggered = entry.fired
+		entry.fired = false
+	}
+	s.scheduleLock.Unlock()
+
+	s.timerLock.Lock()
+	for _, entry := range s.timersByID {
+		entry.triggered = entry.fired
+		entry.fired = false
+	}
+	s.timerLock.Unlock()
+}
@@ -0,0 +1,141 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rmrobinson/nerves/services/weather"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// testWeatherClient reports a temperature equal to the latitude of the request.
+type testWeatherClient struct {
+	lock     sync.Mutex
+	requests []float64
+	failing  bool
+}
+
+func (c *testWeatherClient) GetCurrentReport(ctx context.Context, in *weather.GetCurrentReportRequest, opts ...grpc.CallOption) (*weather.GetCurrentReportResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.requests = append(c.requests, in.Latitude)
+	if c.failing {
+		return nil, errors.New("unavailable")
+	}
+	return &weather.GetCurrentReportResponse{
+		Report: &weather.WeatherReport{
+			Conditions: &weather.WeatherCondition{
+				Temperature: float32(in.Latitude),
+			},
+		},
+	}, nil
+}
+
+func (c *testWeatherClient) GetForecast(ctx context.Context, in *weather.GetForecastRequest, opts ...grpc.CallOption) (*weather.GetForecastResponse, error) {
+	return &weather.GetForecastResponse{
+		ForecastRecords: []*weather.WeatherForecast{
+			{
+				Conditions: &weather.WeatherCondition{SummaryIcon: weather.WeatherIcon_RAIN},
+			},
+		},
+	}, nil
+}
+
+func (c *testWeatherClient) pollRequests() []float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	requests := c.requests
+	c.requests = nil
+	return requests
+}
+
+func weatherPolicy(id string, location string, latitude float64) *Policy {
+	return &Policy{
+		Id:   id,
+		Name: "weather policy " + id,
+		Condition: &Condition{
+			Weather: &WeatherCondition{
+				Location: location,
+				Latitude: latitude,
+				Temperature: &WeatherCondition_Temperature{
+					Comparison:         Comparison_GREATER_THAN,
+					TemperatureCelsius: 10,
+				},
+			},
+		},
+	}
+}
+
+func TestStatePollWeather(t *testing.T) {
+	// The engine logs as it stops, which may be after the test completes.
+	logger := zap.NewNop()
+	state := NewState(logger, nil)
+	engine := NewEngine(logger, state)
+	client := &testWeatherClient{}
+
+	// The engine consumes the refreshes sent as the weather changes.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.Run(ctx)
+
+	require.NoError(t, engine.AddPolicy(weatherPolicy("1", "YKF", 43)))
+	require.NoError(t, engine.AddPolicy(weatherPolicy("2", "YKF", 43)))
+	require.NoError(t, engine.AddPolicy(weatherPolicy("3", "YVR", 49)))
+
+	// Each location is polled once, no matter how many conditions use it.
+	state.pollWeather(ctx, client, true)
+	assert.ElementsMatch(t, []float64{43, 49}, client.pollRequests())
+
+	report, forecasts := state.weather("YKF")
+	require.NotNil(t, report)
+	assert.Equal(t, float32(43), report.Conditions.Temperature)
+	assert.Len(t, forecasts, 1)
+
+	// Only new locations are polled when policies are added.
+	require.NoError(t, engine.AddPolicy(weatherPolicy("4", "YYZ", 44)))
+	state.pollWeather(ctx, client, false)
+	assert.Equal(t, []float64{44}, client.pollRequests())
+
+	// A failed poll keeps the previous weather.
+	client.failing = true
+	state.pollWeather(ctx, client, true)
+	report, _ = state.weather("YVR")
+	assert.NotNil(t, report)
+	client.pollRequests()
+	client.failing = false
+
+	// Locations which are no longer used are forgotten.
+	require.NoError(t, engine.RemovePolicy("3"))
+	state.pollWeather(ctx, client, true)
+	assert.ElementsMatch(t, []float64{43, 44}, client.pollRequests())
+	report, _ = state.weather("YVR")
+	assert.Nil(t, report)
+}
+
+func TestStateMonitorWeather(t *testing.T) {
+	// The engine logs as it stops, which may be after the test completes.
+	logger := zap.NewNop()
+	state := NewState(logger, nil)
+	engine := NewEngine(logger, state)
+	client := &testWeatherClient{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.Run(ctx)
+	go state.MonitorWeather(ctx, client)
+
+	// Adding a policy with a new location polls it straight away.
+	require.NoError(t, engine.AddPolicy(weatherPolicy("1", "YKF", 43)))
+	require.Eventually(t, func() bool {
+		report, _ := state.weather("YKF")
+		return report != nil
+	}, time.Second, 10*time.Millisecond)
+}
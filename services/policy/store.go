@@ -0,0 +1,300 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/protobuf/proto"
+	"github.com/rmrobinson/nerves/lib/yamlpb"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"gopkg.in/yaml.v2"
+)
+
+// reloadDelay is how long the store waits for changes to the directory to settle before reloading it,
+// as editors often write a file in several steps.
+const reloadDelay = 250 * time.Millisecond
+
+var (
+	// ErrInvalidPolicyFile is returned if a policy file can't be parsed, or defines a policy which another file also defines.
+	ErrInvalidPolicyFile = errors.New("invalid policy file")
+)
+
+// FileStore loads policies from a directory of files, each of which contains a PolicySet, and saves changes
+// to the policies back to the files they came from. Files may be written as textproto (.textproto, .txtpb or .pbtxt),
+// or in the protobuf JSON format as JSON (.json) or YAML (.yaml or .yml); other files are ignored.
+// Actions are written using the Any JSON format, e.g. {"@type": "type.googleapis.com/faltung.nerves.policy.TimerAction", ...}.
+type FileStore struct {
+	logger *zap.Logger
+	dir    string
+
+	// files records the file each policy was loaded from.
+	files    map[string]string
+	fileLock sync.Mutex
+}
+
+// NewFileStore creates a new store for the policy files in the specified directory.
+func NewFileStore(logger *zap.Logger, dir string) *FileStore {
+	return &FileStore{
+		logger: logger,
+		dir:    dir,
+		files:  map[string]string{},
+	}
+}
+
+// Load reads the policies from all of the files in the directory.
+func (fs *FileStore) Load() (*PolicySet, error) {
+	fs.fileLock.Lock()
+	defer fs.fileLock.Unlock()
+
+	return fs.load()
+}
+
+func (fs *FileStore) load() (*PolicySet, error) {
+	entries, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &PolicySet{}
+	files := map[string]string{}
+	for _, entry := range entries {
+		if entry.IsDir() || !supportedFile(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(fs.dir, entry.Name())
+		fileSet, err := readPolicyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidPolicyFile, entry.Name(), err.Error())
+		}
+
+		for _, policy := range fileSet.Policies {
+			if len(policy.Id) < 1 {
+				return nil, fmt.Errorf("%w: %s: policy %s has no id", ErrInvalidPolicyFile, entry.Name(), policy.Name)
+			} else if other, ok := files[policy.Id]; ok {
+				return nil, fmt.Errorf("%w: %s: policy %s is also defined in %s", ErrInvalidPolicyFile, entry.Name(), policy.Id, filepath.Base(other))
+			}
+
+			files[policy.Id] = path
+			set.Policies = append(set.Policies, policy)
+		}
+	}
+
+	fs.files = files
+	return set, nil
+}
+
+// Save writes the supplied policy to the file it was loaded from, replacing the existing version.
+// A policy which wasn't loaded from a file is written to a new YAML file named after its ID.
+func (fs *FileStore) Save(policy *Policy) error {
+	if len(policy.Id) < 1 {
+		return ErrInvalidPolicy
+	}
+
+	fs.fileLock.Lock()
+	defer fs.fileLock.Unlock()
+
+	path, ok := fs.files[policy.Id]
+	if !ok {
+		path = filepath.Join(fs.dir, policy.Id+".yaml")
+	}
+
+	set := &PolicySet{}
+	if _, err := os.Stat(path); err == nil {
+		if set, err = readPolicyFile(path); err != nil {
+			return err
+		}
+	}
+
+	replaced := false
+	for idx, existing := range set.Policies {
+		if existing.Id == policy.Id {
+			set.Policies[idx] = policy
+			replaced = true
+		}
+	}
+	if !replaced {
+		set.Policies = append(set.Policies, policy)
+	}
+
+	if err := writePolicyFile(path, set); err != nil {
+		return err
+	}
+
+	fs.files[policy.Id] = path
+	return nil
+}
+
+// Delete removes the specified policy from the file it was loaded from, removing the file if it has no other policies.
+func (fs *FileStore) Delete(id string) error {
+	fs.fileLock.Lock()
+	defer fs.fileLock.Unlock()
+
+	path, ok := fs.files[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	set, err := readPolicyFile(path)
+	if err != nil {
+		return err
+	}
+
+	var policies []*Policy
+	for _, policy := range set.Policies {
+		if policy.Id != id {
+			policies = append(policies, policy)
+		}
+	}
+
+	if len(policies) < 1 {
+		err = os.Remove(path)
+	} else {
+		err = writePolicyFile(path, &PolicySet{Policies: policies})
+	}
+	if err != nil {
+		return err
+	}
+
+	delete(fs.files, id)
+	return nil
+}
+
+// Watch reloads the policies each time the files in the directory change, until the context is cancelled.
+// The reloaded policies are supplied to the callback; if they can't be loaded the error is logged and the
+// callback isn't invoked, so the policies in use remain unchanged until the files are fixed.
+func (fs *FileStore) Watch(ctx context.Context, reloaded func(*PolicySet)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(fs.dir); err != nil {
+		return err
+	}
+
+	// A stopped timer with a drained channel, which is started when a change is seen.
+	timer := time.NewTimer(reloadDelay)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			} else if !supportedFile(event.Name) {
+				continue
+			}
+
+			fs.logger.Debug("policy file changed",
+				zap.String("path", event.Name),
+				zap.String("op", event.Op.String()),
+			)
+			timer.Reset(reloadDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fs.logger.Info("error watching policy files",
+				zap.Error(err),
+			)
+		case <-timer.C:
+			set, err := fs.Load()
+			if err != nil {
+				fs.logger.Info("error reloading policies, keeping existing policies",
+					zap.String("dir", fs.dir),
+					zap.Error(err),
+				)
+				continue
+			}
+
+			fs.logger.Info("reloaded policies",
+				zap.String("dir", fs.dir),
+				zap.Int("count", len(set.Policies)),
+			)
+			reloaded(set)
+		}
+	}
+}
+
+func supportedFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".textproto", ".txtpb", ".pbtxt", ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+func readPolicyFile(path string) (*PolicySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &PolicySet{}
+	switch filepath.Ext(path) {
+	case ".textproto", ".txtpb", ".pbtxt":
+		err = prototext.Unmarshal(data, proto.MessageV2(set))
+	case ".json":
+		err = protojson.Unmarshal(data, proto.MessageV2(set))
+	case ".yaml", ".yml":
+		// An empty file leaves the set empty, so has no policies.
+		err = yamlpb.Unmarshal(data, set)
+	default:
+		err = fmt.Errorf("unsupported file type %s", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// writePolicyFile writes the set to the path in the format its extension names.
+// The set is written to a temporary file first so a reload never sees a partially written file.
+func writePolicyFile(path string, set *PolicySet) error {
+	var data []byte
+	var err error
+
+	switch filepath.Ext(path) {
+	case ".textproto", ".txtpb", ".pbtxt":
+		data, err = prototext.MarshalOptions{Multiline: true}.Marshal(proto.MessageV2(set))
+	case ".json":
+		data, err = protojson.MarshalOptions{Multiline: true}.Marshal(proto.MessageV2(set))
+	case ".yaml", ".yml":
+		if data, err = protojson.Marshal(proto.MessageV2(set)); err != nil {
+			return err
+		}
+		var doc interface{}
+		if err = json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		data, err = yaml.Marshal(doc)
+	default:
+		err = fmt.Errorf("unsupported file type %s", filepath.Ext(path))
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,225 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+const (
+	testTextPolicies = `
+policies {
+	id: "text"
+	name: "text policy"
+	weight: 1
+	condition {
+		name: "timer"
+		timer { id: "t1" }
+	}
+	actions {
+		name: "start timer"
+		type: TIMER
+		details {
+			[type.googleapis.com/faltung.nerves.policy.TimerAction] {
+				id: "t2"
+				timer { interval_ms: 1000 }
+			}
+		}
+	}
+}
+`
+	testJSONPolicies = `{
+	"policies": [{
+		"id": "json",
+		"name": "json policy",
+		"condition": {"name": "timer", "timer": {"id": "t1"}},
+		"actions": [{"name": "log", "type": "LOG"}]
+	}]
+}`
+	testYAMLPolicies = `
+policies:
+  - id: yaml
+    name: yaml policy
+    isDisabled: true
+    condition:
+      name: timer
+      timer:
+        id: t1
+    actions:
+      - name: start timer
+        type: TIMER
+        details:
+          "@type": type.googleapis.com/faltung.nerves.policy.TimerAction
+          id: t2
+          timer:
+            intervalMs: 1000
+`
+)
+
+func writeTestFile(t *testing.T, dir string, name string, contents string) {
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+}
+
+func policyIDs(set *PolicySet) []string {
+	var ids []string
+	for _, policy := range set.Policies {
+		ids = append(ids, policy.Id)
+	}
+	return ids
+}
+
+func TestFileStoreLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.textproto", testTextPolicies)
+	writeTestFile(t, dir, "b.json", testJSONPolicies)
+	writeTestFile(t, dir, "c.yaml", testYAMLPolicies)
+	writeTestFile(t, dir, "d.yml", "")
+	writeTestFile(t, dir, "README.md", "not a policy")
+
+	fs := NewFileStore(zaptest.NewLogger(t), dir)
+	set, err := fs.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"text", "json", "yaml"}, policyIDs(set))
+
+	timer := &TimerAction{}
+	require.NoError(t, ptypes.UnmarshalAny(set.Policies[0].Actions[0].Details, timer))
+	assert.Equal(t, int32(1000), timer.Timer.IntervalMs)
+
+	assert.Equal(t, Action_LOG, set.Policies[1].Actions[0].Type)
+
+	assert.True(t, set.Policies[2].IsDisabled)
+	assert.True(t, proto.Equal(set.Policies[0].Actions[0], set.Policies[2].Actions[0]))
+}
+
+func TestFileStoreLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{
+			"unparseable",
+			map[string]string{"a.json": "{"},
+		},
+		{
+			"missing id",
+			map[string]string{"a.json": `{"policies": [{"name": "no id"}]}`},
+		},
+		{
+			"duplicate id",
+			map[string]string{
+				"a.json": testJSONPolicies,
+				"b.json": testJSONPolicies,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, contents := range tt.files {
+				writeTestFile(t, dir, name, contents)
+			}
+
+			_, err := NewFileStore(zaptest.NewLogger(t), dir).Load()
+			assert.True(t, errors.Is(err, ErrInvalidPolicyFile))
+		})
+	}
+}
+
+func TestFileStoreSaveDelete(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.textproto", testTextPolicies)
+	writeTestFile(t, dir, "b.json", testJSONPolicies)
+
+	fs := NewFileStore(zaptest.NewLogger(t), dir)
+	set, err := fs.Load()
+	require.NoError(t, err)
+
+	// Changes are written back to the file the policy came from.
+	updated := proto.Clone(set.Policies[0]).(*Policy)
+	updated.Name = "renamed"
+	require.NoError(t, fs.Save(updated))
+
+	// New policies are written to their own file.
+	added := &Policy{
+		Id:   "new",
+		Name: "new policy",
+		Condition: &Condition{
+			Name:  "timer",
+			Timer: &Condition_Timer{Id: "t1"},
+		},
+	}
+	require.NoError(t, fs.Save(added))
+	assert.FileExists(t, filepath.Join(dir, "new.yaml"))
+
+	reloaded, err := NewFileStore(zaptest.NewLogger(t), dir).Load()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"text", "json", "new"}, policyIDs(reloaded))
+	assert.True(t, proto.Equal(updated, reloaded.Policies[0]))
+	assert.True(t, proto.Equal(added, reloaded.Policies[2]))
+
+	// Files without any policies left are removed.
+	require.NoError(t, fs.Delete("json"))
+	_, err = os.Stat(filepath.Join(dir, "b.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, ErrNotFound, fs.Delete("json"))
+
+	reloaded, err = fs.Load()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"text", "new"}, policyIDs(reloaded))
+}
+
+func TestFileStoreWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "a.json", testJSONPolicies)
+
+	fs := NewFileStore(zaptest.NewLogger(t), dir)
+	_, err := fs.Load()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sets := make(chan *PolicySet, 8)
+	started := make(chan error)
+	go func() {
+		started <- fs.Watch(ctx, func(set *PolicySet) {
+			sets <- set
+		})
+	}()
+
+	// Give the watcher time to start before changing the directory.
+	time.Sleep(100 * time.Millisecond)
+	writeTestFile(t, dir, "b.textproto", testTextPolicies)
+
+	select {
+	case set := <-sets:
+		assert.Equal(t, []string{"json", "text"}, policyIDs(set))
+	case err := <-started:
+		t.Fatalf("watch stopped: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("policies not reloaded")
+	}
+
+	// Invalid files don't replace the loaded policies.
+	writeTestFile(t, dir, "c.json", "{")
+	select {
+	case <-sets:
+		t.Fatal("invalid policies reloaded")
+	case <-time.After(4 * reloadDelay):
+	}
+
+	cancel()
+	assert.NoError(t, <-started)
+}
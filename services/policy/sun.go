@@ -0,0 +1,187 @@
+package policy
+
+import (
+	"math"
+	"time"
+)
+
+// The positions of the sun are computed using the approximations of the sunrise equation, which are accurate to
+// within a minute or two away from the poles.
+// See https://en.wikipedia.org/wiki/Sunrise_equation and https://aa.usno.navy.mil/faq/sun_approx.
+
+const (
+	// The altitude of the center of the sun at sunrise and sunset, accounting for refraction and the size of the sun.
+	sunriseAltitude = -0.833
+	// The altitude of the sun at civil dawn and dusk.
+	civilTwilightAltitude = -6.0
+	// The altitude of the sun at nautical dawn and dusk.
+	nauticalTwilightAltitude = -12.0
+
+	// The Julian date of the J2000.0 epoch.
+	j2000 = 2451545.0
+	// The Julian date of the Unix epoch.
+	unixEpochJulianDate = 2440587.5
+	// The obliquity of the ecliptic, in degrees.
+	obliquity = 23.4397
+)
+
+// sunLocation is the location the position of the sun is computed for.
+type sunLocation struct {
+	latitude  float64
+	longitude float64
+	tz        *time.Location
+}
+
+func julianDate(t time.Time) float64 {
+	return float64(t.UnixNano())/float64(24*time.Hour) + unixEpochJulianDate
+}
+
+func julianDateTime(jd float64) time.Time {
+	return time.Unix(0, int64((jd-unixEpochJulianDate)*float64(24*time.Hour))).UTC()
+}
+
+func sin(deg float64) float64 {
+	return math.Sin(deg * math.Pi / 180)
+}
+
+func cos(deg float64) float64 {
+	return math.Cos(deg * math.Pi / 180)
+}
+
+// eclipticLongitude returns the mean anomaly and ecliptic longitude of the sun, in degrees, for the days since J2000.0.
+func eclipticLongitude(days float64) (float64, float64) {
+	m := math.Mod(357.5291+0.98560028*days, 360)
+	c := 1.9148*sin(m) + 0.0200*sin(2*m) + 0.0003*sin(3*m)
+	return m, math.Mod(m+c+180+102.9372, 360)
+}
+
+// sunEvent returns when the sun crosses the specified altitude on the specified day at the location, either rising or setting.
+// false is returned if the sun doesn't cross the altitude that day, e.g. during polar day or night.
+func (l *sunLocation) sunEvent(day time.Time, altitude float64, rising bool) (time.Time, bool) {
+	// The day is identified by its local noon, and the solar transit nearest to it is used.
+	year, month, date := day.In(l.tz).Date()
+	noon := time.Date(year, month, date, 12, 0, 0, 0, l.tz)
+
+	n := math.Round(julianDate(noon) - j2000 + 0.0008)
+	meanNoon := n - l.longitude/360
+	m, lambda := eclipticLongitude(meanNoon)
+	transit := j2000 + meanNoon + 0.0053*sin(m) - 0.0069*sin(2*lambda)
+
+	declination := math.Asin(sin(lambda)*sin(obliquity)) * 180 / math.Pi
+	cosHourAngle := (sin(altitude) - sin(l.latitude)*sin(declination)) / (cos(l.latitude) * cos(declination))
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, false
+	}
+
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+	if rising {
+		return julianDateTime(transit - hourAngle/360), true
+	}
+	return julianDateTime(transit + hourAngle/360), true
+}
+
+// sunAltitude returns the altitude of the sun above the horizon at the location at the specified time, in degrees.
+func (l *sunLocation) sunAltitude(t time.Time) float64 {
+	days := julianDate(t) - j2000
+	_, lambda := eclipticLongitude(days)
+
+	declination := math.Asin(sin(lambda)*sin(obliquity)) * 180 / math.Pi
+	rightAscension := math.Atan2(cos(obliquity)*sin(lambda), cos(lambda)) * 180 / math.Pi
+	siderealTime := 280.16 + 360.9856235*days
+	hourAngle := siderealTime + l.longitude - rightAscension
+
+	return math.Asin(sin(l.latitude)*sin(declination)+cos(l.latitude)*cos(declination)*cos(hourAngle)) * 180 / math.Pi
+}
+
+// sunEventParams returns the altitude of the sun at the event, and whether the sun is rising at it.
+func sunEventParams(event Condition_Sun_Event) (float64, bool) {
+	switch event {
+	case Condition_Sun_SUNRISE:
+		return sunriseAltitude, true
+	case Condition_Sun_SUNSET:
+		return sunriseAltitude, false
+	case Condition_Sun_CIVIL_DAWN:
+		return civilTwilightAltitude, true
+	case Condition_Sun_CIVIL_DUSK:
+		return civilTwilightAltitude, false
+	case Condition_Sun_NAUTICAL_DAWN:
+		return nauticalTwilightAltitude, true
+	case Condition_Sun_NAUTICAL_DUSK:
+		return nauticalTwilightAltitude, false
+	}
+	return sunriseAltitude, true
+}
+
+// darkAltitude returns the altitude the sun must be below for it to be dark.
+func darkAltitude(twilight Condition_Dark_Twilight) float64 {
+	switch twilight {
+	case Condition_Dark_CIVIL:
+		return civilTwilightAltitude
+	case Condition_Dark_NAUTICAL:
+		return nauticalTwilightAltitude
+	}
+	return sunriseAltitude
+}
+
+// nextSunEvent returns the first time after the specified time the event, shifted by the offset, occurs at the location.
+// false is returned if the event doesn't occur in the next week, e.g. during polar day or night.
+func (l *sunLocation) nextSunEvent(event Condition_Sun_Event, offset time.Duration, after time.Time) (time.Time, bool) {
+	altitude, rising := sunEventParams(event)
+
+	// A large offset can move the event of the previous day past the specified time.
+	for day := -1; day <= 7; day++ {
+		at, ok := l.sunEvent(after.AddDate(0, 0, day), altitude, rising)
+		if ok && at.Add(offset).After(after) {
+			return at.Add(offset), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// nextDarkChange returns the first time after the specified time it becomes dark or light at the location.
+// false is returned if neither happens in the next week.
+func (l *sunLocation) nextDarkChange(twilight Condition_Dark_Twilight, after time.Time) (time.Time, bool) {
+	altitude := darkAltitude(twilight)
+
+	var next time.Time
+	for _, rising := range []bool{true, false} {
+		for day := 0; day <= 7; day++ {
+			at, ok := l.sunEvent(after.AddDate(0, 0, day), altitude, rising)
+			if ok && at.After(after) {
+				if next.IsZero() || at.Before(next) {
+					next = at
+				}
+				break
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// previousSunEvent returns the last time at or before the specified time the sun crossed the altitude at the location.
+// false is returned if it didn't cross it in the last week.
+func (l *sunLocation) previousSunEvent(altitude float64, rising bool, before time.Time) (time.Time, bool) {
+	for day := 1; day >= -7; day-- {
+		at, ok := l.sunEvent(before.AddDate(0, 0, day), altitude, rising)
+		if ok && !at.After(before) {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// dark checks whether it is dark at the location at the specified time, i.e. whether the sun last set below the
+// altitude of the twilight more recently than it rose above it. This uses the same computation as the events, so
+// a condition evaluated as a dusk or dawn event fires sees the change.
+func (l *sunLocation) dark(twilight Condition_Dark_Twilight, now time.Time) bool {
+	altitude := darkAltitude(twilight)
+
+	rose, roseOK := l.previousSunEvent(altitude, true, now)
+	set, setOK := l.previousSunEvent(altitude, false, now)
+	if roseOK && setOK {
+		return set.After(rose)
+	}
+
+	// During polar day or night the sun doesn't cross the altitude, so its current altitude is used instead.
+	return l.sunAltitude(now) < altitude
+}
@@ -0,0 +1,217 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// The expected times are those published by NOAA, which the approximations used are expected to be within a few minutes of.
+const sunTolerance = 3 * time.Minute
+
+func sanFrancisco(t *testing.T) *sunLocation {
+	tz, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+	return &sunLocation{latitude: 37.7749, longitude: -122.4194, tz: tz}
+}
+
+func tromso(t *testing.T) *sunLocation {
+	tz, err := time.LoadLocation("Europe/Oslo")
+	require.NoError(t, err)
+	return &sunLocation{latitude: 69.65, longitude: 18.96, tz: tz}
+}
+
+func TestNextSunEvent(t *testing.T) {
+	sf := sanFrancisco(t)
+	day := time.Date(2020, time.June, 21, 0, 0, 0, 0, sf.tz)
+
+	tests := []struct {
+		name     string
+		event    Condition_Sun_Event
+		offset   time.Duration
+		after    time.Time
+		expected time.Time
+	}{
+		{
+			"sunrise",
+			Condition_Sun_SUNRISE,
+			0,
+			day,
+			time.Date(2020, time.June, 21, 5, 48, 0, 0, sf.tz),
+		},
+		{
+			"sunset",
+			Condition_Sun_SUNSET,
+			0,
+			day,
+			time.Date(2020, time.June, 21, 20, 35, 0, 0, sf.tz),
+		},
+		{
+			"civil dusk",
+			Condition_Sun_CIVIL_DUSK,
+			0,
+			day,
+			time.Date(2020, time.June, 21, 21, 8, 0, 0, sf.tz),
+		},
+		{
+			"nautical dawn",
+			Condition_Sun_NAUTICAL_DAWN,
+			0,
+			day,
+			time.Date(2020, time.June, 21, 4, 38, 0, 0, sf.tz),
+		},
+		{
+			"sunset with negative offset",
+			Condition_Sun_SUNSET,
+			-15 * time.Minute,
+			day,
+			time.Date(2020, time.June, 21, 20, 20, 0, 0, sf.tz),
+		},
+		{
+			"sunrise after today's is tomorrow's",
+			Condition_Sun_SUNRISE,
+			0,
+			day.Add(12 * time.Hour),
+			time.Date(2020, time.June, 22, 5, 48, 0, 0, sf.tz),
+		},
+		{
+			"offset moves yesterday's event past the time",
+			Condition_Sun_SUNSET,
+			6 * time.Hour,
+			day,
+			time.Date(2020, time.June, 21, 2, 35, 0, 0, sf.tz),
+		},
+		{
+			"winter sunset",
+			Condition_Sun_SUNSET,
+			0,
+			time.Date(2020, time.December, 21, 0, 0, 0, 0, sf.tz),
+			time.Date(2020, time.December, 21, 16, 55, 0, 0, sf.tz),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at, ok := sf.nextSunEvent(tt.event, tt.offset, tt.after)
+			require.True(t, ok)
+			assert.WithinDuration(t, tt.expected, at, sunTolerance)
+		})
+	}
+}
+
+func TestNextSunEventPolar(t *testing.T) {
+	tr := tromso(t)
+
+	// The sun doesn't set during the summer or rise during the winter.
+	_, ok := tr.nextSunEvent(Condition_Sun_SUNSET, 0, time.Date(2020, time.June, 21, 0, 0, 0, 0, tr.tz))
+	assert.False(t, ok)
+	_, ok = tr.nextSunEvent(Condition_Sun_SUNRISE, 0, time.Date(2020, time.December, 21, 0, 0, 0, 0, tr.tz))
+	assert.False(t, ok)
+
+	// It still gets light enough for civil dawn in the winter.
+	_, ok = tr.nextSunEvent(Condition_Sun_CIVIL_DAWN, 0, time.Date(2020, time.December, 21, 0, 0, 0, 0, tr.tz))
+	assert.True(t, ok)
+}
+
+func TestSunLocationDark(t *testing.T) {
+	sf := sanFrancisco(t)
+	tr := tromso(t)
+
+	tests := []struct {
+		name     string
+		location *sunLocation
+		twilight Condition_Dark_Twilight
+		at       time.Time
+		expected bool
+	}{
+		{"noon", sf, Condition_Dark_NONE, time.Date(2020, time.June, 21, 12, 0, 0, 0, sf.tz), false},
+		{"midnight", sf, Condition_Dark_NONE, time.Date(2020, time.June, 21, 0, 0, 0, 0, sf.tz), true},
+		{"after sunset", sf, Condition_Dark_NONE, time.Date(2020, time.June, 21, 20, 50, 0, 0, sf.tz), true},
+		{"before civil dusk", sf, Condition_Dark_CIVIL, time.Date(2020, time.June, 21, 20, 50, 0, 0, sf.tz), false},
+		{"after nautical dusk", sf, Condition_Dark_NAUTICAL, time.Date(2020, time.June, 21, 22, 0, 0, 0, sf.tz), true},
+		{"polar day", tr, Condition_Dark_NONE, time.Date(2020, time.June, 21, 0, 0, 0, 0, tr.tz), false},
+		{"polar night", tr, Condition_Dark_NONE, time.Date(2020, time.December, 21, 12, 0, 0, 0, tr.tz), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.location.dark(tt.twilight, tt.at))
+		})
+	}
+}
+
+func TestNextDarkChange(t *testing.T) {
+	sf := sanFrancisco(t)
+
+	// It next becomes dark at sunset, and then light at sunrise.
+	at, ok := sf.nextDarkChange(Condition_Dark_NONE, time.Date(2020, time.June, 21, 12, 0, 0, 0, sf.tz))
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Date(2020, time.June, 21, 20, 35, 0, 0, sf.tz), at, sunTolerance)
+	assert.True(t, sf.dark(Condition_Dark_NONE, at))
+
+	at, ok = sf.nextDarkChange(Condition_Dark_NONE, at)
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Date(2020, time.June, 22, 5, 48, 0, 0, sf.tz), at, sunTolerance)
+	assert.False(t, sf.dark(Condition_Dark_NONE, at))
+}
+
+func TestConditionValidateSun(t *testing.T) {
+	assert.True(t, (&Condition{Sun: &Condition_Sun{Event: Condition_Sun_SUNSET}}).validate())
+	assert.True(t, (&Condition{Sun: &Condition_Sun{
+		Event:  Condition_Sun_SUNSET,
+		Offset: ptypes.DurationProto(-15 * time.Minute),
+	}}).validate())
+	assert.False(t, (&Condition{Sun: &Condition_Sun{Event: Condition_Sun_Event(100)}}).validate())
+	assert.True(t, (&Condition{Dark: &Condition_Dark{Twilight: Condition_Dark_CIVIL}}).validate())
+	assert.False(t, (&Condition{Dark: &Condition_Dark{Twilight: Condition_Dark_Twilight(100)}}).validate())
+}
+
+func TestStateSunEntries(t *testing.T) {
+	// The engine logs as it stops, which may be after the test completes.
+	logger := zap.NewNop()
+	state := NewState(logger, nil)
+	engine := NewEngine(logger, state)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.Run(ctx)
+
+	sunset := &Condition{Sun: &Condition_Sun{Event: Condition_Sun_SUNSET}}
+
+	// Sun conditions can't be scheduled without a location.
+	err := state.addSunEntry(sunset)
+	assert.True(t, errors.Is(err, ErrNoLocation))
+	assert.Error(t, engine.AddPolicy(&Policy{Id: "1", Name: "sunset", Condition: sunset}))
+
+	sf := sanFrancisco(t)
+	state.SetLocation(sf.latitude, sf.longitude, sf.tz)
+
+	dark := &Condition{Dark: &Condition_Dark{}}
+	require.NoError(t, engine.AddPolicy(&Policy{
+		Id:   "2",
+		Name: "sunset or dark",
+		Condition: &Condition{
+			Set: &Condition_Set{
+				Operator:   Condition_Set_OR,
+				Conditions: []*Condition{sunset, dark},
+			},
+		},
+	}))
+
+	state.scheduleLock.Lock()
+	assert.Contains(t, state.sunsByCond, sunset)
+	assert.Contains(t, state.sunsByCond, dark)
+	state.scheduleLock.Unlock()
+
+	require.NoError(t, engine.RemovePolicy("2"))
+
+	state.scheduleLock.Lock()
+	assert.Empty(t, state.sunsByCond)
+	state.scheduleLock.Unlock()
+}
@@ -0,0 +1,88 @@
+package policy
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// policyState tracks the truth of the condition of a policy across evaluations, so the actions of the policy
+// are executed as its trigger describes rather than on every evaluation.
+type policyState struct {
+	// active is the truth of the condition, once a change has held for the minimum hold duration.
+	active bool
+	// changedAt is when the condition last changed from the active value, or zero if it matches.
+	changedAt time.Time
+	// executedAt is when the actions were last executed, or zero if they haven't been.
+	executedAt time.Time
+}
+
+func (t *Policy_Trigger) validate() bool {
+	if t == nil {
+		return true
+	}
+
+	// Unset durations are valid, and treated as 0.
+	for _, d := range []*durationpb.Duration{t.RepeatInterval, t.Cooldown, t.MinHold} {
+		if d != nil && (!d.IsValid() || d.AsDuration() < 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// update records the truth of the condition at the specified time, and returns whether the actions should be executed.
+// If the policy needs to be evaluated again at a later time even if nothing else changes, e.g. to repeat its actions
+// or confirm a change has held, the delay until then is also returned; otherwise the delay is 0.
+func (ps *policyState) update(t *Policy_Trigger, value bool, now time.Time) (bool, time.Duration) {
+	changed := false
+	if value == ps.active {
+		ps.changedAt = time.Time{}
+	} else {
+		if ps.changedAt.IsZero() {
+			ps.changedAt = now
+		}
+		if held := now.Sub(ps.changedAt); held < t.GetMinHold().AsDuration() {
+			return false, t.GetMinHold().AsDuration() - held
+		}
+
+		ps.active = value
+		ps.changedAt = time.Time{}
+		changed = true
+	}
+
+	repeat := t.GetRepeatInterval().AsDuration()
+
+	execute := false
+	switch t.GetMode() {
+	case Policy_Trigger_ON_ENTER:
+		execute = changed && ps.active
+	case Policy_Trigger_ON_EXIT:
+		execute = changed && !ps.active
+	case Policy_Trigger_WHILE_TRUE:
+		if !ps.active {
+			return false, 0
+		}
+		execute = changed || repeat <= 0 || now.Sub(ps.executedAt) >= repeat
+		if !execute {
+			return false, repeat - now.Sub(ps.executedAt)
+		}
+	}
+	if !execute {
+		return false, 0
+	}
+
+	if cooldown := t.GetCooldown().AsDuration(); !ps.executedAt.IsZero() && now.Sub(ps.executedAt) < cooldown {
+		// A change during the cooldown is dropped, but a repeating policy executes once the cooldown ends.
+		if t.GetMode() == Policy_Trigger_WHILE_TRUE && repeat > 0 {
+			return false, cooldown - now.Sub(ps.executedAt)
+		}
+		return false, 0
+	}
+
+	ps.executedAt = now
+	if t.GetMode() == Policy_Trigger_WHILE_TRUE && repeat > 0 {
+		return true, repeat
+	}
+	return true, 0
+}
@@ -0,0 +1,212 @@
+package policy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/rmrobinson/nerves/services/domotics/bridge"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+)
+
+// evaluation is the truth of a condition at an offset from the start of a test, and the expected result of updating the policy state with it.
+type evaluation struct {
+	at      time.Duration
+	value   bool
+	execute bool
+	next    time.Duration
+}
+
+func TestPolicyStateUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		trigger     *Policy_Trigger
+		evaluations []evaluation
+	}{
+		{
+			"default executes on enter",
+			nil,
+			[]evaluation{
+				{0, false, false, 0},
+				{time.Second, true, true, 0},
+				{2 * time.Second, true, false, 0},
+				{3 * time.Second, false, false, 0},
+				{4 * time.Second, true, true, 0},
+			},
+		},
+		{
+			"on exit",
+			&Policy_Trigger{Mode: Policy_Trigger_ON_EXIT},
+			[]evaluation{
+				{0, true, false, 0},
+				{time.Second, true, false, 0},
+				{2 * time.Second, false, true, 0},
+				{3 * time.Second, false, false, 0},
+			},
+		},
+		{
+			"while true without repeat interval",
+			&Policy_Trigger{Mode: Policy_Trigger_WHILE_TRUE},
+			[]evaluation{
+				{0, true, true, 0},
+				{time.Second, true, true, 0},
+				{2 * time.Second, false, false, 0},
+			},
+		},
+		{
+			"while true with repeat interval",
+			&Policy_Trigger{
+				Mode:           Policy_Trigger_WHILE_TRUE,
+				RepeatInterval: ptypes.DurationProto(10 * time.Second),
+			},
+			[]evaluation{
+				{0, true, true, 10 * time.Second},
+				{4 * time.Second, true, false, 6 * time.Second},
+				{10 * time.Second, true, true, 10 * time.Second},
+				{12 * time.Second, false, false, 0},
+				{13 * time.Second, true, true, 10 * time.Second},
+			},
+		},
+		{
+			"cooldown drops changes",
+			&Policy_Trigger{
+				Cooldown: ptypes.DurationProto(10 * time.Second),
+			},
+			[]evaluation{
+				{0, true, true, 0},
+				{time.Second, false, false, 0},
+				{2 * time.Second, true, false, 0},
+				{3 * time.Second, false, false, 0},
+				{11 * time.Second, true, true, 0},
+			},
+		},
+		{
+			"cooldown delays repeats",
+			&Policy_Trigger{
+				Mode:           Policy_Trigger_WHILE_TRUE,
+				RepeatInterval: ptypes.DurationProto(time.Second),
+				Cooldown:       ptypes.DurationProto(5 * time.Second),
+			},
+			[]evaluation{
+				{0, true, true, time.Second},
+				{time.Second, true, false, 4 * time.Second},
+				{5 * time.Second, true, true, time.Second},
+			},
+		},
+		{
+			"min hold ignores brief changes",
+			&Policy_Trigger{
+				MinHold: ptypes.DurationProto(5 * time.Second),
+			},
+			[]evaluation{
+				{0, true, false, 5 * time.Second},
+				{2 * time.Second, false, false, 0},
+				{3 * time.Second, true, false, 5 * time.Second},
+				{6 * time.Second, true, false, 2 * time.Second},
+				{8 * time.Second, true, true, 0},
+				{9 * time.Second, false, false, 5 * time.Second},
+				{10 * time.Second, true, false, 0},
+			},
+		},
+		{
+			"min hold applies to exits",
+			&Policy_Trigger{
+				Mode:    Policy_Trigger_ON_EXIT,
+				MinHold: ptypes.DurationProto(5 * time.Second),
+			},
+			[]evaluation{
+				{0, true, false, 5 * time.Second},
+				{5 * time.Second, true, false, 0},
+				{6 * time.Second, false, false, 5 * time.Second},
+				{11 * time.Second, false, true, 0},
+			},
+		},
+	}
+
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := &policyState{}
+			for _, eval := range tt.evaluations {
+				execute, next := ps.update(tt.trigger, eval.value, start.Add(eval.at))
+				assert.Equal(t, eval.execute, execute, "execute at %s", eval.at)
+				assert.Equal(t, eval.next, next, "next at %s", eval.at)
+			}
+		})
+	}
+}
+
+func TestPolicyTriggerValidate(t *testing.T) {
+	assert.True(t, (*Policy_Trigger)(nil).validate())
+	assert.True(t, (&Policy_Trigger{Cooldown: ptypes.DurationProto(time.Second)}).validate())
+	assert.False(t, (&Policy_Trigger{MinHold: ptypes.DurationProto(-time.Second)}).validate())
+}
+
+func TestEngineEdgeTrigger(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	state := NewState(logger, nil)
+	engine := NewEngine(logger, state)
+
+	now := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	engine.now = func() time.Time { return now }
+
+	timerAction, err := ptypes.MarshalAny(&TimerAction{
+		Id:    "lights-on",
+		Timer: &TimerAction_Timer{IntervalMs: 60000},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, engine.AddPolicy(&Policy{
+		Id:   "1",
+		Name: "lights on",
+		Condition: &Condition{
+			Device: &DeviceCondition{
+				DeviceId: "light",
+				Binary:   &DeviceCondition_Binary{IsOn: true},
+			},
+		},
+		Actions: []*Action{
+			{
+				Name:    "start timer",
+				Type:    Action_TIMER,
+				Details: timerAction,
+			},
+		},
+	}))
+
+	setLight := func(isOn bool) {
+		state.deviceState["light"] = &bridge.Device{
+			Id: "light",
+			State: &bridge.DeviceState{
+				Binary: &bridge.DeviceState_Binary{IsOn: isOn},
+			},
+		}
+	}
+	executions := func() time.Time {
+		return engine.policyStates["1"].executedAt
+	}
+
+	setLight(false)
+	engine.execute(context.Background())
+	assert.True(t, executions().IsZero())
+
+	setLight(true)
+	engine.execute(context.Background())
+	assert.Equal(t, now, executions())
+	assert.Contains(t, state.timersByID, "lights-on")
+
+	// Unrelated refreshes don't execute the policy again while the condition remains true.
+	now = now.Add(time.Minute)
+	engine.execute(context.Background())
+	engine.execute(context.Background())
+	assert.Equal(t, now.Add(-time.Minute), executions())
+
+	// Replacing the policy resets its state.
+	policy, err := engine.Policy("1")
+	assert.NoError(t, err)
+	policy.Name = "renamed"
+	assert.NoError(t, engine.PutPolicy(policy))
+	assert.NotContains(t, engine.policyStates, "1")
+}
@@ -44,6 +44,14 @@ func newArrivalDetails(st *gtfs.StopTime, loc *time.Location) *arrivalDetails {
 	}
 }
 
+// expectedArrivalTime is the estimated arrival time, if known, otherwise the scheduled arrival time.
+func (a *arrivalDetails) expectedArrivalTime() time.Time {
+	if a.estimatedArrivalTime != nil {
+		return *a.estimatedArrivalTime
+	}
+	return a.arrivalTime
+}
+
 // RouteID is the ID of the route the trip making the arrival is from.
 func (a *arrivalDetails) RouteID() string {
 	return a.trip.RouteID
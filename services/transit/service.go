@@ -2,6 +2,7 @@ package transit
 
 import (
 	"context"
+	"sort"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
@@ -16,6 +17,8 @@ var (
 	ErrStopNotFound = status.New(codes.NotFound, "stop not found")
 	// ErrStopCutoffInvalid is returned if the stop cutoff is invalid
 	ErrStopCutoffInvalid = status.New(codes.InvalidArgument, "stop cutoff not a valid time")
+	// ErrStopRadiusInvalid is returned if the location radius is negative
+	ErrStopRadiusInvalid = status.New(codes.InvalidArgument, "stop radius not valid")
 )
 
 // Service is a really simple service that retrieves a transit feed
@@ -43,26 +46,36 @@ func (s *Service) AddFeed(feed *Feed) {
 	}
 }
 
-// GetStopArrivals returns the arrival info for the specified stop.
+// GetStopArrivals returns the arrival info for the specified stop, or for the stops near the specified location.
 func (s *Service) GetStopArrivals(ctx context.Context, req *GetStopArrivalsRequest) (*GetStopArrivalsResponse, error) {
 	if req.Location == nil && len(req.StopCode) < 1 {
 		return nil, ErrStopNotFound.Err()
+	} else if req.Location != nil && req.Location.Radius < 0 {
+		return nil, ErrStopRadiusInvalid.Err()
 	}
 
-	var stop *stopDetails
-	if req.Location != nil {
-		stop = s.stops.Closest(req.Location.Latitude, req.Location.Longitude).(*stopDetails)
+	var stops []geoset.Result
+	if req.Location != nil && req.Location.Radius > 0 {
+		stops = s.stops.WithinRadius(req.Location.Latitude, req.Location.Longitude, req.Location.Radius)
+	} else if req.Location != nil {
+		if closest := s.stops.Closest(req.Location.Latitude, req.Location.Longitude); closest != nil {
+			stops = append(stops, *closest)
+		}
 	} else {
 		for _, feed := range s.feeds {
 			if feedStop, ok := feed.stops[req.StopCode]; ok {
-				stop = feedStop
+				stops = append(stops, geoset.Result{
+					Latitude:  float64(feedStop.Latitude),
+					Longitude: float64(feedStop.Longitude),
+					Value:     feedStop,
+				})
 				break
 			}
 		}
+	}
 
-		if stop == nil {
-			return nil, ErrStopNotFound.Err()
-		}
+	if len(stops) < 1 {
+		return nil, ErrStopNotFound.Err()
 	}
 
 	var cutoff time.Time
@@ -77,22 +90,39 @@ func (s *Service) GetStopArrivals(ctx context.Context, req *GetStopArrivalsReque
 		cutoff = cutoff.In(time.Now().Location())
 	}
 
-	arrivals := stop.arrivalsForDay(cutoff)
+	resp := &GetStopArrivalsResponse{}
+
+	var arrivals []*arrivalDetails
+	for _, result := range stops {
+		stop := result.Value.(*stopDetails)
+
+		resp.Stops = append(resp.Stops, &NearbyStop{
+			Stop: &Stop{
+				Id:        stop.ID,
+				Code:      stop.Code,
+				Name:      stop.Name,
+				Latitude:  float64(stop.Latitude),
+				Longitude: float64(stop.Longitude),
+			},
+			Distance: result.Distance,
+		})
+
+		arrivals = append(arrivals, stop.arrivalsForDay(cutoff)...)
+	}
+	resp.Stop = resp.Stops[0].Stop
 
-	resp := &GetStopArrivalsResponse{
-		Stop: &Stop{
-			Id:        stop.ID,
-			Code:      stop.Code,
-			Name:      stop.Name,
-			Latitude:  float64(stop.Latitude),
-			Longitude: float64(stop.Longitude),
-		},
+	// Each stop's arrivals are already ordered, but once merged they need to be ordered again.
+	if len(stops) > 1 {
+		sort.SliceStable(arrivals, func(i, j int) bool {
+			return arrivals[i].expectedArrivalTime().Before(arrivals[j].expectedArrivalTime())
+		})
 	}
 
 	for _, arrival := range arrivals {
 		a := &Arrival{
 			RouteId:  arrival.RouteID(),
 			Headsign: arrival.VehicleHeadsign(),
+			StopId:   arrival.StopID,
 		}
 		a.ScheduledArrivalTime, _ = ptypes.TimestampProto(arrival.arrivalTime)
 		a.ScheduledDepartureTime, _ = ptypes.TimestampProto(arrival.departureTime)
@@ -25,6 +25,7 @@ const (
 	envVarLatitude          = "LATITUDE"
 	envVarLongitude         = "LONGITUDE"
 	envVarTransitdStopID    = "TRANSIT_STOP_ID"
+	envVarTransitdRadius    = "TRANSIT_RADIUS"
 )
 
 func main() {
@@ -36,6 +37,7 @@ func main() {
 	viper.BindEnv(envVarLatitude)
 	viper.BindEnv(envVarLongitude)
 	viper.BindEnv(envVarTransitdStopID)
+	viper.BindEnv(envVarTransitdRadius)
 
 	app := tview.NewApplication()
 
@@ -136,6 +138,7 @@ func main() {
 	devicesClient := bridge.NewBridgeServiceClient(domoticsConn)
 
 	devicesView := widget.NewDevices(app, logger, devicesClient)
+	go devicesView.Run(context.Background())
 
 	newsConn, err := grpc.Dial(viper.GetString(envVarNewsdEndpoint), grpcOpts...)
 	if err != nil {
@@ -172,10 +175,21 @@ func main() {
 
 	transitClient := transit.NewTransitServiceClient(transitConn)
 
-	getStopArrivalsResp, err := transitClient.GetStopArrivals(context.Background(), &transit.GetStopArrivalsRequest{
+	getStopArrivalsReq := &transit.GetStopArrivalsRequest{
 		StopCode:              viper.GetString(envVarTransitdStopID),
 		ExcludeArrivalsBefore: ptypes.TimestampNow(),
-	})
+	}
+	// If a radius is supplied we show the arrivals at every stop near us rather than a specific one.
+	if radius := viper.GetFloat64(envVarTransitdRadius); radius > 0 {
+		getStopArrivalsReq.StopCode = ""
+		getStopArrivalsReq.Location = &transit.GetStopArrivalsRequest_Location{
+			Latitude:  viper.GetFloat64(envVarLatitude),
+			Longitude: viper.GetFloat64(envVarLongitude),
+			Radius:    radius,
+		}
+	}
+
+	getStopArrivalsResp, err := transitClient.GetStopArrivals(context.Background(), getStopArrivalsReq)
 	if err != nil {
 		logger.Warn("unable to retrieve transit arrivals",
 			zap.Error(err),
@@ -186,7 +200,7 @@ func main() {
 	transitView := widget.NewTransit(app, 3)
 	go func() {
 		for {
-			transitView.Refresh(getStopArrivalsResp.Stop, getStopArrivalsResp.Arrivals)
+			transitView.Refresh(getStopArrivalsResp.Stops, getStopArrivalsResp.Arrivals)
 
 			time.Sleep(time.Second * 30)
 		}
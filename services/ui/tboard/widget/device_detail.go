@@ -11,6 +11,7 @@ import (
 	"github.com/rivo/tview"
 	"github.com/rmrobinson/nerves/services/domotics/bridge"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 // DeviceDetail is a widget that provides for viewing and editing DeviceInfo details.
@@ -144,48 +145,113 @@ func (dd *DeviceDetail) Refresh(client bridge.BridgeServiceClient, device *bridg
 		dd.device = device
 
 		dd.SetTitle(dd.device.Config.Name)
-		if dd.device.State.Binary != nil {
-			dd.isOnCheckbox.SetChecked(dd.device.State.Binary.IsOn)
-		} else {
-			dd.isOnCheckbox.SetChecked(false)
+		dd.descriptionText.SetText(dd.device.Config.Description + stateSummary(dd.device.State))
+
+		// Only the values the device allows to be changed are shown.
+		dd.isOnCheckbox.SetTitle("On?")
+		dd.isOnCheckbox.SetChecked(dd.device.State.GetBinary().GetIsOn())
+		if !dd.device.IsWritable(bridge.Trait_BINARY) && dd.device.IsWritable(bridge.Trait_LOCK) {
+			dd.isOnCheckbox.SetTitle("Locked?")
+			dd.isOnCheckbox.SetChecked(dd.device.State.GetLock().GetState() == bridge.DeviceState_Lock_LOCKED)
 		}
-		dd.descriptionText.SetText(dd.device.Config.Description)
 
-		// TODO: do not allow/show values for fields that aren't supported.
-		if dd.device.State.Range != nil {
-			dd.levelInput.SetText(fmt.Sprintf("%2d", dd.device.State.Range.Value))
-		} else if dd.device.State.Audio != nil {
-			dd.levelInput.SetText(fmt.Sprintf("%2d", dd.device.State.Audio.Volume))
+		dd.levelInput.SetText("")
+		if dd.device.IsWritable(bridge.Trait_RANGE) {
+			dd.levelInput.SetTitle("Level")
+			dd.levelInput.SetText(fmt.Sprintf("%2d", dd.device.State.GetRange().GetValue()))
+		} else if dd.device.IsWritable(bridge.Trait_AUDIO) {
+			dd.levelInput.SetTitle("Volume")
+			dd.levelInput.SetText(fmt.Sprintf("%2d", dd.device.State.GetAudio().GetVolume()))
+		} else if dd.device.IsWritable(bridge.Trait_COVER) {
+			dd.levelInput.SetTitle("Position")
+			dd.levelInput.SetText(fmt.Sprintf("%2d", dd.device.State.GetCover().GetPosition()))
+		} else if dd.device.IsWritable(bridge.Trait_THERMOSTAT) {
+			dd.levelInput.SetTitle("Setpoint")
+			dd.levelInput.SetText(fmt.Sprintf("%2.0f", thermostatSetpoint(dd.device.State.GetThermostat())))
 		}
-		if dd.device.State.ColorRgb != nil {
-			dd.redInput.SetText(fmt.Sprintf("%3d", dd.device.State.ColorRgb.Red))
-			dd.greenInput.SetText(fmt.Sprintf("%3d", dd.device.State.ColorRgb.Green))
-			dd.blueInput.SetText(fmt.Sprintf("%3d", dd.device.State.ColorRgb.Blue))
+
+		dd.redInput.SetText("")
+		dd.greenInput.SetText("")
+		dd.blueInput.SetText("")
+		if dd.device.IsWritable(bridge.Trait_COLOR_RGB) {
+			dd.redInput.SetText(fmt.Sprintf("%3d", dd.device.State.GetColorRgb().GetRed()))
+			dd.greenInput.SetText(fmt.Sprintf("%3d", dd.device.State.GetColorRgb().GetGreen()))
+			dd.blueInput.SetText(fmt.Sprintf("%3d", dd.device.State.GetColorRgb().GetBlue()))
 		}
 	})
 }
 
 // saveFields is used to persist the contents of the view back into the linked DeviceInfo.
+// Only the fields the device allows to be changed are sent, so the rest of its state is left alone.
 func (dd *DeviceDetail) saveFields() {
-	// TODO: do not persist fields that aren't supported
-	dd.device.State.Binary.IsOn = dd.isOnCheckbox.IsChecked()
-	dd.device.State.Audio.IsMuted = !dd.isOnCheckbox.IsChecked()
-
-	if dd.device.State.Range != nil {
-		dd.device.State.Range.Value = int32FromInputField(dd.levelInput)
-	} else if dd.device.State.Audio != nil {
-		dd.device.State.Audio.Volume = int32FromInputField(dd.levelInput)
+	state := &bridge.DeviceState{}
+	mask := &fieldmaskpb.FieldMask{}
+
+	if dd.device.IsWritable(bridge.Trait_BINARY) {
+		state.Binary = &bridge.DeviceState_Binary{
+			IsOn: dd.isOnCheckbox.IsChecked(),
+		}
+		mask.Paths = append(mask.Paths, "binary.is_on")
+	} else if dd.device.IsWritable(bridge.Trait_LOCK) {
+		state.Lock = &bridge.DeviceState_Lock{
+			State: bridge.DeviceState_Lock_UNLOCKED,
+		}
+		if dd.isOnCheckbox.IsChecked() {
+			state.Lock.State = bridge.DeviceState_Lock_LOCKED
+		}
+		mask.Paths = append(mask.Paths, "lock.state")
 	}
 
-	if dd.device.State.ColorRgb != nil {
-		dd.device.State.ColorRgb.Red = int32FromInputField(dd.redInput)
-		dd.device.State.ColorRgb.Green = int32FromInputField(dd.greenInput)
-		dd.device.State.ColorRgb.Blue = int32FromInputField(dd.blueInput)
+	if dd.device.IsWritable(bridge.Trait_RANGE) {
+		state.Range = &bridge.DeviceState_Range{
+			Value: int32FromInputField(dd.levelInput),
+		}
+		mask.Paths = append(mask.Paths, "range.value")
+	} else if dd.device.IsWritable(bridge.Trait_AUDIO) {
+		state.Audio = &bridge.DeviceState_Audio{
+			Volume:  int32FromInputField(dd.levelInput),
+			IsMuted: !dd.isOnCheckbox.IsChecked(),
+		}
+		mask.Paths = append(mask.Paths, "audio.volume", "audio.is_muted")
+	} else if dd.device.IsWritable(bridge.Trait_COVER) {
+		state.Cover = &bridge.DeviceState_Cover{
+			Position: int32FromInputField(dd.levelInput),
+		}
+		mask.Paths = append(mask.Paths, "cover.position")
+	} else if dd.device.IsWritable(bridge.Trait_THERMOSTAT) {
+		// The setpoint shown is the one the thermostat is currently working towards, so that's the one changed.
+		state.Thermostat = &bridge.DeviceState_Thermostat{}
+		setpoint := float64(int32FromInputField(dd.levelInput))
+		if dd.device.State.GetThermostat().GetMode() == bridge.DeviceState_Thermostat_COOL {
+			state.Thermostat.CoolSetpointCelsius = setpoint
+			mask.Paths = append(mask.Paths, "thermostat.cool_setpoint_celsius")
+		} else {
+			state.Thermostat.HeatSetpointCelsius = setpoint
+			mask.Paths = append(mask.Paths, "thermostat.heat_setpoint_celsius")
+		}
+	}
+
+	if dd.device.IsWritable(bridge.Trait_COLOR_RGB) {
+		state.ColorRgb = &bridge.DeviceState_ColorRGB{
+			Red:   int32FromInputField(dd.redInput),
+			Green: int32FromInputField(dd.greenInput),
+			Blue:  int32FromInputField(dd.blueInput),
+		}
+		mask.Paths = append(mask.Paths, "color_rgb")
+	}
+
+	if len(mask.Paths) < 1 {
+		dd.logger.Debug("device has no writable fields, not saving",
+			zap.String("device_id", dd.device.Id),
+		)
+		return
 	}
 
 	resp, err := dd.devicesClient.UpdateDeviceState(context.Background(), &bridge.UpdateDeviceStateRequest{
-		Id:    dd.device.Id,
-		State: dd.device.State,
+		Id:         dd.device.Id,
+		Version:    dd.device.Version,
+		State:      state,
+		UpdateMask: mask,
 	})
 
 	if err != nil {
@@ -194,7 +260,34 @@ func (dd *DeviceDetail) saveFields() {
 		)
 	} else {
 		dd.device.State = resp.State
+		dd.device.Version = resp.Version
+	}
+}
+
+// thermostatSetpoint retrieves the setpoint the thermostat is working towards; cooling if it is cooling, otherwise heating.
+func thermostatSetpoint(thermostat *bridge.DeviceState_Thermostat) float64 {
+	if thermostat.GetMode() == bridge.DeviceState_Thermostat_COOL {
+		return thermostat.GetCoolSetpointCelsius()
+	}
+	return thermostat.GetHeatSetpointCelsius()
+}
+
+// stateSummary describes the parts of the state which can't be edited but are useful to see, e.g. who last unlocked a lock.
+func stateSummary(state *bridge.DeviceState) string {
+	summary := ""
+	if lock := state.GetLock(); lock != nil {
+		summary += fmt.Sprintf("\nLock: %s", lock.State)
+		if len(lock.ChangedBy) > 0 {
+			summary += fmt.Sprintf(" by %s", lock.ChangedBy)
+		}
+	}
+	if cover := state.GetCover(); cover != nil && cover.IsMoving {
+		summary += "\nCover: moving"
+	}
+	if thermostat := state.GetThermostat(); thermostat != nil {
+		summary += fmt.Sprintf("\nThermostat: %s, %.1f°C, %s", thermostat.Mode, thermostat.CurrentCelsius, thermostat.HvacState)
 	}
+	return summary
 }
 
 func int32FromInputField(view *tview.InputField) int32 {
@@ -66,6 +66,69 @@ func NewDevices(app *tview.Application, logger *zap.Logger, client bridge.Bridge
 	return d
 }
 
+// Run keeps the list of devices current by monitoring device updates until the context is cancelled.
+func (d *Devices) Run(ctx context.Context) {
+	stream, err := d.devicesClient.StreamBridgeUpdates(ctx, &bridge.StreamBridgeUpdatesRequest{
+		Filter: &bridge.UpdateFilter{
+			DevicesOnly: true,
+		},
+	})
+	if err != nil {
+		d.logger.Warn("unable to monitor devices",
+			zap.Error(err),
+		)
+		return
+	}
+
+	for {
+		update, err := stream.Recv()
+		if err != nil {
+			d.logger.Warn("error receiving device update",
+				zap.Error(err),
+			)
+			return
+		}
+
+		deviceUpdate := update.GetDeviceUpdate()
+		if deviceUpdate == nil {
+			continue
+		}
+
+		action := update.Action
+		d.app.QueueUpdateDraw(func() {
+			d.applyUpdate(action, deviceUpdate)
+		})
+	}
+}
+
+// applyUpdate reflects the device change in the list. This must be called on the UI goroutine.
+func (d *Devices) applyUpdate(action bridge.Update_Action, update *bridge.DeviceUpdate) {
+	deviceID := update.DeviceId
+	if update.Device != nil {
+		deviceID = update.Device.Id
+	}
+
+	idx := -1
+	for i, device := range d.devices {
+		if device.Id == deviceID {
+			idx = i
+			break
+		}
+	}
+
+	switch {
+	case action == bridge.Update_REMOVED && idx >= 0:
+		d.devices = append(d.devices[:idx], d.devices[idx+1:]...)
+		d.deviceList.RemoveItem(idx)
+	case action != bridge.Update_REMOVED && update.Device != nil && idx >= 0:
+		d.devices[idx] = update.Device
+		d.deviceList.SetItemText(idx, update.Device.Config.GetName(), update.Device.Config.GetDescription())
+	case action != bridge.Update_REMOVED && update.Device != nil:
+		d.devices = append(d.devices, update.Device)
+		d.deviceList.AddItem(update.Device.Config.GetName(), update.Device.Config.GetDescription(), 0, nil)
+	}
+}
+
 func (d *Devices) onListEntrySelected(idx int, mainText string, secondaryText string, shortcut rune) {
 	d.deviceDetail.Refresh(d.devicesClient, d.devices[idx])
 }
@@ -69,10 +69,18 @@ func NewTransit(app *tview.Application, rowCount int) *Transit {
 }
 
 // Refresh causes the transit data to be updated.
-func (wf *Transit) Refresh(stop *transit.Stop, records []*transit.Arrival) {
+// If the arrivals are from more than one stop each is labelled with the name of its stop.
+func (wf *Transit) Refresh(stops []*transit.NearbyStop, records []*transit.Arrival) {
+	stopNames := map[string]string{}
+	for _, stop := range stops {
+		stopNames[stop.Stop.Id] = stop.Stop.Name
+	}
+
 	wf.app.QueueUpdateDraw(func() {
-		if stop != nil {
-			wf.SetTitle(stop.Name + " Arrivals")
+		if len(stops) == 1 {
+			wf.SetTitle(stops[0].Stop.Name + " Arrivals")
+		} else if len(stops) > 1 {
+			wf.SetTitle("Nearby Arrivals")
 		} else {
 			wf.SetTitle("Arrivals")
 		}
@@ -86,7 +94,11 @@ func (wf *Transit) Refresh(stop *transit.Stop, records []*transit.Arrival) {
 
 			record := records[i]
 
-			wf.records[i].routeText.SetText(record.RouteId + " " + record.Headsign)
+			routeText := record.RouteId + " " + record.Headsign
+			if len(stops) > 1 && len(stopNames[record.StopId]) > 0 {
+				routeText += " @ " + stopNames[record.StopId]
+			}
+			wf.records[i].routeText.SetText(routeText)
 
 			msg := "(Sched) "
 			var err error
@@ -42,10 +42,11 @@ func (api *API) RegisterStation(s Station, latitude float64, longitude float64)
 
 // GetCurrentReport gets a weather report
 func (api *API) GetCurrentReport(ctx context.Context, req *GetCurrentReportRequest) (*GetCurrentReportResponse, error) {
-	s := api.stations.Closest(req.Latitude, req.Longitude).(Station)
-	if s == nil {
+	closest := api.stations.Closest(req.Latitude, req.Longitude)
+	if closest == nil {
 		return nil, ErrLocationNotFound.Err()
 	}
+	s := closest.Value.(Station)
 
 	report, err := s.GetReport(ctx)
 	if err != nil {
@@ -63,10 +64,11 @@ func (api *API) GetCurrentReport(ctx context.Context, req *GetCurrentReportReque
 
 // GetForecast gets a weather forecast.
 func (api *API) GetForecast(ctx context.Context, req *GetForecastRequest) (*GetForecastResponse, error) {
-	s := api.stations.Closest(req.Latitude, req.Longitude).(Station)
-	if s == nil {
+	closest := api.stations.Closest(req.Latitude, req.Longitude)
+	if closest == nil {
 		return nil, ErrLocationNotFound.Err()
 	}
+	s := closest.Value.(Station)
 
 	forecast, err := s.GetForecast(ctx)
 	if err != nil {